@@ -0,0 +1,1193 @@
+// In file: api.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The JSON API exposes the objects of the HTML interface to programs under /api/v1/.
+// Every response body is JSON; errors always have the form
+//
+//	{"error": {"status": 404, "message": "Not found"}}
+
+// apiPrefix is the path below which the current version of the JSON API is served.
+const apiPrefix = "/api/v1/"
+
+// maxAPIBodyBytes limits the size of JSON request bodies.
+const maxAPIBodyBytes = 1 << 20
+
+// ValidationError is returned for a request whose content is invalid. The JSON API
+// answers it with 400 Bad Request.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// apiError is the error member of an error response.
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("failed to write JSON response: %v", err)
+	}
+}
+
+// writeAPIError writes an error response with the given status.
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Status: status, Message: message}})
+}
+
+// writeAPIErrorFor is the JSON counterpart of writeConflictOr: unknown objects are
+// 404, invalid requests 400, forbidden changes 403, conflicts 409 and anything else 500.
+func writeAPIErrorFor(w http.ResponseWriter, prefix string, err error) {
+	var invalid *ValidationError
+	var forbidden *ForbiddenError
+	var conflict *ConflictError
+	var inUse *ContletInUseError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeAPIError(w, http.StatusNotFound, "Not found")
+	case errors.As(err, &invalid):
+		writeAPIError(w, http.StatusBadRequest, prefix+err.Error())
+	case errors.As(err, &forbidden):
+		writeAPIError(w, http.StatusForbidden, prefix+err.Error())
+	case errors.As(err, &conflict), errors.As(err, &inUse):
+		writeAPIError(w, http.StatusConflict, prefix+err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, prefix+err.Error())
+	}
+}
+
+// decodeJSON decodes the request body into v. Unknown members are rejected so that
+// misspelled names do not go unnoticed.
+func decodeJSON(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+			return &ValidationError{"the request body must be application/json"}
+		}
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return &ValidationError{"invalid JSON body: " + err.Error()}
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return &ValidationError{"the request body must contain a single JSON object"}
+	}
+	return nil
+}
+
+// emptyIfNil makes a nil slice encode as [] rather than null.
+func emptyIfNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// apiFields holds the administrator-defined field values of a request body, by
+// field name. Values may be JSON strings, numbers, booleans or null.
+type apiFields map[string]interface{}
+
+// values converts the fields to the raw values accepted by the field types and
+// validates them against the fields of table. When updating, a missing "fields"
+// member returns nil, which leaves the stored values untouched; when creating it
+// counts as empty so that missing required fields are reported.
+func (f apiFields) values(table string, create bool) (map[string]string, error) {
+	if f == nil && !create {
+		return nil, nil
+	}
+	fields, err := getClassFields(table)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(fields))
+	for _, cf := range fields {
+		known[cf.Name] = true
+	}
+
+	raw := make(map[string]string, len(f))
+	for name, v := range f {
+		if !known[name] {
+			return nil, &ValidationError{fmt.Sprintf("%s has no field named %q", table, name)}
+		}
+		switch v := v.(type) {
+		case nil:
+			raw[name] = ""
+		case string:
+			raw[name] = v
+		case json.Number:
+			raw[name] = v.String()
+		case bool:
+			raw[name] = "0"
+			if v {
+				raw[name] = "1"
+			}
+		default:
+			return nil, &ValidationError{fmt.Sprintf("field %s must be a string, number, boolean or null", name)}
+		}
+	}
+	if _, err := parseFieldValues(fields, raw); err != nil {
+		return nil, &ValidationError{err.Error()}
+	}
+	return raw, nil
+}
+
+// apiResource describes an object type served by the JSON API.
+type apiResource struct {
+	name     string // singular, used in error messages
+	taggable bool   // whether /{id}/tags is served
+	list     func(r *http.Request) (interface{}, error)
+	load     func(id int) (interface{}, error)
+	create   func(r *http.Request) (int64, error)
+	update   func(r *http.Request, id int) error
+	remove   func(id int) error
+}
+
+// apiResources are the object types of the JSON API, by path segment.
+var apiResources = map[string]apiResource{
+	"pieces": {
+		name: "piece", taggable: true,
+		list:   func(r *http.Request) (interface{}, error) { return listOr(getAllContentPieces()) },
+		load:   loadAPIPiece,
+		create: createAPIPiece,
+		update: updateAPIPiece,
+		remove: deleteContentPiece,
+	},
+	"contlets": {
+		name: "contlet", taggable: true,
+		list:   func(r *http.Request) (interface{}, error) { return listOr(getAllContlets()) },
+		load:   func(id int) (interface{}, error) { return getContletByID(id) },
+		create: createAPIContlet,
+		update: updateAPIContlet,
+		remove: deleteContlet,
+	},
+	"tags": {
+		name: "tag", taggable: true,
+		list:   listAPITags,
+		load:   loadAPITag,
+		create: createAPITag,
+		update: updateAPITag,
+		remove: deleteTag,
+	},
+	"taxonomies": {
+		name: "taxonomy", taggable: true,
+		list:   func(r *http.Request) (interface{}, error) { return listOr(getAllTaxonomies()) },
+		load:   loadAPITaxonomy,
+		create: createAPITaxonomy,
+		update: updateAPITaxonomy,
+		remove: deleteTaxonomy,
+	},
+	"links": {
+		name:   "link",
+		list:   listAPILinks,
+		load:   func(id int) (interface{}, error) { return getLinkByID(id) },
+		create: createAPILink,
+		update: updateAPILink,
+		remove: deleteLink,
+	},
+}
+
+// listOr adapts a list query to apiResource.list.
+func listOr[T any](items []T, err error) (interface{}, error) {
+	return emptyIfNil(items), err
+}
+
+// apiRouter serves the JSON API. For each resource in apiResources:
+//
+//	GET    /api/v1/{resource}                    list
+//	POST   /api/v1/{resource}                    create; answers 201 with the new object
+//	GET    /api/v1/{resource}/{id}               get
+//	PUT    /api/v1/{resource}/{id}               update; answers with the updated object
+//	DELETE /api/v1/{resource}/{id}               delete; answers 204
+//	GET    /api/v1/{resource}/{id}/tags          tags of the object
+//	POST   /api/v1/{resource}/{id}/tags          attach a tag: {"tag_id": 12}
+//	DELETE /api/v1/{resource}/{id}/tags/{tag}    detach a tag
+//
+// Pieces also have their workflow status under /api/v1/pieces/{id}/status (see
+// apiStatus) and their publication state under /api/v1/pieces/{id}/publication (see
+// apiPublication). The workflow is described by /api/v1/workflow, the published
+// pieces are served under /api/v1/published by apiPublishedRouter, any object by its
+// entity ID under /api/v1/entities/{id} by apiEntity and the schema under
+// /api/v1/schema by apiSchemaRouter.
+func apiRouter(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	if parts[0] == "schema" {
+		if r.Method != http.MethodGet && !currentUser(r).Has(roleSchemaAdmin) {
+			forbidRole(w, r, roleSchemaAdmin)
+			return
+		}
+		apiSchemaRouter(w, r, parts[1:])
+		return
+	}
+	if parts[0] == "published" {
+		apiPublishedRouter(w, r, parts[1:])
+		return
+	}
+	if parts[0] == "workflow" && len(parts) == 1 {
+		apiWorkflow(w, r)
+		return
+	}
+	if parts[0] == "schedule" && len(parts) == 1 {
+		apiSchedule(w, r)
+		return
+	}
+	if parts[0] == "entities" && len(parts) == 2 {
+		apiEntity(w, r, parts[1])
+		return
+	}
+	res, ok := apiResources[parts[0]]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			items, err := res.list(r)
+			if err != nil {
+				writeAPIErrorFor(w, "Failed to list "+parts[0]+": ", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, items)
+		case http.MethodPost:
+			id, err := res.create(r)
+			if err != nil {
+				writeAPIErrorFor(w, "Failed to create "+res.name+": ", err)
+				return
+			}
+			obj, err := res.load(int(id))
+			if err != nil {
+				writeAPIErrorFor(w, "Failed to retrieve "+res.name+": ", err)
+				return
+			}
+			w.Header().Set("Location", fmt.Sprintf("%s%s/%d", apiPrefix, parts[0], id))
+			writeJSON(w, http.StatusCreated, obj)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	// Every route below addresses an existing object; unknown IDs are 404.
+	obj, err := res.load(id)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve "+res.name+": ", err)
+		return
+	}
+
+	switch {
+	case len(parts) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, obj)
+		case http.MethodPut:
+			if err := res.update(r, id); err != nil {
+				writeAPIErrorFor(w, "Failed to update "+res.name+": ", err)
+				return
+			}
+			if obj, err = res.load(id); err != nil {
+				writeAPIErrorFor(w, "Failed to retrieve "+res.name+": ", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, obj)
+		case http.MethodDelete:
+			if parts[0] == "pieces" && !currentUser(r).Has(rolePublisher) {
+				forbidRole(w, r, rolePublisher)
+				return
+			}
+			if err := res.remove(id); err != nil {
+				writeAPIErrorFor(w, "Failed to delete "+res.name+": ", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	case res.taggable && parts[2] == "tags" && len(parts) <= 4:
+		apiEntityTags(w, r, id, parts[3:])
+	case parts[0] == "pieces" && parts[2] == "publication" && len(parts) <= 4:
+		apiPublication(w, r, id, parts[3:])
+	case parts[0] == "pieces" && parts[2] == "status" && len(parts) == 3:
+		apiStatus(w, r, id)
+	case parts[0] == "pieces" && parts[2] == "schedule" && len(parts) == 3:
+		apiPieceSchedule(w, r, id)
+	case parts[0] == "pieces" && parts[2] == "render" && len(parts) == 4:
+		apiPieceRender(w, r, obj.(apiPiece).PieceDetail, parts[3])
+	default:
+		writeAPIError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// apiPieceRender serves the draft of a piece rendered for a channel:
+//
+//	GET /api/v1/pieces/{id}/render/{channel}    the parts and the limits they break
+func apiPieceRender(w http.ResponseWriter, r *http.Request, piece PieceDetail, channel string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if _, ok := findChannel(channel); !ok {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	rendering, err := renderPiece(piece, channel)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to render piece: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rendering)
+}
+
+// methodNotAllowed answers 405 with the methods the route supports.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed; use "+allow)
+}
+
+// apiEntityTags serves the tags attached to an object.
+func apiEntityTags(w http.ResponseWriter, r *http.Request, entityID int, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		// The tags are listed below.
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var in struct {
+			TagID int `json:"tag_id"`
+		}
+		if err := decodeJSON(r, &in); err != nil {
+			writeAPIErrorFor(w, "Failed to attach tag: ", err)
+			return
+		}
+		if err := attachTag(entityID, in.TagID, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to attach tag: ", err)
+			return
+		}
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		tagID, err := strconv.Atoi(rest[0])
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if err := detachTag(entityID, tagID, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to detach tag: ", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case len(rest) == 0:
+		methodNotAllowed(w, "GET, POST")
+		return
+	default:
+		methodNotAllowed(w, "DELETE")
+		return
+	}
+
+	tags, err := getTagsForEntity(entityID)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve tags: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, emptyIfNil(tags))
+}
+
+// --- Pieces ---
+
+// apiPieceInput is the request body for creating or updating a piece. When
+// updating, a status other than the current one is a workflow transition, and
+// status_comment is the comment given for it.
+type apiPieceInput struct {
+	Title         string    `json:"title"`
+	Class         string    `json:"class"`
+	Fields        apiFields `json:"fields"`
+	Status        string    `json:"status"`
+	StatusComment string    `json:"status_comment"`
+}
+
+// apiPiece is a piece as the API returns it.
+type apiPiece struct {
+	PieceDetail
+	Status string `json:"status"`
+}
+
+// decode reads and validates the body of a piece request.
+func (in *apiPieceInput) decode(r *http.Request, create bool) (map[string]string, error) {
+	if err := decodeJSON(r, in); err != nil {
+		return nil, err
+	}
+	in.Title = strings.TrimSpace(in.Title)
+	if in.Title == "" {
+		return nil, &ValidationError{"title is required"}
+	}
+	return in.Fields.values("content_piece", create)
+}
+
+// loadAPIPiece loads a piece with its ordered contlets and its status.
+func loadAPIPiece(id int) (interface{}, error) {
+	piece, err := getPieceByID(id)
+	if err != nil {
+		return nil, err
+	}
+	piece.Contlets = emptyIfNil(piece.Contlets)
+	out := apiPiece{PieceDetail: piece}
+	if err := db.QueryRow("SELECT status FROM content_piece WHERE id = ?", id).Scan(&out.Status); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func createAPIPiece(r *http.Request) (int64, error) {
+	var in apiPieceInput
+	extra, err := in.decode(r, true)
+	if err != nil {
+		return 0, err
+	}
+	if in.Status != "" {
+		return 0, &ValidationError{"new pieces start in the first status of the workflow; change it afterwards"}
+	}
+	return createContentPiece(in.Title, in.Class, extra, requestAuthor(r))
+}
+
+func updateAPIPiece(r *http.Request, id int) error {
+	var in apiPieceInput
+	extra, err := in.decode(r, false)
+	if err != nil {
+		return err
+	}
+	status := StatusRequest{To: in.Status, Comment: in.StatusComment}
+	return updateContentPiece(id, in.Title, in.Class, extra, status, requestAuthor(r))
+}
+
+// apiPublication serves the publication state of a piece:
+//
+//	GET  /api/v1/pieces/{id}/publication            draft versus published
+//	POST /api/v1/pieces/{id}/publication/discard    reset the draft to the published version
+//
+// Both answer with the resulting state. Pieces are published by status transitions.
+func apiPublication(w http.ResponseWriter, r *http.Request, id int, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		// The state is written below.
+	case len(rest) == 0:
+		methodNotAllowed(w, "GET")
+		return
+	case rest[0] != "discard":
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	case r.Method != http.MethodPost:
+		methodNotAllowed(w, "POST")
+		return
+	default:
+		if err := discardDraft(id, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to discard draft: ", err)
+			return
+		}
+	}
+
+	state, err := getPublicationState(id)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve publication state: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// apiPieceStatus is the workflow state of a piece.
+type apiPieceStatus struct {
+	Status      string               `json:"status"`
+	Transitions []WorkflowTransition `json:"transitions"` // the transitions out of the current status
+	Changes     []StatusChange       `json:"changes"`     // newest first
+}
+
+// apiStatus serves the workflow status of a piece:
+//
+//	GET  /api/v1/pieces/{id}/status    the status, the possible transitions and the log
+//	POST /api/v1/pieces/{id}/status    make a transition: {"to": "approved", "comment": "..."}
+func apiStatus(w http.ResponseWriter, r *http.Request, id int) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req StatusRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeAPIErrorFor(w, "Failed to change status: ", err)
+			return
+		}
+		if req.To == "" {
+			writeAPIError(w, http.StatusBadRequest, "Failed to change status: to is required")
+			return
+		}
+		if err := changePieceStatus(id, req, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to change status: ", err)
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET, POST")
+		return
+	}
+
+	var out apiPieceStatus
+	if err := db.QueryRow("SELECT status FROM content_piece WHERE id = ?", id).Scan(&out.Status); err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve status: ", err)
+		return
+	}
+	transitions, err := getTransitionsFrom(out.Status)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve transitions: ", err)
+		return
+	}
+	changes, err := getStatusChanges(id)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve status changes: ", err)
+		return
+	}
+	out.Transitions, out.Changes = emptyIfNil(transitions), emptyIfNil(changes)
+	writeJSON(w, http.StatusOK, out)
+}
+
+// apiWorkflow serves GET /api/v1/workflow: the statuses and transitions of the
+// editorial workflow.
+func apiWorkflow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	statuses, err := getWorkflowStatuses()
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve workflow: ", err)
+		return
+	}
+	transitions, err := getWorkflowTransitions()
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve workflow: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Statuses    []WorkflowStatus     `json:"statuses"`
+		Transitions []WorkflowTransition `json:"transitions"`
+	}{emptyIfNil(statuses), emptyIfNil(transitions)})
+}
+
+// apiPieceSchedule serves the schedule of a piece:
+//
+//	GET    /api/v1/pieces/{id}/schedule    the scheduled times, in UTC
+//	PUT    /api/v1/pieces/{id}/schedule    {"publish_at": "2026-11-01T09:00:00Z", "unpublish_at": null}
+//	DELETE /api/v1/pieces/{id}/schedule    clear the schedule
+func apiPieceSchedule(w http.ResponseWriter, r *http.Request, id int) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var in PieceSchedule
+		if err := decodeJSON(r, &in); err != nil {
+			writeAPIErrorFor(w, "Failed to schedule piece: ", err)
+			return
+		}
+		if err := setPieceSchedule(id, in.PublishAt, in.UnpublishAt, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to schedule piece: ", err)
+			return
+		}
+	case http.MethodDelete:
+		if err := setPieceSchedule(id, nil, nil, requestAuthor(r)); err != nil {
+			writeAPIErrorFor(w, "Failed to clear schedule: ", err)
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+		return
+	}
+
+	schedule, err := getPieceSchedule(id)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve schedule: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schedule)
+}
+
+// apiSchedule serves GET /api/v1/schedule: the pieces with a scheduled time, the
+// next one first.
+func apiSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	pieces, err := getSchedule()
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to retrieve schedule: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, emptyIfNil(pieces))
+}
+
+// apiEntityObject is any object looked up by its entity ID, with its class and kind.
+type apiEntityObject struct {
+	ID     int         `json:"id"`
+	Class  string      `json:"class"`
+	Kind   string      `json:"kind"`
+	Object interface{} `json:"object"` // the piece, contlet, tag or taxonomy
+}
+
+// apiEntity resolves an entity ID to its object, whatever its class:
+//
+//	GET /api/v1/entities/{id}
+func apiEntity(w http.ResponseWriter, r *http.Request, idText string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	e, err := resolveEntity(id)
+	if err != nil {
+		writeAPIErrorFor(w, "Failed to resolve entity: ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiEntityObject{ID: e.ID, Class: e.Class, Kind: e.Kind(), Object: e.Object})
+}
+
+// apiPublishedRouter serves the published versions of pieces, which is what
+// delivery channels show to readers:
+//
+//	GET /api/v1/published         every published piece, most recently published first
+//	GET /api/v1/published/{id}    the published version of a piece
+func apiPublishedRouter(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	switch len(parts) {
+	case 0:
+		pieces, err := getPublishedPieces()
+		if err != nil {
+			writeAPIErrorFor(w, "Failed to list published pieces: ", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, emptyIfNil(pieces))
+	case 1:
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		pub, err := getPublishedPiece(id)
+		if err != nil {
+			writeAPIErrorFor(w, "Failed to retrieve published piece: ", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, pub)
+	default:
+		writeAPIError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// --- Contlets ---
+
+// apiContletInput is the request body for creating or updating a contlet. Only the
+// members that belong to the class are used.
+type apiContletInput struct {
+	Class       string    `json:"class"`
+	TextContent string    `json:"text_content"`
+	Src         string    `json:"src"`
+	AltText     string    `json:"alt_text"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Level       int       `json:"level"`
+	Fields      apiFields `json:"fields"`
+}
+
+// contlet reads and validates the body of a contlet request. existing is the class
+// of the contlet being updated, or "" when creating one.
+func (in *apiContletInput) contlet(r *http.Request, existing string) (ContletDetail, error) {
+	if err := decodeJSON(r, in); err != nil {
+		return ContletDetail{}, err
+	}
+	if existing != "" {
+		if in.Class != "" && in.Class != existing {
+			return ContletDetail{}, &ValidationError{"the class of a contlet cannot change"}
+		}
+		in.Class = existing
+	}
+	if !isContletClass(in.Class) {
+		return ContletDetail{}, &ValidationError{fmt.Sprintf("unknown contlet class: %q", in.Class)}
+	}
+
+	c := ContletDetail{
+		Class:       in.Class,
+		TextContent: strings.TrimSpace(in.TextContent),
+		Src:         strings.TrimSpace(in.Src),
+		AltText:     in.AltText,
+	}
+	switch c.Class {
+	case "heading":
+		c.Level = in.Level
+		if c.Level == 0 {
+			c.Level = 2 // matches the column default of contlet_heading.level
+		}
+	case "image":
+		c.Width, c.Height = in.Width, in.Height
+	}
+
+	var err error
+	if c.Extra, err = in.Fields.values("contlet_"+c.Class, existing == ""); err != nil {
+		return ContletDetail{}, err
+	}
+	if err := validateContlet(c); err != nil {
+		return ContletDetail{}, &ValidationError{err.Error()}
+	}
+	return c, nil
+}
+
+func createAPIContlet(r *http.Request) (int64, error) {
+	var in apiContletInput
+	c, err := in.contlet(r, "")
+	if err != nil {
+		return 0, err
+	}
+	return createContlet(c, requestAuthor(r))
+}
+
+func updateAPIContlet(r *http.Request, id int) error {
+	existing, err := getContletByID(id)
+	if err != nil {
+		return err
+	}
+	var in apiContletInput
+	c, err := in.contlet(r, existing.Class)
+	if err != nil {
+		return err
+	}
+	c.ID = id
+	return updateContlet(c, requestAuthor(r))
+}
+
+// --- Tags ---
+
+// apiTagInput is the request body for creating or updating a tag.
+type apiTagInput struct {
+	TaxonomyID int       `json:"taxonomy_id"`
+	Value      string    `json:"value"`
+	Fields     apiFields `json:"fields"`
+}
+
+// decode reads and validates the body of a tag request.
+func (in *apiTagInput) decode(r *http.Request, create bool) (map[string]string, error) {
+	if err := decodeJSON(r, in); err != nil {
+		return nil, err
+	}
+	in.Value = strings.TrimSpace(in.Value)
+	if in.Value == "" {
+		return nil, &ValidationError{"value is required"}
+	}
+	if _, err := getTaxonomyByID(in.TaxonomyID); err == sql.ErrNoRows {
+		return nil, &ValidationError{fmt.Sprintf("taxonomy %d does not exist", in.TaxonomyID)}
+	} else if err != nil {
+		return nil, err
+	}
+	return in.Fields.values("tag", create)
+}
+
+// listAPITags lists all tags, or those of one taxonomy with ?taxonomy_id=.
+func listAPITags(r *http.Request) (interface{}, error) {
+	if v := r.URL.Query().Get("taxonomy_id"); v != "" {
+		taxonomyID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &ValidationError{"taxonomy_id must be a whole number"}
+		}
+		return listOr(getTagsByTaxonomy(taxonomyID))
+	}
+	return listOr(getAllTags())
+}
+
+// loadAPITag loads a tag with its administrator-defined fields.
+func loadAPITag(id int) (interface{}, error) {
+	tag, err := getTagByID(id)
+	if err != nil {
+		return nil, err
+	}
+	tag.Extra, err = readFieldValues(db, "tag", id)
+	return tag, err
+}
+
+func createAPITag(r *http.Request) (int64, error) {
+	var in apiTagInput
+	extra, err := in.decode(r, true)
+	if err != nil {
+		return 0, err
+	}
+	return createTag(in.TaxonomyID, in.Value, extra)
+}
+
+func updateAPITag(r *http.Request, id int) error {
+	var in apiTagInput
+	extra, err := in.decode(r, false)
+	if err != nil {
+		return err
+	}
+	return updateTag(id, in.TaxonomyID, in.Value, extra)
+}
+
+// --- Taxonomies ---
+
+// apiTaxonomyInput is the request body for creating or updating a taxonomy.
+type apiTaxonomyInput struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Fields      apiFields `json:"fields"`
+}
+
+// decode reads and validates the body of a taxonomy request.
+func (in *apiTaxonomyInput) decode(r *http.Request, create bool) (map[string]string, error) {
+	if err := decodeJSON(r, in); err != nil {
+		return nil, err
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return nil, &ValidationError{"name is required"}
+	}
+	return in.Fields.values("taxonomy", create)
+}
+
+// loadAPITaxonomy loads a taxonomy with its administrator-defined fields.
+func loadAPITaxonomy(id int) (interface{}, error) {
+	taxonomy, err := getTaxonomyByID(id)
+	if err != nil {
+		return nil, err
+	}
+	taxonomy.Extra, err = readFieldValues(db, "taxonomy", id)
+	return taxonomy, err
+}
+
+func createAPITaxonomy(r *http.Request) (int64, error) {
+	var in apiTaxonomyInput
+	extra, err := in.decode(r, true)
+	if err != nil {
+		return 0, err
+	}
+	return createTaxonomy(in.Name, in.Description, extra)
+}
+
+func updateAPITaxonomy(r *http.Request, id int) error {
+	var in apiTaxonomyInput
+	extra, err := in.decode(r, false)
+	if err != nil {
+		return err
+	}
+	return updateTaxonomy(id, in.Name, in.Description, extra)
+}
+
+// --- Links ---
+
+// MarshalJSON encodes a link with its confidence as a number or null.
+func (l Link) MarshalJSON() ([]byte, error) {
+	var confidence *float64
+	if l.Confidence.Valid {
+		confidence = &l.Confidence.Float64
+	}
+	return json.Marshal(struct {
+		ID         int       `json:"id"`
+		Subject    EntityRef `json:"subject"`
+		LinkType   string    `json:"link_type"`
+		Object     EntityRef `json:"object"`
+		Source     string    `json:"source"`
+		Confidence *float64  `json:"confidence"`
+	}{l.ID, l.Subject, l.LinkType, l.Object, l.Source, confidence})
+}
+
+// apiLinkInput is the request body for creating a link. Only source and
+// confidence can be updated; the ends and type of a link are fixed.
+type apiLinkInput struct {
+	SubjectID  int      `json:"subject_id"`
+	LinkType   string   `json:"link_type"`
+	ObjectID   int      `json:"object_id"`
+	Source     string   `json:"source"`
+	Confidence *float64 `json:"confidence"`
+}
+
+// nullFloat maps an optional JSON number to SQL NULL when it is absent.
+func nullFloat(f *float64) sql.NullFloat64 {
+	if f == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *f, Valid: true}
+}
+
+// listAPILinks lists every link, optionally filtered with ?entity_id= (links in
+// either direction) and ?link_type=.
+func listAPILinks(r *http.Request) (interface{}, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	q := r.URL.Query()
+	if v := q.Get("entity_id"); v != "" {
+		entityID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &ValidationError{"entity_id must be a whole number"}
+		}
+		where = append(where, "(er.subject_id = ? OR er.object_id = ?)")
+		args = append(args, entityID, entityID)
+	}
+	if v := q.Get("link_type"); v != "" {
+		where = append(where, "er.link_type = ?")
+		args = append(args, v)
+	}
+	return listOr(queryLinks(strings.Join(where, " AND "), args...))
+}
+
+func createAPILink(r *http.Request) (int64, error) {
+	var in apiLinkInput
+	if err := decodeJSON(r, &in); err != nil {
+		return 0, err
+	}
+	return createLink(in.SubjectID, in.LinkType, in.ObjectID, strings.TrimSpace(in.Source), nullFloat(in.Confidence))
+}
+
+func updateAPILink(r *http.Request, id int) error {
+	var in struct {
+		Source     string   `json:"source"`
+		Confidence *float64 `json:"confidence"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	return updateLink(id, strings.TrimSpace(in.Source), nullFloat(in.Confidence))
+}
+
+// --- Schema ---
+
+// apiSchemaColumn is a column of a table as described by the JSON API.
+type apiSchemaColumn struct {
+	Name      string  `json:"name"`
+	SQLType   string  `json:"sql_type"`
+	FieldType string  `json:"field_type,omitempty"` // the semantic type, if the column type is in the registry
+	Required  bool    `json:"required"`
+	Default   *string `json:"default"`
+	System    bool    `json:"system"` // managed by the application; read-only
+}
+
+// apiSchemaTable is a table as described by the JSON API.
+type apiSchemaTable struct {
+	Name    string            `json:"name"`
+	IsClass bool              `json:"is_class"` // only class tables can be edited
+	Columns []apiSchemaColumn `json:"columns"`
+}
+
+// apiSchemaPlan is the response to a schema change.
+type apiSchemaPlan struct {
+	SchemaPlan
+	DDL          string `json:"ddl"`
+	AffectedRows int64  `json:"affected_rows"`
+	Applied      bool   `json:"applied"` // false for a dry run or a plan without changes
+}
+
+// apiFieldInput is the request body for adding or changing a field of a class table.
+type apiFieldInput struct {
+	Name     string `json:"name"` // only when adding
+	Type     string `json:"type"` // a semantic field type, e.g. "single_line_text"
+	Required bool   `json:"required"`
+	Default  string `json:"default"`
+}
+
+// loadAPISchema describes every table in the form used by the JSON API.
+func loadAPISchema() ([]apiSchemaTable, error) {
+	tables, err := loadSchemaTables()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]apiSchemaTable, len(tables))
+	for i, t := range tables {
+		out[i] = apiSchemaTable{Name: t.Name, IsClass: t.IsClass, Columns: []apiSchemaColumn{}}
+		for _, col := range t.Columns {
+			c := apiSchemaColumn{
+				Name:      col.Field,
+				SQLType:   col.Type,
+				FieldType: col.FieldType.Name,
+				Required:  col.Null == "NO",
+				System:    col.System,
+			}
+			if col.Default.Valid {
+				def := col.Default.String
+				c.Default = &def
+			}
+			out[i].Columns = append(out[i].Columns, c)
+		}
+	}
+	return out, nil
+}
+
+// apiSchemaRouter serves the schema of the class tables:
+//
+//	GET    /api/v1/schema                          every table, and the field types
+//	GET    /api/v1/schema/{table}                  one table
+//	POST   /api/v1/schema/{table}/fields           add a field
+//	PUT    /api/v1/schema/{table}/fields/{name}    change a field
+//	DELETE /api/v1/schema/{table}/fields/{name}    remove a field
+//
+// Changes are planned exactly as in the schema editor. With ?dry_run=true the plan
+// is returned without being applied, like the editor's preview.
+func apiSchemaRouter(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 1 && parts[0] == "" {
+		parts = nil
+	}
+
+	if len(parts) <= 1 {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		tables, err := loadAPISchema()
+		if err != nil {
+			writeAPIErrorFor(w, "Failed to retrieve schema: ", err)
+			return
+		}
+		if len(parts) == 0 {
+			writeJSON(w, http.StatusOK, struct {
+				FieldTypes []FieldType      `json:"field_types"`
+				Tables     []apiSchemaTable `json:"tables"`
+			}{fieldTypes, tables})
+			return
+		}
+		for _, t := range tables {
+			if t.Name == parts[0] {
+				writeJSON(w, http.StatusOK, t)
+				return
+			}
+		}
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if parts[1] != "fields" || len(parts) > 3 {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	table := parts[0]
+	var plan SchemaPlan
+	var err error
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		var in apiFieldInput
+		if err = decodeJSON(r, &in); err == nil {
+			plan, err = planAddField(table, strings.TrimSpace(in.Name), in.Type, in.Required, strings.TrimSpace(in.Default))
+		}
+	case len(parts) == 3 && r.Method == http.MethodPut:
+		var in apiFieldInput
+		if err = decodeJSON(r, &in); err != nil {
+			break
+		}
+		ft, ok := fieldTypeByName(in.Type)
+		if !ok {
+			err = &ValidationError{fmt.Sprintf("unknown field type %q", in.Type)}
+			break
+		}
+		if in.Name != "" && in.Name != parts[2] {
+			err = &ValidationError{"fields cannot be renamed"}
+			break
+		}
+		col := ColumnDetail{Field: parts[2], Type: ft.SQLType, Null: "YES"}
+		if in.Required {
+			col.Null = "NO"
+		}
+		if def := strings.TrimSpace(in.Default); def != "" {
+			col.Default = sql.NullString{String: def, Valid: true}
+		}
+		plan, err = planFieldUpdates(table, []ColumnDetail{col})
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		plan, err = planRemoveField(table, parts[2])
+	case len(parts) == 2:
+		methodNotAllowed(w, "POST")
+		return
+	default:
+		methodNotAllowed(w, "PUT, DELETE")
+		return
+	}
+	if err != nil {
+		writeAPIErrorFor(w, "Invalid schema change: ", err)
+		return
+	}
+
+	resp := apiSchemaPlan{SchemaPlan: plan, DDL: plan.DDL(), AffectedRows: plan.AffectedRows()}
+	resp.Changes = emptyIfNil(resp.Changes)
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); !dryRun && len(plan.Changes) > 0 {
+		if err := applySchemaPlan(plan); err != nil {
+			writeAPIErrorFor(w, "Failed to update schema: ", err)
+			return
+		}
+		resp.Applied = true
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// --- Content negotiation ---
+
+// prefersJSON reports whether an Accept header ranks application/json above
+// text/html. Wildcards are ignored, so browsers and clients that send */* get HTML.
+func prefersJSON(accept string) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// negotiate lets the HTML pages of the object types be fetched as JSON: a GET
+// request that prefers application/json is answered by the JSON API resource at
+// the same path, e.g. /pieces/12 by /api/v1/pieces/12.
+func negotiate(html http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.Header().Add("Vary", "Accept")
+			if prefersJSON(r.Header.Get("Accept")) {
+				r2 := r.Clone(r.Context())
+				r2.URL.Path = strings.TrimSuffix(apiPrefix, "/") + r.URL.Path
+				apiRouter(w, r2)
+				return
+			}
+		}
+		html(w, r)
+	}
+}
@@ -0,0 +1,896 @@
+// In file: archive.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An archive is a dump of the whole object graph as newline-delimited JSON: a
+// header, the definitions of the class tables and link classes, every object
+// with its class row, and the tags, contlet slots, links and published
+// snapshots between them. Objects keep the IDs of the database they were
+// exported from; importing gives every object a new ID, so an archive can be
+// loaded into a database that already has content. Users, sessions, API
+// tokens, revisions and the workflow configuration are not part of it.
+
+const (
+	archiveFormat  = "sherpa-archive"
+	archiveVersion = 1
+)
+
+// ArchiveHeader is the first record of an archive.
+type ArchiveHeader struct {
+	Type          string    `json:"type"`
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"` // the last migration applied to the exporting database
+}
+
+// ArchiveField is an administrator-defined field of a class table.
+type ArchiveField struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"` // a FieldType name
+	Required bool    `json:"required"`
+	Default  *string `json:"default"`
+}
+
+// ArchiveClass is a class table with its administrator-defined fields. The
+// description is that of a contlet class, and empty for the built-in tables.
+type ArchiveClass struct {
+	Type        string         `json:"type"`
+	Table       string         `json:"table"`
+	Description string         `json:"description,omitempty"`
+	Fields      []ArchiveField `json:"fields"`
+}
+
+// ArchiveLinkClass is a link class.
+type ArchiveLinkClass struct {
+	Type          string  `json:"type"`
+	Name          string  `json:"name"`
+	Description   string  `json:"description"`
+	SymmetricLink *string `json:"symmetric_link"`
+}
+
+// ArchiveEntity is an object with the columns of its class row, as stored.
+// NULL columns are null.
+type ArchiveEntity struct {
+	Type   string             `json:"type"`
+	ID     int                `json:"id"`
+	Class  string             `json:"class"`
+	Values map[string]*string `json:"values"`
+}
+
+// ArchiveTags lists the tags of an object.
+type ArchiveTags struct {
+	Type     string `json:"type"`
+	EntityID int    `json:"entity_id"`
+	TagIDs   []int  `json:"tag_ids"`
+}
+
+// ArchiveSlot is a contlet at its place in a piece.
+type ArchiveSlot struct {
+	ContletID int `json:"contlet_id"`
+	SortOrder int `json:"sort_order"`
+}
+
+// ArchiveSlots lists the contlets of a piece in order.
+type ArchiveSlots struct {
+	Type    string        `json:"type"`
+	PieceID int           `json:"piece_id"`
+	Slots   []ArchiveSlot `json:"slots"`
+}
+
+// ArchiveLink is a relationship between two objects.
+type ArchiveLink struct {
+	Type       string   `json:"type"`
+	SubjectID  int      `json:"subject_id"`
+	LinkType   string   `json:"link_type"`
+	ObjectID   int      `json:"object_id"`
+	Source     *string  `json:"source"`
+	Confidence *float64 `json:"confidence"`
+}
+
+// ArchivePublication is the published snapshot of a piece.
+type ArchivePublication struct {
+	Type        string          `json:"type"`
+	PieceID     int             `json:"piece_id"`
+	PublishedBy string          `json:"published_by"`
+	PublishedAt time.Time       `json:"published_at"`
+	Snapshot    json.RawMessage `json:"snapshot"`
+}
+
+// Archive holds the records of an archive, in the order they are written:
+// classes and link classes first, then objects with taxonomies before tags
+// before everything else, so that each record only refers to earlier ones.
+type Archive struct {
+	Header       ArchiveHeader
+	Classes      []ArchiveClass
+	LinkClasses  []ArchiveLinkClass
+	Entities     []ArchiveEntity
+	Tags         []ArchiveTags
+	Slots        []ArchiveSlots
+	Links        []ArchiveLink
+	Publications []ArchivePublication
+}
+
+// ArchiveImportStats counts what an import did.
+type ArchiveImportStats struct {
+	Created          int // objects created
+	Merged           int // taxonomies and tags that already existed and were used instead
+	Links            int
+	Publications     int
+	StatusesReset    int // pieces whose status the workflow does not have; they start in its initial status
+	SchedulesCleared int // pieces that were scheduled; they are imported without a schedule
+}
+
+// schemaVersion returns the last migration applied to the database.
+func schemaVersion() (int, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema migrations: %w", err)
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// requireCurrentSchema refuses to work on a database with pending migrations.
+func requireCurrentSchema() error {
+	pending, err := pendingMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to check schema migrations: %w", err)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("the database schema has %d pending migration(s); run `go run . migrate up` first", len(pending))
+	}
+	return nil
+}
+
+// archiveClassTables returns the class tables in the order their objects are
+// archived: taxonomies, tags, contlets, pieces.
+func archiveClassTables() []string {
+	tables := []string{"taxonomy", "tag"}
+	for _, c := range getContletClasses() {
+		tables = append(tables, c.Table())
+	}
+	return append(tables, "content_piece")
+}
+
+// archivedColumns returns the columns of a class table that are archived: its
+// system columns and the fields of a known type, without the id.
+func archivedColumns(table string, columns []ColumnDetail) []string {
+	var names []string
+	for _, col := range columns {
+		if col.Field == "id" {
+			continue
+		}
+		if _, ok := fieldTypeForColumn(col.Type); ok || isSystemColumn(table, col.Field) {
+			names = append(names, col.Field)
+		}
+	}
+	return names
+}
+
+// exportArchive reads the object graph into an archive. It reads in one
+// transaction, so the archive is consistent while editors keep working.
+func exportArchive() (Archive, error) {
+	version, err := schemaVersion()
+	if err != nil {
+		return Archive{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return Archive{}, err
+	}
+	a, err := readArchive(tx)
+	if err != nil {
+		tx.Rollback()
+		return Archive{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Archive{}, err
+	}
+	a.Header = ArchiveHeader{Format: archiveFormat, Version: archiveVersion, CreatedAt: time.Now().UTC(), SchemaVersion: version}
+	return a, nil
+}
+
+// readArchive reads every record of an archive but the header through tx.
+func readArchive(tx *sql.Tx) (Archive, error) {
+	var a Archive
+	contletDescriptions := map[string]string{}
+	for _, c := range getContletClasses() {
+		contletDescriptions[c.Table()] = c.Description
+	}
+
+	for _, table := range archiveClassTables() {
+		columns, err := describeTable(table)
+		if err != nil {
+			return a, fmt.Errorf("failed to describe %s: %w", table, err)
+		}
+		class := ArchiveClass{Table: table, Description: contletDescriptions[table], Fields: []ArchiveField{}}
+		for _, f := range classFieldsOf(table, columns) {
+			field := ArchiveField{Name: f.Name, Type: f.Type.Name, Required: f.Required}
+			if f.Default.Valid {
+				field.Default = &f.Default.String
+			}
+			class.Fields = append(class.Fields, field)
+		}
+		a.Classes = append(a.Classes, class)
+
+		entities, err := readArchiveEntities(tx, table, archivedColumns(table, columns))
+		if err != nil {
+			return a, err
+		}
+		a.Entities = append(a.Entities, entities...)
+	}
+
+	rows, err := tx.Query("SELECT name, description, symmetric_link FROM link_class ORDER BY name")
+	if err != nil {
+		return a, fmt.Errorf("failed to read link classes: %w", err)
+	}
+	for rows.Next() {
+		var lc ArchiveLinkClass
+		if err := rows.Scan(&lc.Name, &lc.Description, &lc.SymmetricLink); err != nil {
+			rows.Close()
+			return a, err
+		}
+		a.LinkClasses = append(a.LinkClasses, lc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return a, err
+	}
+
+	// Only the objects in the archive are referred to; rows of unknown classes are left out.
+	archived := make(map[int]bool, len(a.Entities))
+	for _, e := range a.Entities {
+		archived[e.ID] = true
+	}
+
+	rows, err = tx.Query("SELECT entity_id, tag_id FROM entity_tags ORDER BY entity_id, tag_id")
+	if err != nil {
+		return a, fmt.Errorf("failed to read tags: %w", err)
+	}
+	for rows.Next() {
+		var entityID, tagID int
+		if err := rows.Scan(&entityID, &tagID); err != nil {
+			rows.Close()
+			return a, err
+		}
+		if !archived[entityID] || !archived[tagID] {
+			continue
+		}
+		if n := len(a.Tags); n > 0 && a.Tags[n-1].EntityID == entityID {
+			a.Tags[n-1].TagIDs = append(a.Tags[n-1].TagIDs, tagID)
+		} else {
+			a.Tags = append(a.Tags, ArchiveTags{EntityID: entityID, TagIDs: []int{tagID}})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return a, err
+	}
+
+	rows, err = tx.Query("SELECT content_piece_id, contlet_id, sort_order FROM content_piece_contlets ORDER BY content_piece_id, sort_order")
+	if err != nil {
+		return a, fmt.Errorf("failed to read contlet slots: %w", err)
+	}
+	for rows.Next() {
+		var pieceID int
+		var slot ArchiveSlot
+		if err := rows.Scan(&pieceID, &slot.ContletID, &slot.SortOrder); err != nil {
+			rows.Close()
+			return a, err
+		}
+		if !archived[pieceID] || !archived[slot.ContletID] {
+			continue
+		}
+		if n := len(a.Slots); n > 0 && a.Slots[n-1].PieceID == pieceID {
+			a.Slots[n-1].Slots = append(a.Slots[n-1].Slots, slot)
+		} else {
+			a.Slots = append(a.Slots, ArchiveSlots{PieceID: pieceID, Slots: []ArchiveSlot{slot}})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return a, err
+	}
+
+	rows, err = tx.Query("SELECT subject_id, link_type, object_id, source, confidence FROM entity_relationships ORDER BY id")
+	if err != nil {
+		return a, fmt.Errorf("failed to read links: %w", err)
+	}
+	for rows.Next() {
+		var l ArchiveLink
+		if err := rows.Scan(&l.SubjectID, &l.LinkType, &l.ObjectID, &l.Source, &l.Confidence); err != nil {
+			rows.Close()
+			return a, err
+		}
+		if archived[l.SubjectID] && archived[l.ObjectID] {
+			a.Links = append(a.Links, l)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return a, err
+	}
+
+	rows, err = tx.Query("SELECT piece_id, snapshot, published_by, published_at FROM published_piece ORDER BY piece_id")
+	if err != nil {
+		return a, fmt.Errorf("failed to read published pieces: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p ArchivePublication
+		var snapshot string
+		if err := rows.Scan(&p.PieceID, &snapshot, &p.PublishedBy, &p.PublishedAt); err != nil {
+			return a, err
+		}
+		p.Snapshot = json.RawMessage(snapshot)
+		if archived[p.PieceID] {
+			a.Publications = append(a.Publications, p)
+		}
+	}
+	return a, rows.Err()
+}
+
+// readArchiveEntities reads the objects of a class table with the given columns.
+func readArchiveEntities(tx *sql.Tx, table string, columns []string) ([]ArchiveEntity, error) {
+	selected := "id"
+	for _, c := range columns {
+		selected += ", `" + c + "`"
+	}
+	// Without arguments the query uses the text protocol, so every value
+	// arrives as its text form, or as a time.Time for time columns.
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM `%s` ORDER BY id", selected, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns)+1)
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var entities []ArchiveEntity
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(*columnText(values[0], types[0].DatabaseTypeName()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id in %s: %w", table, err)
+		}
+		e := ArchiveEntity{ID: id, Class: table, Values: make(map[string]*string, len(columns))}
+		for i, c := range columns {
+			e.Values[c] = columnText(values[i+1], types[i+1].DatabaseTypeName())
+		}
+		entities = append(entities, e)
+	}
+	return entities, rows.Err()
+}
+
+// writeArchive writes an archive as one JSON record per line.
+func writeArchive(w io.Writer, a Archive) error {
+	enc := json.NewEncoder(w)
+	a.Header.Type = "header"
+	if err := enc.Encode(a.Header); err != nil {
+		return err
+	}
+	for _, r := range a.Classes {
+		r.Type = "class"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.LinkClasses {
+		r.Type = "link_class"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Entities {
+		r.Type = "entity"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Tags {
+		r.Type = "tags"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Slots {
+		r.Type = "slots"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Links {
+		r.Type = "link"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Publications {
+		r.Type = "publication"
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseArchive reads an archive written by writeArchive. It refuses other
+// formats and newer versions, and checks that every record refers only to
+// objects and link classes of the archive.
+func parseArchive(r io.Reader) (Archive, error) {
+	var a Archive
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return a, &ValidationError{fmt.Sprintf("record %d: %v", n, err)}
+		}
+		var record struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return a, &ValidationError{fmt.Sprintf("record %d: %v", n, err)}
+		}
+		if n == 1 && record.Type != "header" {
+			return a, &ValidationError{"not a sherpa archive: the first record is not a header"}
+		}
+
+		var err error
+		switch record.Type {
+		case "header":
+			if n > 1 {
+				return a, &ValidationError{fmt.Sprintf("record %d: a second header", n)}
+			}
+			err = json.Unmarshal(raw, &a.Header)
+		case "class":
+			a.Classes = append(a.Classes, ArchiveClass{})
+			err = json.Unmarshal(raw, &a.Classes[len(a.Classes)-1])
+		case "link_class":
+			a.LinkClasses = append(a.LinkClasses, ArchiveLinkClass{})
+			err = json.Unmarshal(raw, &a.LinkClasses[len(a.LinkClasses)-1])
+		case "entity":
+			a.Entities = append(a.Entities, ArchiveEntity{})
+			err = json.Unmarshal(raw, &a.Entities[len(a.Entities)-1])
+		case "tags":
+			a.Tags = append(a.Tags, ArchiveTags{})
+			err = json.Unmarshal(raw, &a.Tags[len(a.Tags)-1])
+		case "slots":
+			a.Slots = append(a.Slots, ArchiveSlots{})
+			err = json.Unmarshal(raw, &a.Slots[len(a.Slots)-1])
+		case "link":
+			a.Links = append(a.Links, ArchiveLink{})
+			err = json.Unmarshal(raw, &a.Links[len(a.Links)-1])
+		case "publication":
+			a.Publications = append(a.Publications, ArchivePublication{})
+			err = json.Unmarshal(raw, &a.Publications[len(a.Publications)-1])
+		default:
+			return a, &ValidationError{fmt.Sprintf("record %d: unknown record type %q", n, record.Type)}
+		}
+		if err != nil {
+			return a, &ValidationError{fmt.Sprintf("record %d (%s): %v", n, record.Type, err)}
+		}
+	}
+
+	if a.Header.Format != archiveFormat {
+		return a, &ValidationError{"not a sherpa archive"}
+	}
+	if a.Header.Version < 1 || a.Header.Version > archiveVersion {
+		return a, &ValidationError{fmt.Sprintf("archive version %d is not supported; the newest version this program reads is %d", a.Header.Version, archiveVersion)}
+	}
+	return a, checkArchiveReferences(a)
+}
+
+// checkArchiveReferences checks that the records of an archive only refer to
+// objects of the right kind and to link classes within it.
+func checkArchiveReferences(a Archive) error {
+	classes := make(map[string]bool, len(a.Classes))
+	for _, c := range a.Classes {
+		if !isClassTable(c.Table) {
+			return &ValidationError{fmt.Sprintf("%s is not a class table", c.Table)}
+		}
+		classes[c.Table] = true
+	}
+	linkClasses := make(map[string]bool, len(a.LinkClasses))
+	for _, lc := range a.LinkClasses {
+		linkClasses[lc.Name] = true
+	}
+
+	kinds := make(map[int]string, len(a.Entities))
+	for _, e := range a.Entities {
+		if !classes[e.Class] {
+			return &ValidationError{fmt.Sprintf("object %d is of class %s, which the archive does not define", e.ID, e.Class)}
+		}
+		if _, dup := kinds[e.ID]; dup {
+			return &ValidationError{fmt.Sprintf("object %d appears twice", e.ID)}
+		}
+		if e.Class == "tag" {
+			taxonomyID, err := strconv.Atoi(stringValue(e.Values["taxonomy_id"]))
+			if err != nil || kinds[taxonomyID] != "taxonomy" {
+				return &ValidationError{fmt.Sprintf("tag %d refers to a taxonomy that does not precede it in the archive", e.ID)}
+			}
+		}
+		kinds[e.ID] = entityKind(e.Class)
+	}
+
+	refer := func(id int, kind, what string) error {
+		k, ok := kinds[id]
+		if !ok {
+			return &ValidationError{fmt.Sprintf("%s refers to object %d, which the archive does not contain", what, id)}
+		}
+		if kind != "" && k != kind {
+			return &ValidationError{fmt.Sprintf("%s refers to object %d, which is not a %s", what, id, kind)}
+		}
+		return nil
+	}
+	for _, t := range a.Tags {
+		if err := refer(t.EntityID, "", "a tag list"); err != nil {
+			return err
+		}
+		for _, id := range t.TagIDs {
+			if err := refer(id, "tag", fmt.Sprintf("the tag list of object %d", t.EntityID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range a.Slots {
+		if err := refer(s.PieceID, "piece", "a contlet list"); err != nil {
+			return err
+		}
+		for _, slot := range s.Slots {
+			if err := refer(slot.ContletID, "contlet", fmt.Sprintf("the contlet list of piece %d", s.PieceID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, l := range a.Links {
+		if !linkClasses[l.LinkType] {
+			return &ValidationError{fmt.Sprintf("a link has type %s, which the archive does not define", l.LinkType)}
+		}
+		if err := refer(l.SubjectID, "", "a link"); err != nil {
+			return err
+		}
+		if err := refer(l.ObjectID, "", "a link"); err != nil {
+			return err
+		}
+	}
+	for _, p := range a.Publications {
+		if err := refer(p.PieceID, "piece", "a publication"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringValue returns the text of a possibly NULL archived value.
+func stringValue(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// prepareArchiveSchema makes sure the database has the classes and fields the
+// archive's objects need. Missing contlet classes are created with their
+// fields; DDL is not transactional, so this happens before the import and
+// stays if the import fails. A field missing from an existing table is an
+// error, since adding it would change the objects already there.
+func prepareArchiveSchema(a Archive) error {
+	for _, c := range a.Classes {
+		name, isContlet := strings.CutPrefix(c.Table, "contlet_")
+		if _, ok := getContletClass(name); isContlet && !ok {
+			if err := createContletClass(name, c.Description, "", ""); err != nil {
+				return fmt.Errorf("failed to create contlet class %s: %w", name, err)
+			}
+			for _, f := range c.Fields {
+				plan, err := planAddField(c.Table, f.Name, f.Type, f.Required, stringValue(f.Default))
+				if err != nil {
+					return fmt.Errorf("failed to add field %s to %s: %w", f.Name, c.Table, err)
+				}
+				if err := applySchemaPlan(plan); err != nil {
+					return err
+				}
+			}
+			log.Printf("Created contlet class %s.", name)
+			continue
+		}
+
+		columns, err := describeTable(c.Table)
+		if err != nil {
+			return fmt.Errorf("failed to describe %s: %w", c.Table, err)
+		}
+		for _, f := range c.Fields {
+			if !slices.ContainsFunc(columns, func(col ColumnDetail) bool { return col.Field == f.Name }) {
+				return &ValidationError{fmt.Sprintf("%s has no field %s; add it in the schema editor before importing", c.Table, f.Name)}
+			}
+		}
+	}
+	return loadContletClasses()
+}
+
+// importArchive loads an archive into the database in one transaction. Every
+// object gets a new ID, except that taxonomies and tags that already exist,
+// by name and by value within their taxonomy, are used instead of duplicated.
+// Link classes are created when missing. Pieces are imported without their
+// publish and unpublish schedules. Pieces and contlets get an
+// "Imported from archive" revision by author.
+func importArchive(a Archive, author string) (ArchiveImportStats, error) {
+	var stats ArchiveImportStats
+	version, err := schemaVersion()
+	if err != nil {
+		return stats, err
+	}
+	if a.Header.SchemaVersion > version {
+		return stats, &ValidationError{fmt.Sprintf("the archive was exported from schema version %d, newer than this database's %d", a.Header.SchemaVersion, version)}
+	}
+	if err := prepareArchiveSchema(a); err != nil {
+		return stats, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	if err := importArchiveTx(tx, a, author, &stats); err != nil {
+		tx.Rollback()
+		return stats, err
+	}
+	if err := tx.Commit(); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// importArchiveTx does the work of importArchive inside tx.
+func importArchiveTx(tx *sql.Tx, a Archive, author string, stats *ArchiveImportStats) error {
+	// Link classes come first; their symmetric links may refer to each other.
+	var createdLinkClasses []ArchiveLinkClass
+	for _, lc := range a.LinkClasses {
+		res, err := tx.Exec("INSERT IGNORE INTO link_class (name, description) VALUES (?, ?)", lc.Name, lc.Description)
+		if err != nil {
+			return fmt.Errorf("failed to create link class %s: %w", lc.Name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			createdLinkClasses = append(createdLinkClasses, lc)
+		}
+	}
+	for _, lc := range createdLinkClasses {
+		if err := pairSymmetricLink(tx, lc.Name, stringValue(lc.SymmetricLink)); err != nil {
+			return fmt.Errorf("failed to pair link class %s: %w", lc.Name, err)
+		}
+	}
+
+	initial, err := initialStatus(tx)
+	if err != nil {
+		return err
+	}
+	ids := make(map[int]int64, len(a.Entities))
+	var created []int64
+	for _, e := range a.Entities {
+		values := maps.Clone(e.Values)
+
+		var existing int64
+		var err error
+		switch e.Class {
+		case "taxonomy":
+			err = tx.QueryRow("SELECT id FROM taxonomy WHERE name = ?", stringValue(values["name"])).Scan(&existing)
+		case "tag":
+			taxonomyID, _ := strconv.Atoi(stringValue(values["taxonomy_id"]))
+			mapped := strconv.FormatInt(ids[taxonomyID], 10)
+			values["taxonomy_id"] = &mapped
+			err = tx.QueryRow("SELECT id FROM tag WHERE taxonomy_id = ? AND value = ?", mapped, stringValue(values["value"])).Scan(&existing)
+		case "content_piece":
+			err = sql.ErrNoRows
+			if _, serr := getWorkflowStatus(tx, stringValue(values["status"])); serr == sql.ErrNoRows {
+				values["status"] = &initial
+				stats.StatusesReset++
+			} else if serr != nil {
+				return serr
+			}
+			// A schedule would fire as a user who may not exist here; an
+			// editor schedules imported pieces again.
+			if values["publish_at"] != nil || values["unpublish_at"] != nil {
+				stats.SchedulesCleared++
+			}
+			for _, c := range []string{"publish_at", "unpublish_at", "scheduled_by", "schedule_error"} {
+				if _, ok := values[c]; ok {
+					values[c] = nil
+				}
+			}
+		default:
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			ids[e.ID] = existing
+			stats.Merged++
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		id, err := newEntity(tx, e.Class)
+		if err != nil {
+			return fmt.Errorf("failed to create entity for %s %d: %w", e.Class, e.ID, err)
+		}
+		cols := []string{"`id`"}
+		args := []interface{}{id}
+		for _, c := range slices.Sorted(maps.Keys(values)) {
+			if !validIdentifier(c) {
+				return &ValidationError{fmt.Sprintf("object %d has an invalid column name %q", e.ID, c)}
+			}
+			cols = append(cols, "`"+c+"`")
+			if v := values[c]; v != nil {
+				args = append(args, *v)
+			} else {
+				args = append(args, nil) // NULL
+			}
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+		query := fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", e.Class, strings.Join(cols, ", "), placeholders)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to insert %s %d: %w", e.Class, e.ID, err)
+		}
+		ids[e.ID] = id
+		created = append(created, id)
+		stats.Created++
+	}
+
+	for _, t := range a.Tags {
+		for _, tagID := range t.TagIDs {
+			if _, err := tx.Exec("INSERT IGNORE INTO entity_tags (entity_id, tag_id) VALUES (?, ?)", ids[t.EntityID], ids[tagID]); err != nil {
+				return fmt.Errorf("failed to tag object %d: %w", t.EntityID, err)
+			}
+		}
+	}
+	for _, s := range a.Slots {
+		for _, slot := range s.Slots {
+			_, err := tx.Exec("INSERT INTO content_piece_contlets (content_piece_id, contlet_id, sort_order) VALUES (?, ?, ?)",
+				ids[s.PieceID], ids[slot.ContletID], slot.SortOrder)
+			if err != nil {
+				return fmt.Errorf("failed to add the contlets of piece %d: %w", s.PieceID, err)
+			}
+		}
+	}
+	for _, l := range a.Links {
+		res, err := tx.Exec("INSERT IGNORE INTO entity_relationships (subject_id, link_type, object_id, source, confidence) VALUES (?, ?, ?, ?, ?)",
+			ids[l.SubjectID], l.LinkType, ids[l.ObjectID], l.Source, l.Confidence)
+		if err != nil {
+			return fmt.Errorf("failed to create a %s link: %w", l.LinkType, err)
+		}
+		n, _ := res.RowsAffected()
+		stats.Links += int(n)
+	}
+	for _, p := range a.Publications {
+		snapshot, err := remapSnapshot(p.Snapshot, ids)
+		if err != nil {
+			return fmt.Errorf("failed to read the published snapshot of piece %d: %w", p.PieceID, err)
+		}
+		_, err = tx.Exec("INSERT INTO published_piece (piece_id, snapshot, published_by, published_at) VALUES (?, ?, ?, ?)",
+			ids[p.PieceID], string(snapshot), p.PublishedBy, p.PublishedAt)
+		if err != nil {
+			return fmt.Errorf("failed to publish piece %d: %w", p.PieceID, err)
+		}
+		stats.Publications++
+	}
+
+	for _, id := range created {
+		if err := recordRevision(tx, int(id), author, "Imported from archive"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapSnapshot gives a published snapshot the new IDs of its piece and
+// contlets. Contlets deleted since publishing are not in the archive and get
+// ID 0.
+func remapSnapshot(snapshot json.RawMessage, ids map[int]int64) ([]byte, error) {
+	var piece PieceDetail
+	if err := json.Unmarshal(snapshot, &piece); err != nil {
+		return nil, err
+	}
+	piece.ID = int(ids[piece.ID])
+	for i, c := range piece.Contlets {
+		piece.Contlets[i].ID = int(ids[c.ID])
+	}
+	return encodePieceSnapshot(piece)
+}
+
+// runExportCommand implements the `export [-o file]` command line.
+func runExportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", "", "File to write the archive to; standard output if empty.")
+	flags.Parse(args)
+	if err := requireCurrentSchema(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadContletClasses(); err != nil {
+		log.Fatal(err)
+	}
+
+	a, err := exportArchive()
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writeArchive(w, a); err != nil {
+		log.Fatalf("Failed to write the archive: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Failed to write the archive: %v", err)
+	}
+	log.Printf("✅ Exported %d object(s), %d link(s) and %d publication(s).", len(a.Entities), len(a.Links), len(a.Publications))
+}
+
+// runImportCommand implements the `import [-author name] file` command line.
+func runImportCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	author := flags.String("author", "system", "Author recorded in the revisions of the imported objects.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-author name] archive.ndjson")
+		os.Exit(2)
+	}
+	if err := requireCurrentSchema(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadContletClasses(); err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := parseArchive(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", flags.Arg(0), err)
+	}
+	stats, err := importArchive(a, *author)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", flags.Arg(0), err)
+	}
+	log.Printf("✅ Imported %d object(s), used %d existing taxonomies and tags, created %d link(s) and %d publication(s).",
+		stats.Created, stats.Merged, stats.Links, stats.Publications)
+	if stats.StatusesReset > 0 {
+		log.Printf("Warning: %d piece(s) had a status this workflow does not have and start in its initial status.", stats.StatusesReset)
+	}
+	if stats.SchedulesCleared > 0 {
+		log.Printf("Warning: %d piece(s) were scheduled; the schedules were not imported.", stats.SchedulesCleared)
+	}
+}
@@ -0,0 +1,569 @@
+// In file: auth.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users log in with a password and are then recognized by a session cookie.
+// Every route except the login page and the static files is wrapped in
+// authorize, which lets a request through only if its user holds the role the
+// route needs. Roles are granted in role_member; the access roles below each
+// include the ones before them, so a publisher may also edit and view.
+
+// The access roles, from least to most privileged.
+const (
+	roleViewer      = "viewer"       // may read everything except the schema editor and user admin
+	roleEditor      = "editor"       // may change pieces, contlets, tags, taxonomies and links
+	rolePublisher   = "publisher"    // may make the publishing transitions of the workflow and delete pieces
+	roleSchemaAdmin = "schema_admin" // may change the schema, the classes, the workflow and the users
+)
+
+// accessRoles lists the access roles; each includes the ones before it.
+var accessRoles = []string{roleViewer, roleEditor, rolePublisher, roleSchemaAdmin}
+
+// sessionCookie names the cookie that carries the session token.
+const sessionCookie = "datalayer_session"
+
+// minPasswordLength is the shortest password an account may have.
+const minPasswordLength = 10
+
+// passwordIterations is the PBKDF2-SHA256 work factor for new password hashes.
+const passwordIterations = 600000
+
+// User is an account together with the roles it holds.
+type User struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"user_name"`
+	Roles       []string  `json:"roles"`
+	HasPassword bool      `json:"has_password"`
+	CreatedAt   time.Time `json:"created_at"`
+	Token       *APIToken `json:"-"` // the API token the request came with, if any
+}
+
+// Has reports whether the user holds role, directly or through a higher access role.
+func (u *User) Has(role string) bool {
+	return u != nil && rolesGrant(u.Roles, role)
+}
+
+// rolesGrant reports whether holding the roles held grants role.
+func rolesGrant(held []string, role string) bool {
+	want := slices.Index(accessRoles, role)
+	for _, h := range held {
+		if h == role || (want >= 0 && slices.Index(accessRoles, h) >= want) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword derives a salted PBKDF2-SHA256 hash of a password, encoded as
+// "pbkdf2-sha256$iterations$salt$key".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches an encoded hash.
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is checked against when a login names no account, so that
+// a failed login takes as long whether or not the user name exists.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	h, _ := hashPassword("no account has this password")
+	return h
+})
+
+// validatePassword checks that a new password is acceptable.
+func validatePassword(password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return &ValidationError{fmt.Sprintf("a password needs at least %d characters", minPasswordLength)}
+	}
+	return nil
+}
+
+// scanUsers collects users from rows of (id, user_name, has password, created_at, roles),
+// where roles is a comma-separated list.
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		var roles sql.NullString
+		if err := rows.Scan(&u.ID, &u.Name, &u.HasPassword, &u.CreatedAt, &roles); err != nil {
+			return nil, err
+		}
+		u.Roles = []string{}
+		if roles.String != "" {
+			u.Roles = strings.Split(roles.String, ",")
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// userColumns selects what scanUsers expects from app_user u.
+const userColumns = `u.id, u.user_name, u.password_hash IS NOT NULL, u.created_at,
+	(SELECT GROUP_CONCAT(rm.role ORDER BY rm.role) FROM role_member rm WHERE rm.user_name = u.user_name)`
+
+// getUsers returns every account, by user name.
+func getUsers() ([]User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM app_user u ORDER BY u.user_name")
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+// getUserByID returns one account, or sql.ErrNoRows.
+func getUserByID(id int) (User, error) {
+	rows, err := db.Query("SELECT "+userColumns+" FROM app_user u WHERE u.id = ?", id)
+	if err != nil {
+		return User{}, err
+	}
+	users, err := scanUsers(rows)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, sql.ErrNoRows
+	}
+	return users[0], nil
+}
+
+// createUser creates an account with a password and roles and returns its ID.
+func createUser(name, password string, roles []string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 || name == "anonymous" {
+		return 0, &ValidationError{fmt.Sprintf("invalid user name %q", name)}
+	}
+	if err := validatePassword(password); err != nil {
+		return 0, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO app_user (user_name, password_hash) VALUES (?, ?)", name, hash)
+	if isDuplicateEntry(err) {
+		tx.Rollback()
+		return 0, &ConflictError{fmt.Sprintf("a user named %q already exists", name)}
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to create user %s: %w", name, err)
+	}
+	id, err := res.LastInsertId()
+	if err == nil {
+		err = writeUserRoles(tx, name, roles)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// setUserPassword replaces the password of an account and ends its sessions.
+func setUserPassword(id int, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE app_user SET password_hash = ? WHERE id = ?", hash, id)
+	if err != nil {
+		return fmt.Errorf("failed to set the password of user %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := db.Exec("DELETE FROM user_session WHERE user_id = ?", id); err != nil {
+		return fmt.Errorf("failed to end the sessions of user %d: %w", id, err)
+	}
+	return nil
+}
+
+// setUserRoles replaces the roles of an account. The last schema admin cannot
+// give up the role, so that someone can always administer the users.
+func setUserRoles(id int, roles []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var name string
+	err = tx.QueryRow("SELECT user_name FROM app_user WHERE id = ? FOR UPDATE", id).Scan(&name)
+	if err == nil && !rolesGrant(roles, roleSchemaAdmin) {
+		err = checkOtherSchemaAdmin(tx, name)
+	}
+	if err == nil {
+		if _, err = tx.Exec("DELETE FROM role_member WHERE user_name = ?", name); err != nil {
+			err = fmt.Errorf("failed to update the roles of %s: %w", name, err)
+		}
+	}
+	if err == nil {
+		err = writeUserRoles(tx, name, roles)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteUser removes an account with its roles and sessions. The changes it made
+// keep its name as their author.
+func deleteUser(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var name string
+	err = tx.QueryRow("SELECT user_name FROM app_user WHERE id = ? FOR UPDATE", id).Scan(&name)
+	if err == nil {
+		err = checkOtherSchemaAdmin(tx, name)
+	}
+	if err == nil {
+		if _, err = tx.Exec("DELETE FROM app_user WHERE id = ?", id); err != nil {
+			err = fmt.Errorf("failed to delete user %s: %w", name, err)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkOtherSchemaAdmin returns a ConflictError if name is a schema admin and
+// no other account is.
+func checkOtherSchemaAdmin(tx *sql.Tx, name string) error {
+	var self, others int
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(user_name = ?), 0), COALESCE(SUM(user_name <> ?), 0)
+		FROM role_member WHERE role = ? FOR UPDATE`, name, name, roleSchemaAdmin).Scan(&self, &others)
+	if err != nil {
+		return fmt.Errorf("failed to count the schema admins: %w", err)
+	}
+	if self > 0 && others == 0 {
+		return &ConflictError{fmt.Sprintf("%s is the last schema admin; make someone else schema admin first", name)}
+	}
+	return nil
+}
+
+// writeUserRoles grants roles to a user name.
+func writeUserRoles(tx *sql.Tx, name string, roles []string) error {
+	for _, role := range roles {
+		if !validIdentifier(role) || len(role) > 50 {
+			return &ValidationError{fmt.Sprintf("invalid role name %q: use letters, digits and underscores", role)}
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO role_member (role, user_name) VALUES (?, ?)", role, name); err != nil {
+			return fmt.Errorf("failed to grant %s to %s: %w", role, name, err)
+		}
+	}
+	return nil
+}
+
+// assignableRoles returns the roles the user admin offers: the access roles and
+// the approver roles of the workflow.
+func assignableRoles() ([]string, error) {
+	roles := slices.Clone(accessRoles)
+	rows, err := db.Query("SELECT DISTINCT approver_role FROM workflow_transition WHERE approver_role IS NOT NULL ORDER BY approver_role")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles, rows.Err()
+}
+
+// hashToken returns the hex SHA-256 of a secret token, which is what is stored of it.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random URL-safe secret.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// login checks a user name and password and starts a session. It returns the
+// session token, or a ValidationError that does not tell which of the two was wrong.
+func login(name, password string) (string, error) {
+	var id int
+	var hash sql.NullString
+	err := db.QueryRow("SELECT id, password_hash FROM app_user WHERE user_name = ?", name).Scan(&id, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if !hash.Valid {
+		checkPassword(dummyPasswordHash(), password)
+		return "", &ValidationError{"unknown user name or wrong password"}
+	}
+	if !checkPassword(hash.String, password) {
+		return "", &ValidationError{"unknown user name or wrong password"}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	// Expired sessions are cleaned up as new ones start.
+	if _, err := db.Exec("DELETE FROM user_session WHERE expires_at <= UTC_TIMESTAMP()"); err != nil {
+		return "", fmt.Errorf("failed to remove expired sessions: %w", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO user_session (token_hash, user_id, created_at, expires_at)
+		VALUES (?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP() + INTERVAL ? SECOND)`,
+		hashToken(token), id, int64(time.Duration(cfg.SessionLifetime).Seconds()))
+	if err != nil {
+		return "", fmt.Errorf("failed to start a session: %w", err)
+	}
+	return token, nil
+}
+
+// logout ends a session.
+func logout(token string) error {
+	if _, err := db.Exec("DELETE FROM user_session WHERE token_hash = ?", hashToken(token)); err != nil {
+		return fmt.Errorf("failed to end the session: %w", err)
+	}
+	return nil
+}
+
+// sessionUser returns the user of the session the request carries, or nil.
+func sessionUser(r *http.Request) (*User, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+	rows, err := db.Query(`
+		SELECT `+userColumns+` FROM user_session s JOIN app_user u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > UTC_TIMESTAMP()`, hashToken(c.Value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the session: %w", err)
+	}
+	users, err := scanUsers(rows)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// currentUser returns the user authorize let the request through for, or nil.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userContextKey).(*User)
+	return u
+}
+
+// requestAuthor names who makes a change: the logged-in user.
+func requestAuthor(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Name
+	}
+	return "anonymous"
+}
+
+// authorize lets a request through to h only if it comes from a logged-in user
+// who holds readRole, for GET and HEAD requests, or writeRole, for any other.
+// Requests without a session are sent to the login page, or answered 401 if
+// they are API requests; requests lacking the role are answered 403. API
+// requests may instead carry a bearer token (tokens.go).
+func authorize(readRole, writeRole string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api := isAPIRequest(r)
+		token, hasToken := bearerToken(r)
+		if hasToken {
+			if !strings.HasPrefix(r.URL.Path, "/api/") {
+				writeAPIError(w, http.StatusUnauthorized, "API tokens are only accepted under /api/")
+				return
+			}
+			authorizeToken(w, r, token, readRole, writeRole, h)
+			return
+		}
+
+		user, err := sessionUser(r)
+		if err != nil {
+			http.Error(w, "Failed to check the session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			if api {
+				writeAPIError(w, http.StatusUnauthorized, "Log in first")
+				return
+			}
+			next := r.URL.RequestURI()
+			if r.Method != http.MethodGet {
+				next = r.Referer() // the page the form was on
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+
+		role := writeRole
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = readRole
+		}
+		if !user.Has(role) {
+			forbidRole(w, r, role)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// requireRole lets a request that authorize has let through go on to h only if
+// its user also holds role. It guards actions that need more than their route.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Has(role) {
+			forbidRole(w, r, role)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// forbidRole answers 403 for a request whose user lacks role.
+func forbidRole(w http.ResponseWriter, r *http.Request, role string) {
+	message := fmt.Sprintf("Forbidden: this needs the %s role", role)
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusForbidden, message)
+		return
+	}
+	http.Error(w, message, http.StatusForbidden)
+}
+
+// isAPIRequest reports whether a request is answered in JSON rather than HTML.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, graphQLPath) ||
+		prefersJSON(r.Header.Get("Accept"))
+}
+
+// safeRedirect returns the path and query of next if it points into this site,
+// and fallback otherwise, so that forms taking a redirect target cannot be used
+// to send users elsewhere. The result is re-encoded, so a path such as "/\evil.com"
+// cannot be read by browsers as another host.
+func safeRedirect(r *http.Request, next, fallback string) string {
+	u, err := url.Parse(next)
+	if err != nil || (u.Host != "" && u.Host != r.Host) || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
+		return fallback
+	}
+	return u.RequestURI()
+}
+
+// runUserCommand implements the "user" sub-command, which manages accounts from
+// the shell; it is how the first schema admin is created. Passwords are read
+// from the first line of standard input.
+func runUserCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: user add <name> [role...] | passwd <name> | list")
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "add" && len(args) >= 2:
+		if _, err := createUser(args[1], readPasswordLine(), args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✅ Created user %s.", args[1])
+	case args[0] == "passwd" && len(args) == 2:
+		var id int
+		if err := db.QueryRow("SELECT id FROM app_user WHERE user_name = ?", args[1]).Scan(&id); err != nil {
+			log.Fatalf("No user named %s: %v", args[1], err)
+		}
+		if err := setUserPassword(id, readPasswordLine()); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✅ Set the password of %s.", args[1])
+	case args[0] == "list":
+		users, err := getUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			fmt.Printf("%-30s %s\n", u.Name, strings.Join(u.Roles, ","))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown user command %q (want add, passwd or list)\n", strings.Join(args, " "))
+		os.Exit(2)
+	}
+}
+
+// readPasswordLine reads a password from the first line of standard input.
+func readPasswordLine() string {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal("Failed to read the password: ", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
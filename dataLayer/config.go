@@ -0,0 +1,296 @@
+// In file: config.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Config holds every externally configurable setting of the application.
+//
+// Values are resolved with the following precedence (highest first):
+// command-line flags, DATALAYER_* environment variables, the optional JSON
+// config file, and finally the built-in defaults.
+type Config struct {
+	DBUser     string `json:"db_user"`
+	DBPassword string `json:"db_password"`
+	DBHost     string `json:"db_host"`
+	DBPort     int    `json:"db_port"`
+	DBName     string `json:"db_name"`
+
+	ListenAddr  string `json:"listen_addr"`
+	TemplateDir string `json:"template_dir"`
+	StaticDir   string `json:"static_dir"`
+
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+
+	SchedulerInterval Duration `json:"scheduler_interval"`
+	SessionLifetime   Duration `json:"session_lifetime"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "5m" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// cfg is the configuration in effect for this process.
+var cfg = defaultConfig()
+
+// defaultConfig returns the settings used when nothing else is configured.
+// They match the local development setup described in the README.
+func defaultConfig() Config {
+	return Config{
+		DBUser:          "dataLayer_admin",
+		DBPassword:      "password",
+		DBHost:          "127.0.0.1",
+		DBPort:          3306,
+		DBName:          "content_db",
+		ListenAddr:      ":8080",
+		TemplateDir:     "templates",
+		StaticDir:       "static",
+		MaxOpenConns:    25,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: Duration(5 * time.Minute),
+
+		SchedulerInterval: Duration(time.Minute),
+		SessionLifetime:   Duration(12 * time.Hour),
+	}
+}
+
+// configSetting binds one Config field to its flag name and environment variable.
+type configSetting struct {
+	name  string // flag name; the env var is DATALAYER_ + upper-cased name with '-' -> '_'
+	usage string
+	set   func(c *Config, v string) error
+}
+
+func (s configSetting) envVar() string {
+	return "DATALAYER_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func stringSetting(name, usage string, field func(c *Config) *string) configSetting {
+	return configSetting{name, usage, func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(name, usage string, field func(c *Config) *int) configSetting {
+	return configSetting{name, usage, func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", name, v)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+// configSettings lists every setting that can be given as a flag or env var.
+var configSettings = []configSetting{
+	stringSetting("db-user", "Database user name.", func(c *Config) *string { return &c.DBUser }),
+	stringSetting("db-password", "Database password.", func(c *Config) *string { return &c.DBPassword }),
+	stringSetting("db-host", "Database host.", func(c *Config) *string { return &c.DBHost }),
+	intSetting("db-port", "Database TCP port.", func(c *Config) *int { return &c.DBPort }),
+	stringSetting("db-name", "Database (schema) name.", func(c *Config) *string { return &c.DBName }),
+	stringSetting("listen-addr", "HTTP listen address, e.g. :8080.", func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("template-dir", "Directory containing the HTML templates.", func(c *Config) *string { return &c.TemplateDir }),
+	stringSetting("static-dir", "Directory served under /static/.", func(c *Config) *string { return &c.StaticDir }),
+	intSetting("max-open-conns", "Maximum open database connections.", func(c *Config) *int { return &c.MaxOpenConns }),
+	intSetting("max-idle-conns", "Maximum idle database connections.", func(c *Config) *int { return &c.MaxIdleConns }),
+	{"conn-max-lifetime", "Maximum lifetime of a database connection, e.g. 5m.", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("conn-max-lifetime: %w", err)
+		}
+		c.ConnMaxLifetime = Duration(d)
+		return nil
+	}},
+	{"scheduler-interval", "How often the scheduler looks for schedules set elsewhere, e.g. 1m.", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("scheduler-interval: %w", err)
+		}
+		c.SchedulerInterval = Duration(d)
+		return nil
+	}},
+	{"session-lifetime", "How long a login session lasts, e.g. 12h.", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("session-lifetime: %w", err)
+		}
+		c.SessionLifetime = Duration(d)
+		return nil
+	}},
+}
+
+// registerConfigFlags defines the config flags on fs. The returned function
+// resolves the final Config once fs has been parsed.
+func registerConfigFlags(fs *flag.FlagSet) func() (Config, error) {
+	configFile := fs.String("config", "", "Path to an optional JSON config file (env: DATALAYER_CONFIG).")
+	flagValues := make(map[string]*string)
+	for _, s := range configSettings {
+		flagValues[s.name] = fs.String(s.name, "", s.usage+" (env: "+s.envVar()+")")
+	}
+
+	return func() (Config, error) {
+		c := defaultConfig()
+
+		path := *configFile
+		if path == "" {
+			path = os.Getenv("DATALAYER_CONFIG")
+		}
+		if path != "" {
+			if err := c.loadFile(path); err != nil {
+				return c, err
+			}
+		}
+
+		for _, s := range configSettings {
+			if v, ok := os.LookupEnv(s.envVar()); ok {
+				if err := s.set(&c, v); err != nil {
+					return c, fmt.Errorf("environment variable %s: %w", s.envVar(), err)
+				}
+			}
+		}
+
+		// Only flags given explicitly on the command line override the other sources.
+		var flagErr error
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range configSettings {
+				if s.name == f.Name && flagErr == nil {
+					flagErr = s.set(&c, *flagValues[s.name])
+				}
+			}
+		})
+		if flagErr != nil {
+			return c, flagErr
+		}
+
+		return c, c.Validate()
+	}
+}
+
+// loadFile overlays the settings present in a JSON config file onto c.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable. The template and static
+// directories are only checked by ValidateDirs, since most commands never read them.
+func (c Config) Validate() error {
+	var errs []error
+	if c.DBUser == "" {
+		errs = append(errs, errors.New("db_user must not be empty"))
+	}
+	if c.DBHost == "" {
+		errs = append(errs, errors.New("db_host must not be empty"))
+	}
+	if c.DBPort < 1 || c.DBPort > 65535 {
+		errs = append(errs, fmt.Errorf("db_port %d is out of range", c.DBPort))
+	}
+	if !validIdentifier(c.DBName) {
+		errs = append(errs, fmt.Errorf("db_name %q is not a valid identifier", c.DBName))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr %q: %w", c.ListenAddr, err))
+	}
+	if c.MaxOpenConns < 1 {
+		errs = append(errs, errors.New("max_open_conns must be at least 1"))
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConns > c.MaxOpenConns {
+		errs = append(errs, errors.New("max_idle_conns must be between 0 and max_open_conns"))
+	}
+	if c.ConnMaxLifetime < 0 {
+		errs = append(errs, errors.New("conn_max_lifetime must not be negative"))
+	}
+	if c.SchedulerInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("scheduler_interval must be at least 1s"))
+	}
+	if c.SessionLifetime < Duration(time.Minute) {
+		errs = append(errs, errors.New("session_lifetime must be at least 1m"))
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateDirs checks that the template and static directories exist. It is
+// called by the commands that render pages: serving and build-site.
+func (c Config) ValidateDirs() error {
+	var errs []error
+	for _, d := range []struct{ name, path string }{{"template_dir", c.TemplateDir}, {"static_dir", c.StaticDir}} {
+		if info, err := os.Stat(d.path); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s %q is not a directory", d.name, d.path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DSN builds the driver connection string. With withDB false the DSN does not
+// select a database, which is what setup and reset need.
+func (c Config) DSN(withDB bool) string {
+	mc := mysql.NewConfig()
+	mc.User = c.DBUser
+	mc.Passwd = c.DBPassword
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort))
+	if withDB {
+		mc.DBName = c.DBName
+		mc.ParseTime = true
+		mc.MultiStatements = true // migrations are multi-statement scripts
+	}
+	return mc.FormatDSN()
+}
+
+// Redacted returns a copy of c that is safe to print or log.
+func (c Config) Redacted() Config {
+	if c.DBPassword != "" {
+		c.DBPassword = "********"
+	}
+	return c
+}
+
+// printConfig writes the effective configuration, with secrets redacted, to stdout.
+func printConfig(c Config) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.Redacted())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resolveTestConfig resolves a Config from a config file, environment variables
+// and command-line arguments, ignoring any DATALAYER_* variables already set.
+func resolveTestConfig(t *testing.T, file string, env map[string]string, args []string) (Config, error) {
+	t.Helper()
+	t.Setenv("DATALAYER_CONFIG", "")
+	os.Unsetenv("DATALAYER_CONFIG")
+	for _, s := range configSettings {
+		t.Setenv(s.envVar(), "")
+		os.Unsetenv(s.envVar())
+	}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("DATALAYER_CONFIG", path)
+	}
+	for name, v := range env {
+		t.Setenv(name, v)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	resolve := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return resolve()
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	const file = `{"db_user": "file-user", "db_host": "file-host", "db_name": "file_db", "db_port": 3307}`
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want func(c *Config)
+	}{
+		{
+			name: "defaults",
+			want: func(c *Config) {},
+		},
+		{
+			name: "file over defaults",
+			file: file,
+			want: func(c *Config) {
+				c.DBUser, c.DBHost, c.DBName, c.DBPort = "file-user", "file-host", "file_db", 3307
+			},
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  map[string]string{"DATALAYER_DB_HOST": "env-host", "DATALAYER_DB_NAME": "env_db"},
+			want: func(c *Config) {
+				c.DBUser, c.DBHost, c.DBName, c.DBPort = "file-user", "env-host", "env_db", 3307
+			},
+		},
+		{
+			name: "flags over env",
+			file: file,
+			env:  map[string]string{"DATALAYER_DB_HOST": "env-host", "DATALAYER_DB_NAME": "env_db"},
+			args: []string{"--db-name=flag_db", "--listen-addr=:9090"},
+			want: func(c *Config) {
+				c.DBUser, c.DBHost, c.DBName, c.DBPort = "file-user", "env-host", "flag_db", 3307
+				c.ListenAddr = ":9090"
+			},
+		},
+		{
+			name: "each source sets only its own settings",
+			file: `{"db_port": 3307, "conn_max_lifetime": "90s"}`,
+			env:  map[string]string{"DATALAYER_DB_USER": "env-user"},
+			args: []string{"--db-port=3308"},
+			want: func(c *Config) {
+				c.DBUser, c.DBPort = "env-user", 3308
+				c.ConnMaxLifetime = Duration(90 * time.Second)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveTestConfig(t, tt.file, tt.env, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := defaultConfig()
+			tt.want(&want)
+			if got != want {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+	}{
+		{name: "unknown file key", file: `{"db_usr": "x"}`},
+		{name: "bad env integer", env: map[string]string{"DATALAYER_DB_PORT": "many"}},
+		{name: "bad flag duration", args: []string{"--session-lifetime=soon"}},
+		{name: "invalid db name", args: []string{"--db-name=content-db"}},
+		{name: "short scheduler interval", env: map[string]string{"DATALAYER_SCHEDULER_INTERVAL": "10ms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := resolveTestConfig(t, tt.file, tt.env, tt.args); err == nil {
+				t.Error("resolved without an error")
+			}
+		})
+	}
+}
+
+// Commands that never render pages must work without the template and static
+// directories, so only ValidateDirs looks at them.
+func TestConfigDirsAreCheckedSeparately(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	c, err := resolveTestConfig(t, "", nil, []string{"--template-dir=" + missing, "--static-dir=" + missing})
+	if err != nil {
+		t.Fatalf("resolving with missing directories: %v", err)
+	}
+	if err := c.ValidateDirs(); err == nil {
+		t.Error("ValidateDirs accepted missing directories")
+	}
+
+	dir := t.TempDir()
+	c.TemplateDir, c.StaticDir = dir, dir
+	if err := c.ValidateDirs(); err != nil {
+		t.Errorf("ValidateDirs with existing directories: %v", err)
+	}
+}
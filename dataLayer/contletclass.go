@@ -0,0 +1,440 @@
+// In file: contletclass.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContletClass is a registered kind of contlet. Its objects live in the
+// contlet_<Name> table, whose id column references entity(id).
+type ContletClass struct {
+	Name        string
+	Description string
+	LabelColumn string         // the first text column, used to summarize objects in lists; may be empty
+	Columns     []ColumnDetail // the columns of the class table, as described when the registry was loaded
+	Count       int            // number of objects; only set by getContletClassesWithCounts
+}
+
+// Table returns the name of the table holding the objects of the class.
+func (c ContletClass) Table() string {
+	return "contlet_" + c.Name
+}
+
+// Builtin reports whether application code depends on the class, in which case it cannot be retired.
+func (c ContletClass) Builtin() bool {
+	return isBuiltinContletClass(c.Name)
+}
+
+// builtinContletClasses are the contlet classes with dedicated handling in the code.
+var builtinContletClasses = []string{"paragraph", "heading", "image"}
+
+func isBuiltinContletClass(name string) bool {
+	for _, c := range builtinContletClasses {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// contletRegistry caches the rows of contlet_class and the columns of their tables.
+// It is loaded at startup and reloaded whenever a class is created or retired or
+// the fields of a class table change.
+var contletRegistry struct {
+	sync.RWMutex
+	classes []ContletClass
+}
+
+// loadContletClasses (re)reads the contlet_class vocabulary into the registry.
+// Registered classes whose table is missing are skipped with a warning.
+func loadContletClasses() error {
+	rows, err := db.Query("SELECT name, description FROM contlet_class ORDER BY name")
+	if err != nil {
+		return fmt.Errorf("failed to load contlet classes: %w", err)
+	}
+	var classes []ContletClass
+	for rows.Next() {
+		var c ContletClass
+		if err := rows.Scan(&c.Name, &c.Description); err != nil {
+			rows.Close()
+			return err
+		}
+		classes = append(classes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var usable []ContletClass
+	for _, c := range classes {
+		if !validIdentifier(c.Name) {
+			log.Printf("Warning: ignoring contlet class with invalid name %q", c.Name)
+			continue
+		}
+		columns, err := describeTable(c.Table())
+		if err != nil {
+			log.Printf("Warning: ignoring contlet class %q: %v", c.Name, err)
+			continue
+		}
+		c.Columns = columns
+		for _, col := range columns {
+			t := strings.ToLower(col.Type)
+			if col.Field != "id" && (strings.Contains(t, "char") || strings.Contains(t, "text")) {
+				c.LabelColumn = col.Field
+				break
+			}
+		}
+		usable = append(usable, c)
+	}
+
+	contletRegistry.Lock()
+	contletRegistry.classes = usable
+	contletRegistry.Unlock()
+	invalidateOpenAPI()
+	invalidateGraphQLSchema()
+	return nil
+}
+
+// getContletClasses returns the registered contlet classes, ordered by name.
+func getContletClasses() []ContletClass {
+	contletRegistry.RLock()
+	defer contletRegistry.RUnlock()
+	return append([]ContletClass(nil), contletRegistry.classes...)
+}
+
+// contletClassNames returns the names of the registered contlet classes.
+func contletClassNames() []string {
+	var names []string
+	for _, c := range getContletClasses() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// getContletClass looks up a registered contlet class by name.
+func getContletClass(name string) (ContletClass, bool) {
+	for _, c := range getContletClasses() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return ContletClass{}, false
+}
+
+// isContletClass reports whether class is a registered contlet class.
+func isContletClass(class string) bool {
+	_, ok := getContletClass(class)
+	return ok
+}
+
+// contletIndexSQL returns a derived table with one row (id, class, label) per
+// contlet object of every registered class. It replaces per-class LEFT JOINs in
+// queries that need to know which class a contlet belongs to.
+func contletIndexSQL() string {
+	var parts []string
+	for _, c := range getContletClasses() {
+		label := "''"
+		if c.LabelColumn != "" {
+			label = fmt.Sprintf("COALESCE(CAST(`%s` AS CHAR), '')", c.LabelColumn)
+		}
+		parts = append(parts, fmt.Sprintf("SELECT id, '%s' AS class, %s AS label FROM `%s`", c.Name, label, c.Table()))
+	}
+	if len(parts) == 0 {
+		return "(SELECT NULL AS id, NULL AS class, NULL AS label FROM DUAL WHERE FALSE)"
+	}
+	return "(" + strings.Join(parts, " UNION ALL ") + ")"
+}
+
+// loadContlets loads contlets with one query per class table that holds any of
+// them, found through entity.class. With ids nil every contlet is loaded,
+// otherwise only the given ones. The result is keyed by contlet ID; IDs that are
+// not contlets are absent. q is the database or the transaction of an
+// uncommitted change.
+func loadContlets(q queryer, ids []int) (map[int]ContletDetail, error) {
+	loaded := make(map[int]ContletDetail)
+	if ids != nil && len(ids) == 0 {
+		return loaded, nil
+	}
+
+	var where string
+	var args []interface{}
+	if ids != nil {
+		where = " WHERE id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := q.Query("SELECT DISTINCT class FROM entity"+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up contlet classes: %w", err)
+	}
+	present := make(map[string]bool)
+	for rows.Next() {
+		var class sql.NullString
+		if err := rows.Scan(&class); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		present[class.String] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, class := range getContletClasses() {
+		if !present[class.Table()] {
+			continue
+		}
+		if err := loadContletsOfClass(q, class, where, args, loaded); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// loadContletsOfClass reads every column of the matching rows of one class table.
+// System columns fill the typed fields of ContletDetail; all other columns are
+// kept in Extra, formatted by their semantic field type when they have one.
+func loadContletsOfClass(q queryer, class ContletClass, where string, args []interface{}, into map[int]ContletDetail) error {
+	table := class.Table()
+	types := make(map[string]string, len(class.Columns))
+	for _, col := range class.Columns {
+		types[col.Field] = col.Type
+	}
+
+	rows, err := q.Query("SELECT * FROM `"+table+"`"+where, args...)
+	if err != nil {
+		return fmt.Errorf("failed to load contlets of class %s: %w", class.Name, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		cd := ContletDetail{Class: class.Name, Extra: map[string]string{}}
+		for i, col := range columns {
+			v := values[i]
+			switch {
+			case col == "id":
+				cd.ID, _ = strconv.Atoi(v.String)
+			case isSystemColumn(table, col):
+				cd.setSystemField(col, v.String)
+			case v.Valid:
+				if ft, ok := fieldTypeForColumn(types[col]); ok {
+					cd.Extra[col] = ft.Display(v.String)
+				} else {
+					cd.Extra[col] = v.String
+				}
+			}
+			if col == class.LabelColumn {
+				cd.Summary = v.String
+			}
+		}
+		into[cd.ID] = cd
+	}
+	return rows.Err()
+}
+
+// setSystemField stores the value of a system column of a built-in class.
+func (cd *ContletDetail) setSystemField(column, value string) {
+	switch column {
+	case "text_content":
+		cd.TextContent = value
+	case "src":
+		cd.Src = value
+	case "alt_text":
+		cd.AltText = value
+	case "width":
+		cd.Width, _ = strconv.Atoi(value)
+	case "height":
+		cd.Height, _ = strconv.Atoi(value)
+	case "level":
+		cd.Level, _ = strconv.Atoi(value)
+	}
+}
+
+// getContletClassesWithCounts returns the registered classes with their number of objects.
+func getContletClassesWithCounts() ([]ContletClass, error) {
+	classes := getContletClasses()
+	for i, c := range classes {
+		if err := db.QueryRow("SELECT COUNT(*) FROM `" + c.Table() + "`").Scan(&classes[i].Count); err != nil {
+			return nil, fmt.Errorf("failed to count objects of contlet class %s: %w", c.Name, err)
+		}
+	}
+	return classes, nil
+}
+
+// contletClassNamePattern restricts class names so that contlet_<name> is a valid,
+// readable table name of at most 64 characters.
+var contletClassNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,55}$`)
+
+// createContletClass creates the contlet_<name> table with the entity FK
+// convention and registers the class. An optional first field can be given;
+// further fields are added from the schema editor.
+func createContletClass(name, description, fieldName, fieldType string) error {
+	if !contletClassNamePattern.MatchString(name) || name == "class" {
+		return &ValidationError{fmt.Sprintf("invalid class name %q: use lowercase letters, digits and underscores, starting with a letter", name)}
+	}
+	if strings.TrimSpace(description) == "" {
+		return &ValidationError{"a description is required"}
+	}
+	table := "contlet_" + name
+	if exists, err := tableExists(table); err != nil {
+		return err
+	} else if exists {
+		return &ConflictError{fmt.Sprintf("a table named %s already exists", table)}
+	}
+
+	var firstField string
+	if fieldName != "" {
+		if !validIdentifier(fieldName) || fieldName == "id" || len(fieldName) > 64 {
+			return &ValidationError{fmt.Sprintf("invalid field name %q: use letters, digits and underscores", fieldName)}
+		}
+		ft, ok := fieldTypeByName(fieldType)
+		if !ok {
+			return &ValidationError{fmt.Sprintf("unknown field type %q", fieldType)}
+		}
+		firstField = fmt.Sprintf("\n    `%s` %s NULL,", fieldName, ft.SQLType)
+	}
+
+	_, err := db.Exec("INSERT INTO contlet_class (name, description) VALUES (?, ?)", name, description)
+	if isDuplicateEntry(err) {
+		return &ConflictError{fmt.Sprintf("a contlet class named %q already exists", name)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register contlet class %s: %w", name, err)
+	}
+
+	query := fmt.Sprintf(`CREATE TABLE `+"`%s`"+` (
+    id INT PRIMARY KEY, -- FK to entity.id%s
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB`, table, firstField)
+	if _, err := db.Exec(query); err != nil {
+		// DDL is not transactional in MariaDB; undo the registration by hand.
+		db.Exec("DELETE FROM contlet_class WHERE name = ?", name)
+		return fmt.Errorf("failed to create table %s: %w", table, err)
+	}
+
+	return loadContletClasses()
+}
+
+// ContletClassUsage counts what still refers to the objects of a contlet class.
+type ContletClassUsage struct {
+	Pieces int // content pieces using one of the objects
+	Links  int // links from or to one of the objects
+	Tags   int // tags attached to one of the objects
+}
+
+// Describe lists the non-zero counts, e.g. "2 content piece(s), 1 link(s)".
+func (u ContletClassUsage) Describe() string {
+	var parts []string
+	if u.Pieces > 0 {
+		parts = append(parts, fmt.Sprintf("%d content piece(s)", u.Pieces))
+	}
+	if u.Links > 0 {
+		parts = append(parts, fmt.Sprintf("%d link(s)", u.Links))
+	}
+	if u.Tags > 0 {
+		parts = append(parts, fmt.Sprintf("%d tag assignment(s)", u.Tags))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// contletClassUsage counts the pieces, links and tags that refer to objects of a
+// class, through q. The rows counted are locked when q is a transaction, so that
+// none can be added between the check and a retirement.
+func contletClassUsage(q queryer, c ContletClass) (ContletClassUsage, error) {
+	var u ContletClassUsage
+	err := q.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(DISTINCT cpc.content_piece_id)
+		FROM content_piece_contlets cpc
+		JOIN `+"`%s`"+` c ON c.id = cpc.contlet_id FOR UPDATE`, c.Table())).Scan(&u.Pieces)
+	if err != nil {
+		return u, err
+	}
+	err = q.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM entity_relationships er
+		WHERE er.subject_id IN (SELECT id FROM `+"`%[1]s`"+`) OR er.object_id IN (SELECT id FROM `+"`%[1]s`"+`) FOR UPDATE`, c.Table())).Scan(&u.Links)
+	if err != nil {
+		return u, err
+	}
+	err = q.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM entity_tags et
+		JOIN `+"`%s`"+` c ON c.id = et.entity_id FOR UPDATE`, c.Table())).Scan(&u.Tags)
+	return u, err
+}
+
+// retireContletClass deletes the objects of an unused contlet class, drops its
+// table and removes it from the registry. It is refused for built-in classes and
+// while any content piece, link or tag still refers to an object of the class,
+// since deleting the objects would silently take those links and tags with them.
+func retireContletClass(name string) error {
+	c, ok := getContletClass(name)
+	if !ok {
+		return &ValidationError{fmt.Sprintf("unknown contlet class: %s", name)}
+	}
+	if c.Builtin() {
+		return &ConflictError{fmt.Sprintf("%s is a built-in contlet class and cannot be retired", name)}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	usage, err := contletClassUsage(tx, c)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to check usage of contlet class %s: %w", name, err)
+	}
+	if usage != (ContletClassUsage{}) {
+		tx.Rollback()
+		return &ConflictError{fmt.Sprintf("contlet class %s is still used by %s; remove them first", name, usage.Describe())}
+	}
+	// Deleting the entity rows cascades to the class table.
+	_, err = tx.Exec(fmt.Sprintf("DELETE e FROM entity e JOIN `%s` c ON c.id = e.id", c.Table()))
+	if err != nil {
+		tx.Rollback()
+		if isForeignKeyViolation(err) {
+			// A piece started using one of the objects between our check and the delete.
+			return &ConflictError{fmt.Sprintf("contlet class %s is still used by a content piece", name)}
+		}
+		return fmt.Errorf("failed to delete objects of contlet class %s: %w", name, err)
+	}
+	if _, err := tx.Exec("DELETE FROM contlet_class WHERE name = ?", name); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to unregister contlet class %s: %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := loadContletClasses(); err != nil {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE `%s`", c.Table())); err != nil {
+		return fmt.Errorf("contlet class %s was retired but its table could not be dropped: %w", name, err)
+	}
+	return nil
+}
@@ -3,13 +3,15 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 var db *sql.DB
@@ -17,28 +19,29 @@ var db *sql.DB
 // connectToDB establishes a connection to the MariaDB database.
 func connectToDB() {
 	var err error
-	// Use the hardcoded DSN as requested, enabling multi-statement support for schema creation.
-	const dsn_app = "dataLayer_admin:password@tcp(127.0.0.1:3306)/content_db?parseTime=true&multiStatements=true"
-	db, err = sql.Open("mysql", dsn_app)
+	db, err = sql.Open("mysql", cfg.DSN(true))
 	if err != nil {
 		log.Fatal("Database connection string is invalid:", err)
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
 	if err = db.Ping(); err != nil {
-		log.Fatal("Could not connect to database 'content_db'. Please ensure it exists and the credentials are correct.", err)
+		log.Fatalf("Could not connect to database '%s'. Please ensure it exists and the credentials are correct. %v", cfg.DBName, err)
 	}
 	log.Println("✅ Successfully connected to the database.")
 }
 
 // setupDatabase ensures the database exists.
 func setupDatabase() {
-	const dsn_setup = "dataLayer_admin:password@tcp(127.0.0.1:3306)/"
-	tempDB, err := sql.Open("mysql", dsn_setup)
+	tempDB, err := sql.Open("mysql", cfg.DSN(false))
 	if err != nil {
 		log.Fatal("Failed to connect for DB setup:", err)
 	}
 	defer tempDB.Close()
 
-	_, err = tempDB.Exec("CREATE DATABASE IF NOT EXISTS content_db CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci")
+	// The name is checked by Config.Validate, so it is safe to quote directly.
+	_, err = tempDB.Exec("CREATE DATABASE IF NOT EXISTS `" + cfg.DBName + "` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci")
 	if err != nil {
 		log.Fatal("Failed to execute 'CREATE DATABASE':", err)
 	}
@@ -46,50 +49,20 @@ func setupDatabase() {
 
 // resetDB drops and recreates the database.
 func resetDB() {
-	const dsn_setup = "dataLayer_admin:password@tcp(127.0.0.1:3306)/"
-	tempDB, err := sql.Open("mysql", dsn_setup)
+	tempDB, err := sql.Open("mysql", cfg.DSN(false))
 	if err != nil {
 		log.Fatal("Failed to connect for DB reset:", err)
 	}
 	defer tempDB.Close()
 
 	log.Println("⚠️ --reset-db flag detected. Dropping database...")
-	_, err = tempDB.Exec("DROP DATABASE IF EXISTS content_db")
+	_, err = tempDB.Exec("DROP DATABASE IF EXISTS `" + cfg.DBName + "`")
 	if err != nil {
 		log.Fatal("Failed to drop database:", err)
 	}
 	log.Println("✅ Database dropped successfully.")
 }
 
-// createSchemaFromArchitecture builds the database tables according to the architecture.
-func createSchemaFromArchitecture() {
-	schemaSQL, err := os.ReadFile("architecture.md")
-	if err != nil {
-		log.Fatalf("Failed to read architecture.md file: %v", err)
-	}
-
-	// Find the start of the actual SQL schema in the markdown file.
-	sqlStartIndex := strings.Index(string(schemaSQL), "-- LAYER 0:")
-	if sqlStartIndex == -1 {
-		log.Fatal("Could not find the start of the SQL schema in architecture.md")
-	}
-	sqlScriptWithComments := string(schemaSQL)[sqlStartIndex:]
-
-	// Find the end of the SQL script.
-	sqlEndIndex := strings.Index(sqlScriptWithComments, "## 5. Application & UI Design")
-	if sqlEndIndex == -1 {
-		log.Fatal("Could not find the end of the SQL schema in architecture.md")
-	}
-	sqlScript := sqlScriptWithComments[:sqlEndIndex]
-
-	// Execute the extracted SQL script.
-	if _, err := db.Exec(sqlScript); err != nil {
-		log.Fatalf("Failed to execute schema script: %v", err)
-	}
-
-	log.Println("✅ Database schema created successfully.")
-}
-
 // seedSampleData populates the database with high-quality sample data.
 func seedSampleData(enabled bool) {
 	if !enabled {
@@ -112,25 +85,24 @@ func seedSampleData(enabled bool) {
 		log.Fatal("Failed to begin transaction for seeding:", err)
 	}
 
-	// Helper to create an entity and return its ID
-	createEntity := func() int64 {
-		res, err := tx.Exec("INSERT INTO entity () VALUES ()")
+	// Helper to create an entity of the given class and return its ID
+	createEntity := func(class string) int64 {
+		id, err := newEntity(tx, class)
 		if err != nil {
 			tx.Rollback()
 			log.Fatal("Failed to create entity:", err)
 		}
-		id, _ := res.LastInsertId()
 		return id
 	}
 
 	// -- Create Taxonomies and Tags --
-	taxonomyTechID := createEntity()
+	taxonomyTechID := createEntity("taxonomy")
 	_, err = tx.Exec("INSERT INTO taxonomy (id, name, description) VALUES (?, ?, ?)", taxonomyTechID, "Technology", "Programming languages, frameworks, and other tech.")
 	if err != nil {
 		tx.Rollback()
 		log.Fatal(err)
 	}
-	tagGoID := createEntity()
+	tagGoID := createEntity("tag")
 	_, err = tx.Exec("INSERT INTO tag (id, taxonomy_id, value) VALUES (?, ?, ?)", tagGoID, taxonomyTechID, "Go")
 	if err != nil {
 		tx.Rollback()
@@ -138,7 +110,7 @@ func seedSampleData(enabled bool) {
 	}
 
 	// -- Create Content Piece 1: "About This System" --
-	piece1ID := createEntity()
+	piece1ID := createEntity("content_piece")
 	_, err = tx.Exec("INSERT INTO content_piece (id, class, title) VALUES (?, ?, ?)", piece1ID, "blog_post", "About This System")
 	if err != nil {
 		tx.Rollback()
@@ -152,7 +124,7 @@ func seedSampleData(enabled bool) {
 	}
 
 	// Create and add contlets to Piece 1
-	heading1ID := createEntity()
+	heading1ID := createEntity("contlet_heading")
 	_, err = tx.Exec("INSERT INTO contlet_heading (id, text_content, level) VALUES (?, ?, ?)", heading1ID, "Core Philosophy", 1)
 	if err != nil {
 		tx.Rollback()
@@ -164,7 +136,7 @@ func seedSampleData(enabled bool) {
 		log.Fatal(err)
 	}
 
-	para1ID := createEntity()
+	para1ID := createEntity("contlet_paragraph")
 	_, err = tx.Exec("INSERT INTO contlet_paragraph (id, text_content) VALUES (?, ?)", para1ID, "This system is built on MariaDB and Go, following a pragmatic design.")
 	if err != nil {
 		tx.Rollback()
@@ -176,6 +148,18 @@ func seedSampleData(enabled bool) {
 		log.Fatal(err)
 	}
 
+	// -- Create a symmetric link class for the knowledge graph --
+	_, err = tx.Exec("INSERT INTO link_class (name, description) VALUES (?, ?)", "related_to", "A general association between two objects.")
+	if err != nil {
+		tx.Rollback()
+		log.Fatal(err)
+	}
+	_, err = tx.Exec("UPDATE link_class SET symmetric_link = name WHERE name = ?", "related_to")
+	if err != nil {
+		tx.Rollback()
+		log.Fatal(err)
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Fatal("Failed to commit seed data transaction:", err)
 	}
@@ -191,14 +175,15 @@ func validIdentifier(s string) bool {
 
 // ContentPiece defines the structure for a single content piece record.
 type ContentPiece struct {
-	ID    int
-	Class string
-	Title string
+	ID     int    `json:"id"`
+	Class  string `json:"class"`
+	Title  string `json:"title"`
+	Status string `json:"status,omitempty"` // the piece's workflow status, one of workflow_status
 }
 
 // getAllContentPieces retrieves all content pieces from the database.
 func getAllContentPieces() ([]ContentPiece, error) {
-	rows, err := db.Query("SELECT id, class, title FROM content_piece ORDER BY id DESC")
+	rows, err := db.Query("SELECT id, class, title, status FROM content_piece ORDER BY id DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -207,7 +192,7 @@ func getAllContentPieces() ([]ContentPiece, error) {
 	var pieces []ContentPiece
 	for rows.Next() {
 		var p ContentPiece
-		if err := rows.Scan(&p.ID, &p.Class, &p.Title); err != nil {
+		if err := rows.Scan(&p.ID, &p.Class, &p.Title, &p.Status); err != nil {
 			return nil, err
 		}
 		pieces = append(pieces, p)
@@ -215,66 +200,50 @@ func getAllContentPieces() ([]ContentPiece, error) {
 	return pieces, nil
 }
 
-// Contlet defines the structure for a contlet record (of any class).
-// Note: This is a simplified view. We will need more detailed structs later.
+// Contlet is the summary of a contlet record (of any class) shown in lists.
 type Contlet struct {
-	ID    int
-	Class string
-	// We need a way to represent the specific data, like text or src.
-	// For a simple list, we can try to coalesce them in the query.
-	Content string
+	ID      int               `json:"id"`
+	Class   string            `json:"class"`
+	Content string            `json:"content"` // the first text field of the class
+	Extra   map[string]string `json:"fields"`  // administrator-defined fields, by column name
 }
 
-// getAllContlets retrieves a summary of all contlets.
+// getAllContlets retrieves a summary of all contlets, newest first.
 func getAllContlets() ([]Contlet, error) {
-	// This query is a bit complex because it needs to pull data from multiple tables.
-	// We use LEFT JOINs and COALESCE to get a single "content" string.
-	query := `
-	SELECT
-		e.id,
-		COALESCE(cp.text_content, ci.src, ch.text_content) as content
-	FROM entity e
-	LEFT JOIN contlet_paragraph cp ON e.id = cp.id
-	LEFT JOIN contlet_image ci ON e.id = ci.id
-	LEFT JOIN contlet_heading ch ON e.id = ch.id
-	WHERE cp.id IS NOT NULL OR ci.id IS NOT NULL OR ch.id IS NOT NULL
-	ORDER BY e.id DESC`
-
-	rows, err := db.Query(query)
+	loaded, err := loadContlets(db, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var contlets []Contlet
-	for rows.Next() {
-		var c Contlet
-		// The class is not easily available in this query. We'll omit it for now for simplicity.
-		if err := rows.Scan(&c.ID, &c.Content); err != nil {
-			return nil, err
-		}
-		contlets = append(contlets, c)
+	contlets := make([]Contlet, 0, len(loaded))
+	for _, cd := range loaded {
+		contlets = append(contlets, Contlet{ID: cd.ID, Class: cd.Class, Content: cd.Summary, Extra: cd.Extra})
 	}
+	sort.Slice(contlets, func(i, j int) bool { return contlets[i].ID > contlets[j].ID })
 	return contlets, nil
 }
 
 // Tag defines the structure for a single tag record.
 type Tag struct {
-	ID    int
-	Value string
-	// We'll need Taxonomy info later for a more detailed view.
-	TaxonomyName string
+	ID           int               `json:"id"`
+	Value        string            `json:"value"`
+	TaxonomyID   int               `json:"taxonomy_id"`
+	TaxonomyName string            `json:"taxonomy_name"`
+	Extra        map[string]string `json:"fields,omitempty"` // administrator-defined fields; only loaded where needed
 }
 
 // getAllTags retrieves all tags from the database.
 func getAllTags() ([]Tag, error) {
-	query := `
-	SELECT t.id, t.value, tx.name
+	return queryTags(`
+	SELECT t.id, t.value, tx.id, tx.name
 	FROM tag t
 	JOIN taxonomy tx ON t.taxonomy_id = tx.id
-	ORDER BY tx.name, t.value`
+	ORDER BY tx.name, t.value`)
+}
 
-	rows, err := db.Query(query)
+// queryTags runs a query selecting (id, value, taxonomy id, taxonomy name) and collects the tags.
+func queryTags(query string, args ...interface{}) ([]Tag, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -283,12 +252,12 @@ func getAllTags() ([]Tag, error) {
 	var tags []Tag
 	for rows.Next() {
 		var t Tag
-		if err := rows.Scan(&t.ID, &t.Value, &t.TaxonomyName); err != nil {
+		if err := rows.Scan(&t.ID, &t.Value, &t.TaxonomyID, &t.TaxonomyName); err != nil {
 			return nil, err
 		}
 		tags = append(tags, t)
 	}
-	return tags, nil
+	return tags, rows.Err()
 }
 
 // ColumnDetail struct holds schema information for a table column.
@@ -320,176 +289,137 @@ func getSchemaDetails() (map[string][]ColumnDetail, error) {
 	}
 
 	for _, table := range tables {
-		descRows, err := db.Query("DESCRIBE `" + table + "`")
+		columns, err := describeTable(table)
 		if err != nil {
 			return nil, err
 		}
-		defer descRows.Close()
-
-		var columns []ColumnDetail
-		for descRows.Next() {
-			var col ColumnDetail
-			if err := descRows.Scan(&col.Field, &col.Type, &col.Null, &col.Key, &col.Default, &col.Extra); err != nil {
-				return nil, err
-			}
-			columns = append(columns, col)
-		}
 		schema[table] = columns
 	}
 	return schema, nil
 }
 
-// updateTableSchema modifies an existing table to match the provided schema details.
-// WARNING: This is a simplistic implementation and can be destructive.
-func updateTableSchema(tableName string, columns []ColumnDetail) error {
-	if !validIdentifier(tableName) {
-		return fmt.Errorf("invalid table name: %s", tableName)
-	}
-
-	// For simplicity, we'll build a series of ALTER TABLE statements.
-	// A more robust solution would compare old and new schemas to generate precise changes.
-	var alterClauses []string
-	for _, col := range columns {
-		if !validIdentifier(col.Field) {
-			return fmt.Errorf("invalid column name: %s", col.Field)
-		}
-		// Basic validation for type - very simplistic
-		if strings.ContainsAny(col.Type, ";)'\"") {
-			return fmt.Errorf("invalid characters in column type: %s", col.Type)
-		}
-
-		clause := fmt.Sprintf("MODIFY COLUMN `%s` %s", col.Field, col.Type)
-		if col.Null == "NO" {
-			clause += " NOT NULL"
-		} else {
-			clause += " NULL"
-		}
-		if col.Default.Valid && col.Default.String != "" {
-			clause += fmt.Sprintf(" DEFAULT '%s'", col.Default.String) // simplistic quoting
-		}
-		if col.Extra != "" {
-			clause += " " + col.Extra // e.g., AUTO_INCREMENT
-		}
-		alterClauses = append(alterClauses, clause)
-	}
-
-	if len(alterClauses) == 0 {
-		return nil // No changes to make
+// describeTable returns the columns of one table as reported by DESCRIBE.
+func describeTable(table string) ([]ColumnDetail, error) {
+	if !validIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name: %s", table)
 	}
-
-	query := fmt.Sprintf("ALTER TABLE `%s` %s", tableName, strings.Join(alterClauses, ", "))
-
-	_, err := db.Exec(query)
+	rows, err := db.Query("DESCRIBE `" + table + "`")
 	if err != nil {
-		return fmt.Errorf("failed to alter table %s: %w. Query: %s", tableName, err, query)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return nil
+	var columns []ColumnDetail
+	for rows.Next() {
+		var col ColumnDetail
+		if err := rows.Scan(&col.Field, &col.Type, &col.Null, &col.Key, &col.Default, &col.Extra); err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
 }
 
 // PieceDetail defines the structure for a full content piece with its contlets.
 type PieceDetail struct {
-	ID       int
-	Class    string
-	Title    string
-	Contlets []ContletDetail
+	ID       int               `json:"id"`
+	Class    string            `json:"class"`
+	Title    string            `json:"title"`
+	Contlets []ContletDetail   `json:"contlets"`
+	Extra    map[string]string `json:"fields"` // administrator-defined fields, by column name
 }
 
 // ContletDetail holds the full data for a single contlet.
 type ContletDetail struct {
-	ID          int
-	Class       string // e.g., 'paragraph', 'image', 'heading'
-	TextContent string
-	Src         string
-	AltText     string
-	Level       int
+	ID          int               `json:"id"`
+	Class       string            `json:"class"` // e.g., 'paragraph', 'image', 'heading'
+	TextContent string            `json:"text_content,omitempty"`
+	Src         string            `json:"src,omitempty"`
+	AltText     string            `json:"alt_text,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Level       int               `json:"level,omitempty"`
+	Summary     string            `json:"summary"`              // short text shown in lists: the first text field of the class
+	SortOrder   int               `json:"sort_order,omitempty"` // position within a piece; only set when loaded as part of one
+	Extra       map[string]string `json:"fields"`               // administrator-defined fields, by column name
 }
 
 // getPieceByID retrieves a single content piece and all its constituent contlets.
 func getPieceByID(id int) (PieceDetail, error) {
+	return readPiece(db, id)
+}
+
+// readPiece reads a piece with its contlets through q, which may be the
+// transaction of an uncommitted change.
+func readPiece(q queryer, id int) (PieceDetail, error) {
 	var piece PieceDetail
-	row := db.QueryRow("SELECT id, class, title FROM content_piece WHERE id = ?", id)
+	row := q.QueryRow("SELECT id, class, title FROM content_piece WHERE id = ?", id)
 	err := row.Scan(&piece.ID, &piece.Class, &piece.Title)
 	if err != nil {
 		return piece, err
 	}
+	if piece.Extra, err = readFieldValues(q, "content_piece", piece.ID); err != nil {
+		return piece, err
+	}
 
-	query := `
-		SELECT
-			cpc.contlet_id,
-			CASE
-				WHEN cp.id IS NOT NULL THEN 'paragraph'
-				WHEN ci.id IS NOT NULL THEN 'image'
-				WHEN ch.id IS NOT NULL THEN 'heading'
-				ELSE 'unknown'
-			END AS class,
-			cp.text_content,
-			ci.src,
-			ci.alt_text,
-			ch.text_content,
-			ch.level
-		FROM content_piece_contlets cpc
-		LEFT JOIN contlet_paragraph cp ON cpc.contlet_id = cp.id
-		LEFT JOIN contlet_image ci ON cpc.contlet_id = ci.id
-		LEFT JOIN contlet_heading ch ON cpc.contlet_id = ch.id
-		WHERE cpc.content_piece_id = ?
-		ORDER BY cpc.sort_order ASC`
-
-	rows, err := db.Query(query, id)
+	rows, err := q.Query(`
+		SELECT contlet_id, sort_order
+		FROM content_piece_contlets
+		WHERE content_piece_id = ?
+		ORDER BY sort_order ASC`, id)
 	if err != nil {
 		return piece, err
 	}
-	defer rows.Close()
-
+	var slots []pieceSlot
+	var ids []int
 	for rows.Next() {
-		var cd ContletDetail
-		var paraText, headingText, src, altText sql.NullString
-		var level sql.NullInt64
-
-		err := rows.Scan(
-			&cd.ID, &cd.Class,
-			&paraText, &src, &altText,
-			&headingText, &level,
-		)
-		if err != nil {
+		var s pieceSlot
+		if err := rows.Scan(&s.ContletID, &s.SortOrder); err != nil {
+			rows.Close()
 			return piece, err
 		}
+		slots = append(slots, s)
+		ids = append(ids, s.ContletID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return piece, err
+	}
 
-		switch cd.Class {
-		case "paragraph":
-			cd.TextContent = paraText.String
-		case "heading":
-			cd.TextContent = headingText.String
-			cd.Level = int(level.Int64)
-		case "image":
-			cd.Src = src.String
-			cd.AltText = altText.String
+	// The contlets themselves are loaded with one query per class, whatever the piece size.
+	loaded, err := loadContlets(q, ids)
+	if err != nil {
+		return piece, err
+	}
+	for _, s := range slots {
+		cd, ok := loaded[s.ContletID]
+		if !ok {
+			// The contlet's class is no longer registered.
+			cd = ContletDetail{ID: s.ContletID, Class: "unknown"}
 		}
+		cd.SortOrder = s.SortOrder
 		piece.Contlets = append(piece.Contlets, cd)
 	}
 	return piece, nil
 }
 
 // createContentPiece creates a new content piece object and returns its ID.
-func createContentPiece(title, class string) (int64, error) {
+// extra holds the raw values of administrator-defined fields and may be nil.
+// author is recorded in the first revision of the piece.
+func createContentPiece(title, class string, extra map[string]string, author string) (int64, error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
 
-	// Create a new entity first to get a unique ID.
-	res, err := tx.Exec("INSERT INTO entity () VALUES ()")
+	id, err := createContentPieceTx(tx, title, class, extra)
 	if err != nil {
 		tx.Rollback()
-		return 0, fmt.Errorf("failed to create entity for piece: %w", err)
+		return 0, err
 	}
-	id, _ := res.LastInsertId()
-
-	// Now create the content piece with the new ID.
-	_, err = tx.Exec("INSERT INTO content_piece (id, title, class) VALUES (?, ?, ?)", id, title, class)
-	if err != nil {
+	if err := recordRevision(tx, int(id), author, "Created"); err != nil {
 		tx.Rollback()
-		return 0, fmt.Errorf("failed to insert into content_piece: %w", err)
+		return 0, err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -499,13 +429,75 @@ func createContentPiece(title, class string) (int64, error) {
 	return id, nil
 }
 
-// updateContentPiece updates an existing content piece object.
-func updateContentPiece(id int, title, class string) error {
-	_, err := db.Exec("UPDATE content_piece SET title = ?, class = ? WHERE id = ?", title, class, id)
+// createContentPieceTx creates the entity and class rows for a new piece inside
+// tx; the caller records its first revision.
+func createContentPieceTx(tx *sql.Tx, title, class string, extra map[string]string) (int64, error) {
+	// Create a new entity first to get a unique ID.
+	id, err := newEntity(tx, "content_piece")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create entity for piece: %w", err)
+	}
+
+	// New pieces start in the first status of the editorial workflow.
+	status, err := initialStatus(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Now create the content piece with the new ID.
+	err = insertObjectRow(tx, "content_piece", []string{"id", "title", "class", "status"}, []interface{}{id, title, class, status}, extra)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert into content_piece: %w", err)
+	}
+	return id, nil
+}
+
+// updateContentPiece updates an existing content piece object and records a revision by author.
+// extra holds the raw values of administrator-defined fields and may be nil.
+// A status request other than the current status must be an allowed transition of
+// the editorial workflow for author; otherwise nothing is changed.
+func updateContentPiece(id int, title, class string, extra map[string]string, status StatusRequest, author string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var current string
+	if status.To != "" {
+		if _, err := lockPieceSlots(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.QueryRow("SELECT status FROM content_piece WHERE id = ?", id).Scan(&current); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE content_piece SET title = ?, class = ? WHERE id = ?", title, class, id)
 	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to update content_piece with id %d: %w", id, err)
 	}
-	return nil
+	if err := writeFieldValues(tx, "content_piece", int64(id), extra); err != nil {
+		tx.Rollback()
+		return err
+	}
+	summary := "Edited"
+	if status.To != "" && status.To != current {
+		change, err := changeStatusTx(tx, id, status, author)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		summary += "; " + change
+	}
+	if err := recordRevision(tx, id, author, summary); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // deleteContentPiece deletes a content piece object.
@@ -517,3 +509,1195 @@ func deleteContentPiece(id int) error {
 	}
 	return nil
 }
+
+// ContletInUseError is returned when a contlet cannot be deleted because
+// content pieces still reference it (content_piece_contlets is ON DELETE RESTRICT).
+type ContletInUseError struct {
+	ID     int
+	Pieces []ContentPiece
+}
+
+func (e *ContletInUseError) Error() string {
+	var names []string
+	for _, p := range e.Pieces {
+		names = append(names, fmt.Sprintf("%q (ID %d)", p.Title, p.ID))
+	}
+	return fmt.Sprintf("contlet %d is still used by content piece(s) %s; remove it from those pieces before deleting it",
+		e.ID, strings.Join(names, ", "))
+}
+
+// getContletByID retrieves a single contlet with its class-specific fields.
+// It returns sql.ErrNoRows if id is not a contlet of a registered class.
+func getContletByID(id int) (ContletDetail, error) {
+	loaded, err := loadContlets(db, []int{id})
+	if err != nil {
+		return ContletDetail{}, err
+	}
+	cd, ok := loaded[id]
+	if !ok {
+		return ContletDetail{}, sql.ErrNoRows
+	}
+	return cd, nil
+}
+
+// nullIfZero maps an unset (zero) optional integer to SQL NULL.
+func nullIfZero(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+// validateContlet checks the fields a contlet of c.Class requires, including its
+// administrator-defined fields unless c.Extra is nil (which leaves them untouched
+// on update). It is shared by the contlet form and the JSON API.
+func validateContlet(c ContletDetail) error {
+	if !isContletClass(c.Class) {
+		return fmt.Errorf("unknown contlet class: %q", c.Class)
+	}
+	if c.Width < 0 || c.Height < 0 || c.Level < 0 {
+		return fmt.Errorf("width, height and level must be non-negative whole numbers")
+	}
+	switch c.Class {
+	case "paragraph":
+		if c.TextContent == "" {
+			return fmt.Errorf("text is required")
+		}
+	case "heading":
+		if c.TextContent == "" {
+			return fmt.Errorf("text is required")
+		}
+		if c.Level < 1 || c.Level > 6 {
+			return fmt.Errorf("heading level must be between 1 and 6")
+		}
+	case "image":
+		if c.Src == "" {
+			return fmt.Errorf("image source is required")
+		}
+	}
+	if c.Extra == nil {
+		return nil
+	}
+	return validateFieldValues("contlet_"+c.Class, c.Extra)
+}
+
+// createContlet creates a new contlet object of c.Class and returns its ID.
+// author is recorded in the first revision of the contlet.
+func createContlet(c ContletDetail, author string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := createContletTx(tx, c, author)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// createContletTx creates the entity and class rows for a new contlet inside tx.
+func createContletTx(tx *sql.Tx, c ContletDetail, author string) (int64, error) {
+	if !isContletClass(c.Class) {
+		return 0, fmt.Errorf("unknown contlet class: %s", c.Class)
+	}
+
+	// Create a new entity first to get a unique ID.
+	id, err := newEntity(tx, "contlet_"+c.Class)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create entity for contlet: %w", err)
+	}
+
+	var cols []string
+	var args []interface{}
+	switch c.Class {
+	case "paragraph":
+		cols, args = []string{"id", "text_content"}, []interface{}{id, c.TextContent}
+	case "heading":
+		cols, args = []string{"id", "text_content", "level"}, []interface{}{id, c.TextContent, c.Level}
+	case "image":
+		cols = []string{"id", "src", "alt_text", "width", "height"}
+		args = []interface{}{id, c.Src, c.AltText, nullIfZero(c.Width), nullIfZero(c.Height)}
+	default:
+		// Classes created from the admin UI only have administrator-defined fields.
+		cols, args = []string{"id"}, []interface{}{id}
+	}
+	if err := insertObjectRow(tx, "contlet_"+c.Class, cols, args, c.Extra); err != nil {
+		return 0, fmt.Errorf("failed to insert into contlet_%s: %w", c.Class, err)
+	}
+	if err := recordRevision(tx, int(id), author, "Created"); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// updateContlet updates the class-specific fields of an existing contlet object
+// and records a revision by author.
+// The class of a contlet cannot change; c.Class must match the stored class.
+func updateContlet(c ContletDetail, author string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := updateContletTx(tx, c); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := recordRevision(tx, c.ID, author, "Edited"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateContletTx writes the fields of an existing contlet inside tx.
+func updateContletTx(tx *sql.Tx, c ContletDetail) error {
+	if !isContletClass(c.Class) {
+		return fmt.Errorf("unknown contlet class: %s", c.Class)
+	}
+
+	var err error
+	switch c.Class {
+	case "paragraph":
+		_, err = tx.Exec("UPDATE contlet_paragraph SET text_content = ? WHERE id = ?", c.TextContent, c.ID)
+	case "heading":
+		_, err = tx.Exec("UPDATE contlet_heading SET text_content = ?, level = ? WHERE id = ?", c.TextContent, c.Level, c.ID)
+	case "image":
+		_, err = tx.Exec("UPDATE contlet_image SET src = ?, alt_text = ?, width = ?, height = ? WHERE id = ?",
+			c.Src, c.AltText, nullIfZero(c.Width), nullIfZero(c.Height), c.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update contlet_%s with id %d: %w", c.Class, c.ID, err)
+	}
+	return writeFieldValues(tx, "contlet_"+c.Class, int64(c.ID), c.Extra)
+}
+
+// getPiecesUsingContlet lists the content pieces that include the given contlet.
+func getPiecesUsingContlet(id int) ([]ContentPiece, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT p.id, p.class, p.title, p.status
+		FROM content_piece_contlets cpc
+		JOIN content_piece p ON p.id = cpc.content_piece_id
+		WHERE cpc.contlet_id = ?
+		ORDER BY p.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pieces []ContentPiece
+	for rows.Next() {
+		var p ContentPiece
+		if err := rows.Scan(&p.ID, &p.Class, &p.Title, &p.Status); err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, p)
+	}
+	return pieces, rows.Err()
+}
+
+// deleteContlet deletes a contlet object through its entity row. It refuses with a
+// *ContletInUseError while any content piece still references the contlet.
+func deleteContlet(id int) error {
+	pieces, err := getPiecesUsingContlet(id)
+	if err != nil {
+		return err
+	}
+	if len(pieces) > 0 {
+		return &ContletInUseError{ID: id, Pieces: pieces}
+	}
+
+	_, err = db.Exec("DELETE FROM entity WHERE id = ?", id)
+	if isForeignKeyViolation(err) {
+		// A piece started using the contlet between our check and the delete.
+		pieces, _ = getPiecesUsingContlet(id)
+		return &ContletInUseError{ID: id, Pieces: pieces}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete entity for contlet with id %d: %w", id, err)
+	}
+	return nil
+}
+
+// isForeignKeyViolation reports whether err is MariaDB's "row is referenced" error (1451).
+func isForeignKeyViolation(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1451
+}
+
+// sortOrderStep is the gap left between consecutive contlets of a piece, so that
+// a contlet can usually be inserted between two others without touching them.
+const sortOrderStep = 100
+
+// pieceSlot is one row of content_piece_contlets.
+type pieceSlot struct {
+	SortOrder int
+	ContletID int
+}
+
+// lockPieceSlots locks the piece row and returns its contlet slots in order.
+// Locking the piece serializes concurrent edits of the same piece.
+func lockPieceSlots(tx *sql.Tx, pieceID int) ([]pieceSlot, error) {
+	var id int
+	if err := tx.QueryRow("SELECT id FROM content_piece WHERE id = ? FOR UPDATE", pieceID).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		"SELECT sort_order, contlet_id FROM content_piece_contlets WHERE content_piece_id = ? ORDER BY sort_order FOR UPDATE",
+		pieceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []pieceSlot
+	for rows.Next() {
+		var s pieceSlot
+		if err := rows.Scan(&s.SortOrder, &s.ContletID); err != nil {
+			return nil, err
+		}
+		slots = append(slots, s)
+	}
+	return slots, rows.Err()
+}
+
+// renumberPieceSlots respaces the contlets of a piece to 100, 200, 300, ...
+// It first moves every row to its negated sort_order and then to its final value,
+// so no intermediate UPDATE can collide with the (content_piece_id, sort_order) key.
+func renumberPieceSlots(tx *sql.Tx, pieceID int, slots []pieceSlot) ([]pieceSlot, error) {
+	if _, err := tx.Exec("UPDATE content_piece_contlets SET sort_order = -sort_order WHERE content_piece_id = ? AND sort_order > 0", pieceID); err != nil {
+		return nil, fmt.Errorf("failed to renumber contlets of piece %d: %w", pieceID, err)
+	}
+
+	renumbered := make([]pieceSlot, len(slots))
+	for i, s := range slots {
+		newOrder := (i + 1) * sortOrderStep
+		if _, err := tx.Exec(
+			"UPDATE content_piece_contlets SET sort_order = ? WHERE content_piece_id = ? AND sort_order = ?",
+			newOrder, pieceID, -s.SortOrder,
+		); err != nil {
+			return nil, fmt.Errorf("failed to renumber contlets of piece %d: %w", pieceID, err)
+		}
+		renumbered[i] = pieceSlot{SortOrder: newOrder, ContletID: s.ContletID}
+	}
+	return renumbered, nil
+}
+
+// insertPieceSlot places contletID at position (0-based) among slots, choosing a
+// sort_order between its neighbours. Positions outside the list append at the end.
+// When the neighbours are adjacent integers the piece is renumbered first.
+func insertPieceSlot(tx *sql.Tx, pieceID, contletID, position int, slots []pieceSlot) error {
+	if position < 0 || position > len(slots) {
+		position = len(slots)
+	}
+
+	gapFor := func(slots []pieceSlot) (int, bool) {
+		prev := 0
+		if position > 0 {
+			prev = slots[position-1].SortOrder
+		}
+		if position == len(slots) {
+			return prev + sortOrderStep, true
+		}
+		next := slots[position].SortOrder
+		return prev + (next-prev)/2, next-prev >= 2
+	}
+
+	order, ok := gapFor(slots)
+	if !ok {
+		var err error
+		if slots, err = renumberPieceSlots(tx, pieceID, slots); err != nil {
+			return err
+		}
+		order, _ = gapFor(slots)
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO content_piece_contlets (content_piece_id, contlet_id, sort_order) VALUES (?, ?, ?)",
+		pieceID, contletID, order,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add contlet %d to piece %d: %w", contletID, pieceID, err)
+	}
+	return nil
+}
+
+// removePieceSlot deletes the slot with the given sort_order and returns the remaining slots.
+func removePieceSlot(tx *sql.Tx, pieceID, sortOrder int, slots []pieceSlot) (pieceSlot, []pieceSlot, error) {
+	for i, s := range slots {
+		if s.SortOrder != sortOrder {
+			continue
+		}
+		if _, err := tx.Exec(
+			"DELETE FROM content_piece_contlets WHERE content_piece_id = ? AND sort_order = ?",
+			pieceID, sortOrder,
+		); err != nil {
+			return s, nil, fmt.Errorf("failed to remove contlet from piece %d: %w", pieceID, err)
+		}
+		remaining := append(append([]pieceSlot{}, slots[:i]...), slots[i+1:]...)
+		return s, remaining, nil
+	}
+	return pieceSlot{}, nil, sql.ErrNoRows
+}
+
+// withPieceSlots runs fn in a transaction holding the lock on the piece's contlets
+// and records the result as a revision of the piece by author.
+func withPieceSlots(pieceID int, author, summary string, fn func(tx *sql.Tx, slots []pieceSlot) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	slots, err := lockPieceSlots(tx, pieceID)
+	if err == nil {
+		err = fn(tx, slots)
+	}
+	if err == nil {
+		err = recordRevision(tx, pieceID, author, summary)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// attachContletToPiece adds an existing contlet to a piece at the given position.
+func attachContletToPiece(pieceID, contletID, position int, author string) error {
+	if _, err := getContletByID(contletID); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("contlet %d does not exist", contletID)
+		}
+		return err
+	}
+	return withPieceSlots(pieceID, author, fmt.Sprintf("Added contlet %d", contletID), func(tx *sql.Tx, slots []pieceSlot) error {
+		return insertPieceSlot(tx, pieceID, contletID, position, slots)
+	})
+}
+
+// addNewContletToPiece creates a contlet and adds it to a piece in one transaction.
+func addNewContletToPiece(pieceID int, c ContletDetail, position int, author string) (int64, error) {
+	var id int64
+	err := withPieceSlots(pieceID, author, "Added a new "+c.Class+" contlet", func(tx *sql.Tx, slots []pieceSlot) error {
+		var err error
+		if id, err = createContletTx(tx, c, author); err != nil {
+			return err
+		}
+		return insertPieceSlot(tx, pieceID, int(id), position, slots)
+	})
+	return id, err
+}
+
+// moveContletInPiece moves the contlet at sortOrder to the given 0-based position.
+func moveContletInPiece(pieceID, sortOrder, position int, author string) error {
+	return withPieceSlots(pieceID, author, "Reordered contlets", func(tx *sql.Tx, slots []pieceSlot) error {
+		moved, remaining, err := removePieceSlot(tx, pieceID, sortOrder, slots)
+		if err != nil {
+			return err
+		}
+		if position < 0 {
+			position = 0
+		}
+		return insertPieceSlot(tx, pieceID, moved.ContletID, position, remaining)
+	})
+}
+
+// shiftContletInPiece moves the contlet at sortOrder one place up (delta -1) or down (delta +1).
+func shiftContletInPiece(pieceID, sortOrder, delta int, author string) error {
+	return withPieceSlots(pieceID, author, "Reordered contlets", func(tx *sql.Tx, slots []pieceSlot) error {
+		index := -1
+		for i, s := range slots {
+			if s.SortOrder == sortOrder {
+				index = i
+			}
+		}
+		if index == -1 {
+			return sql.ErrNoRows
+		}
+		target := index + delta
+		if target < 0 || target >= len(slots) {
+			return nil // already at the edge
+		}
+		moved, remaining, err := removePieceSlot(tx, pieceID, sortOrder, slots)
+		if err != nil {
+			return err
+		}
+		return insertPieceSlot(tx, pieceID, moved.ContletID, target, remaining)
+	})
+}
+
+// detachContletFromPiece removes the contlet at sortOrder from a piece.
+// The contlet object itself is kept.
+func detachContletFromPiece(pieceID, sortOrder int, author string) error {
+	return withPieceSlots(pieceID, author, "Removed a contlet", func(tx *sql.Tx, slots []pieceSlot) error {
+		_, _, err := removePieceSlot(tx, pieceID, sortOrder, slots)
+		return err
+	})
+}
+
+// ConflictError reports a change that was refused because of existing data,
+// such as a duplicate unique value or a row that is still referenced.
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// isDuplicateEntry reports whether err is MariaDB's "duplicate entry" error (1062).
+func isDuplicateEntry(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1062
+}
+
+// Taxonomy defines the structure for a single taxonomy record.
+type Taxonomy struct {
+	ID          int               `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	TagCount    int               `json:"tag_count"`
+	Extra       map[string]string `json:"fields,omitempty"` // administrator-defined fields; only loaded where needed
+}
+
+// getAllTaxonomies retrieves all taxonomies with the number of tags in each.
+func getAllTaxonomies() ([]Taxonomy, error) {
+	rows, err := db.Query(`
+	SELECT tx.id, tx.name, COALESCE(tx.description, ''), COUNT(t.id)
+	FROM taxonomy tx
+	LEFT JOIN tag t ON t.taxonomy_id = tx.id
+	GROUP BY tx.id, tx.name, tx.description
+	ORDER BY tx.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var taxonomies []Taxonomy
+	for rows.Next() {
+		var tx Taxonomy
+		if err := rows.Scan(&tx.ID, &tx.Name, &tx.Description, &tx.TagCount); err != nil {
+			return nil, err
+		}
+		taxonomies = append(taxonomies, tx)
+	}
+	return taxonomies, rows.Err()
+}
+
+// getTaxonomyByID retrieves a single taxonomy.
+func getTaxonomyByID(id int) (Taxonomy, error) {
+	var tx Taxonomy
+	err := db.QueryRow(`
+	SELECT tx.id, tx.name, COALESCE(tx.description, ''), (SELECT COUNT(*) FROM tag t WHERE t.taxonomy_id = tx.id)
+	FROM taxonomy tx WHERE tx.id = ?`, id).Scan(&tx.ID, &tx.Name, &tx.Description, &tx.TagCount)
+	return tx, err
+}
+
+// getTagsByTaxonomy retrieves the tags belonging to one taxonomy.
+func getTagsByTaxonomy(taxonomyID int) ([]Tag, error) {
+	return queryTags(`
+	SELECT t.id, t.value, tx.id, tx.name
+	FROM tag t
+	JOIN taxonomy tx ON t.taxonomy_id = tx.id
+	WHERE tx.id = ?
+	ORDER BY t.value`, taxonomyID)
+}
+
+// createTaxonomy creates a new taxonomy object and returns its ID.
+// extra holds the raw values of administrator-defined fields and may be nil.
+func createTaxonomy(name, description string, extra map[string]string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := newEntity(tx, "taxonomy")
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to create entity for taxonomy: %w", err)
+	}
+
+	err = insertObjectRow(tx, "taxonomy", []string{"id", "name", "description"}, []interface{}{id, name, description}, extra)
+	if err != nil {
+		tx.Rollback()
+		if isDuplicateEntry(err) {
+			return 0, &ConflictError{fmt.Sprintf("a taxonomy named %q already exists", name)}
+		}
+		return 0, fmt.Errorf("failed to insert into taxonomy: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// updateTaxonomy updates an existing taxonomy object.
+// extra holds the raw values of administrator-defined fields and may be nil.
+func updateTaxonomy(id int, name, description string, extra map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE taxonomy SET name = ?, description = ? WHERE id = ?", name, description, id)
+	if err != nil {
+		tx.Rollback()
+		if isDuplicateEntry(err) {
+			return &ConflictError{fmt.Sprintf("a taxonomy named %q already exists", name)}
+		}
+		return fmt.Errorf("failed to update taxonomy with id %d: %w", id, err)
+	}
+	if err := writeFieldValues(tx, "taxonomy", int64(id), extra); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteTaxonomy deletes a taxonomy object. Tags reference their taxonomy with
+// ON DELETE RESTRICT, so a taxonomy that still has tags cannot be deleted.
+func deleteTaxonomy(id int) error {
+	taxonomy, err := getTaxonomyByID(id)
+	if err != nil {
+		return err
+	}
+	if taxonomy.TagCount > 0 {
+		return taxonomyInUse(taxonomy)
+	}
+
+	_, err = db.Exec("DELETE FROM entity WHERE id = ?", id)
+	if isForeignKeyViolation(err) {
+		// A tag was added between our check and the delete.
+		taxonomy, _ = getTaxonomyByID(id)
+		return taxonomyInUse(taxonomy)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete entity for taxonomy with id %d: %w", id, err)
+	}
+	return nil
+}
+
+// taxonomyInUse builds the friendly message for a taxonomy that still has tags.
+func taxonomyInUse(taxonomy Taxonomy) error {
+	return &ConflictError{fmt.Sprintf("taxonomy %q still has %d tag(s); delete them or move them to another taxonomy first",
+		taxonomy.Name, taxonomy.TagCount)}
+}
+
+// getTagByID retrieves a single tag with its taxonomy.
+func getTagByID(id int) (Tag, error) {
+	var t Tag
+	err := db.QueryRow(`
+	SELECT t.id, t.value, tx.id, tx.name
+	FROM tag t
+	JOIN taxonomy tx ON t.taxonomy_id = tx.id
+	WHERE t.id = ?`, id).Scan(&t.ID, &t.Value, &t.TaxonomyID, &t.TaxonomyName)
+	return t, err
+}
+
+// tagConflict builds the friendly message for a violation of UNIQUE(taxonomy_id, value).
+func tagConflict(taxonomyID int, value string) error {
+	name := fmt.Sprintf("#%d", taxonomyID)
+	if taxonomy, err := getTaxonomyByID(taxonomyID); err == nil {
+		name = taxonomy.Name
+	}
+	return &ConflictError{fmt.Sprintf("the tag %q already exists in taxonomy %q", value, name)}
+}
+
+// createTag creates a new tag object in a taxonomy and returns its ID.
+// extra holds the raw values of administrator-defined fields and may be nil.
+func createTag(taxonomyID int, value string, extra map[string]string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := newEntity(tx, "tag")
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to create entity for tag: %w", err)
+	}
+
+	err = insertObjectRow(tx, "tag", []string{"id", "taxonomy_id", "value"}, []interface{}{id, taxonomyID, value}, extra)
+	if err != nil {
+		tx.Rollback()
+		if isDuplicateEntry(err) {
+			return 0, tagConflict(taxonomyID, value)
+		}
+		return 0, fmt.Errorf("failed to insert into tag: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// updateTag updates an existing tag object.
+// extra holds the raw values of administrator-defined fields and may be nil.
+func updateTag(id, taxonomyID int, value string, extra map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE tag SET taxonomy_id = ?, value = ? WHERE id = ?", taxonomyID, value, id)
+	if err != nil {
+		tx.Rollback()
+		if isDuplicateEntry(err) {
+			return tagConflict(taxonomyID, value)
+		}
+		return fmt.Errorf("failed to update tag with id %d: %w", id, err)
+	}
+	if err := writeFieldValues(tx, "tag", int64(id), extra); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteTag deletes a tag object. Its entity_tags rows are removed by CASCADE.
+func deleteTag(id int) error {
+	_, err := db.Exec("DELETE FROM entity WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete entity for tag with id %d: %w", id, err)
+	}
+	return nil
+}
+
+// getTagsForEntity retrieves the tags attached to any entity.
+func getTagsForEntity(entityID int) ([]Tag, error) {
+	return queryTags(`
+	SELECT t.id, t.value, tx.id, tx.name
+	FROM entity_tags et
+	JOIN tag t ON t.id = et.tag_id
+	JOIN taxonomy tx ON t.taxonomy_id = tx.id
+	WHERE et.entity_id = ?
+	ORDER BY tx.name, t.value`, entityID)
+}
+
+// getEntitiesWithTag retrieves the IDs of all entities carrying a tag.
+func getEntitiesWithTag(tagID int) ([]int, error) {
+	rows, err := db.Query("SELECT entity_id FROM entity_tags WHERE tag_id = ? ORDER BY entity_id", tagID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// attachTag tags an entity. Attaching a tag that is already present is a no-op;
+// a tag or entity that does not exist is a ValidationError. Pieces and contlets
+// get a revision by author.
+func attachTag(entityID, tagID int, author string) error {
+	return inTransactionWithRevision(entityID, author, fmt.Sprintf("Added tag %d", tagID), func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO entity_tags (entity_id, tag_id) VALUES (?, ?)", entityID, tagID)
+		switch {
+		case err == nil, isDuplicateEntry(err):
+			return nil
+		case isMissingReference(err):
+			return &ValidationError{fmt.Sprintf("cannot tag entity %d with tag %d: one of them does not exist", entityID, tagID)}
+		}
+		return fmt.Errorf("failed to attach tag %d to entity %d: %w", tagID, entityID, err)
+	})
+}
+
+// detachTag removes a tag from an entity. Pieces and contlets get a revision by author.
+func detachTag(entityID, tagID int, author string) error {
+	return inTransactionWithRevision(entityID, author, fmt.Sprintf("Removed tag %d", tagID), func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM entity_tags WHERE entity_id = ? AND tag_id = ?", entityID, tagID)
+		if err != nil {
+			return fmt.Errorf("failed to detach tag %d from entity %d: %w", tagID, entityID, err)
+		}
+		return nil
+	})
+}
+
+// isDuplicateColumn reports whether err is MariaDB's "duplicate column name" error (1060).
+func isDuplicateColumn(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1060
+}
+
+// isMissingReference reports whether err is MariaDB's "referenced row does not exist" error (1452).
+func isMissingReference(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1452
+}
+
+// LinkClass defines the structure for a single link_class record: a "verb" of the knowledge graph.
+type LinkClass struct {
+	Name        string
+	Description string
+	// SymmetricLink names the link class of the inverse edge (e.g. 'parent_of' for
+	// 'child_of', or 'related_to' for itself). Empty when the link has no inverse.
+	SymmetricLink string
+	LinkCount     int
+}
+
+// getAllLinkClasses retrieves all link classes with the number of links using each.
+func getAllLinkClasses() ([]LinkClass, error) {
+	rows, err := db.Query(`
+	SELECT lc.name, lc.description, COALESCE(lc.symmetric_link, ''),
+		(SELECT COUNT(*) FROM entity_relationships er WHERE er.link_type = lc.name)
+	FROM link_class lc
+	ORDER BY lc.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var classes []LinkClass
+	for rows.Next() {
+		var lc LinkClass
+		if err := rows.Scan(&lc.Name, &lc.Description, &lc.SymmetricLink, &lc.LinkCount); err != nil {
+			return nil, err
+		}
+		classes = append(classes, lc)
+	}
+	return classes, rows.Err()
+}
+
+// getLinkClass retrieves a single link class by name.
+func getLinkClass(name string) (LinkClass, error) {
+	var lc LinkClass
+	err := db.QueryRow(`
+	SELECT lc.name, lc.description, COALESCE(lc.symmetric_link, ''),
+		(SELECT COUNT(*) FROM entity_relationships er WHERE er.link_type = lc.name)
+	FROM link_class lc WHERE lc.name = ?`, name).Scan(&lc.Name, &lc.Description, &lc.SymmetricLink, &lc.LinkCount)
+	return lc, err
+}
+
+// nullIfEmpty maps an empty optional string to SQL NULL.
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// pairSymmetricLink makes inverse the symmetric link of name and vice versa, and
+// back-fills the inverse edge of every existing link of both classes. A missing
+// inverse is a ValidationError; an inverse already paired with another class is
+// a ConflictError, since re-pairing it would leave that class pointing one way.
+func pairSymmetricLink(tx *sql.Tx, name, inverse string) error {
+	if inverse == "" {
+		return nil
+	}
+	var partner sql.NullString
+	err := tx.QueryRow("SELECT symmetric_link FROM link_class WHERE name = ? FOR UPDATE", inverse).Scan(&partner)
+	if err == sql.ErrNoRows {
+		return &ValidationError{fmt.Sprintf("symmetric link class %q does not exist", inverse)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read link class %s: %w", inverse, err)
+	}
+	if partner.Valid && partner.String != name {
+		return &ConflictError{fmt.Sprintf("link class %q is already the symmetric link of %q; unpair them first", inverse, partner.String)}
+	}
+
+	if _, err := tx.Exec("UPDATE link_class SET symmetric_link = ? WHERE name = ?", inverse, name); err != nil {
+		return fmt.Errorf("failed to set symmetric link of %s: %w", name, err)
+	}
+	if _, err := tx.Exec("UPDATE link_class SET symmetric_link = ? WHERE name = ?", name, inverse); err != nil {
+		return fmt.Errorf("failed to set symmetric link of %s: %w", inverse, err)
+	}
+	for _, pair := range [][2]string{{name, inverse}, {inverse, name}} {
+		_, err := tx.Exec(`
+		INSERT IGNORE INTO entity_relationships (subject_id, link_type, object_id, source, confidence)
+		SELECT object_id, ?, subject_id, source, confidence
+		FROM entity_relationships WHERE link_type = ?`, pair[1], pair[0])
+		if err != nil {
+			return fmt.Errorf("failed to add inverse %s links: %w", pair[1], err)
+		}
+	}
+	return nil
+}
+
+// createLinkClass creates a new link class. When symmetricLink is set, the inverse
+// class is paired back to this one; it must not already be paired with another.
+func createLinkClass(lc LinkClass) error {
+	if !validIdentifier(lc.Name) {
+		return fmt.Errorf("invalid link class name %q: use letters, digits and underscores", lc.Name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO link_class (name, description) VALUES (?, ?)", lc.Name, lc.Description)
+	if err != nil {
+		tx.Rollback()
+		if isDuplicateEntry(err) {
+			return &ConflictError{fmt.Sprintf("a link class named %q already exists", lc.Name)}
+		}
+		return fmt.Errorf("failed to insert into link_class: %w", err)
+	}
+	if err := pairSymmetricLink(tx, lc.Name, lc.SymmetricLink); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateLinkClass updates the description and symmetric link of a link class.
+// The class it was paired with before is unpaired, so that no class is left
+// pointing at one that no longer points back. Unpairing is refused while links
+// of the two classes mirror each other, since the back-filled inverses could not
+// be told apart from links entered by hand. Link class names are referenced by
+// every link and cannot be renamed.
+func updateLinkClass(lc LinkClass) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var old sql.NullString
+	err = tx.QueryRow("SELECT symmetric_link FROM link_class WHERE name = ? FOR UPDATE", lc.Name).Scan(&old)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return &ValidationError{fmt.Sprintf("link class %q does not exist", lc.Name)}
+		}
+		return fmt.Errorf("failed to read link class %s: %w", lc.Name, err)
+	}
+	if old.Valid && old.String != lc.SymmetricLink {
+		var mirrored int
+		err = tx.QueryRow(`
+		SELECT COUNT(*) FROM entity_relationships er
+		JOIN entity_relationships inv
+			ON inv.subject_id = er.object_id AND inv.object_id = er.subject_id AND inv.link_type = ?
+		WHERE er.link_type = ?`, old.String, lc.Name).Scan(&mirrored)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to count mirrored links of %s: %w", lc.Name, err)
+		}
+		if mirrored > 0 {
+			tx.Rollback()
+			return &ConflictError{fmt.Sprintf("%d %q link(s) are mirrored as %q; delete them before unpairing the classes", mirrored, lc.Name, old.String)}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE link_class SET description = ?, symmetric_link = NULL WHERE name = ?", lc.Description, lc.Name)
+	if err == nil {
+		_, err = tx.Exec("UPDATE link_class SET symmetric_link = NULL WHERE symmetric_link = ? AND name <> ?", lc.Name, lc.Name)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update link class %s: %w", lc.Name, err)
+	}
+	if err := pairSymmetricLink(tx, lc.Name, lc.SymmetricLink); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteLinkClass deletes a link class that no link uses. Classes that name it as
+// their symmetric link are unpaired first.
+func deleteLinkClass(name string) error {
+	lc, err := getLinkClass(name)
+	if err != nil {
+		return err
+	}
+	if lc.LinkCount > 0 {
+		return &ConflictError{fmt.Sprintf("link class %q is used by %d link(s); delete those links first", name, lc.LinkCount)}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE link_class SET symmetric_link = NULL WHERE symmetric_link = ?", name); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to unpair link class %s: %w", name, err)
+	}
+	_, err = tx.Exec("DELETE FROM link_class WHERE name = ?", name)
+	if err != nil {
+		tx.Rollback()
+		if isForeignKeyViolation(err) {
+			return &ConflictError{fmt.Sprintf("link class %q is still in use", name)}
+		}
+		return fmt.Errorf("failed to delete link class %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+// EntityRef is a lightweight reference to any object, with a human-readable label.
+type EntityRef struct {
+	ID    int    `json:"id"`
+	Kind  string `json:"kind"` // "piece", "contlet", "tag", "taxonomy" or "" when unknown
+	Label string `json:"label"`
+}
+
+// URL returns the detail page of the referenced object.
+func (e EntityRef) URL() string {
+	switch e.Kind {
+	case "piece":
+		return fmt.Sprintf("/pieces/%d", e.ID)
+	case "contlet":
+		return fmt.Sprintf("/contlets/%d", e.ID)
+	case "tag":
+		return fmt.Sprintf("/tags/%d", e.ID)
+	case "taxonomy":
+		return fmt.Sprintf("/taxonomies/%d", e.ID)
+	}
+	return ""
+}
+
+// entityRefSQL returns the SELECT expressions and JOINs that describe the entity
+// whose ID is in column col, using alias as a prefix for the joined tables.
+func entityRefSQL(col, alias string) (selectExprs, joins string) {
+	a := func(t string) string { return alias + "_" + t }
+	selectExprs = fmt.Sprintf(`
+		CASE
+			WHEN %[1]s.id IS NOT NULL THEN 'piece'
+			WHEN %[2]s.id IS NOT NULL THEN 'contlet'
+			WHEN %[3]s.id IS NOT NULL THEN 'tag'
+			WHEN %[4]s.id IS NOT NULL THEN 'taxonomy'
+			ELSE ''
+		END,
+		COALESCE(%[1]s.title, %[2]s.label, %[3]s.value, %[4]s.name, '')`,
+		a("cp"), a("ctl"), a("tag"), a("tx"))
+	joins = fmt.Sprintf(`
+		LEFT JOIN content_piece %[2]s ON %[2]s.id = %[1]s
+		LEFT JOIN %[6]s %[3]s ON %[3]s.id = %[1]s
+		LEFT JOIN tag %[4]s ON %[4]s.id = %[1]s
+		LEFT JOIN taxonomy %[5]s ON %[5]s.id = %[1]s`,
+		col, a("cp"), a("ctl"), a("tag"), a("tx"), contletIndexSQL())
+	return selectExprs, joins
+}
+
+// Link defines the structure for a single entity_relationships record.
+type Link struct {
+	ID         int
+	Subject    EntityRef
+	LinkType   string
+	Object     EntityRef
+	Source     string
+	Confidence sql.NullFloat64
+}
+
+// queryLinks retrieves links matching the WHERE clause, with both ends described.
+func queryLinks(where string, args ...interface{}) ([]Link, error) {
+	subjectSelect, subjectJoins := entityRefSQL("er.subject_id", "s")
+	objectSelect, objectJoins := entityRefSQL("er.object_id", "o")
+	query := `
+	SELECT er.id, er.subject_id, ` + subjectSelect + `, er.link_type, er.object_id, ` + objectSelect + `,
+		COALESCE(er.source, ''), er.confidence
+	FROM entity_relationships er` + subjectJoins + objectJoins + `
+	WHERE ` + where + `
+	ORDER BY er.link_type, er.id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		var l Link
+		if err := rows.Scan(
+			&l.ID, &l.Subject.ID, &l.Subject.Kind, &l.Subject.Label,
+			&l.LinkType, &l.Object.ID, &l.Object.Kind, &l.Object.Label,
+			&l.Source, &l.Confidence,
+		); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// getAllLinks retrieves every link in the knowledge graph.
+func getAllLinks() ([]Link, error) {
+	return queryLinks("1 = 1")
+}
+
+// getOutboundLinks retrieves the links whose subject is the given entity.
+func getOutboundLinks(entityID int) ([]Link, error) {
+	return queryLinks("er.subject_id = ?", entityID)
+}
+
+// getInboundLinks retrieves the links whose object is the given entity.
+func getInboundLinks(entityID int) ([]Link, error) {
+	return queryLinks("er.object_id = ?", entityID)
+}
+
+// createLink links subject to object with the given link class. If the class has
+// a symmetric link, the inverse edge is created in the same transaction.
+func createLink(subjectID int, linkType string, objectID int, source string, confidence sql.NullFloat64) (int64, error) {
+	if err := checkConfidence(confidence); err != nil {
+		return 0, err
+	}
+	lc, err := getLinkClass(linkType)
+	if err == sql.ErrNoRows {
+		return 0, &ValidationError{fmt.Sprintf("link class %q does not exist", linkType)}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := createLinkTx(tx, lc, subjectID, objectID, source, confidence)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// checkConfidence validates the optional confidence of a link.
+func checkConfidence(confidence sql.NullFloat64) error {
+	if confidence.Valid && !(confidence.Float64 >= 0 && confidence.Float64 <= 1) { // also refuses NaN
+		return &ValidationError{"confidence must be between 0.0 and 1.0"}
+	}
+	return nil
+}
+
+// createLinkTx inserts a link of class lc inside tx, with its symmetric
+// counterpart if the class has one.
+func createLinkTx(tx *sql.Tx, lc LinkClass, subjectID, objectID int, source string, confidence sql.NullFloat64) (int64, error) {
+	res, err := tx.Exec(
+		"INSERT INTO entity_relationships (subject_id, link_type, object_id, source, confidence) VALUES (?, ?, ?, ?, ?)",
+		subjectID, lc.Name, objectID, nullIfEmpty(source), confidence,
+	)
+	if err != nil {
+		return 0, linkError(err, subjectID, lc.Name, objectID)
+	}
+	id, _ := res.LastInsertId()
+
+	if lc.SymmetricLink != "" && !(lc.SymmetricLink == lc.Name && subjectID == objectID) {
+		_, err = tx.Exec(
+			"INSERT IGNORE INTO entity_relationships (subject_id, link_type, object_id, source, confidence) VALUES (?, ?, ?, ?, ?)",
+			objectID, lc.SymmetricLink, subjectID, nullIfEmpty(source), confidence,
+		)
+		if err != nil {
+			return 0, linkError(err, objectID, lc.SymmetricLink, subjectID)
+		}
+	}
+	return id, nil
+}
+
+// linkError turns constraint violations on entity_relationships into friendly errors.
+func linkError(err error, subjectID int, linkType string, objectID int) error {
+	switch {
+	case isDuplicateEntry(err):
+		return &ConflictError{fmt.Sprintf("entity %d is already linked to entity %d as %q", subjectID, objectID, linkType)}
+	case isMissingReference(err):
+		return &ValidationError{fmt.Sprintf("cannot link entity %d to entity %d: one of them does not exist", subjectID, objectID)}
+	}
+	return fmt.Errorf("failed to insert into entity_relationships: %w", err)
+}
+
+// getLinkByID retrieves a single link with both ends described.
+func getLinkByID(id int) (Link, error) {
+	links, err := queryLinks("er.id = ?", id)
+	if err != nil {
+		return Link{}, err
+	}
+	if len(links) == 0 {
+		return Link{}, sql.ErrNoRows
+	}
+	return links[0], nil
+}
+
+// updateLink changes the provenance of a link. If its class has a symmetric link,
+// the inverse edge is updated in the same transaction so both stay in step.
+func updateLink(id int, source string, confidence sql.NullFloat64) error {
+	if err := checkConfidence(confidence); err != nil {
+		return err
+	}
+	var subjectID, objectID int
+	var symmetric sql.NullString
+	err := db.QueryRow(`
+	SELECT er.subject_id, er.object_id, lc.symmetric_link
+	FROM entity_relationships er
+	JOIN link_class lc ON lc.name = er.link_type
+	WHERE er.id = ?`, id).Scan(&subjectID, &objectID, &symmetric)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE entity_relationships SET source = ?, confidence = ? WHERE id = ?", nullIfEmpty(source), confidence, id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update link %d: %w", id, err)
+	}
+	if symmetric.Valid {
+		_, err := tx.Exec(
+			"UPDATE entity_relationships SET source = ?, confidence = ? WHERE subject_id = ? AND link_type = ? AND object_id = ?",
+			nullIfEmpty(source), confidence, objectID, symmetric.String, subjectID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update inverse of link %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteLink deletes a link and, if its class has a symmetric link, the inverse edge.
+func deleteLink(id int) error {
+	var subjectID, objectID int
+	var linkType string
+	var symmetric sql.NullString
+	err := db.QueryRow(`
+	SELECT er.subject_id, er.link_type, er.object_id, lc.symmetric_link
+	FROM entity_relationships er
+	JOIN link_class lc ON lc.name = er.link_type
+	WHERE er.id = ?`, id).Scan(&subjectID, &linkType, &objectID, &symmetric)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM entity_relationships WHERE id = ?", id); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete link %d: %w", id, err)
+	}
+	if symmetric.Valid {
+		_, err := tx.Exec(
+			"DELETE FROM entity_relationships WHERE subject_id = ? AND link_type = ? AND object_id = ?",
+			objectID, symmetric.String, subjectID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete inverse of link %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
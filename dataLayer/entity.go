@@ -0,0 +1,99 @@
+// In file: entity.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Entity is any Object of the system, resolved from its global entity ID.
+type Entity struct {
+	ID     int
+	Class  string      // the discriminator stored in entity.class: the table holding the object, e.g. "contlet_image"
+	Object interface{} // PieceDetail, ContletDetail, Tag or Taxonomy
+}
+
+// Kind returns the kind of object, matching EntityRef.Kind.
+func (e Entity) Kind() string {
+	return entityKind(e.Class)
+}
+
+// URL returns the detail page of the object.
+func (e Entity) URL() string {
+	return EntityRef{ID: e.ID, Kind: e.Kind()}.URL()
+}
+
+// entityKind maps an entity class to the kind of object it holds:
+// "piece", "contlet", "tag", "taxonomy" or "" when unknown.
+func entityKind(class string) string {
+	switch {
+	case class == "content_piece":
+		return "piece"
+	case class == "tag", class == "taxonomy":
+		return class
+	case strings.HasPrefix(class, "contlet_") && class != "contlet_class":
+		return "contlet"
+	}
+	return ""
+}
+
+// newEntity creates the entity row for a new object of class inside tx and returns its ID.
+// Every object must be created through it so that entity.class stays consistent;
+// deleting the entity row cascades to the class table.
+func newEntity(tx *sql.Tx, class string) (int64, error) {
+	res, err := tx.Exec("INSERT INTO entity (class) VALUES (?)", class)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// backfillEntityClasses records the class of entities created before the class
+// column existed. Migrations handle the built-in tables; this covers contlet
+// classes created from the admin UI, which the migrations cannot know about.
+func backfillEntityClasses() error {
+	for _, c := range getContletClasses() {
+		_, err := db.Exec(fmt.Sprintf(
+			"UPDATE entity e JOIN `%s` t ON t.id = e.id SET e.class = ? WHERE e.class IS NULL", c.Table()), c.Table())
+		if err != nil {
+			return fmt.Errorf("failed to backfill entity classes for %s: %w", c.Table(), err)
+		}
+	}
+	return nil
+}
+
+// getEntityClass returns the class of an entity. It returns sql.ErrNoRows for
+// unknown IDs and an empty class for entities whose class was never recorded.
+func getEntityClass(id int) (string, error) {
+	var class sql.NullString
+	err := db.QueryRow("SELECT class FROM entity WHERE id = ?", id).Scan(&class)
+	return class.String, err
+}
+
+// resolveEntity resolves any entity ID to its typed object.
+// It returns sql.ErrNoRows if the ID does not belong to a known object.
+func resolveEntity(id int) (Entity, error) {
+	class, err := getEntityClass(id)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	e := Entity{ID: id, Class: class}
+	switch e.Kind() {
+	case "piece":
+		e.Object, err = getPieceByID(id)
+	case "contlet":
+		e.Object, err = getContletByID(id)
+	case "tag":
+		e.Object, err = getTagByID(id)
+	case "taxonomy":
+		e.Object, err = getTaxonomyByID(id)
+	default:
+		return Entity{}, sql.ErrNoRows
+	}
+	if err != nil {
+		return Entity{}, err
+	}
+	return e, nil
+}
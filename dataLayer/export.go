@@ -0,0 +1,158 @@
+// In file: export.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Pieces are exported from their drafts as Markdown with front matter, which
+// importMarkdown reads back, or as standalone HTML documents.
+
+// exportFormats maps the export formats to their file extension and content type.
+var exportFormats = map[string]string{
+	"md":   "text/markdown; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+}
+
+// exportPiece returns a piece in format "md" or "html".
+func exportPiece(piece PieceDetail, format string) (string, error) {
+	tags, err := getTagsForEntity(piece.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve the tags of piece %d: %w", piece.ID, err)
+	}
+	if format == "html" {
+		return exportHTML(piece, tags)
+	}
+	links, err := getOutboundLinks(piece.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve the links of piece %d: %w", piece.ID, err)
+	}
+	return exportMarkdown(piece, tags, links), nil
+}
+
+// exportMarkdown writes a piece as Markdown with front matter holding its
+// title, class, tags and outbound links. The links are commented with what
+// they point to.
+func exportMarkdown(piece PieceDetail, tags []Tag, links []Link) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\nclass: %s\n", quoteYAML(piece.Title), quoteYAML(piece.Class))
+	if len(tags) > 0 {
+		b.WriteString("tags:\n")
+		taxonomy := ""
+		for _, t := range tags { // sorted by taxonomy
+			if t.TaxonomyName != taxonomy {
+				taxonomy = t.TaxonomyName
+				fmt.Fprintf(&b, "  %s:\n", quoteYAML(taxonomy))
+			}
+			fmt.Fprintf(&b, "    - %s\n", quoteYAML(t.Value))
+		}
+	}
+	if len(links) > 0 {
+		b.WriteString("links:\n")
+		linkType := ""
+		for _, l := range links { // sorted by link type
+			if l.LinkType != linkType {
+				linkType = l.LinkType
+				fmt.Fprintf(&b, "  %s:\n", linkType)
+			}
+			fmt.Fprintf(&b, "    - %d", l.Object.ID)
+			if l.Object.Label != "" {
+				fmt.Fprintf(&b, " # %s %s", l.Object.Kind, strings.ReplaceAll(l.Object.Label, "\n", " "))
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("---\n\n")
+	if blocks := markdownBlocks(piece.Contlets, 1); len(blocks) > 0 {
+		b.WriteString(strings.Join(blocks, "\n\n") + "\n")
+	}
+	return b.String()
+}
+
+// quoteYAML quotes a front matter value when unquoteYAML would otherwise read
+// it differently or the parser would split it.
+func quoteYAML(s string) string {
+	if s != "" && s == strings.TrimSpace(s) && !strings.ContainsAny(s, ":#,[]'\"\n") && s[0] != '-' {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\n", " ")
+	if strings.Contains(s, `"`) {
+		return "'" + s + "'"
+	}
+	return `"` + s + `"`
+}
+
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>{{.Title}}</title>
+<meta name="class" content="{{.Class}}">
+{{with .Keywords}}<meta name="keywords" content="{{.}}">
+{{end}}</head>
+<body>
+{{.Article}}</body>
+</html>
+`))
+
+// exportHTML writes a piece as a standalone HTML document around the html
+// channel rendering. All content is escaped by html/template, which also
+// replaces unsafe image URLs, so the document carries no markup or script from
+// the content itself.
+func exportHTML(piece PieceDetail, tags []Tag) (string, error) {
+	rendering, err := renderPiece(piece, "html")
+	if err != nil {
+		return "", err
+	}
+	keywords := make([]string, len(tags))
+	for i, t := range tags {
+		keywords[i] = t.Value
+	}
+	var buf bytes.Buffer
+	err = exportHTMLTemplate.Execute(&buf, struct {
+		Title, Class, Keywords string
+		Article                template.HTML
+	}{piece.Title, piece.Class, strings.Join(keywords, ", "), template.HTML(rendering.Body())})
+	return buf.String(), err
+}
+
+// exportFileName names the export of a piece: its ID and title slug.
+func exportFileName(piece PieceDetail, format string) string {
+	name := strconv.Itoa(piece.ID)
+	if slug := slugify(piece.Title); slug != "" {
+		name += "-" + slug
+	}
+	return name + "." + format
+}
+
+// writePiecesZip writes a zip archive with the export of each piece in each format.
+func writePiecesZip(w io.Writer, ids []int, formats []string) error {
+	zw := zip.NewWriter(w)
+	for _, id := range ids {
+		piece, err := getPieceByID(id)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve piece %d: %w", id, err)
+		}
+		for _, format := range formats {
+			content, err := exportPiece(piece, format)
+			if err != nil {
+				return err
+			}
+			f, err := zw.Create(exportFileName(piece, format))
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(f, content); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
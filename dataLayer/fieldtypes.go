@@ -0,0 +1,460 @@
+// In file: fieldtypes.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldType is a semantic field type offered by the Class Management UI.
+// Administrators only ever pick a FieldType; the SQL type is fixed by this
+// registry (see architecture.md, section 5.2).
+type FieldType struct {
+	Name    string `json:"name"`     // stable key used in forms, e.g. "single_line_text"
+	Label   string `json:"label"`    // shown in the UI, e.g. "Single Line of Text"
+	SQLType string `json:"sql_type"` // the column type used in ALTER TABLE, e.g. "VARCHAR(255)"
+	Widget  string `json:"widget"`   // the HTML input used in object forms: text, textarea, number, date, datetime-local, checkbox, url
+
+	// parse validates a submitted value and converts it to the value stored in the
+	// column. An empty string returns nil (NULL) unless the type has a natural zero.
+	parse func(v string) (interface{}, error)
+	// display converts a stored value, as scanned into a string, to the form value.
+	display func(v string) string
+}
+
+// Parse validates a submitted form value and returns the value to store.
+func (ft FieldType) Parse(v string) (interface{}, error) {
+	return ft.parse(v)
+}
+
+// Display converts a stored value to what the object form shows.
+func (ft FieldType) Display(v string) string {
+	if ft.display == nil {
+		return v
+	}
+	return ft.display(v)
+}
+
+// maxLengthParser accepts text up to max characters.
+func maxLengthParser(max int) func(string) (interface{}, error) {
+	return func(v string) (interface{}, error) {
+		if v == "" {
+			return nil, nil
+		}
+		if utf8.RuneCountInString(v) > max {
+			return nil, fmt.Errorf("must be at most %d characters", max)
+		}
+		return v, nil
+	}
+}
+
+// reformatTime re-renders a scanned time value in layout, leaving other input untouched.
+func reformatTime(layout string) func(string) string {
+	return func(v string) string {
+		for _, in := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(in, v); err == nil {
+				return t.Format(layout)
+			}
+		}
+		return v
+	}
+}
+
+// fieldTypes is the registry of semantic field types, in the order shown in the UI.
+var fieldTypes = []FieldType{
+	{
+		Name: "single_line_text", Label: "Single Line of Text", SQLType: "VARCHAR(255)", Widget: "text",
+		parse: maxLengthParser(255),
+	},
+	{
+		Name: "paragraph", Label: "Paragraph", SQLType: "TEXT", Widget: "textarea",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			if len(v) > 65535 {
+				return nil, fmt.Errorf("must be at most 65535 bytes")
+			}
+			return v, nil
+		},
+	},
+	{
+		Name: "number", Label: "Number", SQLType: "INT", Widget: "number",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("must be a whole number")
+			}
+			return n, nil
+		},
+	},
+	{
+		Name: "decimal", Label: "Decimal Number", SQLType: "DECIMAL(12,2)", Widget: "number",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || math.Abs(f) >= 1e10 {
+				return nil, fmt.Errorf("must be a number below 10,000,000,000 with at most two decimals")
+			}
+			return strconv.FormatFloat(f, 'f', 2, 64), nil
+		},
+	},
+	{
+		Name: "date", Label: "Date", SQLType: "DATE", Widget: "date",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return nil, fmt.Errorf("must be a date like 2024-12-31")
+			}
+			return t.Format("2006-01-02"), nil
+		},
+		display: reformatTime("2006-01-02"),
+	},
+	{
+		Name: "datetime", Label: "Date and Time", SQLType: "DATETIME", Widget: "datetime-local",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t.Format("2006-01-02 15:04:05"), nil
+				}
+			}
+			return nil, fmt.Errorf("must be a date and time like 2024-12-31T18:30")
+		},
+		display: reformatTime("2006-01-02T15:04"),
+	},
+	{
+		Name: "boolean", Label: "Yes / No", SQLType: "BOOLEAN", Widget: "checkbox",
+		parse: func(v string) (interface{}, error) {
+			switch strings.ToLower(v) {
+			case "", "0", "false", "off", "no":
+				return 0, nil
+			case "1", "true", "on", "yes":
+				return 1, nil
+			}
+			return nil, fmt.Errorf("must be yes or no")
+		},
+	},
+	{
+		Name: "url", Label: "Web Address (URL)", SQLType: "VARCHAR(2048)", Widget: "url",
+		parse: func(v string) (interface{}, error) {
+			if v == "" {
+				return nil, nil
+			}
+			u, err := url.Parse(v)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(v) > 2048 {
+				return nil, fmt.Errorf("must be an http(s) URL of at most 2048 characters")
+			}
+			return v, nil
+		},
+	},
+}
+
+// fieldTypeByName looks up a semantic field type by its key.
+func fieldTypeByName(name string) (FieldType, bool) {
+	for _, ft := range fieldTypes {
+		if ft.Name == name {
+			return ft, true
+		}
+	}
+	return FieldType{}, false
+}
+
+// intDisplayWidth matches the display width MariaDB reports for integer columns, e.g. "int(11)".
+var intDisplayWidth = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|bigint)\(\d+\)`)
+
+// normalizeSQLType brings a type as reported by DESCRIBE and a registry SQL type to a comparable form.
+func normalizeSQLType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	switch t {
+	case "boolean", "bool", "tinyint(1)":
+		return "boolean"
+	}
+	return intDisplayWidth.ReplaceAllString(t, "$1")
+}
+
+// fieldTypeForColumn returns the semantic type whose SQL type matches a column type.
+func fieldTypeForColumn(sqlType string) (FieldType, bool) {
+	norm := normalizeSQLType(sqlType)
+	for _, ft := range fieldTypes {
+		if normalizeSQLType(ft.SQLType) == norm {
+			return ft, true
+		}
+	}
+	return FieldType{}, false
+}
+
+// systemColumns lists, per class table, the columns the application code depends on.
+// They are shown read-only in the Class Management UI and cannot be removed.
+var systemColumns = map[string][]string{
+	"content_piece":     {"id", "class", "title", "created_at", "status", "publish_at", "unpublish_at", "scheduled_by", "schedule_error"},
+	"contlet_paragraph": {"id", "text_content"},
+	"contlet_image":     {"id", "src", "alt_text", "width", "height"},
+	"contlet_heading":   {"id", "text_content", "level"},
+	"taxonomy":          {"id", "name", "description"},
+	"tag":               {"id", "taxonomy_id", "value"},
+}
+
+// isSystemColumn reports whether column is managed by the application rather than an administrator.
+func isSystemColumn(table, column string) bool {
+	if column == "id" {
+		return true
+	}
+	for _, c := range systemColumns[table] {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// isClassTable reports whether table holds the objects of a Class and may be
+// altered through the Class Management UI. Infrastructure tables may not.
+func isClassTable(table string) bool {
+	switch table {
+	case "content_piece", "taxonomy", "tag":
+		return true
+	case "contlet_class":
+		return false
+	}
+	return strings.HasPrefix(table, "contlet_") && validIdentifier(table)
+}
+
+// ClassField is an administrator-defined field of a Class table.
+type ClassField struct {
+	Name     string
+	Type     FieldType
+	Required bool
+	Default  sql.NullString
+}
+
+// getClassFields returns the administrator-defined fields of a class table, in column order.
+// Columns whose SQL type is not in the registry are skipped.
+func getClassFields(table string) ([]ClassField, error) {
+	if !isClassTable(table) {
+		return nil, fmt.Errorf("%s is not a class table", table)
+	}
+	columns, err := describeTable(table)
+	if err != nil {
+		return nil, err
+	}
+	return classFieldsOf(table, columns), nil
+}
+
+// classFieldsOf picks the administrator-defined fields out of the columns of a class table.
+func classFieldsOf(table string, columns []ColumnDetail) []ClassField {
+	var fields []ClassField
+	for _, col := range columns {
+		if isSystemColumn(table, col.Field) {
+			continue
+		}
+		ft, ok := fieldTypeForColumn(col.Type)
+		if !ok {
+			continue
+		}
+		fields = append(fields, ClassField{Name: col.Field, Type: ft, Required: col.Null == "NO", Default: col.Default})
+	}
+	return fields
+}
+
+// parseFieldValues validates raw form values for fields and returns the values to store.
+func parseFieldValues(fields []ClassField, raw map[string]string) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		v, err := f.Type.Parse(strings.TrimSpace(raw[f.Name]))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", f.Name, err)
+		}
+		if v == nil && f.Required && !f.Default.Valid {
+			return nil, fmt.Errorf("%s is required", f.Name)
+		}
+		values[f.Name] = v
+	}
+	return values, nil
+}
+
+// validateFieldValues checks raw form values against the administrator-defined fields of table.
+func validateFieldValues(table string, raw map[string]string) error {
+	fields, err := getClassFields(table)
+	if err != nil {
+		return err
+	}
+	_, err = parseFieldValues(fields, raw)
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertObjectRow inserts the class row of a new object. cols and args hold the
+// system columns; the administrator-defined fields of table are validated from raw
+// and written in the same statement, so that required fields never see a NULL.
+// Empty fields that have a column default are left out and take the default.
+func insertObjectRow(ex execer, table string, cols []string, args []interface{}, raw map[string]string) error {
+	fields, err := getClassFields(table)
+	if err != nil {
+		return err
+	}
+	values, err := parseFieldValues(fields, raw)
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, 0, len(cols)+len(fields))
+	for _, c := range cols {
+		quoted = append(quoted, "`"+c+"`")
+	}
+	for _, f := range fields {
+		v := values[f.Name]
+		if v == nil && f.Default.Valid {
+			continue
+		}
+		quoted = append(quoted, "`"+f.Name+"`")
+		args = append(args, v)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(quoted)), ", ")
+	_, err = ex.Exec(fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", table, strings.Join(quoted, ", "), placeholders), args...)
+	return err
+}
+
+// writeFieldValues validates raw values for the administrator-defined fields of
+// table and stores them on the object with the given id. A nil raw leaves the
+// fields untouched; otherwise every field is written, missing ones as empty.
+func writeFieldValues(ex execer, table string, id int64, raw map[string]string) error {
+	if raw == nil {
+		return nil
+	}
+	fields, err := getClassFields(table)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	values, err := parseFieldValues(fields, raw)
+	if err != nil {
+		return err
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, f := range fields {
+		v := values[f.Name]
+		if v == nil && f.Default.Valid {
+			sets = append(sets, fmt.Sprintf("`%s` = DEFAULT", f.Name))
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("`%s` = ?", f.Name))
+		args = append(args, v)
+	}
+	args = append(args, id)
+	_, err = ex.Exec(fmt.Sprintf("UPDATE `%s` SET %s WHERE id = ?", table, strings.Join(sets, ", ")), args...)
+	if err != nil {
+		return fmt.Errorf("failed to save fields of %s %d: %w", table, id, err)
+	}
+	return nil
+}
+
+// readFieldValues loads the administrator-defined field values of one object through q,
+// formatted for display.
+func readFieldValues(q queryer, table string, id int) (map[string]string, error) {
+	fields, err := getClassFields(table)
+	if err != nil || len(fields) == 0 {
+		return map[string]string{}, err
+	}
+
+	cols := make([]string, len(fields))
+	dest := make([]interface{}, len(fields))
+	scanned := make([]sql.NullString, len(fields))
+	for i, f := range fields {
+		cols[i] = "`" + f.Name + "`"
+		dest[i] = &scanned[i]
+	}
+	err = q.QueryRow(fmt.Sprintf("SELECT %s FROM `%s` WHERE id = ?", strings.Join(cols, ", "), table), id).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(fields))
+	for i, f := range fields {
+		if scanned[i].Valid {
+			values[f.Name] = f.Type.Display(scanned[i].String)
+		}
+	}
+	return values, nil
+}
+
+// fieldValuesFromForm collects the "field_<name>" inputs of an object form.
+func fieldValuesFromForm(form url.Values) map[string]string {
+	raw := make(map[string]string)
+	for key := range form {
+		if name, ok := strings.CutPrefix(key, "field_"); ok {
+			raw[name] = form.Get(key)
+		}
+	}
+	return raw
+}
+
+// ClassFieldsData holds the data for the class fields partial of an object form.
+type ClassFieldsData struct {
+	Fields []ClassField
+	Values map[string]string
+}
+
+// loadClassFieldsData gathers the administrator-defined fields of table and, for an
+// existing object (id > 0), its current values.
+func loadClassFieldsData(table string, id int) (ClassFieldsData, error) {
+	fields, err := getClassFields(table)
+	if err != nil {
+		return ClassFieldsData{}, err
+	}
+	data := ClassFieldsData{Fields: fields, Values: map[string]string{}}
+	if id > 0 && len(fields) > 0 {
+		if data.Values, err = readFieldValues(db, table, id); err != nil {
+			return ClassFieldsData{}, err
+		}
+	}
+	return data, nil
+}
+
+// sqlQuoteString renders s as a MariaDB string literal. It is only used for
+// column defaults in DDL, where placeholders are not allowed.
+func sqlQuoteString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `''`, "\x00", `\0`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// defaultClause validates a default value against ft and renders the DEFAULT clause.
+func defaultClause(ft FieldType, def string) (string, error) {
+	if def == "" {
+		return "", nil
+	}
+	v, err := ft.Parse(def)
+	if err != nil {
+		return "", &ValidationError{fmt.Sprintf("default value %s", err)}
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return " DEFAULT " + sqlQuoteString(v), nil
+	default:
+		return fmt.Sprintf(" DEFAULT %v", v), nil
+	}
+}
@@ -0,0 +1,1288 @@
+// In file: graphql.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A small GraphQL implementation for the read-only query endpoint: a parser for
+// executable documents, a validator and an executor that resolves each field for
+// all parent objects of a level at once, so that resolvers can load in batches
+// instead of once per object. Mutations, subscriptions and introspection beyond
+// __typename are not supported; the schema is published as SDL instead.
+//
+// The schema itself (types and resolvers) is built in graphqlschema.go.
+
+// gqlMaxDepth limits the nesting of selection sets in a query.
+const gqlMaxDepth = 12
+
+// --- Type system ---
+
+// gqlTypeRef is a reference to a type as written in SDL, e.g. [Tag!]!. Lists of lists are not supported.
+type gqlTypeRef struct {
+	Name        string
+	NonNull     bool
+	List        bool
+	ItemNonNull bool
+}
+
+// parseTypeRef parses a type reference such as "Int", "String!" or "[Tag!]!".
+func parseTypeRef(s string) gqlTypeRef {
+	var t gqlTypeRef
+	if strings.HasSuffix(s, "!") {
+		t.NonNull = true
+		s = strings.TrimSuffix(s, "!")
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		t.List = true
+		s = s[1 : len(s)-1]
+		if strings.HasSuffix(s, "!") {
+			t.ItemNonNull = true
+			s = strings.TrimSuffix(s, "!")
+		}
+	}
+	t.Name = s
+	return t
+}
+
+func (t gqlTypeRef) String() string {
+	s := t.Name
+	if t.List {
+		if t.ItemNonNull {
+			s += "!"
+		}
+		s = "[" + s + "]"
+	}
+	if t.NonNull {
+		s += "!"
+	}
+	return s
+}
+
+// gqlArg is an argument of a field.
+type gqlArg struct {
+	Name    string
+	Type    gqlTypeRef
+	Default interface{} // already coerced; nil for none
+}
+
+// gqlResolver resolves a field for a batch of parent objects. It returns one value
+// per parent, in order: a scalar for leaf fields, a *gqlObject (or nil) for object
+// fields and a []*gqlObject for list fields.
+type gqlResolver func(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error)
+
+// gqlFieldDef is a field of an object or interface type.
+type gqlFieldDef struct {
+	Name        string
+	Type        gqlTypeRef
+	Args        []gqlArg
+	Description string
+	resolve     gqlResolver // nil: the value is read from the parent's Data
+}
+
+// gqlTypeDef is an object, interface or enum type.
+type gqlTypeDef struct {
+	Name        string
+	Kind        string // "type", "interface" or "enum", as in SDL
+	Description string
+	Interfaces  []string
+	Fields      []*gqlFieldDef
+	Values      []string // enum values
+}
+
+// field looks up a field by name.
+func (t *gqlTypeDef) field(name string) *gqlFieldDef {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// gqlSchema is a set of types whose root is the Query type.
+type gqlSchema struct {
+	types map[string]*gqlTypeDef
+	order []string
+}
+
+func newGQLSchema() *gqlSchema {
+	return &gqlSchema{types: map[string]*gqlTypeDef{}}
+}
+
+// add adds a type to the schema.
+func (s *gqlSchema) add(t *gqlTypeDef) {
+	s.types[t.Name] = t
+	s.order = append(s.order, t.Name)
+}
+
+// isLeaf reports whether values of the named type are scalars or enum values.
+func (s *gqlSchema) isLeaf(name string) bool {
+	switch name {
+	case "Int", "Float", "String", "Boolean", "ID":
+		return true
+	}
+	t := s.types[name]
+	return t != nil && t.Kind == "enum"
+}
+
+// implements reports whether the concrete type is, or implements, the named type.
+func (s *gqlSchema) implements(concrete, name string) bool {
+	if concrete == name {
+		return true
+	}
+	if t := s.types[concrete]; t != nil {
+		for _, i := range t.Interfaces {
+			if i == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SDL renders the schema in the GraphQL schema definition language.
+func (s *gqlSchema) SDL() string {
+	var b strings.Builder
+	for _, name := range s.order {
+		t := s.types[name]
+		if t.Description != "" {
+			fmt.Fprintf(&b, "%s\n", strconv.Quote(t.Description))
+		}
+		fmt.Fprintf(&b, "%s %s", t.Kind, t.Name)
+		if len(t.Interfaces) > 0 {
+			fmt.Fprintf(&b, " implements %s", strings.Join(t.Interfaces, " & "))
+		}
+		b.WriteString(" {\n")
+		for _, v := range t.Values {
+			fmt.Fprintf(&b, "  %s\n", v)
+		}
+		for _, f := range t.Fields {
+			if f.Description != "" {
+				fmt.Fprintf(&b, "  %s\n", strconv.Quote(f.Description))
+			}
+			fmt.Fprintf(&b, "  %s", f.Name)
+			if len(f.Args) > 0 {
+				args := make([]string, len(f.Args))
+				for i, a := range f.Args {
+					args[i] = a.Name + ": " + a.Type.String()
+					if a.Default != nil {
+						args[i] += " = " + fmt.Sprint(a.Default)
+					}
+				}
+				fmt.Fprintf(&b, "(%s)", strings.Join(args, ", "))
+			}
+			fmt.Fprintf(&b, ": %s\n", f.Type)
+		}
+		b.WriteString("}\n\n")
+	}
+	return b.String()
+}
+
+// gqlObject is an object value during execution.
+type gqlObject struct {
+	Type string // the concrete type
+	ID   int
+	Data map[string]interface{} // scalar field values, by field name
+}
+
+// gqlEnum is an enum value written in a query.
+type gqlEnum string
+
+// --- Lexer ---
+
+type gqlToken struct {
+	kind  byte // 'P' punctuator, 'N' name, 'I' int, 'F' float, 'S' string, 0 end
+	value string
+	pos   int
+}
+
+// gqlLex splits a GraphQL document into tokens.
+func gqlLex(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{'P', "...", i})
+			i += 3
+		case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{'P', string(c), i})
+			i++
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{'N', src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			kind := byte('I')
+			if c == '-' {
+				i++
+			}
+			digits := func() {
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			digits()
+			if i < len(src) && src[i] == '.' {
+				kind = 'F'
+				i++
+				digits()
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = 'F'
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated block string at offset %d", i)
+			}
+			tokens = append(tokens, gqlToken{'S', src[i+3 : i+3+end], i})
+			i += end + 6
+		case c == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) || src[i] == '\n' {
+					return nil, fmt.Errorf("unterminated string at offset %d", start)
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] != '\\' {
+					r, size := utf8.DecodeRuneInString(src[i:])
+					b.WriteRune(r)
+					i += size
+					continue
+				}
+				if i+1 >= len(src) {
+					return nil, fmt.Errorf("unterminated string at offset %d", start)
+				}
+				switch e := src[i+1]; e {
+				case '"', '\\', '/':
+					b.WriteByte(e)
+				case 'b':
+					b.WriteByte('\b')
+				case 'f':
+					b.WriteByte('\f')
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				case 'u':
+					if i+6 > len(src) {
+						return nil, fmt.Errorf("invalid unicode escape at offset %d", i)
+					}
+					n, err := strconv.ParseUint(src[i+2:i+6], 16, 32)
+					if err != nil {
+						return nil, fmt.Errorf("invalid unicode escape at offset %d", i)
+					}
+					b.WriteRune(rune(n))
+					i += 4
+				default:
+					return nil, fmt.Errorf("invalid escape sequence at offset %d", i)
+				}
+				i += 2
+			}
+			tokens = append(tokens, gqlToken{'S', b.String(), start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	return append(tokens, gqlToken{0, "", len(src)}), nil
+}
+
+// --- Parser ---
+
+// gqlValue is an input value as written in a query.
+type gqlValue struct {
+	kind   byte // '$' variable, 'I' int, 'F' float, 'S' string, 'B' boolean, '0' null, 'E' enum, '[' list, '{' object
+	raw    string
+	list   []gqlValue
+	fields map[string]gqlValue
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]gqlValue
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment.
+type gqlSelection struct {
+	kind       byte // 'F' field, 'S' fragment spread, 'I' inline fragment
+	alias      string
+	name       string // field or fragment name
+	typeCond   string // inline fragments only; may be empty
+	args       map[string]gqlValue
+	directives []gqlDirective
+	selections []gqlSelection
+}
+
+// key returns the response key of a field.
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlVarDef struct {
+	name string
+	typ  gqlTypeRef
+	def  *gqlValue
+}
+
+type gqlOperation struct {
+	kind       string // "query", "mutation" or "subscription"
+	name       string
+	vars       []gqlVarDef
+	selections []gqlSelection
+}
+
+type gqlFragment struct {
+	typeCond   string
+	selections []gqlSelection
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the given punctuator or keyword.
+func (p *gqlParser) is(value string) bool {
+	t := p.peek()
+	return (t.kind == 'P' || t.kind == 'N') && t.value == value
+}
+
+func (p *gqlParser) expect(value string) error {
+	if !p.is(value) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != 'N' {
+		return "", p.unexpected()
+	}
+	return p.next().value, nil
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("syntax error: unexpected end of document")
+	}
+	return fmt.Errorf("syntax error: unexpected %q at offset %d", t.value, t.pos)
+}
+
+// parseGQLDocument parses an executable GraphQL document.
+func parseGQLDocument(src string) (*gqlDocument, error) {
+	tokens, err := gqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.peek().kind != 0 {
+		switch {
+		case p.is("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: sel})
+		case p.is("query"), p.is("mutation"), p.is("subscription"):
+			op := &gqlOperation{kind: p.next().value}
+			if p.peek().kind == 'N' {
+				op.name = p.next().value
+			}
+			if p.is("(") {
+				if op.vars, err = p.variableDefinitions(); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			if op.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.is("fragment"):
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("on"); err != nil {
+				return nil, err
+			}
+			f := &gqlFragment{}
+			if f.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			if f.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("there can be only one fragment named %q", name)
+			}
+			doc.fragments[name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("the document contains no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) variableDefinitions() ([]gqlVarDef, error) {
+	p.next() // (
+	var defs []gqlVarDef
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		typ, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		def := gqlVarDef{name: name, typ: parseTypeRef(typ)}
+		if p.is("=") {
+			p.next()
+			v, err := p.value(true)
+			if err != nil {
+				return nil, err
+			}
+			def.def = &v
+		}
+		defs = append(defs, def)
+	}
+	p.next() // )
+	return defs, nil
+}
+
+func (p *gqlParser) typeRef() (string, error) {
+	var s string
+	if p.is("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		s = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		s = name
+	}
+	if p.is("!") {
+		p.next()
+		s += "!"
+	}
+	return s, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []gqlSelection
+	for !p.is("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	p.next() // }
+	return sel, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var s gqlSelection
+	var err error
+	if p.is("...") {
+		p.next()
+		if p.peek().kind == 'N' && !p.is("on") {
+			s.kind = 'S'
+			s.name = p.next().value
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.kind = 'I'
+		if p.is("on") {
+			p.next()
+			if s.typeCond, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return s, err
+		}
+		s.selections, err = p.selectionSet()
+		return s, err
+	}
+
+	s.kind = 'F'
+	if s.name, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.is(":") {
+		p.next()
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if p.is("(") {
+		if s.args, err = p.arguments(); err != nil {
+			return s, err
+		}
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.is("{") {
+		s.selections, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]gqlValue, error) {
+	p.next() // (
+	args := map[string]gqlValue{}
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	p.next() // )
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.is("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		d := gqlDirective{name: name}
+		if p.is("(") {
+			if d.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// value parses an input value. Variables are not allowed in constant contexts.
+func (p *gqlParser) value(constant bool) (gqlValue, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 'P' && t.value == "$" && !constant:
+		p.next()
+		name, err := p.name()
+		return gqlValue{kind: '$', raw: name}, err
+	case t.kind == 'I' || t.kind == 'F' || t.kind == 'S':
+		p.next()
+		return gqlValue{kind: t.kind, raw: t.value}, nil
+	case t.kind == 'N':
+		p.next()
+		switch t.value {
+		case "true", "false":
+			return gqlValue{kind: 'B', raw: t.value}, nil
+		case "null":
+			return gqlValue{kind: '0'}, nil
+		}
+		return gqlValue{kind: 'E', raw: t.value}, nil
+	case t.kind == 'P' && t.value == "[":
+		p.next()
+		v := gqlValue{kind: '['}
+		for !p.is("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return v, err
+			}
+			v.list = append(v.list, item)
+		}
+		p.next()
+		return v, nil
+	case t.kind == 'P' && t.value == "{":
+		p.next()
+		v := gqlValue{kind: '{', fields: map[string]gqlValue{}}
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return v, err
+			}
+			if err := p.expect(":"); err != nil {
+				return v, err
+			}
+			if v.fields[name], err = p.value(constant); err != nil {
+				return v, err
+			}
+		}
+		p.next()
+		return v, nil
+	}
+	return gqlValue{}, p.unexpected()
+}
+
+// --- Validation ---
+
+// validate checks an operation against the schema before it is executed.
+func (s *gqlSchema) validate(doc *gqlDocument, op *gqlOperation) error {
+	if op.kind != "query" {
+		return fmt.Errorf("%s operations are not supported; this endpoint is read-only", op.kind)
+	}
+	declared := map[string]bool{}
+	for _, v := range op.vars {
+		declared[v.name] = true
+	}
+	return s.validateSelections(doc, "Query", op.selections, declared, map[string]bool{}, 1)
+}
+
+func (s *gqlSchema) validateSelections(doc *gqlDocument, typeName string, sel []gqlSelection, vars, fragmentPath map[string]bool, depth int) error {
+	if depth > gqlMaxDepth {
+		return fmt.Errorf("the query is nested more than %d levels deep", gqlMaxDepth)
+	}
+	t := s.types[typeName]
+	for i := range sel {
+		f := &sel[i]
+		if err := validateVariableUses(f, vars); err != nil {
+			return err
+		}
+		switch f.kind {
+		case 'F':
+			if f.name == "__typename" {
+				if len(f.selections) > 0 {
+					return fmt.Errorf("field __typename must not have a selection")
+				}
+				continue
+			}
+			def := t.field(f.name)
+			if def == nil {
+				return fmt.Errorf("cannot query field %q on type %q", f.name, typeName)
+			}
+			for name := range f.args {
+				if !hasArg(def, name) {
+					return fmt.Errorf("unknown argument %q on field %s.%s", name, typeName, f.name)
+				}
+			}
+			for _, a := range def.Args {
+				if _, ok := f.args[a.Name]; !ok && a.Type.NonNull && a.Default == nil {
+					return fmt.Errorf("field %s.%s requires argument %q", typeName, f.name, a.Name)
+				}
+			}
+			leaf := s.isLeaf(def.Type.Name)
+			switch {
+			case leaf && len(f.selections) > 0:
+				return fmt.Errorf("field %s.%s of type %s must not have a selection", typeName, f.name, def.Type)
+			case !leaf && len(f.selections) == 0:
+				return fmt.Errorf("field %s.%s of type %s must have a selection of subfields", typeName, f.name, def.Type)
+			case !leaf:
+				if err := s.validateSelections(doc, def.Type.Name, f.selections, vars, fragmentPath, depth+1); err != nil {
+					return err
+				}
+			}
+		case 'S':
+			frag := doc.fragments[f.name]
+			if frag == nil {
+				return fmt.Errorf("unknown fragment %q", f.name)
+			}
+			if fragmentPath[f.name] {
+				return fmt.Errorf("fragment %q spreads itself", f.name)
+			}
+			if err := s.validateTypeCondition(frag.typeCond); err != nil {
+				return err
+			}
+			fragmentPath[f.name] = true
+			err := s.validateSelections(doc, frag.typeCond, frag.selections, vars, fragmentPath, depth)
+			delete(fragmentPath, f.name)
+			if err != nil {
+				return err
+			}
+		case 'I':
+			cond := f.typeCond
+			if cond == "" {
+				cond = typeName
+			} else if err := s.validateTypeCondition(cond); err != nil {
+				return err
+			}
+			if err := s.validateSelections(doc, cond, f.selections, vars, fragmentPath, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *gqlSchema) validateTypeCondition(name string) error {
+	if t := s.types[name]; t == nil || t.Kind == "enum" {
+		return fmt.Errorf("unknown type %q in fragment", name)
+	}
+	return nil
+}
+
+func hasArg(def *gqlFieldDef, name string) bool {
+	for _, a := range def.Args {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateVariableUses checks that the arguments of a selection only use declared variables.
+func validateVariableUses(f *gqlSelection, vars map[string]bool) error {
+	var check func(v gqlValue) error
+	check = func(v gqlValue) error {
+		switch v.kind {
+		case '$':
+			if !vars[v.raw] {
+				return fmt.Errorf("variable $%s is not defined", v.raw)
+			}
+		case '[':
+			for _, item := range v.list {
+				if err := check(item); err != nil {
+					return err
+				}
+			}
+		case '{':
+			for _, item := range v.fields {
+				if err := check(item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, v := range f.args {
+		if err := check(v); err != nil {
+			return err
+		}
+	}
+	for _, d := range f.directives {
+		for _, v := range d.args {
+			if err := check(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- Execution ---
+
+// gqlExecutor executes one operation. Resolvers may keep per-request state in
+// loaded, so that an object referenced many times is only read once.
+type gqlExecutor struct {
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	loaded map[int]*gqlObject
+}
+
+// gqlResult is a response object whose keys keep the order of the query.
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *gqlResult) set(key string, v interface{}) {
+	if _, ok := r.values[key]; !ok {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = v
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		v, err := json.Marshal(r.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// execute parses, validates and executes a query. Errors before execution
+// (syntax, validation, variables) are returned as requestErr; the query then has
+// no data.
+func (s *gqlSchema) execute(query, operationName string, variables map[string]interface{}) (data *gqlResult, requestErr, execErr error) {
+	doc, err := parseGQLDocument(query)
+	if err != nil {
+		return nil, err, nil
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if operationName == "" && len(doc.operations) > 1 {
+			return nil, fmt.Errorf("the document contains several operations; operationName is required"), nil
+		}
+		if operationName == "" || o.name == operationName {
+			op = o
+			break
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", operationName), nil
+	}
+	if err := s.validate(doc, op); err != nil {
+		return nil, err, nil
+	}
+
+	ex := &gqlExecutor{schema: s, doc: doc, vars: map[string]interface{}{}, loaded: map[int]*gqlObject{}}
+	for _, v := range op.vars {
+		value, ok := variables[v.name]
+		if !ok && v.def != nil {
+			value, ok = ex.valueOf(*v.def), true
+		}
+		if !ok {
+			if v.typ.NonNull {
+				return nil, fmt.Errorf("variable $%s of type %s was not provided", v.name, v.typ), nil
+			}
+			continue
+		}
+		if ex.vars[v.name], err = ex.coerce(v.typ, value); err != nil {
+			return nil, fmt.Errorf("variable $%s: %w", v.name, err), nil
+		}
+	}
+
+	results, err := ex.executeSelections("Query", []*gqlObject{{Type: "Query"}}, op.selections)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results[0], nil, nil
+}
+
+// valueOf evaluates an input value, substituting variables.
+func (ex *gqlExecutor) valueOf(v gqlValue) interface{} {
+	switch v.kind {
+	case '$':
+		return ex.vars[v.raw]
+	case 'I':
+		n, _ := strconv.ParseInt(v.raw, 10, 64)
+		return n
+	case 'F':
+		f, _ := strconv.ParseFloat(v.raw, 64)
+		return f
+	case 'S':
+		return v.raw
+	case 'B':
+		return v.raw == "true"
+	case 'E':
+		return gqlEnum(v.raw)
+	case '[':
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			list[i] = ex.valueOf(item)
+		}
+		return list
+	case '{':
+		obj := map[string]interface{}{}
+		for k, item := range v.fields {
+			obj[k] = ex.valueOf(item)
+		}
+		return obj
+	}
+	return nil
+}
+
+// coerce converts an argument or variable value to the Go value of its type:
+// int, float64, string or bool (enum values are strings). Coerced values may be
+// coerced again, as variables are when they are used as arguments.
+func (ex *gqlExecutor) coerce(t gqlTypeRef, v interface{}) (interface{}, error) {
+	if v == nil {
+		if t.NonNull {
+			return nil, fmt.Errorf("expected a non-null %s", t)
+		}
+		return nil, nil
+	}
+	if t.List {
+		return nil, fmt.Errorf("list arguments are not supported")
+	}
+	switch t.Name {
+	case "Int":
+		var n int64
+		switch v := v.(type) {
+		case int:
+			n = int64(v)
+		case int64:
+			n = v
+		case json.Number:
+			i, err := v.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("expected an Int, got %s", v)
+			}
+			n = i
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("expected an Int, got %v", v)
+			}
+			n = int64(v)
+		default:
+			return nil, fmt.Errorf("expected an Int, got %v", v)
+		}
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("Int %d is out of range", n)
+		}
+		return int(n), nil
+	case "Float":
+		switch v := v.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case json.Number:
+			f, err := v.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("expected a Float, got %s", v)
+			}
+			return f, nil
+		}
+		return nil, fmt.Errorf("expected a Float, got %v", v)
+	case "String", "ID":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("expected a %s, got %v", t.Name, v)
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected a Boolean, got %v", v)
+	}
+
+	if def := ex.schema.types[t.Name]; def != nil && def.Kind == "enum" {
+		var s string
+		switch v := v.(type) {
+		case gqlEnum:
+			s = string(v)
+		case string:
+			s = v // enum values in variables are strings
+		}
+		for _, allowed := range def.Values {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("expected one of %s, got %v", strings.Join(def.Values, ", "), v)
+	}
+	return nil, fmt.Errorf("unsupported input type %s", t)
+}
+
+// included evaluates the @skip and @include directives of a selection.
+func (ex *gqlExecutor) included(s *gqlSelection) (bool, error) {
+	for _, d := range s.directives {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		v, err := ex.coerce(gqlTypeRef{Name: "Boolean", NonNull: true}, ex.valueOf(d.args["if"]))
+		if err != nil {
+			return false, fmt.Errorf("@%s(if:): %w", d.name, err)
+		}
+		if (d.name == "skip") == v.(bool) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// gqlCollected is the set of field selections that share a response key.
+type gqlCollected struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// collectFields flattens the fragments of a selection set that apply to the
+// concrete type, grouping fields by response key in query order.
+func (ex *gqlExecutor) collectFields(concrete string, sel []gqlSelection, into []*gqlCollected, visited map[string]bool) ([]*gqlCollected, error) {
+	for i := range sel {
+		s := &sel[i]
+		ok, err := ex.included(s)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		switch s.kind {
+		case 'F':
+			found := false
+			for _, c := range into {
+				if c.key == s.key() {
+					c.fields = append(c.fields, s)
+					found = true
+					break
+				}
+			}
+			if !found {
+				into = append(into, &gqlCollected{key: s.key(), fields: []*gqlSelection{s}})
+			}
+		case 'S':
+			frag := ex.doc.fragments[s.name]
+			if visited[s.name] || !ex.schema.implements(concrete, frag.typeCond) {
+				continue
+			}
+			visited[s.name] = true
+			if into, err = ex.collectFields(concrete, frag.selections, into, visited); err != nil {
+				return nil, err
+			}
+		case 'I':
+			if s.typeCond != "" && !ex.schema.implements(concrete, s.typeCond) {
+				continue
+			}
+			if into, err = ex.collectFields(concrete, s.selections, into, visited); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return into, nil
+}
+
+// arguments coerces the arguments of a field selection and applies defaults.
+func (ex *gqlExecutor) arguments(def *gqlFieldDef, s *gqlSelection) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for _, a := range def.Args {
+		v, ok := s.args[a.Name]
+		if !ok || v.kind == '$' && ex.vars[v.raw] == nil && a.Default != nil {
+			if a.Default != nil {
+				args[a.Name] = a.Default
+			}
+			continue
+		}
+		coerced, err := ex.coerce(a.Type, ex.valueOf(v))
+		if err != nil {
+			return nil, fmt.Errorf("argument %q of field %q: %w", a.Name, def.Name, err)
+		}
+		if coerced != nil {
+			args[a.Name] = coerced
+		}
+	}
+	return args, nil
+}
+
+// executeSelections resolves a selection set for a batch of parent objects whose
+// static type is typeName. Parents are grouped by concrete type and every field
+// is resolved once per group, which lets resolvers load all children in one go.
+func (ex *gqlExecutor) executeSelections(typeName string, parents []*gqlObject, sel []gqlSelection) ([]*gqlResult, error) {
+	results := make([]*gqlResult, len(parents))
+	groups := map[string][]int{}
+	var order []string
+	for i, p := range parents {
+		results[i] = &gqlResult{values: map[string]interface{}{}}
+		if _, ok := groups[p.Type]; !ok {
+			order = append(order, p.Type)
+		}
+		groups[p.Type] = append(groups[p.Type], i)
+	}
+
+	for _, concrete := range order {
+		idx := groups[concrete]
+		t := ex.schema.types[concrete]
+		if t == nil {
+			return nil, fmt.Errorf("internal error: %s resolved to unknown type %q", typeName, concrete)
+		}
+		group := make([]*gqlObject, len(idx))
+		for i, j := range idx {
+			group[i] = parents[j]
+		}
+
+		fields, err := ex.collectFields(concrete, sel, nil, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range fields {
+			f := c.fields[0]
+			if f.name == "__typename" {
+				for _, j := range idx {
+					results[j].set(c.key, concrete)
+				}
+				continue
+			}
+			def := t.field(f.name)
+			args, err := ex.arguments(def, f)
+			if err != nil {
+				return nil, err
+			}
+			values, err := ex.resolve(def, group, args)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", concrete, def.Name, err)
+			}
+
+			if ex.schema.isLeaf(def.Type.Name) {
+				for i, j := range idx {
+					if values[i] == nil && def.Type.NonNull {
+						return nil, fmt.Errorf("cannot return null for non-nullable field %s.%s", concrete, def.Name)
+					}
+					results[j].set(c.key, values[i])
+				}
+				continue
+			}
+
+			var sub []gqlSelection
+			for _, same := range c.fields {
+				sub = append(sub, same.selections...)
+			}
+			if err := ex.executeChildren(def, concrete, values, sub, func(i int, v interface{}) {
+				results[idx[i]].set(c.key, v)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// resolve calls the resolver of a field, or reads the field from each parent's Data.
+func (ex *gqlExecutor) resolve(def *gqlFieldDef, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	if def.resolve == nil {
+		values := make([]interface{}, len(parents))
+		for i, p := range parents {
+			values[i] = p.Data[def.Name]
+		}
+		return values, nil
+	}
+	values, err := def.resolve(ex, parents, args)
+	if err == nil && len(values) != len(parents) {
+		err = fmt.Errorf("internal error: resolver returned %d values for %d parents", len(values), len(parents))
+	}
+	return values, err
+}
+
+// executeChildren executes the sub-selection of an object or list field for the
+// values returned for all parents at once and hands each parent its result.
+func (ex *gqlExecutor) executeChildren(def *gqlFieldDef, concrete string, values []interface{}, sub []gqlSelection, set func(i int, v interface{})) error {
+	var children []*gqlObject
+	for i, v := range values {
+		switch v := v.(type) {
+		case *gqlObject:
+			if v != nil {
+				children = append(children, v)
+			}
+		case []*gqlObject:
+			children = append(children, v...)
+		case nil:
+		default:
+			return fmt.Errorf("internal error: %s.%s resolved to %T for parent %d", concrete, def.Name, v, i)
+		}
+	}
+	childResults, err := ex.executeSelections(def.Type.Name, children, sub)
+	if err != nil {
+		return err
+	}
+
+	next := 0
+	for i, v := range values {
+		switch v := v.(type) {
+		case *gqlObject:
+			if v == nil {
+				if def.Type.NonNull {
+					return fmt.Errorf("cannot return null for non-nullable field %s.%s", concrete, def.Name)
+				}
+				set(i, nil)
+				continue
+			}
+			set(i, childResults[next])
+			next++
+		case []*gqlObject:
+			list := make([]*gqlResult, len(v))
+			copy(list, childResults[next:next+len(v)])
+			next += len(v)
+			set(i, list)
+		default:
+			if def.Type.NonNull {
+				return fmt.Errorf("cannot return null for non-nullable field %s.%s", concrete, def.Name)
+			}
+			set(i, nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// These tests cover the parser, validator and executor of graphql.go and the
+// schema of graphqlschema.go without a database: the schema is built from fixed
+// column details, and execution uses resolvers that return objects from memory.
+
+// withContletClasses replaces the contlet class registry for the duration of a test.
+func withContletClasses(t *testing.T, classes ...ContletClass) {
+	t.Helper()
+	contletRegistry.Lock()
+	saved := contletRegistry.classes
+	contletRegistry.classes = classes
+	contletRegistry.Unlock()
+	t.Cleanup(func() {
+		contletRegistry.Lock()
+		contletRegistry.classes = saved
+		contletRegistry.Unlock()
+	})
+}
+
+// testSchemaTables are the columns of the class tables the schema tests build on,
+// as DESCRIBE reports them.
+func testSchemaTables() map[string][]ColumnDetail {
+	col := func(field, typ, null string) ColumnDetail {
+		return ColumnDetail{Field: field, Type: typ, Null: null}
+	}
+	return map[string][]ColumnDetail{
+		"content_piece": {
+			col("id", "int(11)", "NO"),
+			col("class", "varchar(255)", "NO"),
+			col("title", "varchar(255)", "NO"),
+			col("created_at", "timestamp", "NO"),
+			col("status", "varchar(50)", "NO"),
+			col("author", "varchar(255)", "YES"),
+			col("rating", "int(11)", "YES"),
+			col("price", "decimal(12,2)", "YES"),
+			col("featured", "tinyint(1)", "NO"),
+			col("links", "varchar(255)", "YES"),
+			col("shape", "geometry", "YES"),
+		},
+		"contlet_paragraph": {
+			col("id", "int(11)", "NO"),
+			col("text_content", "text", "NO"),
+			col("class", "varchar(255)", "YES"),
+		},
+		"tag": {
+			col("id", "int(11)", "NO"),
+			col("taxonomy_id", "int(11)", "NO"),
+			col("value", "varchar(255)", "NO"),
+		},
+		"taxonomy": {
+			col("id", "int(11)", "NO"),
+			col("name", "varchar(255)", "NO"),
+			col("description", "text", "YES"),
+		},
+	}
+}
+
+// testGraphQLSchema builds the schema for testSchemaTables with paragraph as the
+// only contlet class that has a table.
+func testGraphQLSchema(t *testing.T) *gqlSchema {
+	t.Helper()
+	withContletClasses(t,
+		ContletClass{Name: "paragraph", Description: "A paragraph of text."},
+		ContletClass{Name: "heading", Description: "A heading."}, // registered, but without a table
+	)
+	return buildGraphQLSchema(testSchemaTables())
+}
+
+func TestBuildGraphQLSchema(t *testing.T) {
+	s := testGraphQLSchema(t)
+
+	tests := []struct {
+		typeName, field string
+		want            string // the field's type, or "" when the field must not exist
+	}{
+		{"Piece", "id", "Int!"},
+		{"Piece", "title", "String!"},
+		{"Piece", "created_at", "String!"},
+		{"Piece", "author", "String"},
+		{"Piece", "rating", "Int"},
+		{"Piece", "price", "Float"},
+		{"Piece", "featured", "Boolean!"},
+		{"Piece", "links", "[Link!]!"},     // the edge keeps its name ...
+		{"Piece", "field_links", "String"}, // ... and the column is renamed
+		{"Piece", "shape", ""},             // a column type the registry does not know
+		{"Piece", "contlets", "[Contlet!]!"},
+		{"Piece", "tags", "[Tag!]!"},
+		{"ContletParagraph", "text_content", "String!"},
+		{"ContletParagraph", "class", "String!"},
+		{"ContletParagraph", "field_class", "String"},
+		{"ContletParagraph", "used_by", "[Piece!]!"},
+		{"ContletParagraph", "related", "[Entity!]!"},
+		{"Tag", "taxonomy", "Taxonomy!"},
+		{"Tag", "taxonomy_id", "Int!"},
+		{"Taxonomy", "members", "[Tag!]!"},
+		{"Taxonomy", "description", "String"},
+		{"Query", "piece", "Piece"},
+		{"Query", "contlets", "[Contlet!]!"},
+		{"Query", "entity", "Entity"},
+		{"Query", "links", "[Link!]!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typeName+"."+tt.field, func(t *testing.T) {
+			typ := s.types[tt.typeName]
+			if typ == nil {
+				t.Fatalf("type %s is missing", tt.typeName)
+			}
+			f := typ.field(tt.field)
+			switch {
+			case f == nil && tt.want != "":
+				t.Fatalf("field is missing, want %s", tt.want)
+			case f != nil && tt.want == "":
+				t.Fatalf("field has type %s, want no such field", f.Type)
+			case f != nil && f.Type.String() != tt.want:
+				t.Fatalf("field has type %s, want %s", f.Type, tt.want)
+			}
+		})
+	}
+
+	if _, ok := s.types["ContletHeading"]; ok {
+		t.Error("a type was built for a contlet class without a table")
+	}
+	if !s.implements("ContletParagraph", "Contlet") || !s.implements("ContletParagraph", "Entity") {
+		t.Errorf("ContletParagraph implements %v, want Contlet and Entity", s.types["ContletParagraph"].Interfaces)
+	}
+	if d := s.types["LinkDirection"]; d == nil || d.Kind != "enum" || strings.Join(d.Values, ",") != "OUT,IN,BOTH" {
+		t.Errorf("LinkDirection = %+v, want the enum OUT, IN, BOTH", d)
+	}
+	if arg := s.types["Piece"].field("related").Args[2]; arg.Name != "direction" || arg.Default != "OUT" {
+		t.Errorf("related's third argument = %+v, want direction defaulting to OUT", arg)
+	}
+
+	sdl := s.SDL()
+	for _, want := range []string{
+		"type ContletParagraph implements Contlet & Entity {",
+		`"A paragraph of text."`,
+		"  pieces(class: String, status: String, limit: Int = 50, offset: Int = 0): [Piece!]!",
+		"  links(link_type: String, min_confidence: Float, direction: LinkDirection = OUT): [Link!]!",
+	} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL does not contain %q", want)
+		}
+	}
+}
+
+func TestGQLClassObject(t *testing.T) {
+	c := newGQLClass("content_piece", testSchemaTables()["content_piece"], map[string]bool{"links": true})
+	obj := c.object(7, map[string]sql.NullString{
+		"id":       {String: "7", Valid: true},
+		"title":    {String: "Hello", Valid: true},
+		"rating":   {String: "4", Valid: true},
+		"price":    {String: "9.50", Valid: true},
+		"featured": {String: "0", Valid: true},
+		"links":    {String: "see also", Valid: true},
+		"author":   {}, // NULL
+	})
+	want := map[string]interface{}{"id": 7, "title": "Hello", "rating": 4, "price": 9.5, "featured": false, "field_links": "see also"}
+	if fmt.Sprint(obj.Data) != fmt.Sprint(want) {
+		t.Errorf("Data = %v, want %v", obj.Data, want)
+	}
+}
+
+func TestParseGQLDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+		check   func(t *testing.T, doc *gqlDocument)
+	}{
+		{
+			name: "shorthand query",
+			src:  "{ pieces { id } }",
+			check: func(t *testing.T, doc *gqlDocument) {
+				op := doc.operations[0]
+				if op.kind != "query" || op.name != "" || len(op.selections) != 1 || op.selections[0].name != "pieces" {
+					t.Errorf("operation = %+v", op)
+				}
+			},
+		},
+		{
+			name: "variables with types and defaults",
+			src:  "query Find($id: Int!, $n: Int = 5, $ids: [Int!]) { piece(id: $id) { id } }",
+			check: func(t *testing.T, doc *gqlDocument) {
+				op := doc.operations[0]
+				if op.name != "Find" || len(op.vars) != 3 {
+					t.Fatalf("operation = %+v", op)
+				}
+				if v := op.vars[0]; v.name != "id" || v.typ.String() != "Int!" || v.def != nil {
+					t.Errorf("$id = %+v", v)
+				}
+				if v := op.vars[1]; v.typ.String() != "Int" || v.def == nil || v.def.raw != "5" {
+					t.Errorf("$n = %+v", v)
+				}
+				if v := op.vars[2]; !v.typ.List || !v.typ.ItemNonNull || v.typ.NonNull {
+					t.Errorf("$ids = %+v", v.typ)
+				}
+				if arg := op.selections[0].args["id"]; arg.kind != '$' || arg.raw != "id" {
+					t.Errorf("argument id = %+v", arg)
+				}
+			},
+		},
+		{
+			name: "aliases, fragments and directives",
+			src: `query {
+				first: piece(id: 1) @include(if: true) { ...Fields ... on Piece { title } ... @skip(if: false) { id } }
+			}
+			fragment Fields on Piece { id }`,
+			check: func(t *testing.T, doc *gqlDocument) {
+				f := doc.operations[0].selections[0]
+				if f.alias != "first" || f.name != "piece" || f.key() != "first" {
+					t.Errorf("field = %+v", f)
+				}
+				if len(f.directives) != 1 || f.directives[0].name != "include" || f.directives[0].args["if"].kind != 'B' {
+					t.Errorf("directives = %+v", f.directives)
+				}
+				if len(f.selections) != 3 {
+					t.Fatalf("selections = %+v", f.selections)
+				}
+				if s := f.selections[0]; s.kind != 'S' || s.name != "Fields" {
+					t.Errorf("spread = %+v", s)
+				}
+				if s := f.selections[1]; s.kind != 'I' || s.typeCond != "Piece" {
+					t.Errorf("inline fragment = %+v", s)
+				}
+				if s := f.selections[2]; s.kind != 'I' || s.typeCond != "" || len(s.directives) != 1 {
+					t.Errorf("inline fragment without type = %+v", s)
+				}
+				if frag := doc.fragments["Fields"]; frag == nil || frag.typeCond != "Piece" {
+					t.Errorf("fragment = %+v", frag)
+				}
+			},
+		},
+		{
+			name: "values",
+			src:  `{ f(s: "a\"bé\n", b: """raw "text" \n""", i: -12, x: 1.5e3, t: false, n: null, e: OUT, l: [1 2], o: {k: "v"}) }`,
+			check: func(t *testing.T, doc *gqlDocument) {
+				args := doc.operations[0].selections[0].args
+				for name, want := range map[string]gqlValue{
+					"s": {kind: 'S', raw: "a\"bé\n"},
+					"b": {kind: 'S', raw: `raw "text" \n`},
+					"i": {kind: 'I', raw: "-12"},
+					"x": {kind: 'F', raw: "1.5e3"},
+					"t": {kind: 'B', raw: "false"},
+					"n": {kind: '0'},
+					"e": {kind: 'E', raw: "OUT"},
+				} {
+					if got := args[name]; got.kind != want.kind || got.raw != want.raw {
+						t.Errorf("%s = %+v, want %+v", name, got, want)
+					}
+				}
+				if l := args["l"]; l.kind != '[' || len(l.list) != 2 || l.list[1].raw != "2" {
+					t.Errorf("l = %+v", l)
+				}
+				if o := args["o"]; o.kind != '{' || o.fields["k"].raw != "v" {
+					t.Errorf("o = %+v", o)
+				}
+			},
+		},
+		{
+			name: "comments and commas are ignored",
+			src:  "# a comment\n{ a, b # another\n c }",
+			check: func(t *testing.T, doc *gqlDocument) {
+				if n := len(doc.operations[0].selections); n != 3 {
+					t.Errorf("%d selections, want 3", n)
+				}
+			},
+		},
+		{name: "duplicate fragment", src: "{ a } fragment F on Piece { id } fragment F on Tag { id }", wantErr: `only one fragment named "F"`},
+		{name: "only fragments", src: "fragment F on Piece { id }", wantErr: "no operation"},
+		{name: "variable in a default", src: "query ($a: Int = $b) { a }", wantErr: `unexpected "$"`},
+		{name: "unterminated string", src: `{ a(s: "abc) }`, wantErr: "unterminated string"},
+		{name: "invalid escape", src: `{ a(s: "\q") }`, wantErr: "invalid escape"},
+		{name: "unexpected character", src: "{ a; }", wantErr: `unexpected character ';'`},
+		{name: "unclosed selection", src: "{ a { b }", wantErr: "unexpected end of document"},
+		{name: "fragment without type condition", src: "{ a } fragment F { id }", wantErr: `unexpected "{"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseGQLDocument(tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, doc)
+		})
+	}
+}
+
+// nestedQuery returns a query whose innermost selection set is depth levels deep,
+// counting the operation's own selection set as the first.
+func nestedQuery(depth int) string {
+	q := "{ piece(id: 1) { tags { "
+	for level := 3; level < depth; level++ {
+		if level%2 == 1 {
+			q += "taxonomy { " // inside a Tag
+		} else {
+			q += "members { " // inside a Taxonomy
+		}
+	}
+	return q + "id" + strings.Repeat(" }", depth)
+}
+
+func TestGQLValidate(t *testing.T) {
+	s := testGraphQLSchema(t)
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{name: "fields, arguments and edges", query: `{ pieces(limit: 5) { id title contlets { id __typename } tags { value taxonomy { name } } } }`},
+		{name: "interface fields", query: `{ entity(id: 1) { id related(direction: BOTH) { id } } }`},
+		{name: "fragments on interfaces and types", query: `
+			query ($id: Int!) { contlet(id: $id) { ...C ... on ContletParagraph { text_content } } }
+			fragment C on Contlet { id class used_by { title } }`},
+		{name: "declared variable in a directive", query: `query ($s: Boolean!) { pieces { id @skip(if: $s) } }`},
+		{name: "depth at the limit", query: nestedQuery(gqlMaxDepth)},
+		{name: "too deep", query: nestedQuery(gqlMaxDepth + 1), wantErr: "nested more than 12 levels"},
+		{name: "unknown field", query: `{ pieces { body } }`, wantErr: `cannot query field "body" on type "Piece"`},
+		{name: "field of a concrete type on an interface", query: `{ contlet(id: 1) { text_content } }`, wantErr: `on type "Contlet"`},
+		{name: "unknown argument", query: `{ pieces(author: "x") { id } }`, wantErr: `unknown argument "author"`},
+		{name: "missing required argument", query: `{ piece { id } }`, wantErr: `requires argument "id"`},
+		{name: "selection on a leaf", query: `{ pieces { title { x } } }`, wantErr: "must not have a selection"},
+		{name: "object without selection", query: `{ pieces }`, wantErr: "must have a selection of subfields"},
+		{name: "selection on __typename", query: `{ pieces { __typename { x } } }`, wantErr: "__typename must not have a selection"},
+		{name: "undefined variable", query: `{ piece(id: $id) { id } }`, wantErr: "variable $id is not defined"},
+		{name: "undefined variable in a directive", query: `{ pieces @include(if: $x) { id } }`, wantErr: "variable $x is not defined"},
+		{name: "unknown fragment", query: `{ pieces { ...Missing } }`, wantErr: `unknown fragment "Missing"`},
+		{name: "fragment spreading itself", query: `{ tags { ...T } } fragment T on Tag { taxonomy { members { ...T } } }`, wantErr: `fragment "T" spreads itself`},
+		{name: "fragment on an unknown type", query: `{ pieces { ... on Article { id } } }`, wantErr: `unknown type "Article"`},
+		{name: "fragment on an enum", query: `{ pieces { ...D } } fragment D on LinkDirection { id }`, wantErr: `unknown type "LinkDirection"`},
+		{name: "mutation", query: `mutation { pieces { id } }`, wantErr: "mutation operations are not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseGQLDocument(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.validate(doc, doc.operations[0])
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGQLCoerce(t *testing.T) {
+	ex := &gqlExecutor{schema: testGraphQLSchema(t)}
+	tests := []struct {
+		typ     string
+		value   interface{}
+		want    interface{}
+		wantErr string
+	}{
+		{typ: "Int", value: int64(42), want: 42},
+		{typ: "Int", value: 7, want: 7},
+		{typ: "Int", value: json.Number("-3"), want: -3},
+		{typ: "Int", value: float64(5), want: 5},
+		{typ: "Int", value: 5.5, wantErr: "expected an Int"},
+		{typ: "Int", value: json.Number("1.5"), wantErr: "expected an Int"},
+		{typ: "Int", value: "5", wantErr: "expected an Int"},
+		{typ: "Int", value: int64(1) << 31, wantErr: "out of range"},
+		{typ: "Float", value: int64(2), want: 2.0},
+		{typ: "Float", value: json.Number("0.25"), want: 0.25},
+		{typ: "Float", value: true, wantErr: "expected a Float"},
+		{typ: "String", value: "abc", want: "abc"},
+		{typ: "String", value: int64(1), wantErr: "expected a String"},
+		{typ: "ID", value: "12", want: "12"},
+		{typ: "Boolean", value: false, want: false},
+		{typ: "Boolean", value: "true", wantErr: "expected a Boolean"},
+		{typ: "Int", value: nil, want: nil},
+		{typ: "Int!", value: nil, wantErr: "expected a non-null Int!"},
+		{typ: "LinkDirection", value: gqlEnum("IN"), want: "IN"},
+		{typ: "LinkDirection", value: "BOTH", want: "BOTH"}, // as sent in variables
+		{typ: "LinkDirection", value: gqlEnum("UP"), wantErr: "expected one of OUT, IN, BOTH"},
+		{typ: "[Int]", value: []interface{}{int64(1)}, wantErr: "list arguments are not supported"},
+		{typ: "Piece", value: map[string]interface{}{}, wantErr: "unsupported input type Piece"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %#v", tt.typ, tt.value), func(t *testing.T) {
+			got, err := ex.coerce(parseTypeRef(tt.typ), tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// itemSchema is a schema whose Query.items returns limit objects from memory.
+func itemSchema() *gqlSchema {
+	s := newGQLSchema()
+	s.add(&gqlTypeDef{Name: "Query", Kind: "type", Fields: []*gqlFieldDef{{
+		Name: "items",
+		Type: parseTypeRef("[Item!]!"),
+		Args: []gqlArg{{Name: "limit", Type: parseTypeRef("Int"), Default: 2}},
+		resolve: func(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+			var items []*gqlObject
+			for i := 1; i <= args["limit"].(int); i++ {
+				items = append(items, &gqlObject{Type: "Item", ID: i, Data: map[string]interface{}{"id": i, "name": fmt.Sprintf("item %d", i)}})
+			}
+			return []interface{}{items}, nil
+		},
+	}}})
+	s.add(&gqlTypeDef{Name: "Named", Kind: "interface", Fields: []*gqlFieldDef{{Name: "name", Type: parseTypeRef("String")}}})
+	s.add(&gqlTypeDef{Name: "Item", Kind: "type", Interfaces: []string{"Named"}, Fields: []*gqlFieldDef{
+		{Name: "id", Type: parseTypeRef("Int!")},
+		{Name: "name", Type: parseTypeRef("String")},
+	}})
+	return s
+}
+
+func TestGQLExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		vars      map[string]interface{}
+		want      string // the data as JSON
+		wantErr   string // a request error, before execution
+		execErr   string
+	}{
+		{name: "argument default", query: `{ items { id } }`, want: `{"items":[{"id":1},{"id":2}]}`},
+		{name: "literal argument", query: `{ items(limit: 1) { id name } }`, want: `{"items":[{"id":1,"name":"item 1"}]}`},
+		{name: "variable default", query: `query ($n: Int = 3) { items(limit: $n) { id } }`, want: `{"items":[{"id":1},{"id":2},{"id":3}]}`},
+		{name: "variable from JSON", query: `query ($n: Int) { items(limit: $n) { id } }`, vars: map[string]interface{}{"n": json.Number("1")}, want: `{"items":[{"id":1}]}`},
+		{name: "unset variable falls back to the argument default", query: `query ($n: Int) { items(limit: $n) { id } }`, want: `{"items":[{"id":1},{"id":2}]}`},
+		{name: "aliases keep query order", query: `{ b: items(limit: 1) { n: name } a: items(limit: 1) { id } }`, want: `{"b":[{"n":"item 1"}],"a":[{"id":1}]}`},
+		{
+			name:  "@skip and @include",
+			query: `query ($s: Boolean!) { items(limit: 1) { id @include(if: false) name @skip(if: $s) __typename @include(if: true) } }`,
+			vars:  map[string]interface{}{"s": true},
+			want:  `{"items":[{"__typename":"Item"}]}`,
+		},
+		{
+			name:  "@skip on a fragment",
+			query: `query ($s: Boolean = false) { items(limit: 1) { id ...N @skip(if: $s) } } fragment N on Item { name }`,
+			want:  `{"items":[{"id":1,"name":"item 1"}]}`,
+		},
+		{
+			name:  "fragments merge with fields in order",
+			query: `{ items(limit: 1) { ...F ... on Named { name } ... on Query { unused: __typename } id } } fragment F on Item { id __typename }`,
+			want:  `{"items":[{"id":1,"__typename":"Item","name":"item 1"}]}`,
+		},
+		{name: "named operation", query: `query A { a: items(limit: 1) { id } } query B { b: items(limit: 1) { id } }`, operation: "B", want: `{"b":[{"id":1}]}`},
+		{name: "several operations without a name", query: `query A { items { id } } query B { items { id } }`, wantErr: "operationName is required"},
+		{name: "unknown operation", query: `query A { items { id } }`, operation: "C", wantErr: `unknown operation "C"`},
+		{name: "missing non-null variable", query: `query ($n: Int!) { items(limit: $n) { id } }`, wantErr: "variable $n of type Int! was not provided"},
+		{name: "variable of the wrong type", query: `query ($n: Int) { items(limit: $n) { id } }`, vars: map[string]interface{}{"n": "two"}, wantErr: "variable $n: expected an Int"},
+		{name: "directive without a Boolean", query: `{ items { id @skip(if: 1) } }`, execErr: "@skip(if:): expected a Boolean"},
+		{name: "unknown directive", query: `{ items { id @defer } }`, execErr: "unknown directive @defer"},
+		{name: "argument out of range", query: `{ items(limit: 3000000000) { id } }`, execErr: "out of range"},
+	}
+	s := itemSchema()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, requestErr, execErr := s.execute(tt.query, tt.operation, tt.vars)
+			if tt.wantErr != "" {
+				if requestErr == nil || !strings.Contains(requestErr.Error(), tt.wantErr) {
+					t.Fatalf("request error = %v, want one containing %q", requestErr, tt.wantErr)
+				}
+				return
+			}
+			if requestErr != nil {
+				t.Fatalf("unexpected request error: %v", requestErr)
+			}
+			if tt.execErr != "" {
+				if execErr == nil || !strings.Contains(execErr.Error(), tt.execErr) {
+					t.Fatalf("execution error = %v, want one containing %q", execErr, tt.execErr)
+				}
+				return
+			}
+			if execErr != nil {
+				t.Fatalf("unexpected execution error: %v", execErr)
+			}
+			got, err := json.Marshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("data = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
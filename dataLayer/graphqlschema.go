@@ -0,0 +1,865 @@
+// In file: graphqlschema.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The GraphQL schema is derived from the class tables, like the OpenAPI document:
+// every class table becomes an object type whose fields are its columns, and the
+// structural tables become edges between them. Every edge is resolved for all
+// parents of a level with one query (one per class table for entities), so the
+// number of queries grows with the depth of a query, not with the size of its result.
+
+// graphQLPath serves the GraphQL endpoint; its schema is served as SDL below it.
+const graphQLPath = "/api/graphql"
+
+// graphQLMaxLimit caps the page size of the root list fields.
+const graphQLMaxLimit = 500
+
+// graphQLCache holds the schema built from the class tables until the next schema change.
+var graphQLCache struct {
+	sync.Mutex
+	schema *gqlSchema
+}
+
+// invalidateGraphQLSchema discards the cached GraphQL schema. Like
+// invalidateOpenAPI, it must be called after every change to the class tables or
+// the contlet class registry.
+func invalidateGraphQLSchema() {
+	graphQLCache.Lock()
+	graphQLCache.schema = nil
+	graphQLCache.Unlock()
+}
+
+// currentGraphQLSchema returns the cached schema, building it if needed.
+func currentGraphQLSchema() (*gqlSchema, error) {
+	graphQLCache.Lock()
+	defer graphQLCache.Unlock()
+	if graphQLCache.schema == nil {
+		tables, err := getSchemaDetails()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema: %w", err)
+		}
+		graphQLCache.schema = buildGraphQLSchema(tables)
+	}
+	return graphQLCache.schema, nil
+}
+
+// graphQLHandler serves /api/graphql. Queries are sent as POST with a JSON body
+// {"query", "operationName", "variables"}, or as GET with the same query parameters.
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			dec := json.NewDecoder(strings.NewReader(v))
+			dec.UseNumber()
+			if err := dec.Decode(&req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "Invalid variables: "+err.Error())
+				return
+			}
+		}
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET, POST")
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "A query is required")
+		return
+	}
+
+	schema, err := currentGraphQLSchema()
+	if err != nil {
+		writeGraphQLError(w, http.StatusInternalServerError, "Failed to build GraphQL schema: "+err.Error())
+		return
+	}
+	data, requestErr, execErr := schema.execute(req.Query, req.OperationName, req.Variables)
+	switch {
+	case requestErr != nil:
+		writeGraphQLError(w, http.StatusBadRequest, requestErr.Error())
+	case execErr != nil:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data":   nil,
+			"errors": []map[string]string{{"message": execErr.Error()}},
+		})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	}
+}
+
+// writeGraphQLError writes a response for a request that could not be executed.
+func writeGraphQLError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"errors": []map[string]string{{"message": msg}}})
+}
+
+// graphQLSchemaHandler serves the schema in SDL at /api/graphql/schema.graphql.
+func graphQLSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	schema, err := currentGraphQLSchema()
+	if err != nil {
+		http.Error(w, "Failed to build GraphQL schema: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(schema.SDL()))
+}
+
+// --- Classes ---
+
+// gqlClass maps a class table to its object type.
+type gqlClass struct {
+	Table    string
+	TypeName string
+	Contlet  string // the contlet class name; empty for pieces, tags and taxonomies
+	columns  []gqlColumn
+}
+
+// gqlColumn is a column of a class table exposed as a scalar field.
+type gqlColumn struct {
+	Column string
+	Field  string
+	Type   gqlTypeRef
+	ft     *FieldType // set for administrator-defined fields
+}
+
+// graphQLTypeName returns the object type of a class table.
+func graphQLTypeName(table string) string {
+	switch table {
+	case "content_piece":
+		return "Piece"
+	case "tag":
+		return "Tag"
+	case "taxonomy":
+		return "Taxonomy"
+	}
+	return schemaName(table)
+}
+
+// graphQLScalar returns the scalar type of a column: administrator-defined fields
+// by their semantic type, system columns by their SQL type.
+func graphQLScalar(col ColumnDetail, ft *FieldType) string {
+	if ft != nil {
+		switch ft.Name {
+		case "number":
+			return "Int"
+		case "decimal":
+			return "Float"
+		case "boolean":
+			return "Boolean"
+		}
+		return "String"
+	}
+	t := normalizeSQLType(col.Type)
+	switch {
+	case strings.Contains(t, "int"):
+		return "Int"
+	case strings.HasPrefix(t, "decimal"), strings.HasPrefix(t, "float"), strings.HasPrefix(t, "double"), strings.HasPrefix(t, "real"):
+		return "Float"
+	}
+	return "String"
+}
+
+// newGQLClass describes the columns of a class table. Columns whose name clashes
+// with an edge of the type, or is reserved by GraphQL, are exposed as field_<name>.
+func newGQLClass(table string, columns []ColumnDetail, reserved map[string]bool) *gqlClass {
+	c := &gqlClass{Table: table, TypeName: graphQLTypeName(table)}
+	custom := map[string]ClassField{}
+	for _, f := range classFieldsOf(table, columns) {
+		custom[f.Name] = f
+	}
+	for _, col := range columns {
+		gc := gqlColumn{Column: col.Field, Field: col.Field}
+		if f, ok := custom[col.Field]; ok {
+			ft := f.Type
+			gc.ft = &ft
+		} else if !isSystemColumn(table, col.Field) {
+			continue // an unknown SQL type; the forms skip it as well
+		}
+		if reserved[gc.Field] || strings.HasPrefix(gc.Field, "__") {
+			gc.Field = "field_" + strings.TrimLeft(gc.Field, "_")
+		}
+		gc.Type = gqlTypeRef{Name: graphQLScalar(col, gc.ft), NonNull: col.Null == "NO"}
+		c.columns = append(c.columns, gc)
+	}
+	return c
+}
+
+// object converts a row of the class table to an object value.
+func (c *gqlClass) object(id int, row map[string]sql.NullString) *gqlObject {
+	obj := &gqlObject{Type: c.TypeName, ID: id, Data: map[string]interface{}{}}
+	for _, col := range c.columns {
+		v, ok := row[col.Column]
+		if !ok || !v.Valid {
+			continue
+		}
+		s := v.String
+		var value interface{} = s
+		switch col.Type.Name {
+		case "Int":
+			if n, err := strconv.Atoi(s); err == nil {
+				value = n
+			}
+		case "Float":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				value = f
+			}
+		case "Boolean":
+			value = s != "0" && s != ""
+		default:
+			if col.ft != nil {
+				value = col.ft.Display(s)
+			}
+		}
+		obj.Data[col.Field] = value
+	}
+	if c.Contlet != "" {
+		obj.Data["class"] = c.Contlet
+	}
+	return obj
+}
+
+// fields returns the scalar fields of the class.
+func (c *gqlClass) fields() []*gqlFieldDef {
+	var fields []*gqlFieldDef
+	for _, col := range c.columns {
+		f := &gqlFieldDef{Name: col.Field, Type: col.Type}
+		if col.ft != nil {
+			f.Description = col.ft.Label
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// --- Schema ---
+
+// buildGraphQLSchema builds the schema for the given table columns and the
+// registered contlet classes.
+func buildGraphQLSchema(tables map[string][]ColumnDetail) *gqlSchema {
+	s := newGQLSchema()
+	classes := map[string]*gqlClass{}
+	l := &graphQLLoader{classes: classes}
+
+	edgeArgs := []gqlArg{
+		{Name: "link_type", Type: parseTypeRef("String")},
+		{Name: "min_confidence", Type: parseTypeRef("Float")},
+		{Name: "direction", Type: parseTypeRef("LinkDirection"), Default: "OUT"},
+	}
+	// entityFields are the edges every object has.
+	entityFields := func() []*gqlFieldDef {
+		return []*gqlFieldDef{
+			{Name: "tags", Type: parseTypeRef("[Tag!]!"), Description: "The tags attached to the object.", resolve: l.tags},
+			{Name: "links", Type: parseTypeRef("[Link!]!"), Args: edgeArgs,
+				Description: "Relationships of the object. min_confidence excludes links without a confidence.", resolve: l.links},
+			{Name: "related", Type: parseTypeRef("[Entity!]!"), Args: edgeArgs,
+				Description: "The objects at the other end of the matching links.", resolve: l.related},
+		}
+	}
+	idField := &gqlFieldDef{Name: "id", Type: parseTypeRef("Int!")}
+	classField := &gqlFieldDef{Name: "class", Type: parseTypeRef("String!")}
+	sortOrderField := &gqlFieldDef{Name: "sort_order", Type: parseTypeRef("Int"), Description: "The position in the piece, when loaded through Piece.contlets."}
+	usedByField := &gqlFieldDef{Name: "used_by", Type: parseTypeRef("[Piece!]!"), Description: "The pieces that contain the contlet.", resolve: l.usedBy}
+
+	reservedNames := func(fields ...*gqlFieldDef) map[string]bool {
+		reserved := map[string]bool{}
+		for _, f := range append(fields, entityFields()...) {
+			reserved[f.Name] = true
+		}
+		return reserved
+	}
+	// objectType builds the type of a class table from its columns and edges.
+	objectType := func(table, contlet string, description string, interfaces []string, edges ...*gqlFieldDef) *gqlTypeDef {
+		var reserved map[string]bool
+		if contlet != "" {
+			reserved = reservedNames(append(edges, classField, sortOrderField, usedByField)...)
+		} else {
+			reserved = reservedNames(edges...)
+		}
+		c := newGQLClass(table, tables[table], reserved)
+		c.Contlet = contlet
+		classes[table] = c
+		t := &gqlTypeDef{Name: c.TypeName, Kind: "type", Description: description, Interfaces: interfaces}
+		t.Fields = c.fields()
+		if contlet != "" {
+			t.Fields = append(t.Fields, classField, sortOrderField, usedByField)
+		}
+		t.Fields = append(t.Fields, edges...)
+		t.Fields = append(t.Fields, entityFields()...)
+		return t
+	}
+
+	query := &gqlTypeDef{Name: "Query", Kind: "type"}
+	s.add(query)
+	s.add(&gqlTypeDef{Name: "LinkDirection", Kind: "enum", Description: "OUT follows links from the object, IN links to it.", Values: []string{"OUT", "IN", "BOTH"}})
+	s.add(&gqlTypeDef{Name: "Entity", Kind: "interface", Description: "Any object with a global entity ID.",
+		Fields: append([]*gqlFieldDef{idField}, entityFields()...)})
+	s.add(&gqlTypeDef{Name: "Contlet", Kind: "interface", Interfaces: []string{"Entity"},
+		Fields: append([]*gqlFieldDef{idField, classField, sortOrderField, usedByField}, entityFields()...)})
+
+	s.add(objectType("content_piece", "", "A content piece.", []string{"Entity"},
+		&gqlFieldDef{Name: "contlets", Type: parseTypeRef("[Contlet!]!"), Description: "The contlets of the piece, in order.", resolve: l.contlets}))
+	var contletTypes []string
+	for _, cc := range getContletClasses() {
+		if _, ok := tables[cc.Table()]; !ok {
+			continue
+		}
+		t := objectType(cc.Table(), cc.Name, cc.Description, []string{"Contlet", "Entity"})
+		contletTypes = append(contletTypes, t.Name)
+		s.add(t)
+	}
+	s.add(objectType("tag", "", "A tag of a taxonomy.", []string{"Entity"},
+		&gqlFieldDef{Name: "taxonomy", Type: parseTypeRef("Taxonomy!"), resolve: l.taxonomy}))
+	s.add(objectType("taxonomy", "", "A taxonomy.", []string{"Entity"},
+		&gqlFieldDef{Name: "members", Type: parseTypeRef("[Tag!]!"), Description: "The tags of the taxonomy, by value.", resolve: l.members}))
+	s.add(&gqlTypeDef{Name: "Link", Kind: "type", Description: "A relationship between two objects.", Fields: []*gqlFieldDef{
+		idField,
+		{Name: "link_type", Type: parseTypeRef("String!")},
+		{Name: "source", Type: parseTypeRef("String")},
+		{Name: "confidence", Type: parseTypeRef("Float")},
+		{Name: "subject", Type: parseTypeRef("Entity"), resolve: l.endpoint("subject_id")},
+		{Name: "object", Type: parseTypeRef("Entity"), resolve: l.endpoint("object_id")},
+	}})
+
+	page := []gqlArg{
+		{Name: "limit", Type: parseTypeRef("Int"), Default: 50},
+		{Name: "offset", Type: parseTypeRef("Int"), Default: 0},
+	}
+	byID := []gqlArg{{Name: "id", Type: parseTypeRef("Int!")}}
+	query.Fields = []*gqlFieldDef{
+		{Name: "piece", Type: parseTypeRef("Piece"), Args: byID, resolve: l.byID("Piece")},
+		{Name: "pieces", Type: parseTypeRef("[Piece!]!"), Description: "Pieces, newest first.",
+			Args: append([]gqlArg{{Name: "class", Type: parseTypeRef("String")}, {Name: "status", Type: parseTypeRef("String")}}, page...),
+			resolve: l.list(func(args map[string]interface{}) (string, []interface{}) {
+				where, params := []string{"1 = 1"}, []interface{}{}
+				for _, col := range []string{"class", "status"} {
+					if v, ok := args[col]; ok {
+						where = append(where, col+" = ?")
+						params = append(params, v)
+					}
+				}
+				return "SELECT id FROM content_piece WHERE " + strings.Join(where, " AND ") + " ORDER BY id DESC", params
+			})},
+		{Name: "contlet", Type: parseTypeRef("Contlet"), Args: byID, resolve: l.byID(contletTypes...)},
+		{Name: "contlets", Type: parseTypeRef("[Contlet!]!"), Description: "Contlets of every registered class, newest first.",
+			Args: append([]gqlArg{{Name: "class", Type: parseTypeRef("String")}}, page...),
+			resolve: l.list(func(args map[string]interface{}) (string, []interface{}) {
+				var params []interface{}
+				for _, cc := range getContletClasses() {
+					if class, ok := args["class"]; !ok || class == cc.Name {
+						params = append(params, cc.Table())
+					}
+				}
+				if len(params) == 0 {
+					return "SELECT id FROM entity WHERE 1 = 0", nil
+				}
+				return "SELECT id FROM entity WHERE class IN (" + placeholders(len(params)) + ") ORDER BY id DESC", params
+			})},
+		{Name: "tag", Type: parseTypeRef("Tag"), Args: byID, resolve: l.byID("Tag")},
+		{Name: "tags", Type: parseTypeRef("[Tag!]!"), Description: "Tags by taxonomy and value.",
+			Args: append([]gqlArg{{Name: "taxonomy", Type: parseTypeRef("String")}}, page...),
+			resolve: l.list(func(args map[string]interface{}) (string, []interface{}) {
+				query := "SELECT t.id FROM tag t JOIN taxonomy tx ON tx.id = t.taxonomy_id"
+				var params []interface{}
+				if name, ok := args["taxonomy"]; ok {
+					query += " WHERE tx.name = ?"
+					params = append(params, name)
+				}
+				return query + " ORDER BY tx.name, t.value", params
+			})},
+		{Name: "taxonomy", Type: parseTypeRef("Taxonomy"), Args: byID, resolve: l.byID("Taxonomy")},
+		{Name: "taxonomies", Type: parseTypeRef("[Taxonomy!]!"), Args: page,
+			resolve: l.list(func(map[string]interface{}) (string, []interface{}) {
+				return "SELECT id FROM taxonomy ORDER BY name", nil
+			})},
+		{Name: "entity", Type: parseTypeRef("Entity"), Args: byID, resolve: l.byID()},
+		{Name: "links", Type: parseTypeRef("[Link!]!"), Description: "Relationships, optionally of one link type and a minimum confidence.",
+			Args:    append([]gqlArg{{Name: "link_type", Type: parseTypeRef("String")}, {Name: "min_confidence", Type: parseTypeRef("Float")}}, page...),
+			resolve: l.allLinks},
+	}
+	return s
+}
+
+// --- Batched loading ---
+
+// graphQLLoader resolves the fields of the schema. Each resolver receives all
+// parents of a level and loads their children with as few queries as possible;
+// objects are cached in the executor for the rest of the request.
+type graphQLLoader struct {
+	classes map[string]*gqlClass
+}
+
+// placeholders returns n comma-separated SQL placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// intArgs converts IDs to query arguments.
+func intArgs(ids []int) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// parentIDs returns the entity IDs of the parents.
+func parentIDs(parents []*gqlObject) []int {
+	ids := make([]int, len(parents))
+	for i, p := range parents {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// queryPairs runs a query returning (key, value) integer pairs and groups the values by key, in row order.
+func queryPairs(query string, args ...interface{}) (map[int][]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pairs := map[int][]int{}
+	for rows.Next() {
+		var key, value int
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		pairs[key] = append(pairs[key], value)
+	}
+	return pairs, rows.Err()
+}
+
+// load returns the objects with the given IDs: one query for their classes and
+// one per class table for the objects not loaded yet in this request. IDs of
+// unknown objects are absent from the result.
+func (l *graphQLLoader) load(ex *gqlExecutor, ids []int) (map[int]*gqlObject, error) {
+	var missing []int
+	for _, id := range ids {
+		if _, ok := ex.loaded[id]; !ok {
+			ex.loaded[id] = nil // also de-duplicates
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		rows, err := db.Query("SELECT id, class FROM entity WHERE id IN ("+placeholders(len(missing))+")", intArgs(missing)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load entities: %w", err)
+		}
+		byClass := map[string][]int{}
+		for rows.Next() {
+			var id int
+			var class sql.NullString
+			if err := rows.Scan(&id, &class); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if l.classes[class.String] != nil {
+				byClass[class.String] = append(byClass[class.String], id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		for table, classIDs := range byClass {
+			if err := l.loadClass(ex, l.classes[table], classIDs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	objects := make(map[int]*gqlObject, len(ids))
+	for _, id := range ids {
+		if obj := ex.loaded[id]; obj != nil {
+			objects[id] = obj
+		}
+	}
+	return objects, nil
+}
+
+// loadClass reads the rows of one class table into the executor's cache.
+func (l *graphQLLoader) loadClass(ex *gqlExecutor, c *gqlClass, ids []int) error {
+	rows, err := db.Query("SELECT * FROM `"+c.Table+"` WHERE id IN ("+placeholders(len(ids))+")", intArgs(ids)...)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", c.Table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		row := make(map[string]sql.NullString, len(columns))
+		for i, col := range columns {
+			row[col] = values[i]
+		}
+		id, _ := strconv.Atoi(row["id"].String)
+		ex.loaded[id] = c.object(id, row)
+	}
+	return rows.Err()
+}
+
+// loadLists loads the objects of grouped IDs and returns one list per parent, in
+// the order of the IDs. Unknown objects are left out.
+func (l *graphQLLoader) loadLists(ex *gqlExecutor, parents []*gqlObject, groups map[int][]int, typeName string) ([]interface{}, error) {
+	var all []int
+	for _, ids := range groups {
+		all = append(all, ids...)
+	}
+	objects, err := l.load(ex, all)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, p := range parents {
+		list := []*gqlObject{}
+		for _, id := range groups[p.ID] {
+			if obj := objects[id]; obj != nil && ex.schema.implements(obj.Type, typeName) {
+				list = append(list, obj)
+			}
+		}
+		values[i] = list
+	}
+	return values, nil
+}
+
+// byID resolves a root field that looks up one object, optionally restricted to some types.
+func (l *graphQLLoader) byID(types ...string) gqlResolver {
+	return func(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+		id := args["id"].(int)
+		objects, err := l.load(ex, []int{id})
+		if err != nil {
+			return nil, err
+		}
+		obj := objects[id]
+		if obj != nil && len(types) > 0 {
+			allowed := false
+			for _, t := range types {
+				allowed = allowed || obj.Type == t
+			}
+			if !allowed {
+				obj = nil
+			}
+		}
+		return []interface{}{obj}, nil
+	}
+}
+
+// list resolves a root list field from a query selecting object IDs, paginated by limit and offset.
+func (l *graphQLLoader) list(query func(args map[string]interface{}) (string, []interface{})) gqlResolver {
+	return func(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+		limit, offset := args["limit"].(int), args["offset"].(int)
+		if limit < 0 || limit > graphQLMaxLimit || offset < 0 {
+			return nil, fmt.Errorf("limit must be between 0 and %d and offset must not be negative", graphQLMaxLimit)
+		}
+		q, params := query(args)
+		rows, err := db.Query(q+" LIMIT ? OFFSET ?", append(params, limit, offset)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		defer rows.Close()
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		root := &gqlObject{}
+		return l.loadLists(ex, []*gqlObject{root}, map[int][]int{root.ID: ids}, "Entity")
+	}
+}
+
+// contlets resolves Piece.contlets. The same contlet may appear in several pieces,
+// so every slot gets its own copy carrying the sort order.
+func (l *graphQLLoader) contlets(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	ids := parentIDs(parents)
+	rows, err := db.Query(`
+		SELECT content_piece_id, contlet_id, sort_order FROM content_piece_contlets
+		WHERE content_piece_id IN (`+placeholders(len(ids))+`)
+		ORDER BY content_piece_id, sort_order`, intArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load piece contlets: %w", err)
+	}
+	type slot struct{ contletID, sortOrder int }
+	slots := map[int][]slot{}
+	var contletIDs []int
+	for rows.Next() {
+		var pieceID int
+		var s slot
+		if err := rows.Scan(&pieceID, &s.contletID, &s.sortOrder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		slots[pieceID] = append(slots[pieceID], s)
+		contletIDs = append(contletIDs, s.contletID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	objects, err := l.load(ex, contletIDs)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, p := range parents {
+		list := []*gqlObject{}
+		for _, s := range slots[p.ID] {
+			obj := objects[s.contletID]
+			if obj == nil || !ex.schema.implements(obj.Type, "Contlet") {
+				continue
+			}
+			data := make(map[string]interface{}, len(obj.Data)+1)
+			for k, v := range obj.Data {
+				data[k] = v
+			}
+			data["sort_order"] = s.sortOrder
+			list = append(list, &gqlObject{Type: obj.Type, ID: obj.ID, Data: data})
+		}
+		values[i] = list
+	}
+	return values, nil
+}
+
+// usedBy resolves Contlet.used_by.
+func (l *graphQLLoader) usedBy(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	ids := parentIDs(parents)
+	groups, err := queryPairs(`
+		SELECT DISTINCT contlet_id, content_piece_id FROM content_piece_contlets
+		WHERE contlet_id IN (`+placeholders(len(ids))+`) ORDER BY content_piece_id`, intArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load contlet usage: %w", err)
+	}
+	return l.loadLists(ex, parents, groups, "Piece")
+}
+
+// tags resolves Entity.tags.
+func (l *graphQLLoader) tags(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	ids := parentIDs(parents)
+	groups, err := queryPairs(`
+		SELECT et.entity_id, et.tag_id FROM entity_tags et JOIN tag t ON t.id = et.tag_id
+		WHERE et.entity_id IN (`+placeholders(len(ids))+`) ORDER BY t.value`, intArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	return l.loadLists(ex, parents, groups, "Tag")
+}
+
+// taxonomy resolves Tag.taxonomy.
+func (l *graphQLLoader) taxonomy(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	ids := make([]int, len(parents))
+	for i, p := range parents {
+		ids[i], _ = p.Data["taxonomy_id"].(int)
+	}
+	objects, err := l.load(ex, ids)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, id := range ids {
+		if obj := objects[id]; obj != nil {
+			values[i] = obj
+		}
+	}
+	return values, nil
+}
+
+// members resolves Taxonomy.members.
+func (l *graphQLLoader) members(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	ids := parentIDs(parents)
+	groups, err := queryPairs("SELECT taxonomy_id, id FROM tag WHERE taxonomy_id IN ("+placeholders(len(ids))+") ORDER BY value", intArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load taxonomy tags: %w", err)
+	}
+	return l.loadLists(ex, parents, groups, "Tag")
+}
+
+// linkRow is a row of entity_relationships with its object value.
+type linkRow struct {
+	id, subjectID, objectID int
+	obj                     *gqlObject
+}
+
+// queryLinkRows loads the links matching a condition, filtered by the link_type
+// and min_confidence arguments.
+func queryLinkRows(where string, params []interface{}, args map[string]interface{}) ([]linkRow, error) {
+	if t, ok := args["link_type"]; ok {
+		where += " AND link_type = ?"
+		params = append(params, t)
+	}
+	if c, ok := args["min_confidence"]; ok {
+		where += " AND confidence >= ?"
+		params = append(params, c)
+	}
+	query := "SELECT id, subject_id, link_type, object_id, source, confidence FROM entity_relationships WHERE " + where + " ORDER BY link_type, id"
+	if limit, ok := args["limit"]; ok {
+		query += " LIMIT ? OFFSET ?"
+		params = append(params, limit, args["offset"])
+	}
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load links: %w", err)
+	}
+	defer rows.Close()
+	var links []linkRow
+	for rows.Next() {
+		var l linkRow
+		var linkType string
+		var source sql.NullString
+		var confidence sql.NullFloat64
+		if err := rows.Scan(&l.id, &l.subjectID, &linkType, &l.objectID, &source, &confidence); err != nil {
+			return nil, err
+		}
+		data := map[string]interface{}{"id": l.id, "link_type": linkType, "subject_id": l.subjectID, "object_id": l.objectID}
+		if source.Valid {
+			data["source"] = source.String
+		}
+		if confidence.Valid {
+			data["confidence"] = confidence.Float64
+		}
+		l.obj = &gqlObject{Type: "Link", ID: l.id, Data: data}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// edges loads the links of all parents in the requested direction and calls add
+// for every parent a link belongs to, with the ID of the object at its other end.
+func (l *graphQLLoader) edges(parents []*gqlObject, args map[string]interface{}, add func(parentID int, link linkRow, otherID int)) error {
+	ids := parentIDs(parents)
+	in, params := "("+placeholders(len(ids))+")", intArgs(ids)
+	var where string
+	switch args["direction"] {
+	case "IN":
+		where = "object_id IN " + in
+	case "BOTH":
+		where = "(subject_id IN " + in + " OR object_id IN " + in + ")"
+		params = append(params, params...)
+	default:
+		where = "subject_id IN " + in
+	}
+	links, err := queryLinkRows(where, params, args)
+	if err != nil {
+		return err
+	}
+	wanted := map[int]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	direction := args["direction"]
+	for _, link := range links {
+		if direction != "IN" && wanted[link.subjectID] {
+			add(link.subjectID, link, link.objectID)
+		}
+		if direction != "OUT" && wanted[link.objectID] && (direction == "IN" || link.objectID != link.subjectID) {
+			add(link.objectID, link, link.subjectID)
+		}
+	}
+	return nil
+}
+
+// links resolves Entity.links.
+func (l *graphQLLoader) links(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	byParent := map[int][]*gqlObject{}
+	if err := l.edges(parents, args, func(parentID int, link linkRow, otherID int) {
+		byParent[parentID] = append(byParent[parentID], link.obj)
+	}); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, p := range parents {
+		values[i] = append([]*gqlObject{}, byParent[p.ID]...)
+	}
+	return values, nil
+}
+
+// related resolves Entity.related: the distinct objects at the other end of the matching links.
+func (l *graphQLLoader) related(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	groups := map[int][]int{}
+	seen := map[[2]int]bool{}
+	if err := l.edges(parents, args, func(parentID int, link linkRow, otherID int) {
+		if !seen[[2]int{parentID, otherID}] {
+			seen[[2]int{parentID, otherID}] = true
+			groups[parentID] = append(groups[parentID], otherID)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return l.loadLists(ex, parents, groups, "Entity")
+}
+
+// endpoint resolves Link.subject or Link.object.
+func (l *graphQLLoader) endpoint(column string) gqlResolver {
+	return func(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+		ids := make([]int, len(parents))
+		for i, p := range parents {
+			ids[i] = p.Data[column].(int)
+		}
+		objects, err := l.load(ex, ids)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(parents))
+		for i, id := range ids {
+			if obj := objects[id]; obj != nil {
+				values[i] = obj
+			}
+		}
+		return values, nil
+	}
+}
+
+// allLinks resolves Query.links.
+func (l *graphQLLoader) allLinks(ex *gqlExecutor, parents []*gqlObject, args map[string]interface{}) ([]interface{}, error) {
+	limit, offset := args["limit"].(int), args["offset"].(int)
+	if limit < 0 || limit > graphQLMaxLimit || offset < 0 {
+		return nil, fmt.Errorf("limit must be between 0 and %d and offset must not be negative", graphQLMaxLimit)
+	}
+	links, err := queryLinkRows("1 = 1", nil, args)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*gqlObject, len(links))
+	for i, link := range links {
+		list[i] = link.obj
+	}
+	return []interface{}{list}, nil
+}
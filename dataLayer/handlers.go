@@ -2,18 +2,24 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // renderTemplate is a helper function to parse and execute templates.
 func renderTemplate(w http.ResponseWriter, tmplName string, data interface{}) {
-	// We parse the layout and the specific template file together.
-	t, err := template.ParseFiles("templates/layout.html", "templates/"+tmplName)
+	// We parse the layout, the shared partials and the specific template file together.
+	t, err := parseTemplates(filepath.Join(cfg.TemplateDir, "layout.html"), filepath.Join(cfg.TemplateDir, tmplName))
 	if err != nil {
 		http.Error(w, "Error parsing template: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -25,6 +31,34 @@ func renderTemplate(w http.ResponseWriter, tmplName string, data interface{}) {
 	}
 }
 
+// parseTemplates parses the given files plus every file in templates/partials,
+// which holds fragments shared between pages (e.g. the entity tag editor).
+func parseTemplates(files ...string) (*template.Template, error) {
+	partials, err := filepath.Glob(filepath.Join(cfg.TemplateDir, "partials", "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	return template.ParseFiles(append(files, partials...)...)
+}
+
+// renderFragment executes a single named template from tmplFile without the layout.
+// It is used to answer Fixi requests, which swap a part of the page in place.
+func renderFragment(w http.ResponseWriter, tmplFile, name string, data interface{}) {
+	t, err := parseTemplates(filepath.Join(cfg.TemplateDir, tmplFile))
+	if err != nil {
+		http.Error(w, "Error parsing template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// isFixiRequest reports whether r was sent by fixi.js rather than a plain form post.
+func isFixiRequest(r *http.Request) bool {
+	return r.Header.Get("FX-Request") == "true"
+}
+
 // DashboardData holds all the data needed for the main dashboard template.
 type DashboardData struct {
 	Pieces   []ContentPiece
@@ -91,24 +125,95 @@ func tagsHandler(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "tags.html", tags)
 }
 
+// SchemaColumn is a column on the schema page together with how it may be edited.
+type SchemaColumn struct {
+	ColumnDetail
+	System    bool      // managed by the application; read-only
+	FieldType FieldType // the semantic type, if the column type is in the registry
+	Index     int       // position among the editable columns, used in form field names
+}
+
+// SchemaTable is a table on the schema page. Only class tables can be edited.
+type SchemaTable struct {
+	Name    string
+	IsClass bool
+	Columns []SchemaColumn
+}
+
+// SchemaPageData holds the data for the schema editor.
+type SchemaPageData struct {
+	Tables     []SchemaTable
+	FieldTypes []FieldType
+}
+
 // schemaHandler displays the database schema.
 func schemaHandler(w http.ResponseWriter, r *http.Request) {
-	schema, err := getSchemaDetails()
+	tables, err := loadSchemaTables()
 	if err != nil {
 		http.Error(w, "Failed to retrieve schema: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	renderTemplate(w, "schema.html", schema)
+	renderTemplate(w, "schema.html", SchemaPageData{Tables: tables, FieldTypes: fieldTypes})
 }
 
-// updateSchemaHandler handles the submission of the schema editor form.
-func updateSchemaHandler(w http.ResponseWriter, r *http.Request) {
+// loadSchemaTables describes every table, sorted by name, with how each column may be edited.
+func loadSchemaTables() ([]SchemaTable, error) {
+	schema, err := getSchemaDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []SchemaTable
+	for name, columns := range schema {
+		table := SchemaTable{Name: name, IsClass: isClassTable(name)}
+		editable := 0
+		for _, col := range columns {
+			sc := SchemaColumn{ColumnDetail: col, System: !table.IsClass || isSystemColumn(name, col.Field)}
+			if ft, ok := fieldTypeForColumn(col.Type); ok {
+				sc.FieldType = ft
+			} else {
+				sc.System = true // unknown SQL types cannot be expressed in the registry
+			}
+			if !sc.System {
+				sc.Index = editable
+				editable++
+			}
+			table.Columns = append(table.Columns, sc)
+		}
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables, nil
+}
+
+// schemaRouter dispatches the schema editor actions under /schema/:
+//
+//	POST /schema/{table}                 update the custom fields of a class table
+//	POST /schema/{table}/fields/add      add a field
+//	POST /schema/{table}/fields/remove   remove a field
+func schemaRouter(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/schema/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		updateSchemaHandler(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "fields" && parts[2] == "add":
+		addFieldHandler(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "fields" && parts[2] == "remove":
+		removeFieldHandler(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
 
-	tableName := strings.TrimPrefix(r.URL.Path, "/schema/")
+// updateSchemaHandler handles the submission of the schema editor form.
+// Only the administrator-defined fields of a class table are submitted; each
+// carries its semantic type, which the registry translates to an SQL type.
+func updateSchemaHandler(w http.ResponseWriter, r *http.Request, tableName string) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
@@ -121,12 +226,18 @@ func updateSchemaHandler(w http.ResponseWriter, r *http.Request) {
 			break // No more columns
 		}
 
+		ft, ok := fieldTypeByName(r.FormValue(fmt.Sprintf("col_%d_type", i)))
+		if !ok {
+			http.Error(w, "Invalid schema: unknown field type for "+r.FormValue(fieldKey), http.StatusBadRequest)
+			return
+		}
 		col := ColumnDetail{
-			Field: r.FormValue(fmt.Sprintf("col_%d_field", i)),
-			Type:  r.FormValue(fmt.Sprintf("col_%d_type", i)),
-			Null:  r.FormValue(fmt.Sprintf("col_%d_null", i)),
-			Key:   r.FormValue(fmt.Sprintf("col_%d_key", i)),
-			Extra: r.FormValue(fmt.Sprintf("col_%d_extra", i)),
+			Field: r.FormValue(fieldKey),
+			Type:  ft.SQLType,
+			Null:  "YES",
+		}
+		if r.FormValue(fmt.Sprintf("col_%d_required", i)) != "" {
+			col.Null = "NO"
 		}
 		defaultVal := r.FormValue(fmt.Sprintf("col_%d_default", i))
 		if defaultVal != "" {
@@ -135,8 +246,91 @@ func updateSchemaHandler(w http.ResponseWriter, r *http.Request) {
 		columns = append(columns, col)
 	}
 
-	if err := updateTableSchema(tableName, columns); err != nil {
-		http.Error(w, "Failed to update schema: "+err.Error(), http.StatusInternalServerError)
+	plan, err := planFieldUpdates(tableName, columns)
+	if err != nil {
+		writeConflictOr(w, "Failed to plan schema update: ", err)
+		return
+	}
+	previewOrApplySchemaPlan(w, r, plan)
+}
+
+// addFieldHandler adds an administrator-defined field to a class table.
+func addFieldHandler(w http.ResponseWriter, r *http.Request, tableName string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	required := r.FormValue("required") != ""
+	plan, err := planAddField(tableName, name, r.FormValue("type"), required, strings.TrimSpace(r.FormValue("default")))
+	if err != nil {
+		writeConflictOr(w, "Failed to add field: ", err)
+		return
+	}
+	previewOrApplySchemaPlan(w, r, plan)
+}
+
+// removeFieldHandler drops an administrator-defined field from a class table.
+func removeFieldHandler(w http.ResponseWriter, r *http.Request, tableName string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plan, err := planRemoveField(tableName, r.FormValue("name"))
+	if err != nil {
+		writeConflictOr(w, "Failed to remove field: ", err)
+		return
+	}
+	previewOrApplySchemaPlan(w, r, plan)
+}
+
+// FormValue is a single submitted form value, carried over as a hidden input.
+type FormValue struct {
+	Name  string
+	Value string
+}
+
+// SchemaPreviewData holds the data for the schema change preview page.
+type SchemaPreviewData struct {
+	Plan   SchemaPlan
+	Action string      // the URL the confirmation is posted back to
+	Form   []FormValue // the original submission, resent on confirmation
+	Stale  bool        // the schema changed between the preview and the confirmation
+}
+
+// previewOrApplySchemaPlan is the dry run step shared by all schema editor actions.
+// Without confirmation it shows the plan's DDL and affected-row estimates; the
+// confirmation posts the same form back together with the DDL that was shown,
+// and the plan is only applied if it still produces exactly that DDL.
+func previewOrApplySchemaPlan(w http.ResponseWriter, r *http.Request, plan SchemaPlan) {
+	if len(plan.Changes) == 0 {
+		http.Redirect(w, r, "/schema", http.StatusFound)
+		return
+	}
+
+	confirmed := r.FormValue("confirm") != ""
+	if !confirmed || r.FormValue("ddl") != plan.DDL() {
+		data := SchemaPreviewData{Plan: plan, Action: r.URL.Path, Stale: confirmed}
+		keys := make([]string, 0, len(r.PostForm))
+		for key := range r.PostForm {
+			if key != "confirm" && key != "ddl" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, v := range r.PostForm[key] {
+				data.Form = append(data.Form, FormValue{Name: key, Value: v})
+			}
+		}
+		renderTemplate(w, "schema_preview.html", data)
+		return
+	}
+
+	if err := applySchemaPlan(plan); err != nil {
+		writeConflictOr(w, "Failed to update schema: ", err)
 		return
 	}
 
@@ -156,7 +350,7 @@ func pieceDetailHandler(w http.ResponseWriter, r *http.Request, id int) {
 		return
 	}
 
-	renderTemplate(w, "piece_form.html", piece)
+	renderPieceForm(w, piece)
 }
 // piecesRouter is a custom router that handles all requests under /pieces/.
 func piecesRouter(w http.ResponseWriter, r *http.Request) {
@@ -169,6 +363,19 @@ func piecesRouter(w http.ResponseWriter, r *http.Request) {
 		newPieceHandler(w, r)
 	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
 		createPieceHandler(w, r)
+	case len(parts) == 1 && parts[0] == "import":
+		importMarkdownHandler(w, r)
+	case len(parts) == 1 && parts[0] == "export.zip" && r.Method == http.MethodGet:
+		exportPiecesHandler(w, r)
+	case len(parts) == 1 && strings.Contains(parts[0], ".") && r.Method == http.MethodGet:
+		// e.g., /pieces/123.md, /pieces/123.html
+		name, format, _ := strings.Cut(parts[0], ".")
+		id, err := strconv.Atoi(name)
+		if _, ok := exportFormats[format]; ok && err == nil {
+			exportPieceHandler(w, r, id, format)
+			return
+		}
+		http.NotFound(w, r)
 	case len(parts) == 2 && parts[1] == "edit" && r.Method == http.MethodGet:
 		// e.g., /pieces/123/edit
 		id, err := strconv.Atoi(parts[0])
@@ -179,7 +386,7 @@ func piecesRouter(w http.ResponseWriter, r *http.Request) {
 	case len(parts) == 1 && parts[0] == "update" && r.Method == http.MethodPost:
 		updatePieceHandler(w, r)
 	case len(parts) == 1 && parts[0] == "delete" && r.Method == http.MethodPost:
-		deletePieceHandler(w, r)
+		requireRole(rolePublisher, deletePieceHandler)(w, r)
 	case len(parts) == 1 && parts[0] != "":
 		// e.g., /pieces/123
 		id, err := strconv.Atoi(parts[0])
@@ -187,6 +394,62 @@ func piecesRouter(w http.ResponseWriter, r *http.Request) {
 			pieceDetailHandler(w, r, id)
 			return
 		}
+	case len(parts) >= 2 && parts[1] == "history":
+		// e.g., /pieces/123/history, /pieces/123/history/4/restore
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			historyRouter(w, r, "piece", id, parts[2:])
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "published" && r.Method == http.MethodGet:
+		// e.g., /pieces/123/published
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			publishedPieceHandler(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "status" && r.Method == http.MethodPost:
+		// e.g., /pieces/123/status
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			pieceStatusHandler(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "schedule" && r.Method == http.MethodPost:
+		// e.g., /pieces/123/schedule
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			pieceScheduleHandler(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 3 && parts[1] == "render" && r.Method == http.MethodGet:
+		// e.g., /pieces/123/render/thread
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			pieceRenderHandler(w, r, id, parts[2])
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "discard" && r.Method == http.MethodPost:
+		// e.g., /pieces/123/discard
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			discardDraftHandler(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 3 && parts[1] == "contlets" && r.Method == http.MethodPost:
+		// e.g., /pieces/123/contlets/move
+		id, err := strconv.Atoi(parts[0])
+		if err == nil {
+			pieceContletsHandler(w, r, id, parts[2])
+			return
+		}
+		http.NotFound(w, r)
 	default:
 		// Default case or more complex routes will be added here.
 		http.NotFound(w, r)
@@ -194,7 +457,12 @@ func piecesRouter(w http.ResponseWriter, r *http.Request) {
 }
 // newPieceHandler displays a form to create a new content piece object.
 func newPieceHandler(w http.ResponseWriter, r *http.Request) {
-	renderTemplate(w, "piece_form.html", nil)
+	fields, err := loadClassFieldsData("content_piece", 0)
+	if err != nil {
+		http.Error(w, "Failed to retrieve piece fields: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "piece_form.html", PieceFormData{Fields: fields})
 }
 
 // createPieceHandler handles the submission of the new piece form.
@@ -211,8 +479,13 @@ func createPieceHandler(w http.ResponseWriter, r *http.Request) {
 
 	title := r.FormValue("title")
 	class := r.FormValue("class")
+	extra := fieldValuesFromForm(r.Form)
+	if err := validateFieldValues("content_piece", extra); err != nil {
+		http.Error(w, "Invalid piece: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	id, err := createContentPiece(title, class)
+	id, err := createContentPiece(title, class, extra, requestAuthor(r))
 	if err != nil {
 		http.Error(w, "Failed to create piece: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -220,6 +493,126 @@ func createPieceHandler(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, fmt.Sprintf("/pieces/%d", id), http.StatusFound)
 }
+// MarkdownImportPageData holds the data for the Markdown import form.
+type MarkdownImportPageData struct {
+	Class string
+	Error string
+}
+
+// importMarkdownHandler shows the Markdown upload form (GET) and imports the
+// uploaded file as a new piece (POST), which it then opens.
+func importMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	data := MarkdownImportPageData{Class: defaultImportClass}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "piece_import.html", data)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMarkdownSize+1<<16)
+	if err := r.ParseMultipartForm(maxMarkdownSize); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Class = r.FormValue("class")
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Failed to read the uploaded file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	src, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read the uploaded file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := importMarkdown(header.Filename, string(src), data.Class, requestAuthor(r))
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		data.Error = invalid.Message
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "piece_import.html", data)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to import the file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/pieces/%d", id), http.StatusFound)
+}
+
+// exportPieceHandler serves the draft of a piece as Markdown or HTML.
+func exportPieceHandler(w http.ResponseWriter, r *http.Request, id int, format string) {
+	piece, err := getPieceByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve piece details: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	content, err := exportPiece(piece, format)
+	if err != nil {
+		http.Error(w, "Failed to export piece: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", exportFormats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", exportFileName(piece, format)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprint(w, content)
+}
+
+// exportPiecesHandler serves a zip archive of pieces: those given as ?id=, or
+// all of them, as Markdown, or in ?format=html or ?format=all.
+func exportPiecesHandler(w http.ResponseWriter, r *http.Request) {
+	formats := []string{"md"}
+	switch r.URL.Query().Get("format") {
+	case "", "md":
+	case "html":
+		formats = []string{"html"}
+	case "all":
+		formats = []string{"md", "html"}
+	default:
+		http.Error(w, "Invalid format; use md, html or all", http.StatusBadRequest)
+		return
+	}
+
+	var ids []int
+	for _, v := range r.URL.Query()["id"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid piece ID", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		pieces, err := getAllContentPieces()
+		if err != nil {
+			http.Error(w, "Failed to retrieve pieces: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, p := range pieces {
+			ids = append(ids, p.ID)
+		}
+	}
+
+	// The archive is built in memory so that a failure can still be reported.
+	var buf bytes.Buffer
+	if err := writePiecesZip(&buf, ids, formats); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to export pieces: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="pieces.zip"`)
+	w.Write(buf.Bytes())
+}
+
 // editPieceHandler displays a form to edit an existing content piece object.
 func editPieceHandler(w http.ResponseWriter, r *http.Request, id int) {
 	piece, err := getPieceByID(id)
@@ -231,7 +624,7 @@ func editPieceHandler(w http.ResponseWriter, r *http.Request, id int) {
 		}
 		return
 	}
-	renderTemplate(w, "piece_form.html", piece)
+	renderPieceForm(w, piece)
 }
 
 // updatePieceHandler handles the submission of the edit piece form.
@@ -253,8 +646,13 @@ func updatePieceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	title := r.FormValue("title")
 	class := r.FormValue("class")
+	extra := fieldValuesFromForm(r.Form)
+	if err := validateFieldValues("content_piece", extra); err != nil {
+		http.Error(w, "Invalid piece: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if err := updateContentPiece(id, title, class); err != nil {
+	if err := updateContentPiece(id, title, class, extra, StatusRequest{}, requestAuthor(r)); err != nil {
 		http.Error(w, "Failed to update piece: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -287,8 +685,1871 @@ func deletePieceHandler(w http.ResponseWriter, r *http.Request) {
 	// Redirect to the main pieces list after deletion.
 	http.Redirect(w, r, "/pieces", http.StatusFound)
 }
+
 // contletsRouter is a custom router for all /contlets/ paths.
 func contletsRouter(w http.ResponseWriter, r *http.Request) {
-	// Logic to be added
-	http.NotFound(w, r)
-}
\ No newline at end of file
+	path := strings.TrimPrefix(r.URL.Path, "/contlets/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "new" && r.Method == http.MethodGet:
+		newContletHandler(w, r)
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		createContletHandler(w, r)
+	case len(parts) == 2 && parts[0] == "edit" && r.Method == http.MethodGet:
+		// e.g., /contlets/edit/123
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		editContletHandler(w, r, id)
+	case len(parts) == 1 && parts[0] == "update" && r.Method == http.MethodPost:
+		updateContletHandler(w, r)
+	case len(parts) == 1 && parts[0] == "delete" && r.Method == http.MethodPost:
+		deleteContletHandler(w, r)
+	case len(parts) == 1 && parts[0] != "":
+		// e.g., /contlets/123
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		contletDetailHandler(w, r, id)
+	case len(parts) >= 2 && parts[1] == "history":
+		// e.g., /contlets/123/history
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		historyRouter(w, r, "contlet", id, parts[2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ContletFormData holds the data for the contlet create/edit form.
+type ContletFormData struct {
+	Contlet ContletDetail
+	Classes []string
+	Fields  ClassFieldsData
+}
+
+// ContletDetailData holds the data for the contlet detail page.
+type ContletDetailData struct {
+	Contlet     ContletDetail
+	UsedBy      []ContentPiece
+	EntityTags  EntityTagsData
+	EntityLinks EntityLinksData
+}
+
+// contletDetailHandler displays a single contlet and the pieces that use it.
+func contletDetailHandler(w http.ResponseWriter, r *http.Request, id int) {
+	contlet, err := getContletByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve contlet: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	usedBy, err := getPiecesUsingContlet(id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve pieces using contlet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	returnTo := fmt.Sprintf("/contlets/%d", id)
+	entityTags, err := loadEntityTagsData(id, returnTo)
+	if err != nil {
+		http.Error(w, "Failed to retrieve contlet tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entityLinks, err := loadEntityLinksData(id, returnTo)
+	if err != nil {
+		http.Error(w, "Failed to retrieve contlet links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, "contlet_detail.html", ContletDetailData{
+		Contlet:     contlet,
+		UsedBy:      usedBy,
+		EntityTags:  entityTags,
+		EntityLinks: entityLinks,
+	})
+}
+
+// newContletHandler displays a form to create a new contlet object.
+// The class is chosen with the ?class= query parameter.
+func newContletHandler(w http.ResponseWriter, r *http.Request) {
+	data := ContletFormData{Classes: contletClassNames()}
+	if class := r.URL.Query().Get("class"); isContletClass(class) {
+		data.Contlet.Class = class
+		data.Contlet.Level = 2 // matches the column default of contlet_heading.level
+
+		var err error
+		if data.Fields, err = loadClassFieldsData("contlet_"+class, 0); err != nil {
+			http.Error(w, "Failed to retrieve contlet fields: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderTemplate(w, "contlet_form.html", data)
+}
+
+// contletFromForm builds a ContletDetail from a submitted contlet form.
+func contletFromForm(r *http.Request) (ContletDetail, error) {
+	c := ContletDetail{
+		Class:       r.FormValue("class"),
+		TextContent: strings.TrimSpace(r.FormValue("text_content")),
+		Src:         strings.TrimSpace(r.FormValue("src")),
+		AltText:     r.FormValue("alt_text"),
+	}
+	atoiOptional := func(name string) (int, error) {
+		v := strings.TrimSpace(r.FormValue(name))
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a non-negative whole number", name)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch c.Class {
+	case "heading":
+		if c.Level, err = atoiOptional("level"); err != nil {
+			return c, err
+		}
+	case "image":
+		if c.Width, err = atoiOptional("width"); err != nil {
+			return c, err
+		}
+		if c.Height, err = atoiOptional("height"); err != nil {
+			return c, err
+		}
+	}
+
+	c.Extra = fieldValuesFromForm(r.Form)
+	return c, validateContlet(c)
+}
+
+// createContletHandler handles the submission of the new contlet form.
+func createContletHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contlet, err := contletFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid contlet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := createContlet(contlet, requestAuthor(r))
+	if err != nil {
+		http.Error(w, "Failed to create contlet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/contlets/%d", id), http.StatusFound)
+}
+
+// editContletHandler displays a form to edit an existing contlet object.
+func editContletHandler(w http.ResponseWriter, r *http.Request, id int) {
+	contlet, err := getContletByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve contlet for editing: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	fields, err := loadClassFieldsData("contlet_"+contlet.Class, id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve contlet fields: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "contlet_form.html", ContletFormData{Contlet: contlet, Classes: contletClassNames(), Fields: fields})
+}
+
+// updateContletHandler handles the submission of the edit contlet form.
+func updateContletHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid contlet ID for update", http.StatusBadRequest)
+		return
+	}
+
+	// The class is taken from the stored contlet, not the form, since it cannot change.
+	existing, err := getContletByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve contlet for update: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	r.Form.Set("class", existing.Class)
+
+	contlet, err := contletFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid contlet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	contlet.ID = id
+
+	if err := updateContlet(contlet, requestAuthor(r)); err != nil {
+		http.Error(w, "Failed to update contlet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/contlets/%d", id), http.StatusFound)
+}
+
+// deleteContletHandler handles the deletion of a contlet object.
+func deleteContletHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for delete: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid contlet ID for delete", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteContlet(id); err != nil {
+		var inUse *ContletInUseError
+		if errors.As(err, &inUse) {
+			http.Error(w, "Cannot delete contlet: "+err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to delete contlet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/contlets", http.StatusFound)
+}
+
+// PieceFormData holds the data for the piece form and its contlet editor.
+type PieceFormData struct {
+	PieceDetail
+	AllContlets []Contlet
+	Classes     []string
+	EntityTags  EntityTagsData
+	EntityLinks EntityLinksData
+	Fields      ClassFieldsData
+	Publication PublicationState
+	Workflow    PieceWorkflowData
+	Schedule    PieceSchedule
+	Channels    []Channel
+	Error       string
+}
+
+// PieceWorkflowData holds the workflow status of a piece, the transitions out of
+// it and the log of earlier status changes.
+type PieceWorkflowData struct {
+	Status      string
+	Transitions []WorkflowTransition
+	Changes     []StatusChange
+}
+
+// loadPieceFormData gathers everything the piece editor needs.
+func loadPieceFormData(piece PieceDetail) (PieceFormData, error) {
+	contlets, err := getAllContlets()
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	returnTo := fmt.Sprintf("/pieces/%d", piece.ID)
+	entityTags, err := loadEntityTagsData(piece.ID, returnTo)
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	entityLinks, err := loadEntityLinksData(piece.ID, returnTo)
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	fields, err := loadClassFieldsData("content_piece", piece.ID)
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	publication, err := getPublicationState(piece.ID)
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	workflow := PieceWorkflowData{Status: publication.Status}
+	if workflow.Transitions, err = getTransitionsFrom(workflow.Status); err != nil {
+		return PieceFormData{}, err
+	}
+	if workflow.Changes, err = getStatusChanges(piece.ID); err != nil {
+		return PieceFormData{}, err
+	}
+	schedule, err := getPieceSchedule(piece.ID)
+	if err != nil {
+		return PieceFormData{}, err
+	}
+	return PieceFormData{
+		PieceDetail: piece,
+		AllContlets: contlets,
+		Classes:     contletClassNames(),
+		EntityTags:  entityTags,
+		EntityLinks: entityLinks,
+		Fields:      fields,
+		Publication: publication,
+		Workflow:    workflow,
+		Schedule:    schedule,
+		Channels:    channels,
+	}, nil
+}
+
+// renderPieceForm renders the full piece form page, including the contlet editor.
+func renderPieceForm(w http.ResponseWriter, piece PieceDetail) {
+	data, err := loadPieceFormData(piece)
+	if err != nil {
+		http.Error(w, "Failed to retrieve piece form data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "piece_form.html", data)
+}
+
+// pieceRenderHandler previews the draft of a piece as rendered for a channel,
+// served with the content type of the channel. A rendering that breaks the
+// limits of the channel is served as text with 422, the problems listed first.
+func pieceRenderHandler(w http.ResponseWriter, r *http.Request, id int, channel string) {
+	if _, ok := findChannel(channel); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	piece, err := getPieceByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve piece details: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	rendering, err := renderPiece(piece, channel)
+	if err != nil {
+		http.Error(w, "Failed to render piece: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if len(rendering.Violations) > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "This rendering breaks the limits of the %s channel:\n", rendering.Channel.Label)
+		for _, v := range rendering.Violations {
+			fmt.Fprintf(w, "- %s\n", v)
+		}
+		fmt.Fprint(w, "\n")
+	} else {
+		w.Header().Set("Content-Type", rendering.Channel.ContentType)
+	}
+	fmt.Fprint(w, rendering.Body())
+}
+
+// pieceContletsHandler handles the contlet editor actions of a piece:
+// attach, add, move, up, down and remove. Fixi requests get the re-rendered
+// editor fragment back; plain form posts are redirected to the piece page.
+func pieceContletsHandler(w http.ResponseWriter, r *http.Request, pieceID int, action string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// position is 0-based; an empty value means "at the end".
+	position := -1
+	if v := r.FormValue("position"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid position", http.StatusBadRequest)
+			return
+		}
+		position = p
+	}
+	sortOrder, sortOrderErr := strconv.Atoi(r.FormValue("sort_order"))
+
+	var err error
+	switch action {
+	case "attach":
+		contletID, convErr := strconv.Atoi(r.FormValue("contlet_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid contlet ID", http.StatusBadRequest)
+			return
+		}
+		err = attachContletToPiece(pieceID, contletID, position, requestAuthor(r))
+	case "add":
+		contlet, formErr := contletFromForm(r)
+		if formErr != nil {
+			err = fmt.Errorf("invalid contlet: %w", formErr)
+			break
+		}
+		_, err = addNewContletToPiece(pieceID, contlet, position, requestAuthor(r))
+	case "move", "up", "down", "remove":
+		if sortOrderErr != nil {
+			http.Error(w, "Invalid sort order", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "move":
+			if position < 0 {
+				http.Error(w, "A position is required to move a contlet", http.StatusBadRequest)
+				return
+			}
+			err = moveContletInPiece(pieceID, sortOrder, position, requestAuthor(r))
+		case "up":
+			err = shiftContletInPiece(pieceID, sortOrder, -1, requestAuthor(r))
+		case "down":
+			err = shiftContletInPiece(pieceID, sortOrder, +1, requestAuthor(r))
+		case "remove":
+			err = detachContletFromPiece(pieceID, sortOrder, requestAuthor(r))
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if !isFixiRequest(r) {
+		if err != nil {
+			http.Error(w, "Failed to update piece contlets: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/pieces/%d", pieceID), http.StatusFound)
+		return
+	}
+
+	piece, loadErr := getPieceByID(pieceID)
+	if loadErr != nil {
+		http.Error(w, "Failed to retrieve piece: "+loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, loadErr := loadPieceFormData(piece)
+	if loadErr != nil {
+		http.Error(w, "Failed to retrieve piece form data: "+loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	renderFragment(w, "piece_form.html", "piece_contlets", data)
+}
+
+// pieceStatusHandler makes a workflow transition of a piece and redirects back to it.
+func pieceStatusHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := StatusRequest{To: r.FormValue("to"), Comment: r.FormValue("comment")}
+	if err := changePieceStatus(id, req, requestAuthor(r)); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		writeConflictOr(w, "Failed to change status: ", err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/pieces/%d", id), http.StatusFound)
+}
+
+// pieceScheduleHandler sets or clears the schedule of a piece and redirects back
+// to it. The times come from datetime-local inputs and are taken as UTC.
+func pieceScheduleHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var times [2]*time.Time
+	if r.FormValue("action") != "clear" {
+		for i, name := range []string{"publish_at", "unpublish_at"} {
+			t, err := parseScheduleInput(r.FormValue(name))
+			if err != nil {
+				http.Error(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			times[i] = t
+		}
+	}
+	if err := setPieceSchedule(id, times[0], times[1], requestAuthor(r)); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		writeConflictOr(w, "Failed to schedule piece: ", err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/pieces/%d", id), http.StatusFound)
+}
+
+// parseScheduleInput parses the value of a datetime-local input as a UTC time;
+// an empty value is no time.
+func parseScheduleInput(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a date and time like 2026-11-01T09:00", v)
+}
+
+// discardDraftHandler resets the draft of a piece to its published version.
+func discardDraftHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if err := discardDraft(id, requestAuthor(r)); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		writeConflictOr(w, "Failed to discard draft: ", err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/pieces/%d", id), http.StatusFound)
+}
+
+// publishedPieceHandler shows the published version of a piece.
+func publishedPieceHandler(w http.ResponseWriter, r *http.Request, id int) {
+	pub, err := getPublishedPiece(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve published piece: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	renderTemplate(w, "piece_detail.html", pub)
+}
+
+// writeConflictOr writes a 409 for a *ConflictError, a 403 for a *ForbiddenError,
+// a 400 for a *ValidationError and a 500 for anything else.
+func writeConflictOr(w http.ResponseWriter, prefix string, err error) {
+	var conflict *ConflictError
+	var forbidden *ForbiddenError
+	var invalid *ValidationError
+	switch {
+	case errors.As(err, &conflict):
+		http.Error(w, prefix+conflict.Error(), http.StatusConflict)
+	case errors.As(err, &forbidden):
+		http.Error(w, prefix+forbidden.Error(), http.StatusForbidden)
+	case errors.As(err, &invalid):
+		http.Error(w, prefix+invalid.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, prefix+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// EntityTagsData holds the data for the entity tag editor partial.
+type EntityTagsData struct {
+	EntityID int
+	Tags     []Tag
+	AllTags  []Tag
+	ReturnTo string // page to redirect to after a plain (non-Fixi) form post
+}
+
+// loadEntityTagsData gathers the tags of an entity and the tags that can be attached.
+func loadEntityTagsData(entityID int, returnTo string) (EntityTagsData, error) {
+	tags, err := getTagsForEntity(entityID)
+	if err != nil {
+		return EntityTagsData{}, err
+	}
+	allTags, err := getAllTags()
+	if err != nil {
+		return EntityTagsData{}, err
+	}
+	return EntityTagsData{EntityID: entityID, Tags: tags, AllTags: allTags, ReturnTo: returnTo}, nil
+}
+
+// tagsRouter is a custom router for all /tags/ paths.
+func tagsRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tags/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "new" && r.Method == http.MethodGet:
+		newTagHandler(w, r)
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		createTagHandler(w, r)
+	case len(parts) == 2 && parts[0] == "edit" && r.Method == http.MethodGet:
+		// e.g., /tags/edit/123
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		editTagHandler(w, r, id)
+	case len(parts) == 1 && parts[0] == "update" && r.Method == http.MethodPost:
+		updateTagHandler(w, r)
+	case len(parts) == 1 && parts[0] == "delete" && r.Method == http.MethodPost:
+		deleteTagHandler(w, r)
+	case len(parts) == 1 && (parts[0] == "attach" || parts[0] == "detach") && r.Method == http.MethodPost:
+		entityTagHandler(w, r, parts[0])
+	case len(parts) == 1 && parts[0] != "":
+		// e.g., /tags/123
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		tagDetailHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TagDetailData holds the data for the tag detail page.
+type TagDetailData struct {
+	Tag         Tag
+	Pieces      []ContentPiece
+	Contlets    []Contlet
+	Others      []int // tagged entities that are neither pieces nor contlets
+	EntityLinks EntityLinksData
+}
+
+// tagDetailHandler displays a tag and the objects tagged with it.
+func tagDetailHandler(w http.ResponseWriter, r *http.Request, id int) {
+	tag, err := getTagByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve tag: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	entityIDs, err := getEntitiesWithTag(id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tagged objects: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pieces, err := getAllContentPieces()
+	if err != nil {
+		http.Error(w, "Failed to retrieve content pieces: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contlets, err := getAllContlets()
+	if err != nil {
+		http.Error(w, "Failed to retrieve contlets: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tagged := make(map[int]bool)
+	for _, eid := range entityIDs {
+		tagged[eid] = true
+	}
+	entityLinks, err := loadEntityLinksData(id, fmt.Sprintf("/tags/%d", id))
+	if err != nil {
+		http.Error(w, "Failed to retrieve tag links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := TagDetailData{Tag: tag, EntityLinks: entityLinks}
+	for _, p := range pieces {
+		if tagged[p.ID] {
+			data.Pieces = append(data.Pieces, p)
+			delete(tagged, p.ID)
+		}
+	}
+	for _, c := range contlets {
+		if tagged[c.ID] {
+			data.Contlets = append(data.Contlets, c)
+			delete(tagged, c.ID)
+		}
+	}
+	for _, eid := range entityIDs {
+		if tagged[eid] {
+			data.Others = append(data.Others, eid)
+		}
+	}
+
+	renderTemplate(w, "tag_detail.html", data)
+}
+
+// TagFormData holds the data for the tag create/edit form.
+type TagFormData struct {
+	Tag        Tag
+	Taxonomies []Taxonomy
+	Fields     ClassFieldsData
+}
+
+// renderTagForm renders the tag form with the list of taxonomies to choose from.
+func renderTagForm(w http.ResponseWriter, tag Tag) {
+	taxonomies, err := getAllTaxonomies()
+	if err != nil {
+		http.Error(w, "Failed to retrieve taxonomies: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fields, err := loadClassFieldsData("tag", tag.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tag fields: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "tag_form.html", TagFormData{Tag: tag, Taxonomies: taxonomies, Fields: fields})
+}
+
+// newTagHandler displays a form to create a new tag object.
+// An optional ?taxonomy_id= preselects the taxonomy.
+func newTagHandler(w http.ResponseWriter, r *http.Request) {
+	taxonomyID, _ := strconv.Atoi(r.URL.Query().Get("taxonomy_id"))
+	renderTagForm(w, Tag{TaxonomyID: taxonomyID})
+}
+
+// tagFromForm reads and validates the tag form fields, including administrator-defined ones.
+func tagFromForm(r *http.Request) (int, string, map[string]string, error) {
+	taxonomyID, err := strconv.Atoi(r.FormValue("taxonomy_id"))
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("a taxonomy must be selected")
+	}
+	value := strings.TrimSpace(r.FormValue("value"))
+	if value == "" {
+		return 0, "", nil, fmt.Errorf("a tag value is required")
+	}
+	extra := fieldValuesFromForm(r.Form)
+	if err := validateFieldValues("tag", extra); err != nil {
+		return 0, "", nil, err
+	}
+	return taxonomyID, value, extra, nil
+}
+
+// createTagHandler handles the submission of the new tag form.
+func createTagHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taxonomyID, value, extra, err := tagFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid tag: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := createTag(taxonomyID, value, extra)
+	if err != nil {
+		writeConflictOr(w, "Failed to create tag: ", err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/tags/%d", id), http.StatusFound)
+}
+
+// editTagHandler displays a form to edit an existing tag object.
+func editTagHandler(w http.ResponseWriter, r *http.Request, id int) {
+	tag, err := getTagByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve tag for editing: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	renderTagForm(w, tag)
+}
+
+// updateTagHandler handles the submission of the edit tag form.
+func updateTagHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID for update", http.StatusBadRequest)
+		return
+	}
+	taxonomyID, value, extra, err := tagFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid tag: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := updateTag(id, taxonomyID, value, extra); err != nil {
+		writeConflictOr(w, "Failed to update tag: ", err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/tags/%d", id), http.StatusFound)
+}
+
+// deleteTagHandler handles the deletion of a tag object.
+func deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for delete: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID for delete", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteTag(id); err != nil {
+		http.Error(w, "Failed to delete tag: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/tags", http.StatusFound)
+}
+
+// entityTagHandler attaches a tag to, or detaches it from, any entity.
+// Fixi requests get the re-rendered tag editor back; plain posts are redirected.
+func entityTagHandler(w http.ResponseWriter, r *http.Request, action string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entityID, err := strconv.Atoi(r.FormValue("entity_id"))
+	if err != nil {
+		http.Error(w, "Invalid entity ID", http.StatusBadRequest)
+		return
+	}
+	tagID, err := strconv.Atoi(r.FormValue("tag_id"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	if action == "attach" {
+		err = attachTag(entityID, tagID, requestAuthor(r))
+	} else {
+		err = detachTag(entityID, tagID, requestAuthor(r))
+	}
+	if err != nil {
+		writeConflictOr(w, "Failed to update tags: ", err)
+		return
+	}
+
+	returnTo := safeRedirect(r, r.FormValue("return_to"), "/tags")
+	if !isFixiRequest(r) {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
+
+	data, err := loadEntityTagsData(entityID, returnTo)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderFragment(w, "partials/entity_tags.html", "entity_tags", data)
+}
+
+// taxonomiesHandler displays a list of all taxonomies.
+func taxonomiesHandler(w http.ResponseWriter, r *http.Request) {
+	taxonomies, err := getAllTaxonomies()
+	if err != nil {
+		http.Error(w, "Failed to retrieve taxonomies: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "taxonomies.html", taxonomies)
+}
+
+// taxonomiesRouter is a custom router for all /taxonomies/ paths.
+func taxonomiesRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/taxonomies/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "new" && r.Method == http.MethodGet:
+		renderTaxonomyForm(w, Taxonomy{})
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		createTaxonomyHandler(w, r)
+	case len(parts) == 2 && parts[0] == "edit" && r.Method == http.MethodGet:
+		// e.g., /taxonomies/edit/123
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		editTaxonomyHandler(w, r, id)
+	case len(parts) == 1 && parts[0] == "update" && r.Method == http.MethodPost:
+		updateTaxonomyHandler(w, r)
+	case len(parts) == 1 && parts[0] == "delete" && r.Method == http.MethodPost:
+		deleteTaxonomyHandler(w, r)
+	case len(parts) == 1 && parts[0] != "":
+		// e.g., /taxonomies/123
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		taxonomyDetailHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TaxonomyDetailData holds the data for the taxonomy detail page.
+type TaxonomyDetailData struct {
+	Taxonomy    Taxonomy
+	Tags        []Tag
+	EntityLinks EntityLinksData
+}
+
+// taxonomyDetailHandler displays a taxonomy and its tags.
+func taxonomyDetailHandler(w http.ResponseWriter, r *http.Request, id int) {
+	taxonomy, err := getTaxonomyByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve taxonomy: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	tags, err := getTagsByTaxonomy(id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entityLinks, err := loadEntityLinksData(id, fmt.Sprintf("/taxonomies/%d", id))
+	if err != nil {
+		http.Error(w, "Failed to retrieve taxonomy links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "taxonomy_detail.html", TaxonomyDetailData{Taxonomy: taxonomy, Tags: tags, EntityLinks: entityLinks})
+}
+
+// createTaxonomyHandler handles the submission of the new taxonomy form.
+func createTaxonomyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Invalid taxonomy: a name is required", http.StatusBadRequest)
+		return
+	}
+	extra := fieldValuesFromForm(r.Form)
+	if err := validateFieldValues("taxonomy", extra); err != nil {
+		http.Error(w, "Invalid taxonomy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := createTaxonomy(name, r.FormValue("description"), extra)
+	if err != nil {
+		writeConflictOr(w, "Failed to create taxonomy: ", err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/taxonomies/%d", id), http.StatusFound)
+}
+
+// editTaxonomyHandler displays a form to edit an existing taxonomy object.
+func editTaxonomyHandler(w http.ResponseWriter, r *http.Request, id int) {
+	taxonomy, err := getTaxonomyByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve taxonomy for editing: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	renderTaxonomyForm(w, taxonomy)
+}
+
+// TaxonomyFormData holds the data for the taxonomy create/edit form.
+type TaxonomyFormData struct {
+	Taxonomy
+	Fields ClassFieldsData
+}
+
+// renderTaxonomyForm renders the taxonomy form with its administrator-defined fields.
+func renderTaxonomyForm(w http.ResponseWriter, taxonomy Taxonomy) {
+	fields, err := loadClassFieldsData("taxonomy", taxonomy.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve taxonomy fields: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "taxonomy_form.html", TaxonomyFormData{Taxonomy: taxonomy, Fields: fields})
+}
+
+// updateTaxonomyHandler handles the submission of the edit taxonomy form.
+func updateTaxonomyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid taxonomy ID for update", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Invalid taxonomy: a name is required", http.StatusBadRequest)
+		return
+	}
+	extra := fieldValuesFromForm(r.Form)
+	if err := validateFieldValues("taxonomy", extra); err != nil {
+		http.Error(w, "Invalid taxonomy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := updateTaxonomy(id, name, r.FormValue("description"), extra); err != nil {
+		writeConflictOr(w, "Failed to update taxonomy: ", err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/taxonomies/%d", id), http.StatusFound)
+}
+
+// deleteTaxonomyHandler handles the deletion of a taxonomy object.
+func deleteTaxonomyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for delete: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid taxonomy ID for delete", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteTaxonomy(id); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		writeConflictOr(w, "Cannot delete taxonomy: ", err)
+		return
+	}
+
+	http.Redirect(w, r, "/taxonomies", http.StatusFound)
+}
+
+// EntityLinksData holds the data for the entity links partial.
+type EntityLinksData struct {
+	EntityID    int
+	Outbound    []Link
+	Inbound     []Link
+	LinkClasses []LinkClass
+	ReturnTo    string // page to redirect to after a plain (non-Fixi) form post
+	Error       string
+}
+
+// loadEntityLinksData gathers the inbound and outbound links of an entity.
+func loadEntityLinksData(entityID int, returnTo string) (EntityLinksData, error) {
+	outbound, err := getOutboundLinks(entityID)
+	if err != nil {
+		return EntityLinksData{}, err
+	}
+	inbound, err := getInboundLinks(entityID)
+	if err != nil {
+		return EntityLinksData{}, err
+	}
+	classes, err := getAllLinkClasses()
+	if err != nil {
+		return EntityLinksData{}, err
+	}
+	return EntityLinksData{EntityID: entityID, Outbound: outbound, Inbound: inbound, LinkClasses: classes, ReturnTo: returnTo}, nil
+}
+
+// LinksPageData holds the data for the knowledge graph overview page.
+type LinksPageData struct {
+	Links       []Link
+	LinkClasses []LinkClass
+}
+
+// linksHandler displays every link and link class in the knowledge graph.
+func linksHandler(w http.ResponseWriter, r *http.Request) {
+	links, err := getAllLinks()
+	if err != nil {
+		http.Error(w, "Failed to retrieve links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	classes, err := getAllLinkClasses()
+	if err != nil {
+		http.Error(w, "Failed to retrieve link classes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "links.html", LinksPageData{Links: links, LinkClasses: classes})
+}
+
+// linksRouter is a custom router for all /links/ paths.
+func linksRouter(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.TrimPrefix(r.URL.Path, "/links/"); {
+	case path == "create" && r.Method == http.MethodPost:
+		createLinkHandler(w, r)
+	case path == "delete" && r.Method == http.MethodPost:
+		deleteLinkHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// respondEntityLinks finishes a link change: plain posts are redirected, Fixi
+// requests get the re-rendered links partial of the entity, showing err if set.
+func respondEntityLinks(w http.ResponseWriter, r *http.Request, entityID int, err error) {
+	returnTo := safeRedirect(r, r.FormValue("return_to"), "/links")
+	if !isFixiRequest(r) {
+		if err != nil {
+			writeConflictOr(w, "Failed to update links: ", err)
+			return
+		}
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
+
+	data, loadErr := loadEntityLinksData(entityID, returnTo)
+	if loadErr != nil {
+		http.Error(w, "Failed to retrieve links: "+loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	renderFragment(w, "partials/entity_links.html", "entity_links", data)
+}
+
+// createLinkHandler creates a link between two entities.
+func createLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subjectID, err := strconv.Atoi(r.FormValue("subject_id"))
+	if err != nil {
+		http.Error(w, "Invalid subject ID", http.StatusBadRequest)
+		return
+	}
+	objectID, err := strconv.Atoi(r.FormValue("object_id"))
+	if err != nil {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return
+	}
+	var confidence sql.NullFloat64
+	if v := strings.TrimSpace(r.FormValue("confidence")); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "Invalid confidence", http.StatusBadRequest)
+			return
+		}
+		confidence = sql.NullFloat64{Float64: f, Valid: true}
+	}
+
+	_, err = createLink(subjectID, r.FormValue("link_type"), objectID, strings.TrimSpace(r.FormValue("source")), confidence)
+
+	// The form is posted from the page of one of the two ends.
+	entityID := subjectID
+	if id, convErr := strconv.Atoi(r.FormValue("entity_id")); convErr == nil {
+		entityID = id
+	}
+	respondEntityLinks(w, r, entityID, err)
+}
+
+// deleteLinkHandler deletes a link (and its inverse edge, if any).
+func deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for delete: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid link ID for delete", http.StatusBadRequest)
+		return
+	}
+	entityID, _ := strconv.Atoi(r.FormValue("entity_id"))
+
+	err = deleteLink(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	respondEntityLinks(w, r, entityID, err)
+}
+
+// linkClassesRouter is a custom router for all /link-classes/ paths.
+func linkClassesRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/link-classes/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "new" && r.Method == http.MethodGet:
+		renderLinkClassForm(w, LinkClass{}, false)
+	case len(parts) == 1 && parts[0] == "create" && r.Method == http.MethodPost:
+		saveLinkClassHandler(w, r, createLinkClass)
+	case len(parts) == 2 && parts[0] == "edit" && r.Method == http.MethodGet:
+		// e.g., /link-classes/edit/related_to
+		lc, err := getLinkClass(parts[1])
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, "Failed to retrieve link class for editing: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		renderLinkClassForm(w, lc, true)
+	case len(parts) == 1 && parts[0] == "update" && r.Method == http.MethodPost:
+		saveLinkClassHandler(w, r, updateLinkClass)
+	case len(parts) == 1 && parts[0] == "delete" && r.Method == http.MethodPost:
+		deleteLinkClassHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// LinkClassFormData holds the data for the link class create/edit form.
+type LinkClassFormData struct {
+	LinkClass   LinkClass
+	Existing    bool
+	LinkClasses []LinkClass
+}
+
+// renderLinkClassForm renders the link class form with the classes available as inverses.
+func renderLinkClassForm(w http.ResponseWriter, lc LinkClass, existing bool) {
+	classes, err := getAllLinkClasses()
+	if err != nil {
+		http.Error(w, "Failed to retrieve link classes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "link_class_form.html", LinkClassFormData{LinkClass: lc, Existing: existing, LinkClasses: classes})
+}
+
+// saveLinkClassHandler handles the submission of the link class form with save.
+func saveLinkClassHandler(w http.ResponseWriter, r *http.Request, save func(LinkClass) error) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lc := LinkClass{
+		Name:          strings.TrimSpace(r.FormValue("name")),
+		Description:   strings.TrimSpace(r.FormValue("description")),
+		SymmetricLink: r.FormValue("symmetric_link"),
+	}
+	if r.FormValue("self_symmetric") == "on" {
+		lc.SymmetricLink = lc.Name
+	}
+	if lc.Name == "" || lc.Description == "" {
+		http.Error(w, "Invalid link class: a name and a description are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := save(lc); err != nil {
+		writeConflictOr(w, "Failed to save link class: ", err)
+		return
+	}
+
+	http.Redirect(w, r, "/links", http.StatusFound)
+}
+
+// deleteLinkClassHandler handles the deletion of a link class.
+func deleteLinkClassHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for delete: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteLinkClass(r.FormValue("name")); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		writeConflictOr(w, "Cannot delete link class: ", err)
+		return
+	}
+
+	http.Redirect(w, r, "/links", http.StatusFound)
+}
+
+// ContletClassesPageData holds the data for the contlet class admin page.
+type ContletClassesPageData struct {
+	Classes    []ContletClass
+	FieldTypes []FieldType
+}
+
+// contletClassesHandler lists the registered contlet classes with a form to create one.
+func contletClassesHandler(w http.ResponseWriter, r *http.Request) {
+	classes, err := getContletClassesWithCounts()
+	if err != nil {
+		http.Error(w, "Failed to retrieve contlet classes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "contlet_classes.html", ContletClassesPageData{Classes: classes, FieldTypes: fieldTypes})
+}
+
+// contletClassesRouter is a custom router for all /contlet-classes/ paths.
+func contletClassesRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/contlet-classes/")
+
+	switch {
+	case path == "create" && r.Method == http.MethodPost:
+		createContletClassHandler(w, r)
+	case path == "retire" && r.Method == http.MethodPost:
+		retireContletClassHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// createContletClassHandler handles the submission of the new contlet class form.
+func createContletClassHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	err := createContletClass(name, strings.TrimSpace(r.FormValue("description")),
+		strings.TrimSpace(r.FormValue("field_name")), r.FormValue("field_type"))
+	if err != nil {
+		writeConflictOr(w, "Failed to create contlet class: ", err)
+		return
+	}
+
+	http.Redirect(w, r, "/contlet-classes", http.StatusFound)
+}
+
+// retireContletClassHandler handles the retirement of a contlet class.
+func retireContletClassHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form for retire: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := retireContletClass(r.FormValue("name")); err != nil {
+		writeConflictOr(w, "Cannot retire contlet class: ", err)
+		return
+	}
+
+	http.Redirect(w, r, "/contlet-classes", http.StatusFound)
+}
+
+// WorkflowPageData holds the data for the workflow admin page.
+type WorkflowPageData struct {
+	Statuses    []WorkflowStatus
+	Transitions []WorkflowTransition
+	Members     []RoleMember
+}
+
+// workflowHandler shows the editorial workflow with forms to change it.
+func workflowHandler(w http.ResponseWriter, r *http.Request) {
+	var data WorkflowPageData
+	var err error
+	if data.Statuses, err = getWorkflowStatuses(); err == nil {
+		if data.Transitions, err = getWorkflowTransitions(); err == nil {
+			data.Members, err = getRoleMembers()
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve workflow: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "workflow.html", data)
+}
+
+// workflowRouter is a custom router for all /workflow/ paths. Every action is a
+// form post that redirects back to the workflow page.
+func workflowRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/workflow/") {
+	case "statuses/create":
+		sortOrder, _ := strconv.Atoi(r.FormValue("sort_order"))
+		err = createWorkflowStatus(WorkflowStatus{
+			Name:      strings.TrimSpace(r.FormValue("name")),
+			Label:     strings.TrimSpace(r.FormValue("label")),
+			SortOrder: sortOrder,
+			Published: r.FormValue("published") != "",
+		})
+	case "statuses/delete":
+		err = deleteWorkflowStatus(r.FormValue("name"))
+	case "transitions/create":
+		err = createWorkflowTransition(WorkflowTransition{
+			From:            r.FormValue("from"),
+			To:              r.FormValue("to"),
+			Label:           strings.TrimSpace(r.FormValue("label")),
+			ApproverRole:    strings.TrimSpace(r.FormValue("approver_role")),
+			RequiresComment: r.FormValue("requires_comment") != "",
+		})
+	case "transitions/delete":
+		id, convErr := strconv.Atoi(r.FormValue("id"))
+		if convErr != nil {
+			http.Error(w, "Invalid transition ID", http.StatusBadRequest)
+			return
+		}
+		err = deleteWorkflowTransition(id)
+	case "roles/add":
+		err = addRoleMember(RoleMember{Role: strings.TrimSpace(r.FormValue("role")), UserName: strings.TrimSpace(r.FormValue("user_name"))})
+	case "roles/remove":
+		err = removeRoleMember(RoleMember{Role: r.FormValue("role"), UserName: r.FormValue("user_name")})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeConflictOr(w, "Failed to change workflow: ", err)
+		return
+	}
+	http.Redirect(w, r, "/workflow", http.StatusFound)
+}
+
+// LoginPageData holds the data for the login page.
+type LoginPageData struct {
+	Next     string
+	UserName string
+	Error    string
+}
+
+// loginHandler shows the login form and, on POST, starts a session and sends
+// the user on to the page they came for.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := LoginPageData{Next: safeRedirect(r, r.FormValue("next"), "/")}
+	switch r.Method {
+	case http.MethodGet:
+		renderTemplate(w, "login.html", data)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data.UserName = strings.TrimSpace(r.FormValue("user_name"))
+	token, err := login(data.UserName, r.FormValue("password"))
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		data.Error = invalid.Error()
+		w.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(w, "login.html", data)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to log in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(time.Duration(cfg.SessionLifetime).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the session of the request and returns to the login page.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := logout(c.Value); err != nil {
+			http.Error(w, "Failed to log out: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// UsersPageData holds the data for the user admin page.
+type UsersPageData struct {
+	Users []User
+	Roles []string // the roles that can be granted
+	Me    string
+}
+
+// usersHandler lists the user accounts with forms to manage them.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := getUsers()
+	if err != nil {
+		http.Error(w, "Failed to retrieve users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	roles, err := assignableRoles()
+	if err != nil {
+		http.Error(w, "Failed to retrieve roles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "users.html", UsersPageData{Users: users, Roles: roles, Me: requestAuthor(r)})
+}
+
+// usersRouter is a custom router for all /users/ paths. Every action is a form
+// post that redirects back to the user admin page.
+func usersRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/users/")
+	var err error
+	if action == "create" {
+		_, err = createUser(r.FormValue("user_name"), r.FormValue("password"), r.Form["role"])
+	} else {
+		id, convErr := strconv.Atoi(r.FormValue("id"))
+		if convErr != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "roles":
+			err = setUserRoles(id, r.Form["role"])
+		case "password":
+			err = setUserPassword(id, r.FormValue("password"))
+		case "delete":
+			err = deleteUser(id)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeConflictOr(w, "Failed to change users: ", err)
+		return
+	}
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+// TokensPageData holds the data for the API token page.
+type TokensPageData struct {
+	Tokens   []APIToken
+	Scopes   []string
+	Users    []User // the accounts service tokens can be made for; schema admins only
+	IsAdmin  bool
+	NewToken string // shown once, right after it was created
+	MaxDays  int
+}
+
+// loadTokensPageData gathers the tokens the user may see: their own, or all of
+// them for a schema admin.
+func loadTokensPageData(r *http.Request) (TokensPageData, error) {
+	me := currentUser(r)
+	data := TokensPageData{Scopes: apiScopes, IsAdmin: me.Has(roleSchemaAdmin), MaxDays: maxTokenDays}
+	var err error
+	if data.IsAdmin {
+		if data.Tokens, err = getAPITokens(0); err == nil {
+			data.Users, err = getUsers()
+		}
+	} else {
+		data.Tokens, err = getAPITokens(me.ID)
+	}
+	return data, err
+}
+
+// tokensHandler lists API tokens with forms to create and revoke them.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := loadTokensPageData(r)
+	if err != nil {
+		http.Error(w, "Failed to retrieve API tokens: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "tokens.html", data)
+}
+
+// tokensRouter is a custom router for all /tokens/ paths. Creating a token shows
+// the page with the new token; revoking one redirects back to the page. Anyone
+// may make personal tokens and revoke their own; service tokens, and other
+// people's tokens, are for schema admins.
+func tokensRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	me := currentUser(r)
+
+	switch strings.TrimPrefix(r.URL.Path, "/tokens/") {
+	case "create":
+		days, _ := strconv.Atoi(r.FormValue("days"))
+		in := APITokenInput{Name: r.FormValue("name"), UserID: me.ID, Kind: "personal", Scopes: r.Form["scope"], Days: days}
+		if r.FormValue("kind") == "service" {
+			if !me.Has(roleSchemaAdmin) {
+				forbidRole(w, r, roleSchemaAdmin)
+				return
+			}
+			in.Kind = "service"
+			if in.UserID, _ = strconv.Atoi(r.FormValue("user_id")); in.UserID == 0 {
+				http.Error(w, "A service token needs an account", http.StatusBadRequest)
+				return
+			}
+		}
+		token, err := createAPIToken(in, requestAuthor(r))
+		if err != nil {
+			writeConflictOr(w, "Failed to create token: ", err)
+			return
+		}
+		data, err := loadTokensPageData(r)
+		if err != nil {
+			http.Error(w, "Failed to retrieve API tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.NewToken = token
+		w.Header().Set("Cache-Control", "no-store")
+		renderTemplate(w, "tokens.html", data)
+	case "revoke":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+		token, err := getAPIToken(id)
+		if err == nil && token.UserID != me.ID && !me.Has(roleSchemaAdmin) {
+			err = sql.ErrNoRows // other people's tokens are not shown either
+		}
+		if err == nil {
+			err = revokeAPIToken(id)
+		}
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			writeConflictOr(w, "Failed to revoke token: ", err)
+			return
+		}
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// entitiesRouter resolves GET /entities/{id} for any object and redirects to its detail page.
+// Wrapped in negotiate, clients asking for JSON get the object from apiEntity instead.
+func entitiesRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/entities/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	entity, err := resolveEntity(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to resolve entity: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Redirect(w, r, entity.URL(), http.StatusSeeOther)
+}
+
+// HistoryData holds the data for the revision history of a piece or contlet.
+type HistoryData struct {
+	Title     string // e.g. "Piece 12"
+	Base      string // the object's page, e.g. /pieces/12
+	Revisions []Revision
+}
+
+// RevisionData holds the data for a single revision.
+type RevisionData struct {
+	Title    string
+	Base     string
+	Revision Revision
+	Lines    []SnapshotLine
+	IsLatest bool
+}
+
+// RevisionDiffData holds the data for the comparison of two revisions.
+type RevisionDiffData struct {
+	Title   string
+	Base    string
+	From    Revision
+	To      Revision
+	Changes []FieldChange
+}
+
+// historyRouter handles the history pages below an object's page, e.g. for /pieces/12:
+// /pieces/12/history, /pieces/12/history/diff?from=1&to=3, /pieces/12/history/3
+// and POST /pieces/12/history/3/restore. rest is the path after "history".
+func historyRouter(w http.ResponseWriter, r *http.Request, kind string, id int, rest []string) {
+	class, err := getEntityClass(id)
+	if err == nil && (entityKind(class) != kind || !hasRevisions(class)) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve object: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	base := EntityRef{ID: id, Kind: kind}.URL()
+	title := fmt.Sprintf("%s %d", strings.ToUpper(kind[:1])+kind[1:], id)
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		revisions, err := getRevisions(id)
+		if err != nil {
+			http.Error(w, "Failed to retrieve revisions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		renderTemplate(w, "history.html", HistoryData{Title: title, Base: base, Revisions: revisions})
+	case len(rest) == 1 && rest[0] == "diff" && r.Method == http.MethodGet:
+		revisionDiffHandler(w, r, id, title, base)
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		number, err := strconv.Atoi(rest[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		revisions, err := getRevisions(id)
+		if err != nil {
+			http.Error(w, "Failed to retrieve revisions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, rev := range revisions {
+			if rev.Number == number {
+				renderTemplate(w, "revision.html", RevisionData{
+					Title:    title,
+					Base:     base,
+					Revision: rev,
+					Lines:    rev.Snapshot.Lines(),
+					IsLatest: rev.Number == revisions[0].Number,
+				})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case len(rest) == 2 && rest[1] == "restore" && r.Method == http.MethodPost:
+		number, err := strconv.Atoi(rest[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := restoreRevision(id, number, requestAuthor(r)); err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(w, r)
+			} else {
+				writeConflictOr(w, "Failed to restore revision: ", err)
+			}
+			return
+		}
+		http.Redirect(w, r, base+"/history", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// revisionDiffHandler compares two revisions of an object, by default the latest
+// one with the one before it.
+func revisionDiffHandler(w http.ResponseWriter, r *http.Request, id int, title, base string) {
+	revisions, err := getRevisions(id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(revisions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	find := func(param string, fallback int) (Revision, bool) {
+		number := fallback
+		if v := r.URL.Query().Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return Revision{}, false
+			}
+			number = n
+		}
+		for _, rev := range revisions {
+			if rev.Number == number {
+				return rev, true
+			}
+		}
+		return Revision{}, false
+	}
+
+	to, okTo := find("to", revisions[0].Number)
+	from, okFrom := find("from", max(to.Number-1, 1))
+	if !okTo || !okFrom {
+		http.Error(w, "Unknown revision", http.StatusNotFound)
+		return
+	}
+	if from.Number > to.Number {
+		from, to = to, from
+	}
+	renderTemplate(w, "revision_diff.html", RevisionDiffData{
+		Title:   title,
+		Base:    base,
+		From:    from,
+		To:      to,
+		Changes: diffSnapshots(from.Snapshot, to.Snapshot),
+	})
+}
+
+// SchedulePageData holds the data for the schedule page.
+type SchedulePageData struct {
+	Pieces []ScheduledPiece
+	Now    time.Time
+}
+
+// scheduleHandler lists the upcoming scheduled publish and unpublish times.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	pieces, err := getSchedule()
+	if err != nil {
+		http.Error(w, "Failed to retrieve schedule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "schedule.html", SchedulePageData{Pieces: pieces, Now: time.Now().UTC()})
+}
@@ -5,40 +5,132 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 )
 
 func main() {
 	resetDBFlag := flag.Bool("reset-db", false, "Drop and recreate the database for development.")
 	noSampleDataFlag := flag.Bool("no-sample-data", false, "Do not insert sample data into the database.")
+	printConfigFlag := flag.Bool("print-config", false, "Print the effective configuration (secrets redacted) and exit.")
+	resolveConfig := registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
+	var err error
+	if cfg, err = resolveConfig(); err != nil {
+		if *printConfigFlag {
+			printConfig(cfg)
+		}
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if *printConfigFlag {
+		if err := printConfig(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Serving needs the template and static directories; build-site checks them itself.
+	if flag.NArg() == 0 {
+		if err := cfg.ValidateDirs(); err != nil {
+			log.Fatal("Invalid configuration: ", err)
+		}
+	}
+
 	if *resetDBFlag {
 		resetDB()
 	}
 	setupDatabase()
 	connectToDB()
-	createSchemaFromArchitecture()
+
+	// Sub-commands run against the database and exit without serving.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "migrate":
+			runMigrateCommand(flag.Args()[1:])
+		case "user":
+			runUserCommand(flag.Args()[1:])
+		case "build-site":
+			runBuildSiteCommand(flag.Args()[1:])
+		case "import-markdown":
+			runImportMarkdownCommand(flag.Args()[1:])
+		case "export":
+			runExportCommand(flag.Args()[1:])
+		case "import":
+			runImportCommand(flag.Args()[1:])
+		default:
+			log.Fatalf("Unknown command %q. Available commands: migrate, user, build-site, import-markdown, export, import", flag.Arg(0))
+		}
+		return
+	}
+
+	// A freshly reset development database is migrated automatically;
+	// otherwise the schema must already be current before we serve.
+	if *resetDBFlag {
+		if _, err := migrateUp(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	checkMigrations()
 	seedSampleData(!*noSampleDataFlag)
+	if err := loadContletClasses(); err != nil {
+		log.Fatal(err)
+	}
+	if err := backfillEntityClasses(); err != nil {
+		log.Fatal(err)
+	}
+	if err := backfillRevisions(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The scheduler fires scheduled publish and unpublish times while we serve.
+	scheduler = newScheduler(systemClock{}, time.Duration(cfg.SchedulerInterval))
+	go scheduler.Run(nil)
 
 	log.Println("Registering application routes...")
 
 	// Serve static files (like fixi.js)
-	fs := http.FileServer(http.Dir("static"))
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
 
 	// --- Application Routes ---
-	http.HandleFunc("/", dashboardHandler)
-	http.HandleFunc("/pieces", piecesHandler)
-	http.HandleFunc("/contlets", contletsHandler)
-	http.HandleFunc("/contlets/", contletsRouter)
-	http.HandleFunc("/tags", tagsHandler)
-	http.HandleFunc("/schema", schemaHandler)
-	http.HandleFunc("/pieces/", piecesRouter)
-	http.HandleFunc("/schema/", updateSchemaHandler)
-
-	log.Println("✅ Application ready: http://localhost:8080")
+	// Every other route needs a logged-in user: authorize(role for GET, role for
+	// changes, handler). Object pages wrapped in negotiate are also served as JSON
+	// to clients that ask for it.
+	http.HandleFunc("/", authorize(roleViewer, roleEditor, dashboardHandler))
+	http.HandleFunc("/pieces", authorize(roleViewer, roleEditor, negotiate(piecesHandler)))
+	http.HandleFunc("/contlets", authorize(roleViewer, roleEditor, negotiate(contletsHandler)))
+	http.HandleFunc("/contlets/", authorize(roleViewer, roleEditor, negotiate(contletsRouter)))
+	http.HandleFunc("/tags", authorize(roleViewer, roleEditor, negotiate(tagsHandler)))
+	http.HandleFunc("/tags/", authorize(roleViewer, roleEditor, negotiate(tagsRouter)))
+	http.HandleFunc("/taxonomies", authorize(roleViewer, roleEditor, negotiate(taxonomiesHandler)))
+	http.HandleFunc("/taxonomies/", authorize(roleViewer, roleEditor, negotiate(taxonomiesRouter)))
+	http.HandleFunc("/links", authorize(roleViewer, roleEditor, negotiate(linksHandler)))
+	http.HandleFunc("/links/", authorize(roleViewer, roleEditor, linksRouter))
+	http.HandleFunc("/link-classes/", authorize(roleViewer, roleSchemaAdmin, linkClassesRouter))
+	http.HandleFunc("/contlet-classes", authorize(roleViewer, roleSchemaAdmin, contletClassesHandler))
+	http.HandleFunc("/contlet-classes/", authorize(roleViewer, roleSchemaAdmin, contletClassesRouter))
+	http.HandleFunc("/workflow", authorize(roleViewer, roleSchemaAdmin, workflowHandler))
+	http.HandleFunc("/workflow/", authorize(roleViewer, roleSchemaAdmin, workflowRouter))
+	http.HandleFunc("/schedule", authorize(roleViewer, roleEditor, negotiate(scheduleHandler)))
+	http.HandleFunc("/users", authorize(roleSchemaAdmin, roleSchemaAdmin, usersHandler))
+	http.HandleFunc("/users/", authorize(roleSchemaAdmin, roleSchemaAdmin, usersRouter))
+	http.HandleFunc("/tokens", authorize(roleViewer, roleViewer, tokensHandler))
+	http.HandleFunc("/tokens/", authorize(roleViewer, roleViewer, tokensRouter))
+	http.HandleFunc("/entities/", authorize(roleViewer, roleEditor, negotiate(entitiesRouter)))
+	http.HandleFunc("/schema", authorize(roleSchemaAdmin, roleSchemaAdmin, negotiate(schemaHandler)))
+	http.HandleFunc("/pieces/", authorize(roleViewer, roleEditor, negotiate(piecesRouter)))
+	http.HandleFunc("/schema/", authorize(roleSchemaAdmin, roleSchemaAdmin, schemaRouter))
+
+	// --- JSON API ---
+	http.HandleFunc(apiPrefix, authorize(roleViewer, roleEditor, apiRouter))
+	http.HandleFunc("/api/openapi.json", authorize(roleViewer, roleViewer, openAPIHandler))
+	http.HandleFunc(graphQLPath, authorize(roleViewer, roleViewer, graphQLHandler))
+	http.HandleFunc(graphQLPath+"/schema.graphql", authorize(roleViewer, roleViewer, graphQLSchemaHandler))
+
+	log.Printf("✅ Application ready on %s", cfg.ListenAddr)
 	if *resetDBFlag {
 		log.Println("💡 Tip: Database was reset because the --reset-db flag was used.")
 	}
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(cfg.ListenAddr, nil))
 }
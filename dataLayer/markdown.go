@@ -0,0 +1,485 @@
+// In file: markdown.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Writers draft in Markdown. A Markdown file is imported as a new piece whose
+// contlets are its blocks, in order: "#" headings become heading contlets with
+// the level of their "#"s, lines holding only an image become image contlets,
+// and everything else (paragraphs, lists, quotes, fenced code) becomes
+// paragraph contlets with the Markdown kept as written. Front matter between
+// "---" lines sets the title, class, tags and outbound links of the piece:
+//
+//	---
+//	title: Hello
+//	class: blog_post
+//	tags:
+//	  Topic: Go, Databases
+//	  Audience:
+//	    - Developers
+//	links:
+//	  related_to:
+//	    - 12 # a comment, e.g. the title of entity 12
+//	---
+//
+// exportMarkdown writes pieces in the same form, so that they can be reviewed
+// as files and imported again.
+
+// maxMarkdownSize is the largest Markdown file the upload form accepts.
+const maxMarkdownSize = 1 << 20
+
+// defaultImportClass is the class of imported pieces without a class in their front matter.
+const defaultImportClass = "blog_post"
+
+// MarkdownTag is a tag named in front matter by taxonomy and value.
+type MarkdownTag struct {
+	Taxonomy, Value string
+}
+
+// MarkdownLink is an outbound link named in front matter by type and object ID.
+type MarkdownLink struct {
+	Type     string
+	ObjectID int
+}
+
+// MarkdownDocument is a parsed Markdown file.
+type MarkdownDocument struct {
+	Title    string
+	Class    string
+	Tags     []MarkdownTag
+	Links    []MarkdownLink
+	Contlets []ContletDetail
+}
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)(?:[ \t]+#+)?$`)
+	markdownImage   = regexp.MustCompile(`^!\[([^\]]*)\]\(\s*<?([^\s>]+)>?(?:\s+"[^"]*")?\s*\)$`)
+)
+
+// parseMarkdown splits a Markdown document into front matter and contlets. The
+// title is taken from the front matter or else from a level 1 heading that
+// starts the document, which then is not imported as a contlet.
+func parseMarkdown(src string) (MarkdownDocument, error) {
+	src = strings.TrimPrefix(strings.ReplaceAll(src, "\r\n", "\n"), "\ufeff")
+	lines := strings.Split(src, "\n")
+
+	var doc MarkdownDocument
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		end := -1
+		for i := 1; i < len(lines); i++ {
+			if t := strings.TrimSpace(lines[i]); t == "---" || t == "..." {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return doc, &ValidationError{"the front matter is not closed with ---"}
+		}
+		if err := parseFrontMatter(lines[1:end], &doc); err != nil {
+			return doc, err
+		}
+		lines = lines[end+1:]
+	}
+
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			doc.Contlets = append(doc.Contlets, ContletDetail{Class: "paragraph", TextContent: strings.Join(paragraph, "\n")})
+			paragraph = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		trimmed := strings.TrimSpace(line)
+		if fence := markdownFence(trimmed); fence != "" {
+			// A fenced block is one paragraph, fences included, whatever it holds.
+			flush()
+			block := []string{line}
+			for i++; i < len(lines); i++ {
+				block = append(block, strings.TrimRight(lines[i], " \t"))
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+					break
+				}
+			}
+			doc.Contlets = append(doc.Contlets, ContletDetail{Class: "paragraph", TextContent: strings.Join(block, "\n")})
+			continue
+		}
+		if trimmed == "" {
+			flush()
+		} else if m := markdownHeading.FindStringSubmatch(trimmed); m != nil && line == trimmed {
+			flush()
+			doc.Contlets = append(doc.Contlets, ContletDetail{Class: "heading", Level: len(m[1]), TextContent: m[2]})
+		} else if m := markdownImage.FindStringSubmatch(trimmed); m != nil {
+			flush()
+			doc.Contlets = append(doc.Contlets, ContletDetail{Class: "image", AltText: m[1], Src: m[2]})
+		} else {
+			// A backslash keeps a line that looks like a block in the paragraph.
+			if rest, ok := strings.CutPrefix(line, "\\"); ok && needsMarkdownEscape(rest) {
+				line = rest
+			}
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+
+	if doc.Title == "" && len(doc.Contlets) > 0 && doc.Contlets[0].Class == "heading" && doc.Contlets[0].Level == 1 {
+		doc.Title = doc.Contlets[0].TextContent
+		doc.Contlets = doc.Contlets[1:]
+	}
+	return doc, nil
+}
+
+// markdownBlocks writes contlets as Markdown blocks, the inverse of
+// parseMarkdown. Heading levels below minHeading are raised to it. Lines of a
+// paragraph that would be read back as a heading, an image or a fence, or that
+// would lose a backslash of their own, are escaped with a backslash, unless the
+// paragraph is a closed fenced block itself.
+func markdownBlocks(contlets []ContletDetail, minHeading int) []string {
+	var blocks []string
+	for _, c := range contlets {
+		switch text := contletText(c); {
+		case c.Class == "heading":
+			blocks = append(blocks, strings.Repeat("#", min(max(c.Level, minHeading), 6))+" "+c.TextContent)
+		case c.Class == "image":
+			blocks = append(blocks, fmt.Sprintf("![%s](%s)", c.AltText, c.Src))
+		case text == "":
+		case isFencedBlock(text):
+			blocks = append(blocks, text)
+		default:
+			lines := strings.Split(text, "\n")
+			for i, line := range lines {
+				if needsMarkdownEscape(line) {
+					lines[i] = "\\" + line
+				}
+			}
+			blocks = append(blocks, strings.Join(lines, "\n"))
+		}
+	}
+	return blocks
+}
+
+// opensMarkdownBlock reports whether parseMarkdown reads line as a heading,
+// an image or a fence rather than as part of a paragraph.
+func opensMarkdownBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return (line == trimmed && markdownHeading.MatchString(trimmed)) || markdownImage.MatchString(trimmed) || markdownFence(trimmed) != ""
+}
+
+// needsMarkdownEscape reports whether a paragraph line must be written with a
+// backslash in front: when it opens a block, or when it already starts with
+// backslashes in front of one, which parseMarkdown would otherwise strip.
+func needsMarkdownEscape(line string) bool {
+	for {
+		if opensMarkdownBlock(line) {
+			return true
+		}
+		rest, ok := strings.CutPrefix(line, "\\")
+		if !ok {
+			return false
+		}
+		line = rest
+	}
+}
+
+// isFencedBlock reports whether text is a single fenced code block, which
+// parseMarkdown reads back whole: it opens with a fence that its last line closes.
+func isFencedBlock(text string) bool {
+	lines := strings.Split(text, "\n")
+	fence := markdownFence(strings.TrimSpace(lines[0]))
+	if fence == "" {
+		return false
+	}
+	for i := 1; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+			return i == len(lines)-1
+		}
+	}
+	return false
+}
+
+// markdownFence returns the fence that opens a fenced code block on line, if any.
+func markdownFence(line string) string {
+	for _, fence := range []string{"```", "~~~"} {
+		if strings.HasPrefix(line, fence) {
+			return fence
+		}
+	}
+	return ""
+}
+
+// parseFrontMatter reads the keys title, class, tags and links. Tags are
+// listed per taxonomy and links per link type, each as a comma-separated list,
+// a [flow, list] or a block list.
+func parseFrontMatter(lines []string, doc *MarkdownDocument) error {
+	section, name := "", ""
+	add := func(n int, value string) error {
+		if section == "tags" {
+			doc.Tags = append(doc.Tags, MarkdownTag{name, value})
+			return nil
+		}
+		// A link is an entity ID, optionally followed by a comment.
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			fields = []string{""}
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return &ValidationError{fmt.Sprintf("front matter line %d: a link needs the ID of the entity it points to", n+2)}
+		}
+		doc.Links = append(doc.Links, MarkdownLink{name, id})
+		return nil
+	}
+	for n, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		nested := line[0] == ' ' || line[0] == '\t'
+		if nested && section != "" {
+			if item, ok := strings.CutPrefix(trimmed, "- "); ok && name != "" {
+				if err := add(n, unquoteYAML(item)); err != nil {
+					return err
+				}
+				continue
+			}
+			key, value, ok := cutYAMLKey(trimmed)
+			if !ok {
+				return &ValidationError{fmt.Sprintf("front matter line %d: expected \"name: value, value\"", n+2)}
+			}
+			name = unquoteYAML(key)
+			for _, v := range splitYAMLList(value) {
+				if err := add(n, v); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		key, value, ok := cutYAMLKey(trimmed)
+		if !ok || nested {
+			return &ValidationError{fmt.Sprintf("front matter line %d: expected \"key: value\"", n+2)}
+		}
+		section = ""
+		switch key, value = strings.ToLower(unquoteYAML(key)), strings.TrimSpace(value); key {
+		case "title":
+			doc.Title = unquoteYAML(value)
+		case "class":
+			doc.Class = unquoteYAML(value)
+		case "tags", "links":
+			if value != "" {
+				return &ValidationError{fmt.Sprintf("front matter: list %s on the lines under \"%s:\", e.g. \"  Topic: Go, Databases\"", key, key)}
+			}
+			section, name = key, ""
+		default:
+			return &ValidationError{fmt.Sprintf("front matter: unknown key %q; use title, class, tags and links", key)}
+		}
+	}
+	return nil
+}
+
+// cutYAMLKey splits "key: value" at the colon after the key, which may be quoted.
+func cutYAMLKey(line string) (key, value string, ok bool) {
+	if line != "" && (line[0] == '"' || line[0] == '\'') {
+		if end := strings.IndexByte(line[1:], line[0]); end >= 0 {
+			key, rest := line[:end+2], strings.TrimLeft(line[end+2:], " \t")
+			if value, ok := strings.CutPrefix(rest, ":"); ok {
+				return key, value, true
+			}
+		}
+		return "", "", false
+	}
+	return strings.Cut(line, ":")
+}
+
+// splitYAMLList splits "a, b" or "[a, b]" into its values. Commas inside
+// quoted values do not split them.
+func splitYAMLList(s string) []string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	var values []string
+	add := func(v string) {
+		if v = unquoteYAML(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	start, quote := 0, byte(0)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && strings.TrimSpace(s[start:i]) == "":
+			quote = c
+		case c == ',':
+			add(s[start:i])
+			start = i + 1
+		}
+	}
+	add(s[start:])
+	return values
+}
+
+// unquoteYAML trims a scalar and removes the quotes around it, if any.
+func unquoteYAML(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// importMarkdown parses src and creates a piece with its contlets and tags in
+// one transaction. name, usually the file name, is the title of a document
+// without one; class is used when the front matter has none. Tags are created
+// in their taxonomy when they do not exist yet; the taxonomies, link classes
+// and linked entities must exist.
+func importMarkdown(name, src, class, author string) (int64, error) {
+	doc, err := parseMarkdown(src)
+	if err != nil {
+		return 0, err
+	}
+	if doc.Title == "" {
+		doc.Title = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+	if doc.Class == "" {
+		doc.Class = class
+	}
+	if doc.Title == "" || doc.Class == "" {
+		return 0, &ValidationError{"an imported piece needs a title and a class"}
+	}
+	for _, c := range doc.Contlets {
+		if err := validateContlet(c); err != nil {
+			return 0, &ValidationError{fmt.Sprintf("invalid %s contlet: %v", c.Class, err)}
+		}
+	}
+
+	linkClasses := map[string]LinkClass{}
+	for _, l := range doc.Links {
+		lc, err := getLinkClass(l.Type)
+		if err == sql.ErrNoRows {
+			return 0, &ValidationError{fmt.Sprintf("there is no link class named %q", l.Type)}
+		}
+		if err != nil {
+			return 0, err
+		}
+		linkClasses[l.Type] = lc
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	id, err := createContentPieceTx(tx, doc.Title, doc.Class, nil)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for i, c := range doc.Contlets {
+		contletID, err := createContletTx(tx, c, author)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		_, err = tx.Exec("INSERT INTO content_piece_contlets (content_piece_id, contlet_id, sort_order) VALUES (?, ?, ?)",
+			id, contletID, (i+1)*sortOrderStep)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to add contlet %d to piece %d: %w", contletID, id, err)
+		}
+	}
+	for _, t := range doc.Tags {
+		tagID, err := findOrCreateTag(tx, t)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO entity_tags (entity_id, tag_id) VALUES (?, ?)", id, tagID); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to attach tag %d to entity %d: %w", tagID, id, err)
+		}
+	}
+	for _, l := range doc.Links {
+		if _, err := createLinkTx(tx, linkClasses[l.Type], int(id), l.ObjectID, "", sql.NullFloat64{}); err != nil {
+			tx.Rollback()
+			var conflict *ConflictError
+			if errors.As(err, &conflict) {
+				return 0, &ValidationError{conflict.Message}
+			}
+			return 0, err
+		}
+	}
+	if err := recordRevision(tx, int(id), author, "Imported from Markdown"); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// findOrCreateTag returns the ID of the tag, creating it in its taxonomy if needed.
+func findOrCreateTag(tx *sql.Tx, t MarkdownTag) (int64, error) {
+	var taxonomyID, tagID int64
+	err := tx.QueryRow("SELECT id FROM taxonomy WHERE name = ?", t.Taxonomy).Scan(&taxonomyID)
+	if err == sql.ErrNoRows {
+		return 0, &ValidationError{fmt.Sprintf("there is no taxonomy named %q", t.Taxonomy)}
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT id FROM tag WHERE taxonomy_id = ? AND value = ?", taxonomyID, t.Value).Scan(&tagID)
+	if err != sql.ErrNoRows {
+		return tagID, err
+	}
+
+	if tagID, err = newEntity(tx, "tag"); err != nil {
+		return 0, fmt.Errorf("failed to create entity for tag: %w", err)
+	}
+	err = insertObjectRow(tx, "tag", []string{"id", "taxonomy_id", "value"}, []interface{}{tagID, taxonomyID, t.Value}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert into tag: %w", err)
+	}
+	return tagID, nil
+}
+
+// runImportMarkdownCommand implements "import-markdown [-class c] [-author a] file.md...".
+func runImportMarkdownCommand(args []string) {
+	flags := flag.NewFlagSet("import-markdown", flag.ExitOnError)
+	class := flags.String("class", defaultImportClass, "Class of pieces whose front matter has none.")
+	author := flags.String("author", "system", "Author recorded in the revisions of the new pieces.")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: import-markdown [-class class] [-author name] file.md...")
+		os.Exit(2)
+	}
+	if err := loadContletClasses(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range flags.Args() {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, err := importMarkdown(name, string(src), *class, *author)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", name, err)
+		}
+		log.Printf("✅ Imported %s as piece %d.", name, id)
+	}
+}
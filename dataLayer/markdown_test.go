@@ -0,0 +1,278 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mdContlet is the part of a contlet that Markdown carries.
+type mdContlet struct {
+	Class, Text string
+	Level       int
+	Src, Alt    string
+}
+
+func mdContlets(contlets []ContletDetail) []mdContlet {
+	out := []mdContlet{}
+	for _, c := range contlets {
+		out = append(out, mdContlet{c.Class, c.TextContent, c.Level, c.Src, c.AltText})
+	}
+	return out
+}
+
+func mdHeading(level int, text string) mdContlet {
+	return mdContlet{Class: "heading", Text: text, Level: level}
+}
+func mdParagraph(text string) mdContlet { return mdContlet{Class: "paragraph", Text: text} }
+func mdImage(alt, src string) mdContlet { return mdContlet{Class: "image", Alt: alt, Src: src} }
+
+func TestParseFrontMatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    MarkdownDocument // Contlets are not compared
+		wantErr string
+	}{
+		{
+			name: "plain and quoted scalars",
+			src:  "---\ntitle: \"Hello: World\"\nclass: 'blog_post'\n---\n",
+			want: MarkdownDocument{Title: "Hello: World", Class: "blog_post"},
+		},
+		{
+			name: "comma, flow and block lists",
+			src: `---
+title: Lists
+tags:
+  Topic: Go, Databases
+  Level: [Beginner, "Advanced, really", 'It''s']
+  Audience:
+    - Developers
+    - "Editors, too"
+---
+`,
+			want: MarkdownDocument{Title: "Lists", Tags: []MarkdownTag{
+				{"Topic", "Go"}, {"Topic", "Databases"},
+				{"Level", "Beginner"}, {"Level", "Advanced, really"}, {"Level", "It''s"},
+				{"Audience", "Developers"}, {"Audience", "Editors, too"},
+			}},
+		},
+		{
+			name: "quoted keys",
+			src: `---
+"Title": Keys
+tags:
+  "Topic: Sub": Go
+  'Audience #1':
+    - Developers
+---
+`,
+			want: MarkdownDocument{Title: "Keys", Tags: []MarkdownTag{{"Topic: Sub", "Go"}, {"Audience #1", "Developers"}}},
+		},
+		{
+			name: "links with comments",
+			src: `---
+# the piece links to these
+links:
+  related_to:
+    - 12 # piece Hello: World
+    - 13
+  cites: [14, 15]
+...
+`,
+			want: MarkdownDocument{Links: []MarkdownLink{{"related_to", 12}, {"related_to", 13}, {"cites", 14}, {"cites", 15}}},
+		},
+		{
+			name: "title from the first heading",
+			src:  "# From the heading\n\nText\n",
+			want: MarkdownDocument{Title: "From the heading"},
+		},
+		{name: "unclosed", src: "---\ntitle: x\n", wantErr: "not closed"},
+		{name: "unknown key", src: "---\nauthor: Ann\n---\n", wantErr: `unknown key "author"`},
+		{name: "inline tags", src: "---\ntags: Go\n---\n", wantErr: "list tags on the lines under"},
+		{name: "link without an ID", src: "---\nlinks:\n  cites:\n    - Hello\n---\n", wantErr: "line 4: a link needs the ID"},
+		{name: "nested line without a section", src: "---\n  title: x\n---\n", wantErr: `line 2: expected "key: value"`},
+		{name: "list item without a name", src: "---\ntags:\n  Go\n---\n", wantErr: `line 3: expected "name: value, value"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseMarkdown(tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc.Contlets = nil
+			if !reflect.DeepEqual(doc, tt.want) {
+				t.Fatalf("got  %+v\nwant %+v", doc, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownBlocks(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []mdContlet
+	}{
+		{
+			name: "headings, paragraphs and images",
+			body: "---\ntitle: T\n---\n# One\n\nFirst line\nsecond line\n### Three ###\n![A cat](cat.png \"Title\")\n\n  # indented\n",
+			want: []mdContlet{
+				mdHeading(1, "One"), mdParagraph("First line\nsecond line"), mdHeading(3, "Three"), mdImage("A cat", "cat.png"),
+				mdParagraph("  # indented"),
+			},
+		},
+		{
+			name: "fenced blocks keep blank lines and headings",
+			body: "Before\n```go\n# not a heading\n\nfunc main() {}\n```\n~~~\n![x](y)\n~~~\nAfter\n",
+			want: []mdContlet{
+				mdParagraph("Before"), mdParagraph("```go\n# not a heading\n\nfunc main() {}\n```"),
+				mdParagraph("~~~\n![x](y)\n~~~"), mdParagraph("After"),
+			},
+		},
+		{
+			name: "an unclosed fence runs to the end",
+			body: "```\ncode\n\nmore",
+			want: []mdContlet{mdParagraph("```\ncode\n\nmore")},
+		},
+		{
+			name: "backslash escapes",
+			body: "Text\n\\# not a heading\n\\![x](y)\n\\```\n\\\\# one backslash\n\\x stays\n",
+			want: []mdContlet{mdParagraph("Text\n# not a heading\n![x](y)\n```\n\\# one backslash\n\\x stays")},
+		},
+		{
+			name: "CRLF and byte order mark",
+			body: "\ufeff# Title\r\n\r\nText\r\n",
+			want: []mdContlet{mdParagraph("Text")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseMarkdown(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mdContlets(doc.Contlets); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMarkdownRoundTrip exports pieces as Markdown and checks that importing the
+// file gives back the same title, class, tags, links and contlets.
+func TestMarkdownRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		title    string
+		tags     []Tag
+		links    []Link
+		contlets []mdContlet
+	}{
+		{
+			name:     "blocks",
+			title:    "Plain",
+			contlets: []mdContlet{mdHeading(1, "Top"), mdParagraph("Some *text*\nover two lines"), mdImage("A cat", "https://example.com/cat.png"), mdHeading(6, "C#")},
+		},
+		{
+			name:  "paragraph lines that look like blocks",
+			title: "Escapes",
+			contlets: []mdContlet{
+				mdParagraph("# not a heading"),
+				mdParagraph("First\n## second line\n![x](y)\n```not a fence"),
+				mdParagraph("~~~"),
+			},
+		},
+		{
+			name:  "paragraph lines with their own backslashes",
+			title: "Backslashes",
+			contlets: []mdContlet{
+				mdParagraph(`\# literally`),
+				mdParagraph(`\\## twice` + "\n" + `\![x](y)`),
+				mdParagraph(`\just a backslash` + "\n" + `C:\path`),
+			},
+		},
+		{
+			name:     "fenced block",
+			title:    "Code",
+			contlets: []mdContlet{mdParagraph("```sh\n# a comment\n\\# escaped\n```")},
+		},
+		{
+			name:  "front matter values that need quotes",
+			title: `Hello: "World" #1`,
+			tags: []Tag{
+				{TaxonomyName: "Topic: Sub", Value: "Go, Databases"},
+				{TaxonomyName: "Topic: Sub", Value: "- dash"},
+				{TaxonomyName: "Zone", Value: "It's [here]"},
+			},
+			links: []Link{
+				{LinkType: "cites", Object: EntityRef{ID: 3, Kind: "piece", Label: "Other: one\nwith # hash"}},
+				{LinkType: "cites", Object: EntityRef{ID: 4}},
+				{LinkType: "related_to", Object: EntityRef{ID: 5, Kind: "tag", Label: "Go"}},
+			},
+			contlets: []mdContlet{mdParagraph("Body")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			piece := PieceDetail{ID: 1, Class: "blog_post", Title: tt.title}
+			for _, c := range tt.contlets {
+				piece.Contlets = append(piece.Contlets, ContletDetail{Class: c.Class, TextContent: c.Text, Level: c.Level, Src: c.Src, AltText: c.Alt})
+			}
+			md := exportMarkdown(piece, tt.tags, tt.links)
+			doc, err := parseMarkdown(md)
+			if err != nil {
+				t.Fatalf("re-importing:\n%s\nfailed: %v", md, err)
+			}
+
+			if doc.Title != tt.title || doc.Class != "blog_post" {
+				t.Errorf("title, class = %q, %q; want %q, blog_post", doc.Title, doc.Class, tt.title)
+			}
+			var wantTags []MarkdownTag
+			for _, tag := range tt.tags {
+				wantTags = append(wantTags, MarkdownTag{tag.TaxonomyName, tag.Value})
+			}
+			if !reflect.DeepEqual(doc.Tags, wantTags) {
+				t.Errorf("tags = %q, want %q", doc.Tags, wantTags)
+			}
+			var wantLinks []MarkdownLink
+			for _, l := range tt.links {
+				wantLinks = append(wantLinks, MarkdownLink{l.LinkType, l.Object.ID})
+			}
+			if !reflect.DeepEqual(doc.Links, wantLinks) {
+				t.Errorf("links = %v, want %v", doc.Links, wantLinks)
+			}
+			if got := mdContlets(doc.Contlets); !reflect.DeepEqual(got, tt.contlets) {
+				t.Errorf("contlets = %q\nwant       %q", got, tt.contlets)
+			}
+			if t.Failed() {
+				t.Logf("exported Markdown:\n%s", md)
+			}
+		})
+	}
+}
+
+func TestSplitYAMLList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"a, b", []string{"a", "b"}},
+		{"[a, b]", []string{"a", "b"}},
+		{` "a, b" , 'c,d', e `, []string{"a, b", "c,d", "e"}},
+		{"[]", nil},
+		{"a,,b,", []string{"a", "b"}},
+		{`it's, fine`, []string{"it's", "fine"}},
+	}
+	for _, tt := range tests {
+		if got := splitYAMLList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitYAMLList(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// In file: migrate.go
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the numbered schema migrations compiled into the binary.
+// Each version has an "up" file and a matching "down" file, e.g.
+// 0001_initial_schema.up.sql and 0001_initial_schema.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationFilePattern matches "<version>_<name>.<up|down>.sql".
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	UpSQL   string
+	DownSQL string
+}
+
+// MigrationStatus describes whether a known migration has been applied.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the embedded migration files and returns them sorted by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected file in migrations directory: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %04d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.UpSQL = string(body)
+		} else {
+			mig.DownSQL = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for _, mig := range byVersion {
+		if mig.UpSQL == "" || mig.DownSQL == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates the schema_migrations bookkeeping table if needed.
+func ensureMigrationsTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations returns the applied versions and when each was applied.
+func appliedMigrations() (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// tableExists reports whether a table exists in the current database.
+func tableExists(name string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+		name,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// adoptLegacySchema marks the initial migration as applied for databases that
+// were created by the old architecture.md loader, so that `migrate up` does not
+// try to create tables which already exist.
+func adoptLegacySchema(migrations []Migration, applied map[int]time.Time) error {
+	if len(applied) > 0 || len(migrations) == 0 {
+		return nil
+	}
+	exists, err := tableExists("entity")
+	if err != nil || !exists {
+		return err
+	}
+	first := migrations[0]
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", first.Version, first.Name); err != nil {
+		return fmt.Errorf("failed to record legacy schema as migration %04d: %w", first.Version, err)
+	}
+	applied[first.Version] = time.Now()
+	log.Printf("Existing schema detected; recorded it as migration %04d_%s.", first.Version, first.Name)
+	return nil
+}
+
+// migrationStatus lists every known migration together with its applied state.
+func migrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		at, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{Migration: m, Applied: ok, AppliedAt: at})
+	}
+	return statuses, nil
+}
+
+// migrateUp applies every pending migration in version order and returns how many ran.
+// MariaDB commits DDL implicitly, so each migration is recorded immediately after it
+// succeeds; a failure leaves the earlier migrations applied and stops the run.
+func migrateUp() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := adoptLegacySchema(migrations, applied); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Printf("Applying migration %04d_%s...", m.Version, m.Name)
+		if _, err := db.Exec(m.UpSQL); err != nil {
+			return count, fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+			return count, fmt.Errorf("failed to record migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// migrateDown reverts the most recently applied migrations, up to steps of them.
+func migrateDown(steps int) (int, error) {
+	statuses, err := migrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(statuses) - 1; i >= 0 && count < steps; i-- {
+		m := statuses[i]
+		if !m.Applied {
+			continue
+		}
+		log.Printf("Reverting migration %04d_%s...", m.Version, m.Name)
+		if _, err := db.Exec(m.DownSQL); err != nil {
+			return count, fmt.Errorf("revert of migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := db.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+			return count, fmt.Errorf("failed to unrecord migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// pendingMigrations returns the migrations that have not yet been applied.
+func pendingMigrations() ([]Migration, error) {
+	statuses, err := migrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range statuses {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// checkMigrations refuses to continue if the database schema is behind the binary.
+func checkMigrations() {
+	pending, err := pendingMigrations()
+	if err != nil {
+		log.Fatal("Failed to check schema migrations: ", err)
+	}
+	if len(pending) == 0 {
+		log.Println("✅ Database schema is up to date.")
+		return
+	}
+
+	var names []string
+	for _, m := range pending {
+		names = append(names, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+	}
+	log.Fatalf("Database schema is behind: %d pending migration(s): %s. Run `go run . migrate up` first.",
+		len(pending), strings.Join(names, ", "))
+}
+
+// runMigrateCommand implements the `migrate up|down [steps]|status` command line.
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up | down [steps] | status")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrateUp()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✅ Applied %d migration(s).", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatalf("Invalid number of steps: %s", args[1])
+			}
+		}
+		n, err := migrateDown(steps)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✅ Reverted %d migration(s).", n)
+	case "status":
+		statuses, err := migrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q (want up, down or status)\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,17 @@
+-- Reverts 0001_initial_schema: drops every table in reverse dependency order.
+
+DROP TABLE IF EXISTS entity_relationships;
+DROP TABLE IF EXISTS link_class;
+
+DROP TABLE IF EXISTS entity_tags;
+DROP TABLE IF EXISTS tag;
+DROP TABLE IF EXISTS taxonomy;
+
+DROP TABLE IF EXISTS contlet_heading;
+DROP TABLE IF EXISTS contlet_image;
+DROP TABLE IF EXISTS contlet_paragraph;
+DROP TABLE IF EXISTS content_piece_contlets;
+DROP TABLE IF EXISTS content_piece;
+DROP TABLE IF EXISTS contlet_class;
+
+DROP TABLE IF EXISTS entity;
@@ -0,0 +1,123 @@
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+-- LAYER 0: THE ENTITY CORE
+-- Provides a globally unique ID for every Object in the system.
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+CREATE TABLE entity (
+    id INT PRIMARY KEY AUTO_INCREMENT
+) ENGINE=InnoDB;
+
+
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+-- LAYER 1: THE STRUCTURAL CORE (The Content "Nodes")
+-- Defines the raw, addressable pieces of content.
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+-- A controlled vocabulary for the structural kinds of Contlet Classes.
+CREATE TABLE contlet_class (
+    name VARCHAR(255) PRIMARY KEY,
+    description TEXT NOT NULL
+) ENGINE=InnoDB;
+
+-- A composed assembly of Contlet Objects, representing a final output like a blog post.
+CREATE TABLE content_piece (
+    id INT PRIMARY KEY, -- FK to entity.id
+    class VARCHAR(255) NOT NULL, -- e.g., 'blog_post', 'tweet'
+    title TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    status VARCHAR(50) NOT NULL DEFAULT 'active',
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- The ordered assembly of Contlet Objects into a Content Piece Object.
+CREATE TABLE content_piece_contlets (
+    content_piece_id INT NOT NULL REFERENCES content_piece(id) ON DELETE CASCADE,
+    contlet_id INT NOT NULL REFERENCES entity(id) ON DELETE RESTRICT, -- Prevent deleting a contlet Object that is in use.
+    sort_order INT NOT NULL, -- Use spaced integers (100, 200, 300) for easy reordering.
+    PRIMARY KEY (content_piece_id, sort_order)
+) ENGINE=InnoDB;
+
+-- SPECIFIC CONTLET CLASS TABLES --
+
+CREATE TABLE contlet_paragraph (
+    id INT PRIMARY KEY, -- FK to entity.id
+    text_content TEXT NOT NULL,
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+CREATE TABLE contlet_image (
+    id INT PRIMARY KEY, -- FK to entity.id
+    src VARCHAR(1024) NOT NULL,
+    alt_text TEXT,
+    width INT,
+    height INT,
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+CREATE TABLE contlet_heading (
+    id INT PRIMARY KEY, -- FK to entity.id
+    text_content VARCHAR(1024) NOT NULL,
+    level INT NOT NULL DEFAULT 2 CHECK (level BETWEEN 1 AND 6),
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+-- LAYER 2: THE SEMANTIC LAYER (The "Tags")
+-- The descriptive metadata that makes content discoverable.
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+-- The high-level categories for tags (e.g., "General Keywords", "Programming Languages").
+CREATE TABLE taxonomy (
+    id INT PRIMARY KEY, -- FK to entity.id
+    name VARCHAR(255) NOT NULL UNIQUE,
+    description TEXT,
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- The specific Tag Objects. Each Tag Object MUST belong to a Taxonomy Object.
+CREATE TABLE tag (
+    id INT PRIMARY KEY, -- FK to entity.id
+    taxonomy_id INT NOT NULL REFERENCES taxonomy(id) ON DELETE RESTRICT,
+    value VARCHAR(255) NOT NULL,
+    -- Ensures a tag's value is unique within its taxonomy.
+    UNIQUE (taxonomy_id, value),
+    FOREIGN KEY (id) REFERENCES entity(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- Links any entity `Object` (Contlets, Content Pieces, etc.) to Tag Objects.
+CREATE TABLE entity_tags (
+    entity_id INT NOT NULL REFERENCES entity(id) ON DELETE CASCADE,
+    tag_id INT NOT NULL REFERENCES tag(id) ON DELETE CASCADE,
+    PRIMARY KEY (entity_id, tag_id)
+) ENGINE=InnoDB;
+
+
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+-- LAYER 3: THE RELATIONAL LAYER (The "Links")
+-- The generalized knowledge graph connecting all `Objects`.
+-- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+-- A controlled vocabulary for the "verbs" or types of relationships.
+CREATE TABLE link_class (
+    name VARCHAR(255) PRIMARY KEY,
+    description TEXT NOT NULL,
+    -- Optional: define symmetric relationships, e.g., 'related_to'
+    symmetric_link VARCHAR(255) REFERENCES link_class(name)
+) ENGINE=InnoDB;
+
+-- The heart of the knowledge graph. Links any `Object` to any other `Object`.
+CREATE TABLE entity_relationships (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    -- The "Subject" of the link (the "from" node)
+    subject_id INT NOT NULL REFERENCES entity(id) ON DELETE CASCADE,
+    -- The "Verb" of the link
+    link_type VARCHAR(255) NOT NULL REFERENCES link_class(name),
+    -- The "Object" of the link (the "to" node)
+    object_id INT NOT NULL REFERENCES entity(id) ON DELETE CASCADE,
+    -- Optional metadata about the link itself
+    source TEXT,
+    confidence REAL CHECK (confidence BETWEEN 0.0 AND 1.0),
+    -- Ensures a specific link between two `Objects` is not duplicated.
+    UNIQUE (subject_id, link_type, object_id)
+) ENGINE=InnoDB;
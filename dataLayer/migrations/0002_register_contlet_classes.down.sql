@@ -0,0 +1 @@
+DELETE FROM contlet_class WHERE name IN ('paragraph', 'heading', 'image');
@@ -0,0 +1,6 @@
+-- Register the built-in contlet classes in the contlet_class vocabulary.
+-- Every contlet_<name> table must have a row here to be used by the application.
+INSERT IGNORE INTO contlet_class (name, description) VALUES
+    ('paragraph', 'A block of body text.'),
+    ('heading', 'A section heading with a level from 1 to 6.'),
+    ('image', 'An image with a source URL, alt text and optional dimensions.');
@@ -0,0 +1,3 @@
+ALTER TABLE entity
+    DROP INDEX idx_entity_class,
+    DROP COLUMN class;
@@ -0,0 +1,13 @@
+-- Record the class of every entity as the name of the table holding the object
+-- (e.g. 'content_piece', 'contlet_image', 'tag'), so that any entity id can be
+-- resolved to its object without probing every class table.
+ALTER TABLE entity
+    ADD COLUMN class VARCHAR(255) NULL,
+    ADD INDEX idx_entity_class (class);
+
+UPDATE entity e JOIN content_piece t ON t.id = e.id SET e.class = 'content_piece';
+UPDATE entity e JOIN contlet_paragraph t ON t.id = e.id SET e.class = 'contlet_paragraph';
+UPDATE entity e JOIN contlet_heading t ON t.id = e.id SET e.class = 'contlet_heading';
+UPDATE entity e JOIN contlet_image t ON t.id = e.id SET e.class = 'contlet_image';
+UPDATE entity e JOIN taxonomy t ON t.id = e.id SET e.class = 'taxonomy';
+UPDATE entity e JOIN tag t ON t.id = e.id SET e.class = 'tag';
@@ -0,0 +1,14 @@
+-- Immutable revisions of content pieces and contlets. Each row is a full JSON
+-- snapshot of the object (its class row, its tags and, for pieces, the ordered
+-- contlets) taken in the transaction of the change that produced it.
+-- Revisions outlive their object, so there is no foreign key to entity.
+CREATE TABLE revision (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    entity_id INT NOT NULL,
+    revision_number INT NOT NULL, -- 1, 2, 3, ... per entity
+    author VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    summary VARCHAR(255) NOT NULL,
+    snapshot LONGTEXT NOT NULL CHECK (JSON_VALID(snapshot)),
+    UNIQUE (entity_id, revision_number)
+) ENGINE=InnoDB;
@@ -0,0 +1,3 @@
+ALTER TABLE content_piece ALTER COLUMN status SET DEFAULT 'active';
+UPDATE content_piece SET status = 'active' WHERE status IN ('draft', 'published');
+DROP TABLE published_piece;
@@ -0,0 +1,14 @@
+-- The published state of content pieces. A row is a frozen JSON snapshot of a
+-- piece (its title, fields and ordered contlets with their content) taken when
+-- it was published; delivery endpoints serve it while editors change the draft.
+CREATE TABLE published_piece (
+    piece_id INT PRIMARY KEY,
+    snapshot LONGTEXT NOT NULL CHECK (JSON_VALID(snapshot)),
+    published_by VARCHAR(255) NOT NULL,
+    published_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (piece_id) REFERENCES content_piece(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- The status of a piece is now 'draft' or 'published'; nothing has been published yet.
+UPDATE content_piece SET status = 'draft' WHERE status = 'active';
+ALTER TABLE content_piece ALTER COLUMN status SET DEFAULT 'draft';
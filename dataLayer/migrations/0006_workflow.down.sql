@@ -0,0 +1,4 @@
+DROP TABLE status_change;
+DROP TABLE role_member;
+DROP TABLE workflow_transition;
+DROP TABLE workflow_status;
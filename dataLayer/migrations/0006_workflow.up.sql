@@ -0,0 +1,58 @@
+-- The editorial workflow of content pieces: the statuses a piece can be in, the
+-- transitions between them and who may make each one. content_piece.status
+-- holds the name of a workflow_status.
+CREATE TABLE workflow_status (
+    name VARCHAR(50) PRIMARY KEY,
+    label VARCHAR(255) NOT NULL,
+    sort_order INT NOT NULL, -- the status with the lowest sort_order is given to new pieces
+    published BOOLEAN NOT NULL DEFAULT FALSE -- pieces in this status are delivered to readers
+) ENGINE=InnoDB;
+
+CREATE TABLE workflow_transition (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    from_status VARCHAR(50) NOT NULL REFERENCES workflow_status(name) ON DELETE CASCADE,
+    to_status VARCHAR(50) NOT NULL REFERENCES workflow_status(name) ON DELETE CASCADE,
+    label VARCHAR(255) NOT NULL, -- e.g. 'Approve'
+    approver_role VARCHAR(50), -- NULL: anyone may make the transition
+    requires_comment BOOLEAN NOT NULL DEFAULT FALSE, -- e.g. rejections must say why
+    UNIQUE (from_status, to_status)
+) ENGINE=InnoDB;
+
+-- Who holds which approver role, by the user name recorded as the author of changes.
+CREATE TABLE role_member (
+    role VARCHAR(50) NOT NULL,
+    user_name VARCHAR(255) NOT NULL,
+    PRIMARY KEY (role, user_name)
+) ENGINE=InnoDB;
+
+-- Every status change of a piece, with the comment given for it.
+CREATE TABLE status_change (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    piece_id INT NOT NULL REFERENCES content_piece(id) ON DELETE CASCADE,
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    author VARCHAR(255) NOT NULL,
+    comment TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+INSERT INTO workflow_status (name, label, sort_order, published) VALUES
+    ('draft', 'Draft', 100, FALSE),
+    ('in_review', 'In review', 200, FALSE),
+    ('approved', 'Approved', 300, FALSE),
+    ('published', 'Published', 400, TRUE),
+    ('archived', 'Archived', 500, FALSE);
+
+INSERT INTO workflow_transition (from_status, to_status, label, approver_role, requires_comment) VALUES
+    ('draft', 'in_review', 'Submit for review', NULL, FALSE),
+    ('in_review', 'approved', 'Approve', 'publisher', FALSE),
+    ('in_review', 'draft', 'Reject', 'publisher', TRUE),
+    ('approved', 'published', 'Publish', 'publisher', FALSE),
+    ('approved', 'draft', 'Reopen', NULL, FALSE),
+    ('published', 'published', 'Publish changes', 'publisher', FALSE),
+    ('published', 'draft', 'Unpublish', 'publisher', FALSE),
+    ('published', 'archived', 'Archive', 'publisher', FALSE),
+    ('archived', 'draft', 'Reopen', NULL, FALSE);
+
+-- Until user names are set up, everyone is "anonymous" and may approve, as before.
+INSERT INTO role_member (role, user_name) VALUES ('publisher', 'anonymous');
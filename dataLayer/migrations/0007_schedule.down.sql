@@ -0,0 +1,7 @@
+ALTER TABLE content_piece
+    DROP INDEX idx_content_piece_unpublish_at,
+    DROP INDEX idx_content_piece_publish_at,
+    DROP COLUMN schedule_error,
+    DROP COLUMN scheduled_by,
+    DROP COLUMN unpublish_at,
+    DROP COLUMN publish_at;
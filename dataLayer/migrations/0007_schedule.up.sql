@@ -0,0 +1,11 @@
+-- Scheduled publishing and expiry of content pieces. The scheduler makes the
+-- workflow transition into a published status at publish_at and out of it at
+-- unpublish_at, and clears each time in the transaction that acts on it, so
+-- that a scheduled time fires once however often the server restarts.
+ALTER TABLE content_piece
+    ADD COLUMN publish_at DATETIME NULL, -- UTC
+    ADD COLUMN unpublish_at DATETIME NULL, -- UTC
+    ADD COLUMN scheduled_by VARCHAR(255) NULL, -- the user the scheduled transitions are made as
+    ADD COLUMN schedule_error TEXT NULL, -- why a due transition failed; the schedule is held until it is changed
+    ADD INDEX idx_content_piece_publish_at (publish_at),
+    ADD INDEX idx_content_piece_unpublish_at (unpublish_at);
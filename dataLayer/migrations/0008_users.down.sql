@@ -0,0 +1,6 @@
+ALTER TABLE role_member
+    DROP FOREIGN KEY fk_role_member_user,
+    DROP INDEX fk_role_member_user;
+INSERT IGNORE INTO role_member (role, user_name) VALUES ('publisher', 'anonymous');
+DROP TABLE user_session;
+DROP TABLE app_user;
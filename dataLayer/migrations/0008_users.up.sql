@@ -0,0 +1,26 @@
+-- User accounts and their login sessions. Roles are granted to accounts in
+-- role_member: the access roles viewer, editor, publisher and schema_admin, and
+-- any approver role the editorial workflow names.
+CREATE TABLE app_user (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_name VARCHAR(255) NOT NULL UNIQUE,
+    password_hash VARCHAR(255) NULL, -- PBKDF2; NULL: the account cannot log in until a password is set
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+CREATE TABLE user_session (
+    token_hash CHAR(64) PRIMARY KEY, -- hex SHA-256 of the session cookie; the cookie itself is not stored
+    user_id INT NOT NULL,
+    created_at DATETIME NOT NULL, -- UTC
+    expires_at DATETIME NOT NULL, -- UTC
+    FOREIGN KEY (user_id) REFERENCES app_user(id) ON DELETE CASCADE,
+    INDEX idx_user_session_expires_at (expires_at)
+) ENGINE=InnoDB;
+
+-- Everyone was "anonymous" before there were accounts. The other user names that
+-- hold roles become accounts without a password.
+DELETE FROM role_member WHERE user_name = 'anonymous';
+INSERT INTO app_user (user_name) SELECT DISTINCT user_name FROM role_member;
+ALTER TABLE role_member
+    ADD CONSTRAINT fk_role_member_user FOREIGN KEY (user_name) REFERENCES app_user(user_name)
+        ON DELETE CASCADE ON UPDATE CASCADE;
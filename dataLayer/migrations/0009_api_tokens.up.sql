@@ -0,0 +1,19 @@
+-- API tokens for machine clients. A token acts as the account it belongs to,
+-- limited to its scopes: personal tokens belong to the user who made them,
+-- service tokens to an account (usually without a password) made for a pipeline
+-- or integration. Only the SHA-256 of a token is stored.
+CREATE TABLE api_token (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(255) NOT NULL, -- what the token is for, e.g. 'nightly site build'
+    token_hash CHAR(64) NOT NULL UNIQUE, -- hex SHA-256 of the token
+    token_prefix VARCHAR(16) NOT NULL, -- the start of the token, to recognize it by
+    user_id INT NOT NULL,
+    kind ENUM('personal', 'service') NOT NULL,
+    scopes VARCHAR(255) NOT NULL, -- comma-separated, e.g. 'pieces:read,pieces:write'
+    created_by VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL, -- UTC
+    expires_at DATETIME NOT NULL, -- UTC
+    last_used_at DATETIME NULL, -- UTC, updated at most once a minute
+    revoked_at DATETIME NULL, -- UTC
+    FOREIGN KEY (user_id) REFERENCES app_user(id) ON DELETE CASCADE
+) ENGINE=InnoDB;
@@ -0,0 +1,698 @@
+// In file: openapi.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The OpenAPI document of the JSON API is generated from the live schema: the
+// columns of every class table and the contlet class registry. Classes change at
+// runtime, so the document is cached only until the next schema change.
+
+// jsonObject is a JSON object of the OpenAPI document.
+type jsonObject = map[string]interface{}
+
+// openAPICache holds the encoded document and its ETag. An empty body means it
+// has to be regenerated.
+var openAPICache struct {
+	sync.Mutex
+	body []byte
+	etag string
+}
+
+// invalidateOpenAPI discards the cached OpenAPI document. It must be called
+// after every change to the class tables or the contlet class registry.
+func invalidateOpenAPI() {
+	openAPICache.Lock()
+	openAPICache.body = nil
+	openAPICache.Unlock()
+}
+
+// openAPIHandler serves /api/openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	openAPICache.Lock()
+	if openAPICache.body == nil {
+		doc, err := buildOpenAPI()
+		if err == nil {
+			openAPICache.body, err = json.MarshalIndent(doc, "", "  ")
+		}
+		if err != nil {
+			openAPICache.Unlock()
+			writeAPIErrorFor(w, "Failed to generate OpenAPI document: ", err)
+			return
+		}
+		sum := sha256.Sum256(openAPICache.body)
+		openAPICache.etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+	}
+	body, etag := openAPICache.body, openAPICache.etag
+	openAPICache.Unlock()
+
+	// The ETag changes with the schema, so clients can tell when to regenerate their SDKs.
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// ref returns a reference to a schema of the document's components.
+func ref(name string) jsonObject {
+	return jsonObject{"$ref": "#/components/schemas/" + name}
+}
+
+// arrayOf returns an array schema.
+func arrayOf(items jsonObject) jsonObject {
+	return jsonObject{"type": "array", "items": items}
+}
+
+// objectSchema returns an object schema with the given properties and required members.
+func objectSchema(properties jsonObject, required ...string) jsonObject {
+	s := jsonObject{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// schemaName turns a table name into a component name, e.g. contlet_image into ContletImage.
+func schemaName(table string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(table, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// fieldValueSchema describes the value of an administrator-defined field. Values
+// are returned as the strings shown in the object forms; requests may also send
+// numbers and booleans.
+func fieldValueSchema(f ClassField) jsonObject {
+	s := jsonObject{"type": "string", "description": f.Type.Label, "x-field-type": f.Type.Name}
+	switch f.Type.Name {
+	case "single_line_text":
+		s["maxLength"] = 255
+	case "url":
+		s["format"] = "uri"
+		s["maxLength"] = 2048
+	case "number":
+		s["pattern"] = `^-?[0-9]+$`
+	case "decimal":
+		s["pattern"] = `^-?[0-9]+(\.[0-9]{1,2})?$`
+	case "date":
+		s["format"] = "date"
+	case "datetime":
+		s["pattern"] = `^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}(:[0-9]{2})?$`
+	case "boolean":
+		s["enum"] = []string{"0", "1"}
+	}
+	if f.Default.Valid {
+		s["default"] = f.Type.Display(f.Default.String)
+	}
+	return s
+}
+
+// fieldsSchema describes the "fields" member of the objects of a class table.
+func fieldsSchema(fields []ClassField) jsonObject {
+	properties := jsonObject{}
+	var required []string
+	for _, f := range fields {
+		properties[f.Name] = fieldValueSchema(f)
+		if f.Required && !f.Default.Valid {
+			required = append(required, f.Name)
+		}
+	}
+	s := objectSchema(properties, required...)
+	s["description"] = "Administrator-defined fields. When updating, omit the member to keep the stored values."
+	return s
+}
+
+// columnSchema describes a system column of a contlet class by its SQL type.
+func columnSchema(col ColumnDetail) jsonObject {
+	t := strings.ToLower(col.Type)
+	if strings.Contains(t, "int") {
+		return jsonObject{"type": "integer"}
+	}
+	return jsonObject{"type": "string"}
+}
+
+// buildOpenAPI generates the OpenAPI document of the JSON API from the current schema.
+func buildOpenAPI() (jsonObject, error) {
+	tables, err := getSchemaDetails()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	return openAPIDocument(tables), nil
+}
+
+// openAPIDocument builds the OpenAPI document for the given table columns and
+// the registered contlet classes.
+func openAPIDocument(tables map[string][]ColumnDetail) jsonObject {
+	fieldsOf := func(table string) jsonObject {
+		return fieldsSchema(classFieldsOf(table, tables[table]))
+	}
+
+	statusSchema := jsonObject{"type": "string", "description": "The name of a status of the editorial workflow; see /workflow."}
+
+	schemas := jsonObject{
+		"Error": objectSchema(jsonObject{
+			"error": objectSchema(jsonObject{
+				"status":  jsonObject{"type": "integer"},
+				"message": jsonObject{"type": "string"},
+			}, "status", "message"),
+		}, "error"),
+		"EntityRef": objectSchema(jsonObject{
+			"id":    jsonObject{"type": "integer"},
+			"kind":  jsonObject{"type": "string", "enum": []string{"piece", "contlet", "tag", "taxonomy", ""}},
+			"label": jsonObject{"type": "string"},
+		}, "id", "kind", "label"),
+		"TagAttachment": objectSchema(jsonObject{"tag_id": jsonObject{"type": "integer"}}, "tag_id"),
+
+		// Pieces
+		"PieceSummary": objectSchema(jsonObject{
+			"id":     jsonObject{"type": "integer"},
+			"class":  jsonObject{"type": "string"},
+			"title":  jsonObject{"type": "string"},
+			"status": statusSchema,
+		}, "id", "class", "title", "status"),
+		"PieceFields": fieldsOf("content_piece"),
+		"Piece": objectSchema(jsonObject{
+			"id":       jsonObject{"type": "integer"},
+			"class":    jsonObject{"type": "string"},
+			"title":    jsonObject{"type": "string"},
+			"contlets": jsonObject{"type": "array", "items": ref("Contlet"), "description": "The contlets of the piece, in order."},
+			"fields":   ref("PieceFields"),
+			"status":   statusSchema,
+		}, "id", "class", "title", "contlets", "fields", "status"),
+		"PublishedPiece": objectSchema(jsonObject{
+			"id":           jsonObject{"type": "integer"},
+			"class":        jsonObject{"type": "string"},
+			"title":        jsonObject{"type": "string"},
+			"contlets":     jsonObject{"type": "array", "items": ref("Contlet"), "description": "The contlets of the piece, in order, as they were when it was published."},
+			"fields":       ref("PieceFields"),
+			"published_at": jsonObject{"type": "string", "format": "date-time"},
+			"published_by": jsonObject{"type": "string"},
+		}, "id", "class", "title", "contlets", "fields", "published_at", "published_by"),
+		"WorkflowStatus": objectSchema(jsonObject{
+			"name":        jsonObject{"type": "string"},
+			"label":       jsonObject{"type": "string"},
+			"sort_order":  jsonObject{"type": "integer"},
+			"published":   jsonObject{"type": "boolean", "description": "Whether pieces in this status are delivered to readers."},
+			"piece_count": jsonObject{"type": "integer"},
+		}, "name", "label", "sort_order", "published", "piece_count"),
+		"WorkflowTransition": objectSchema(jsonObject{
+			"id":               jsonObject{"type": "integer"},
+			"from":             jsonObject{"type": "string"},
+			"to":               jsonObject{"type": "string"},
+			"label":            jsonObject{"type": "string"},
+			"approver_role":    jsonObject{"type": "string", "description": "Only members of this role may make the transition; absent if anyone may."},
+			"requires_comment": jsonObject{"type": "boolean"},
+		}, "id", "from", "to", "label", "requires_comment"),
+		"Workflow": objectSchema(jsonObject{
+			"statuses":    arrayOf(ref("WorkflowStatus")),
+			"transitions": arrayOf(ref("WorkflowTransition")),
+		}, "statuses", "transitions"),
+		"StatusRequest": objectSchema(jsonObject{
+			"to":      jsonObject{"type": "string"},
+			"comment": jsonObject{"type": "string"},
+		}, "to"),
+		"PieceStatus": objectSchema(jsonObject{
+			"status":      statusSchema,
+			"transitions": jsonObject{"type": "array", "items": ref("WorkflowTransition"), "description": "The transitions out of the current status."},
+			"changes": jsonObject{"type": "array", "description": "Earlier status changes, newest first.", "items": objectSchema(jsonObject{
+				"from":       jsonObject{"type": "string"},
+				"to":         jsonObject{"type": "string"},
+				"author":     jsonObject{"type": "string"},
+				"comment":    jsonObject{"type": "string"},
+				"created_at": jsonObject{"type": "string", "format": "date-time"},
+			}, "from", "to", "author", "comment", "created_at")},
+		}, "status", "transitions", "changes"),
+		"PublicationState": objectSchema(jsonObject{
+			"status":       statusSchema,
+			"published":    jsonObject{"type": "boolean"},
+			"changed":      jsonObject{"type": "boolean", "description": "Whether the draft differs from the published version."},
+			"published_at": jsonObject{"type": "string", "format": "date-time", "nullable": true},
+			"published_by": jsonObject{"type": "string"},
+		}, "status", "published", "changed", "published_at"),
+		"PieceSchedule": objectSchema(jsonObject{
+			"publish_at":   jsonObject{"type": "string", "format": "date-time", "nullable": true, "description": "When the piece is to be published; null if it is not scheduled."},
+			"unpublish_at": jsonObject{"type": "string", "format": "date-time", "nullable": true, "description": "When the piece is to be taken down; must be after publish_at."},
+			"scheduled_by": jsonObject{"type": "string", "readOnly": true, "description": "The user the scheduled transitions are made as."},
+			"error":        jsonObject{"type": "string", "readOnly": true, "description": "Why a due transition failed; the schedule is held until it is changed."},
+		}, "publish_at", "unpublish_at"),
+		"ScheduledPiece": objectSchema(jsonObject{
+			"piece_id":     jsonObject{"type": "integer"},
+			"title":        jsonObject{"type": "string"},
+			"status":       statusSchema,
+			"publish_at":   jsonObject{"type": "string", "format": "date-time", "nullable": true},
+			"unpublish_at": jsonObject{"type": "string", "format": "date-time", "nullable": true},
+			"scheduled_by": jsonObject{"type": "string"},
+			"error":        jsonObject{"type": "string"},
+		}, "piece_id", "title", "status", "publish_at", "unpublish_at"),
+		"Rendering": objectSchema(jsonObject{
+			"piece_id": jsonObject{"type": "integer"},
+			"class":    jsonObject{"type": "string"},
+			"channel": objectSchema(jsonObject{
+				"name":           jsonObject{"type": "string", "enum": channelNames()},
+				"label":          jsonObject{"type": "string"},
+				"content_type":   jsonObject{"type": "string"},
+				"max_chars":      jsonObject{"type": "integer", "description": "The most characters a part may have."},
+				"max_parts":      jsonObject{"type": "integer"},
+				"max_line_chars": jsonObject{"type": "integer", "description": "The most characters a line may have."},
+			}, "name", "label", "content_type"),
+			"parts":      jsonObject{"type": "array", "items": jsonObject{"type": "string"}, "description": "The output; a thread has one part per post."},
+			"violations": jsonObject{"type": "array", "items": jsonObject{"type": "string"}, "description": "The limits of the channel the output breaks."},
+		}, "piece_id", "class", "channel", "parts", "violations"),
+		"PieceInput": objectSchema(jsonObject{
+			"title":          jsonObject{"type": "string", "minLength": 1},
+			"class":          jsonObject{"type": "string"},
+			"fields":         ref("PieceFields"),
+			"status":         jsonObject{"type": "string", "description": "Only when updating. A status other than the current one must be an allowed transition for the requesting user."},
+			"status_comment": jsonObject{"type": "string", "description": "The comment for the status change; some transitions, such as rejections, require one."},
+		}, "title"),
+
+		// Contlets
+		"ContletSummary": objectSchema(jsonObject{
+			"id":      jsonObject{"type": "integer"},
+			"class":   jsonObject{"type": "string", "enum": contletClassNames()},
+			"content": jsonObject{"type": "string"},
+			"fields":  jsonObject{"type": "object", "additionalProperties": jsonObject{"type": "string"}},
+		}, "id", "class", "content", "fields"),
+
+		// Tags and taxonomies
+		"TagFields": fieldsOf("tag"),
+		"Tag": objectSchema(jsonObject{
+			"id":            jsonObject{"type": "integer"},
+			"value":         jsonObject{"type": "string"},
+			"taxonomy_id":   jsonObject{"type": "integer"},
+			"taxonomy_name": jsonObject{"type": "string"},
+			"fields":        jsonObject{"allOf": []jsonObject{ref("TagFields")}, "description": "Only returned for a single tag."},
+		}, "id", "value", "taxonomy_id", "taxonomy_name"),
+		"TagInput": objectSchema(jsonObject{
+			"taxonomy_id": jsonObject{"type": "integer"},
+			"value":       jsonObject{"type": "string", "minLength": 1},
+			"fields":      ref("TagFields"),
+		}, "taxonomy_id", "value"),
+		"TaxonomyFields": fieldsOf("taxonomy"),
+		"Taxonomy": objectSchema(jsonObject{
+			"id":          jsonObject{"type": "integer"},
+			"name":        jsonObject{"type": "string"},
+			"description": jsonObject{"type": "string"},
+			"tag_count":   jsonObject{"type": "integer"},
+			"fields":      jsonObject{"allOf": []jsonObject{ref("TaxonomyFields")}, "description": "Only returned for a single taxonomy."},
+		}, "id", "name", "description", "tag_count"),
+		"TaxonomyInput": objectSchema(jsonObject{
+			"name":        jsonObject{"type": "string", "minLength": 1},
+			"description": jsonObject{"type": "string"},
+			"fields":      ref("TaxonomyFields"),
+		}, "name"),
+
+		// Links
+		"Link": objectSchema(jsonObject{
+			"id":         jsonObject{"type": "integer"},
+			"subject":    ref("EntityRef"),
+			"link_type":  jsonObject{"type": "string"},
+			"object":     ref("EntityRef"),
+			"source":     jsonObject{"type": "string"},
+			"confidence": jsonObject{"type": "number", "minimum": 0, "maximum": 1, "nullable": true},
+		}, "id", "subject", "link_type", "object", "source", "confidence"),
+		"LinkInput": objectSchema(jsonObject{
+			"subject_id": jsonObject{"type": "integer"},
+			"link_type":  jsonObject{"type": "string", "description": "The name of a link class. Symmetric link classes also create the inverse edge."},
+			"object_id":  jsonObject{"type": "integer"},
+			"source":     jsonObject{"type": "string"},
+			"confidence": jsonObject{"type": "number", "minimum": 0, "maximum": 1, "nullable": true},
+		}, "subject_id", "link_type", "object_id"),
+		"LinkUpdate": objectSchema(jsonObject{
+			"source":     jsonObject{"type": "string"},
+			"confidence": jsonObject{"type": "number", "minimum": 0, "maximum": 1, "nullable": true},
+		}),
+		"Entity": objectSchema(jsonObject{
+			"id":     jsonObject{"type": "integer"},
+			"class":  jsonObject{"type": "string", "description": "The table holding the object, e.g. content_piece or contlet_image."},
+			"kind":   jsonObject{"type": "string", "enum": []string{"piece", "contlet", "tag", "taxonomy"}},
+			"object": jsonObject{"type": "object", "description": "The piece, contlet, tag or taxonomy."},
+		}, "id", "class", "kind", "object"),
+
+		// Schema
+		"FieldType": objectSchema(jsonObject{
+			"name":     jsonObject{"type": "string"},
+			"label":    jsonObject{"type": "string"},
+			"sql_type": jsonObject{"type": "string"},
+			"widget":   jsonObject{"type": "string"},
+		}, "name", "label", "sql_type", "widget"),
+		"SchemaColumn": objectSchema(jsonObject{
+			"name":       jsonObject{"type": "string"},
+			"sql_type":   jsonObject{"type": "string"},
+			"field_type": jsonObject{"type": "string"},
+			"required":   jsonObject{"type": "boolean"},
+			"default":    jsonObject{"type": "string", "nullable": true},
+			"system":     jsonObject{"type": "boolean"},
+		}, "name", "sql_type", "required", "default", "system"),
+		"SchemaTable": objectSchema(jsonObject{
+			"name":     jsonObject{"type": "string"},
+			"is_class": jsonObject{"type": "boolean"},
+			"columns":  arrayOf(ref("SchemaColumn")),
+		}, "name", "is_class", "columns"),
+		"Schema": objectSchema(jsonObject{
+			"field_types": arrayOf(ref("FieldType")),
+			"tables":      arrayOf(ref("SchemaTable")),
+		}, "field_types", "tables"),
+		"FieldInput": objectSchema(jsonObject{
+			"name":     jsonObject{"type": "string", "pattern": `^[A-Za-z_][A-Za-z0-9_]*$`, "maxLength": 64, "description": "Only when adding a field."},
+			"type":     jsonObject{"type": "string", "enum": fieldTypeNames()},
+			"required": jsonObject{"type": "boolean"},
+			"default":  jsonObject{"type": "string"},
+		}, "type"),
+		"SchemaPlan": objectSchema(jsonObject{
+			"table": jsonObject{"type": "string"},
+			"changes": arrayOf(objectSchema(jsonObject{
+				"action": jsonObject{"type": "string", "enum": []string{"add", "modify", "drop"}},
+				"column": jsonObject{"type": "string"},
+				"from":   jsonObject{"type": "string"},
+				"to":     jsonObject{"type": "string"},
+				"clause": jsonObject{"type": "string"},
+				"risks": jsonObject{"type": "array", "nullable": true, "items": objectSchema(jsonObject{
+					"description": jsonObject{"type": "string"},
+					"rows":        jsonObject{"type": "integer"},
+				}, "description", "rows")},
+			}, "action", "column", "from", "to", "clause", "risks")),
+			"ddl":           jsonObject{"type": "string"},
+			"affected_rows": jsonObject{"type": "integer"},
+			"applied":       jsonObject{"type": "boolean"},
+		}, "table", "changes", "ddl", "affected_rows", "applied"),
+	}
+
+	// Each registered contlet class gets its own schema; Contlet and ContletInput
+	// are unions of them, discriminated by class.
+	var contlets, inputs []jsonObject
+	mapping, inputMapping := map[string]string{}, map[string]string{}
+	for _, c := range getContletClasses() {
+		table := c.Table()
+		name := schemaName(table)
+		properties := jsonObject{
+			"id":         jsonObject{"type": "integer"},
+			"class":      jsonObject{"type": "string", "enum": []string{c.Name}},
+			"summary":    jsonObject{"type": "string"},
+			"sort_order": jsonObject{"type": "integer", "description": "Position within the piece; only set for the contlets of a piece."},
+			"fields":     ref(name + "Fields"),
+		}
+		inputProperties := jsonObject{
+			"class":  jsonObject{"type": "string", "enum": []string{c.Name}},
+			"fields": ref(name + "Fields"),
+		}
+		inputRequired := []string{"class"}
+		for _, col := range tables[table] {
+			if col.Field == "id" || !isSystemColumn(table, col.Field) {
+				continue
+			}
+			properties[col.Field] = columnSchema(col)
+			inputProperties[col.Field] = columnSchema(col)
+			if col.Null == "NO" && !col.Default.Valid {
+				inputRequired = append(inputRequired, col.Field)
+			}
+		}
+
+		schemas[name+"Fields"] = fieldsOf(table)
+		schemas[name] = objectSchema(properties, "id", "class", "summary", "fields")
+		schemas[name+"Input"] = objectSchema(inputProperties, inputRequired...)
+		contlets = append(contlets, ref(name))
+		inputs = append(inputs, ref(name+"Input"))
+		mapping[c.Name] = "#/components/schemas/" + name
+		inputMapping[c.Name] = "#/components/schemas/" + name + "Input"
+	}
+	schemas["Contlet"] = jsonObject{
+		"oneOf":         contlets,
+		"discriminator": jsonObject{"propertyName": "class", "mapping": mapping},
+	}
+	schemas["ContletInput"] = jsonObject{
+		"oneOf":         inputs,
+		"discriminator": jsonObject{"propertyName": "class", "mapping": inputMapping},
+		"description":   "When updating, class may be omitted; the class of a contlet cannot change.",
+	}
+
+	paths := jsonObject{}
+	addResourcePaths(paths, "pieces", "Piece", "PieceSummary", "PieceInput", true, nil)
+	addResourcePaths(paths, "contlets", "Contlet", "ContletSummary", "ContletInput", true, nil)
+	addResourcePaths(paths, "tags", "Tag", "Tag", "TagInput", true, []jsonObject{
+		queryParam("taxonomy_id", "integer", "Only list the tags of this taxonomy."),
+	})
+	addResourcePaths(paths, "taxonomies", "Taxonomy", "Taxonomy", "TaxonomyInput", true, nil)
+	addResourcePaths(paths, "links", "Link", "Link", "LinkInput", false, []jsonObject{
+		queryParam("entity_id", "integer", "Only list the links from or to this entity."),
+		queryParam("link_type", "string", "Only list the links of this link class."),
+	})
+	paths["/links/{id}"].(jsonObject)["put"].(jsonObject)["requestBody"] = jsonBody(ref("LinkUpdate"))
+	paths["/entities/{id}"] = jsonObject{
+		"parameters": []jsonObject{pathParam("id", "integer")},
+		"get": operation("getEntity", "entities", "Look up any object by its entity ID, whatever its class", jsonObject{
+			"200": jsonResponse("The object with its class", ref("Entity")),
+		}),
+	}
+	addPublicationPaths(paths)
+	addSchemaPaths(paths)
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":       "Sherpa data layer API",
+			"version":     "v1",
+			"description": "Generated from the live class schema; it changes when classes or their fields change.",
+		},
+		"servers":  []jsonObject{{"url": strings.TrimSuffix(apiPrefix, "/")}},
+		"security": []jsonObject{{"session": []string{}}, {"bearer": []string{}}},
+		"paths":    paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"session": jsonObject{"type": "apiKey", "in": "cookie", "name": sessionCookie,
+					"description": "The session cookie set by logging in at /login. Reading needs the viewer role, changing the editor role, deleting pieces the publisher role and changing the schema the schema_admin role."},
+				"bearer": jsonObject{"type": "http", "scheme": "bearer",
+					"description": "An API token created at /tokens. Besides the roles of its account, it needs the pieces:read scope to read and run GraphQL queries, pieces:write to change content and schema:admin to change the schema."},
+			},
+			"responses": jsonObject{
+				"Error": jsonResponse("Error", ref("Error")),
+			},
+		},
+	}
+}
+
+// fieldTypeNames returns the keys of the semantic field types.
+func fieldTypeNames() []string {
+	names := make([]string, len(fieldTypes))
+	for i, ft := range fieldTypes {
+		names[i] = ft.Name
+	}
+	return names
+}
+
+// jsonBody returns a request body or response content of the given schema.
+func jsonBody(schema jsonObject) jsonObject {
+	return jsonObject{"required": true, "content": jsonObject{"application/json": jsonObject{"schema": schema}}}
+}
+
+// jsonResponse returns a response with a JSON body of the given schema.
+func jsonResponse(description string, schema jsonObject) jsonObject {
+	return jsonObject{"description": description, "content": jsonBody(schema)["content"]}
+}
+
+// queryParam returns an optional query parameter.
+func queryParam(name, typ, description string) jsonObject {
+	return jsonObject{"name": name, "in": "query", "description": description, "schema": jsonObject{"type": typ}}
+}
+
+// pathParam returns a required path parameter.
+func pathParam(name, typ string) jsonObject {
+	return jsonObject{"name": name, "in": "path", "required": true, "schema": jsonObject{"type": typ}}
+}
+
+// operation returns an operation with the error responses every route can give.
+func operation(id, tag, summary string, responses jsonObject) jsonObject {
+	errorRef := jsonObject{"$ref": "#/components/responses/Error"}
+	for _, code := range []string{"400", "401", "403", "404", "409", "default"} {
+		responses[code] = errorRef
+	}
+	return jsonObject{"operationId": id, "tags": []string{tag}, "summary": summary, "responses": responses}
+}
+
+// addResourcePaths adds the routes apiRouter serves for one resource.
+func addResourcePaths(paths jsonObject, resource, schema, summarySchema, inputSchema string, taggable bool, listParams []jsonObject) {
+	plural := schemaName(resource)
+	idParam := []jsonObject{pathParam("id", "integer")}
+
+	list := operation("list"+plural, resource, "List "+resource, jsonObject{
+		"200": jsonResponse("The "+resource, arrayOf(ref(summarySchema))),
+	})
+	if len(listParams) > 0 {
+		list["parameters"] = listParams
+	}
+	create := operation("create"+schema, resource, "Create a "+strings.ToLower(schema), jsonObject{
+		"201": jsonResponse("The new "+strings.ToLower(schema), ref(schema)),
+	})
+	create["requestBody"] = jsonBody(ref(inputSchema))
+	paths["/"+resource] = jsonObject{"get": list, "post": create}
+
+	update := operation("update"+schema, resource, "Update a "+strings.ToLower(schema), jsonObject{
+		"200": jsonResponse("The updated "+strings.ToLower(schema), ref(schema)),
+	})
+	update["requestBody"] = jsonBody(ref(inputSchema))
+	paths["/"+resource+"/{id}"] = jsonObject{
+		"parameters": idParam,
+		"get": operation("get"+schema, resource, "Get a "+strings.ToLower(schema), jsonObject{
+			"200": jsonResponse("The "+strings.ToLower(schema), ref(schema)),
+		}),
+		"put": update,
+		"delete": operation("delete"+schema, resource, "Delete a "+strings.ToLower(schema), jsonObject{
+			"204": jsonObject{"description": "Deleted"},
+		}),
+	}
+
+	if !taggable {
+		return
+	}
+	attach := operation("attach"+schema+"Tag", resource, "Attach a tag", jsonObject{
+		"200": jsonResponse("The tags of the "+strings.ToLower(schema), arrayOf(ref("Tag"))),
+	})
+	attach["requestBody"] = jsonBody(ref("TagAttachment"))
+	paths["/"+resource+"/{id}/tags"] = jsonObject{
+		"parameters": idParam,
+		"get": operation("list"+schema+"Tags", resource, "List the tags of a "+strings.ToLower(schema), jsonObject{
+			"200": jsonResponse("The tags of the "+strings.ToLower(schema), arrayOf(ref("Tag"))),
+		}),
+		"post": attach,
+	}
+	paths["/"+resource+"/{id}/tags/{tag_id}"] = jsonObject{
+		"parameters": []jsonObject{pathParam("id", "integer"), pathParam("tag_id", "integer")},
+		"delete": operation("detach"+schema+"Tag", resource, "Detach a tag", jsonObject{
+			"204": jsonObject{"description": "Detached"},
+		}),
+	}
+}
+
+// addPublicationPaths adds the routes apiPublication, apiStatus, apiWorkflow,
+// apiPieceSchedule, apiSchedule and apiPublishedRouter serve.
+func addPublicationPaths(paths jsonObject) {
+	idParam := []jsonObject{pathParam("id", "integer")}
+	stateResponse := func() jsonObject {
+		return jsonObject{"200": jsonResponse("The publication state of the piece", ref("PublicationState"))}
+	}
+
+	paths["/pieces/{id}/publication"] = jsonObject{
+		"parameters": idParam,
+		"get":        operation("getPublicationState", "pieces", "Compare the draft of a piece with its published version", stateResponse()),
+	}
+	paths["/pieces/{id}/publication/discard"] = jsonObject{
+		"parameters": idParam,
+		"post": operation("discardDraft", "pieces",
+			"Reset the draft of a piece, including the content of its contlets, to the published version", stateResponse()),
+	}
+
+	statusResponse := func() jsonObject {
+		return jsonObject{"200": jsonResponse("The workflow status of the piece", ref("PieceStatus"))}
+	}
+	change := operation("changePieceStatus", "pieces", "Make a workflow transition; entering a published status publishes the draft", statusResponse())
+	change["requestBody"] = jsonBody(ref("StatusRequest"))
+	paths["/pieces/{id}/status"] = jsonObject{
+		"parameters": idParam,
+		"get":        operation("getPieceStatus", "pieces", "Get the workflow status of a piece and the transitions out of it", statusResponse()),
+		"post":       change,
+	}
+	paths["/workflow"] = jsonObject{
+		"get": operation("getWorkflow", "workflow", "Describe the statuses and transitions of the editorial workflow", jsonObject{
+			"200": jsonResponse("The workflow", ref("Workflow")),
+		}),
+	}
+
+	scheduleResponse := func() jsonObject {
+		return jsonObject{"200": jsonResponse("The schedule of the piece", ref("PieceSchedule"))}
+	}
+	setSchedule := operation("schedulePiece", "pieces", "Schedule a piece to be published and taken down; the transitions are made as the requesting user", scheduleResponse())
+	setSchedule["requestBody"] = jsonBody(ref("PieceSchedule"))
+	paths["/pieces/{id}/schedule"] = jsonObject{
+		"parameters": idParam,
+		"get":        operation("getPieceSchedule", "pieces", "Get the schedule of a piece", scheduleResponse()),
+		"put":        setSchedule,
+		"delete":     operation("clearPieceSchedule", "pieces", "Clear the schedule of a piece", scheduleResponse()),
+	}
+	paths["/schedule"] = jsonObject{
+		"get": operation("listSchedule", "workflow", "List the pieces with a scheduled time, the next one first", jsonObject{
+			"200": jsonResponse("The scheduled pieces", arrayOf(ref("ScheduledPiece"))),
+		}),
+	}
+
+	paths["/pieces/{id}/render/{channel}"] = jsonObject{
+		"parameters": []jsonObject{pathParam("id", "integer"), pathParam("channel", "string")},
+		"get": operation("renderPiece", "pieces", "Render the draft of a piece for an output channel and check it against the channel's limits", jsonObject{
+			"200": jsonResponse("The rendering", ref("Rendering")),
+		}),
+	}
+
+	paths["/published"] = jsonObject{
+		"get": operation("listPublishedPieces", "published", "List the published pieces, most recently published first", jsonObject{
+			"200": jsonResponse("The published pieces", arrayOf(ref("PublishedPiece"))),
+		}),
+	}
+	paths["/published/{id}"] = jsonObject{
+		"parameters": idParam,
+		"get": operation("getPublishedPiece", "published", "Get the published version of a piece", jsonObject{
+			"200": jsonResponse("The published piece", ref("PublishedPiece")),
+		}),
+	}
+}
+
+// addSchemaPaths adds the routes apiSchemaRouter serves.
+func addSchemaPaths(paths jsonObject) {
+	tableParam := pathParam("table", "string")
+	dryRun := queryParam("dry_run", "boolean", "Return the plan without applying it.")
+	planResponse := jsonObject{"200": jsonResponse("The planned changes and whether they were applied", ref("SchemaPlan"))}
+	copyResponses := func(r jsonObject) jsonObject {
+		c := jsonObject{}
+		for k, v := range r {
+			c[k] = v
+		}
+		return c
+	}
+
+	paths["/schema"] = jsonObject{
+		"get": operation("getSchema", "schema", "Describe every table and the field types", jsonObject{
+			"200": jsonResponse("The schema", ref("Schema")),
+		}),
+	}
+	paths["/schema/{table}"] = jsonObject{
+		"parameters": []jsonObject{tableParam},
+		"get": operation("getSchemaTable", "schema", "Describe one table", jsonObject{
+			"200": jsonResponse("The table", ref("SchemaTable")),
+		}),
+	}
+
+	add := operation("addField", "schema", "Add a field to a class table", copyResponses(planResponse))
+	add["requestBody"] = jsonBody(ref("FieldInput"))
+	add["parameters"] = []jsonObject{dryRun}
+	paths["/schema/{table}/fields"] = jsonObject{"parameters": []jsonObject{tableParam}, "post": add}
+
+	update := operation("updateField", "schema", "Change the type, required flag or default of a field", copyResponses(planResponse))
+	update["requestBody"] = jsonBody(ref("FieldInput"))
+	update["parameters"] = []jsonObject{dryRun}
+	remove := operation("removeField", "schema", "Remove a field and its values", copyResponses(planResponse))
+	remove["parameters"] = []jsonObject{dryRun}
+	paths["/schema/{table}/fields/{name}"] = jsonObject{
+		"parameters": []jsonObject{tableParam, pathParam("name", "string")},
+		"put":        update,
+		"delete":     remove,
+	}
+}
@@ -0,0 +1,199 @@
+// In file: publication.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Editors always work on the draft of a content piece: its row, its contlet slots
+// and the contlets themselves. Publishing freezes the draft into a snapshot in
+// published_piece, and that snapshot is what delivery endpoints serve until the
+// piece is published again or unpublished. Pieces are published and unpublished by
+// the status transitions of the editorial workflow (workflow.go).
+
+// PublishedPiece is the frozen state of a piece as delivered to readers.
+type PublishedPiece struct {
+	PieceDetail
+	PublishedAt time.Time `json:"published_at"`
+	PublishedBy string    `json:"published_by"`
+}
+
+// PublicationState tells how the draft of a piece relates to its published snapshot.
+type PublicationState struct {
+	Status      string     `json:"status"`
+	Published   bool       `json:"published"`
+	Changed     bool       `json:"changed"` // the draft differs from the published snapshot
+	PublishedAt *time.Time `json:"published_at"`
+	PublishedBy string     `json:"published_by,omitempty"`
+}
+
+// encodePieceSnapshot encodes a piece the way it is stored in published_piece, so
+// that a draft and a snapshot can be compared byte for byte.
+func encodePieceSnapshot(piece PieceDetail) ([]byte, error) {
+	piece.Contlets = emptyIfNil(piece.Contlets)
+	return json.Marshal(piece)
+}
+
+// scanPublishedPiece scans a (snapshot, published_by, published_at) row.
+func scanPublishedPiece(row interface{ Scan(...interface{}) error }) (PublishedPiece, []byte, error) {
+	var pub PublishedPiece
+	var snapshot string
+	if err := row.Scan(&snapshot, &pub.PublishedBy, &pub.PublishedAt); err != nil {
+		return pub, nil, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &pub.PieceDetail); err != nil {
+		return pub, nil, fmt.Errorf("failed to decode published piece: %w", err)
+	}
+	pub.Contlets = emptyIfNil(pub.Contlets)
+	return pub, []byte(snapshot), nil
+}
+
+// getPublishedPiece returns the published snapshot of a piece, or sql.ErrNoRows
+// if the piece is not published.
+func getPublishedPiece(pieceID int) (PublishedPiece, error) {
+	pub, _, err := scanPublishedPiece(db.QueryRow(
+		"SELECT snapshot, published_by, published_at FROM published_piece WHERE piece_id = ?", pieceID))
+	return pub, err
+}
+
+// getPublishedPieces returns every published piece, most recently published first.
+func getPublishedPieces() ([]PublishedPiece, error) {
+	rows, err := db.Query("SELECT snapshot, published_by, published_at FROM published_piece ORDER BY published_at DESC, piece_id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pieces []PublishedPiece
+	for rows.Next() {
+		pub, _, err := scanPublishedPiece(rows)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, pub)
+	}
+	return pieces, rows.Err()
+}
+
+// getPublicationState compares the draft of a piece with its published snapshot.
+func getPublicationState(pieceID int) (PublicationState, error) {
+	var state PublicationState
+	if err := db.QueryRow("SELECT status FROM content_piece WHERE id = ?", pieceID).Scan(&state.Status); err != nil {
+		return state, err
+	}
+	pub, published, err := scanPublishedPiece(db.QueryRow(
+		"SELECT snapshot, published_by, published_at FROM published_piece WHERE piece_id = ?", pieceID))
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.Published = true
+	state.PublishedAt = &pub.PublishedAt
+	state.PublishedBy = pub.PublishedBy
+
+	draft, err := getPieceByID(pieceID)
+	if err != nil {
+		return state, err
+	}
+	encoded, err := encodePieceSnapshot(draft)
+	if err != nil {
+		return state, err
+	}
+	state.Changed = !bytes.Equal(encoded, published)
+	return state, nil
+}
+
+// publishSnapshot freezes the draft of a piece as seen by tx, including the content
+// of its contlets, as the published version, replacing any earlier one. It is
+// called by the workflow when a piece enters a published status.
+func publishSnapshot(tx *sql.Tx, pieceID int, author string) error {
+	draft, err := readPiece(tx, pieceID)
+	if err != nil {
+		return err
+	}
+	snapshot, err := encodePieceSnapshot(draft)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO published_piece (piece_id, snapshot, published_by, published_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON DUPLICATE KEY UPDATE snapshot = VALUES(snapshot), published_by = VALUES(published_by), published_at = VALUES(published_at)`,
+		pieceID, string(snapshot), author)
+	if err != nil {
+		return fmt.Errorf("failed to publish piece %d: %w", pieceID, err)
+	}
+	return nil
+}
+
+// withdrawSnapshot removes the published version of a piece, if any. The draft is kept.
+func withdrawSnapshot(tx *sql.Tx, pieceID int) error {
+	if _, err := tx.Exec("DELETE FROM published_piece WHERE piece_id = ?", pieceID); err != nil {
+		return fmt.Errorf("failed to unpublish piece %d: %w", pieceID, err)
+	}
+	return nil
+}
+
+// discardDraft resets the draft of a piece to its published version: the title,
+// class and fields of the piece, the contlets it uses and their order, and the
+// content of those contlets. Contlets are shared, so the reset also shows in the
+// drafts of other pieces using them; contlets deleted since publishing stay gone.
+// Every object that changes gets a revision, so the discarded draft can be restored.
+func discardDraft(pieceID int, author string) error {
+	pub, err := getPublishedPiece(pieceID)
+	if err == sql.ErrNoRows {
+		return &ConflictError{fmt.Sprintf("piece %d is not published, so there is no draft to discard", pieceID)}
+	}
+	if err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("Discarded the draft of piece %d", pieceID)
+
+	return withPieceSlots(pieceID, author, summary, func(tx *sql.Tx, slots []pieceSlot) error {
+		if _, err := tx.Exec("UPDATE content_piece SET title = ?, class = ? WHERE id = ?", pub.Title, pub.Class, pieceID); err != nil {
+			return fmt.Errorf("failed to reset piece %d: %w", pieceID, err)
+		}
+		if err := writeFieldValues(tx, "content_piece", int64(pieceID), emptyIfNilMap(pub.Extra)); err != nil {
+			return &ConflictError{"the published fields no longer fit the piece: " + err.Error()}
+		}
+
+		if _, err := tx.Exec("DELETE FROM content_piece_contlets WHERE content_piece_id = ?", pieceID); err != nil {
+			return fmt.Errorf("failed to reset contlets of piece %d: %w", pieceID, err)
+		}
+		for _, c := range pub.Contlets {
+			res, err := tx.Exec(`
+				INSERT INTO content_piece_contlets (content_piece_id, contlet_id, sort_order)
+				SELECT ?, id, ? FROM entity WHERE id = ?`, pieceID, c.SortOrder, c.ID)
+			if err != nil {
+				return fmt.Errorf("failed to reset contlets of piece %d: %w", pieceID, err)
+			}
+			if n, _ := res.RowsAffected(); n == 0 || !isContletClass(c.Class) {
+				continue // deleted, or of a class that is no longer registered
+			}
+			c.Extra = emptyIfNilMap(c.Extra)
+			if err := updateContletTx(tx, c); err != nil {
+				return &ConflictError{fmt.Sprintf("the published content of contlet %d cannot be restored: %v", c.ID, err)}
+			}
+			if err := recordRevision(tx, c.ID, author, summary); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// emptyIfNilMap makes a missing map count as "every field empty" for
+// writeFieldValues, which leaves the fields untouched for a nil map.
+func emptyIfNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
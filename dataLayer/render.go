@@ -0,0 +1,284 @@
+// In file: render.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"unicode/utf8"
+)
+
+// A piece is rendered for an output channel by the renderer registered for its
+// class and that channel, or else by the one registered for every class. The
+// renderer walks the contlets in order; the limits of the channel are checked
+// on what it returns, so a renderer cannot get around them.
+
+// Channel is an output a piece can be rendered for, with the limits its
+// renderings must keep. A limit of 0 means no limit.
+type Channel struct {
+	Name         string `json:"name"`
+	Label        string `json:"label"`
+	ContentType  string `json:"content_type"`
+	MaxChars     int    `json:"max_chars,omitempty"`      // characters per part
+	MaxParts     int    `json:"max_parts,omitempty"`      // parts, e.g. posts of a thread
+	MaxLineChars int    `json:"max_line_chars,omitempty"` // characters per line
+	separator    string // joins the parts when they are served as one document
+}
+
+// channels lists the output channels in the order they are offered.
+var channels = []Channel{
+	{Name: "html", Label: "HTML article", ContentType: "text/html; charset=utf-8"},
+	{Name: "text", Label: "Plain text", ContentType: "text/plain; charset=utf-8"},
+	{Name: "markdown", Label: "Markdown", ContentType: "text/markdown; charset=utf-8"},
+	{Name: "thread", Label: "Tweet thread", ContentType: "text/plain; charset=utf-8", MaxChars: 280, MaxParts: 25, separator: "\n\n---\n\n"},
+	{Name: "email", Label: "Email body", ContentType: "text/plain; charset=utf-8", MaxLineChars: 998}, // the line limit of RFC 5322
+}
+
+// findChannel returns the channel with the given name.
+func findChannel(name string) (Channel, bool) {
+	for _, ch := range channels {
+		if ch.Name == name {
+			return ch, true
+		}
+	}
+	return Channel{}, false
+}
+
+// channelNames returns the names of the channels.
+func channelNames() []string {
+	names := make([]string, len(channels))
+	for i, ch := range channels {
+		names[i] = ch.Name
+	}
+	return names
+}
+
+// Renderer turns a piece into the parts of its output for a channel. Most
+// channels have a single part; a thread has one per post.
+type Renderer interface {
+	Render(piece PieceDetail, ch Channel) ([]string, error)
+}
+
+// RendererFunc lets an ordinary function be used as a Renderer.
+type RendererFunc func(piece PieceDetail, ch Channel) ([]string, error)
+
+// Render calls f.
+func (f RendererFunc) Render(piece PieceDetail, ch Channel) ([]string, error) {
+	return f(piece, ch)
+}
+
+// anyClass registers a renderer for pieces of every class.
+const anyClass = "*"
+
+type rendererKey struct{ class, channel string }
+
+var renderers = map[rendererKey]Renderer{}
+
+// registerRenderer makes r the renderer of pieces of class for channel; use
+// anyClass for the fallback of a channel.
+func registerRenderer(class, channel string, r Renderer) {
+	if _, ok := findChannel(channel); !ok {
+		panic("registerRenderer: unknown channel " + channel)
+	}
+	renderers[rendererKey{class, channel}] = r
+}
+
+func init() {
+	registerRenderer(anyClass, "html", RendererFunc(renderHTMLArticle))
+	registerRenderer(anyClass, "text", RendererFunc(renderPlainText))
+	registerRenderer(anyClass, "markdown", RendererFunc(renderMarkdown))
+	registerRenderer(anyClass, "thread", RendererFunc(renderThread))
+	registerRenderer(anyClass, "email", RendererFunc(renderEmailBody))
+	// A tweet is posted as one post: it is checked against the limit, not split.
+	registerRenderer("tweet", "thread", RendererFunc(renderSinglePost))
+}
+
+// Rendering is a piece rendered for a channel, with the limits it breaks.
+type Rendering struct {
+	PieceID    int      `json:"piece_id"`
+	Class      string   `json:"class"`
+	Channel    Channel  `json:"channel"`
+	Parts      []string `json:"parts"`
+	Violations []string `json:"violations"`
+}
+
+// Body returns the rendering as one document.
+func (r Rendering) Body() string {
+	return strings.Join(r.Parts, r.Channel.separator)
+}
+
+// renderPiece renders a piece for the named channel and checks the result
+// against the channel's limits. An unknown channel is a ValidationError.
+func renderPiece(piece PieceDetail, channel string) (Rendering, error) {
+	ch, ok := findChannel(channel)
+	if !ok {
+		return Rendering{}, &ValidationError{fmt.Sprintf("unknown channel %q; the channels are %s", channel, strings.Join(channelNames(), ", "))}
+	}
+	r, ok := renderers[rendererKey{piece.Class, ch.Name}]
+	if !ok {
+		r = renderers[rendererKey{anyClass, ch.Name}]
+	}
+	parts, err := r.Render(piece, ch)
+	if err != nil {
+		return Rendering{}, fmt.Errorf("failed to render piece %d for %s: %w", piece.ID, ch.Name, err)
+	}
+	return Rendering{PieceID: piece.ID, Class: piece.Class, Channel: ch, Parts: parts, Violations: checkChannelLimits(ch, parts)}, nil
+}
+
+// checkChannelLimits describes every way parts break the limits of ch.
+func checkChannelLimits(ch Channel, parts []string) []string {
+	violations := []string{}
+	if ch.MaxParts > 0 && len(parts) > ch.MaxParts {
+		violations = append(violations, fmt.Sprintf("%d parts, the limit is %d", len(parts), ch.MaxParts))
+	}
+	for i, part := range parts {
+		name := "the text"
+		if len(parts) > 1 {
+			name = fmt.Sprintf("part %d", i+1)
+		}
+		if n := utf8.RuneCountInString(part); ch.MaxChars > 0 && n > ch.MaxChars {
+			violations = append(violations, fmt.Sprintf("%s has %d characters, the limit is %d", name, n, ch.MaxChars))
+		}
+		if ch.MaxLineChars == 0 {
+			continue
+		}
+		for j, line := range strings.Split(part, "\n") {
+			if n := utf8.RuneCountInString(line); n > ch.MaxLineChars {
+				violations = append(violations, fmt.Sprintf("line %d of %s has %d characters, the limit is %d", j+1, name, n, ch.MaxLineChars))
+			}
+		}
+	}
+	return violations
+}
+
+// contletText returns the text of a contlet: the text content of the built-in
+// classes, or the label field of an administrator-defined one.
+func contletText(c ContletDetail) string {
+	if c.TextContent != "" {
+		return c.TextContent
+	}
+	return c.Summary
+}
+
+// headingLevel keeps a heading level within h2-h6; h1 is the title of the piece.
+func headingLevel(level int) int {
+	return min(max(level, 2), 6)
+}
+
+var articleTemplate = template.Must(template.New("article").Funcs(template.FuncMap{
+	"level": headingLevel,
+	"text":  contletText,
+}).Parse(`<article>
+<h1>{{.Title}}</h1>
+{{range .Contlets}}{{if eq .Class "heading"}}<h{{level .Level}}>{{.TextContent}}</h{{level .Level}}>
+{{else if eq .Class "image"}}<figure><img src="{{.Src}}" alt="{{.AltText}}"{{if .Width}} width="{{.Width}}"{{end}}{{if .Height}} height="{{.Height}}"{{end}}>{{if .AltText}}<figcaption>{{.AltText}}</figcaption>{{end}}</figure>
+{{else if text .}}<p class="{{.Class}}">{{text .}}</p>
+{{end}}{{end}}</article>
+`))
+
+// renderHTMLArticle renders a piece as an HTML article element.
+func renderHTMLArticle(piece PieceDetail, ch Channel) ([]string, error) {
+	var buf bytes.Buffer
+	if err := articleTemplate.Execute(&buf, piece); err != nil {
+		return nil, err
+	}
+	return []string{buf.String()}, nil
+}
+
+// renderMarkdown renders a piece as a Markdown document.
+func renderMarkdown(piece PieceDetail, ch Channel) ([]string, error) {
+	blocks := append([]string{"# " + piece.Title}, markdownBlocks(piece.Contlets, 2)...)
+	return []string{strings.Join(blocks, "\n\n") + "\n"}, nil
+}
+
+// textBlocks returns the title and contlets of a piece as paragraphs of plain
+// text; images become their description and address.
+func textBlocks(piece PieceDetail) []string {
+	blocks := []string{piece.Title}
+	for _, c := range piece.Contlets {
+		switch {
+		case c.Class == "image":
+			if c.AltText != "" {
+				blocks = append(blocks, fmt.Sprintf("[Image: %s] %s", c.AltText, c.Src))
+			} else {
+				blocks = append(blocks, "[Image] "+c.Src)
+			}
+		case contletText(c) != "":
+			blocks = append(blocks, contletText(c))
+		}
+	}
+	return blocks
+}
+
+// renderPlainText renders a piece as plain text, one paragraph per contlet.
+func renderPlainText(piece PieceDetail, ch Channel) ([]string, error) {
+	return []string{strings.Join(textBlocks(piece), "\n\n") + "\n"}, nil
+}
+
+// emailWidth is the column at which email bodies are wrapped.
+const emailWidth = 72
+
+// renderEmailBody renders a piece as a plain-text email body wrapped at
+// emailWidth columns. Words longer than a line, such as long addresses, are
+// kept whole.
+func renderEmailBody(piece PieceDetail, ch Channel) ([]string, error) {
+	blocks := textBlocks(piece)
+	blocks[0] += "\n" + strings.Repeat("=", min(utf8.RuneCountInString(blocks[0]), emailWidth))
+	for i := 1; i < len(blocks); i++ {
+		blocks[i] = strings.Join(wrapWords(blocks[i], emailWidth), "\n")
+	}
+	return []string{strings.Join(blocks, "\n\n") + "\n"}, nil
+}
+
+// renderThread renders a piece as a thread of posts of at most MaxChars
+// characters, numbered "1/3" and so on. Each paragraph starts a new post
+// unless it fits in the previous one; longer paragraphs are split between words.
+func renderThread(piece PieceDetail, ch Channel) ([]string, error) {
+	limit := ch.MaxChars - len(fmt.Sprintf(" %d/%d", ch.MaxParts, ch.MaxParts))
+	var posts []string
+	for _, block := range textBlocks(piece) {
+		if n := len(posts); n > 0 && utf8.RuneCountInString(posts[n-1])+2+utf8.RuneCountInString(block) <= limit {
+			posts[n-1] += "\n\n" + block
+			continue
+		}
+		posts = append(posts, wrapWords(block, limit)...)
+	}
+	if len(posts) > 1 {
+		for i := range posts {
+			posts[i] += fmt.Sprintf(" %d/%d", i+1, len(posts))
+		}
+	}
+	return posts, nil
+}
+
+// renderSinglePost renders the contlets of a piece as one post, without its
+// title, for pieces that are posts themselves.
+func renderSinglePost(piece PieceDetail, ch Channel) ([]string, error) {
+	blocks := textBlocks(piece)[1:]
+	return []string{strings.Join(blocks, "\n\n")}, nil
+}
+
+// wrapWords breaks text into lines of at most width characters between words.
+// A word longer than width gets a line of its own.
+func wrapWords(text string, width int) []string {
+	var lines []string
+	line, n := "", 0
+	for _, word := range strings.Fields(text) {
+		w := utf8.RuneCountInString(word)
+		if n > 0 && n+1+w > width {
+			lines = append(lines, line)
+			line, n = "", 0
+		}
+		if n > 0 {
+			line += " "
+			n++
+		}
+		line += word
+		n += w
+	}
+	if n > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
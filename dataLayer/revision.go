@@ -0,0 +1,520 @@
+// In file: revision.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every change to a content piece or a contlet is recorded as an immutable
+// revision: a numbered, full snapshot of the object taken inside the transaction
+// of the change, so that a change and its revision are committed together.
+
+// Revision is one recorded state of a piece or contlet.
+type Revision struct {
+	EntityID  int
+	Number    int
+	Author    string
+	CreatedAt time.Time
+	Summary   string
+	Snapshot  Snapshot
+}
+
+// Snapshot is the full state of an object at one revision.
+type Snapshot struct {
+	Class    string             `json:"class"`              // the entity class, e.g. "content_piece" or "contlet_image"
+	Fields   map[string]*string `json:"fields"`             // every column of the class row except id; nil for NULL
+	Tags     []SnapshotTag      `json:"tags"`               // ordered by taxonomy and value
+	Contlets []SnapshotSlot     `json:"contlets,omitempty"` // pieces only, in order
+}
+
+// SnapshotTag is a tag attached to the object.
+type SnapshotTag struct {
+	ID       int    `json:"id"`
+	Taxonomy string `json:"taxonomy"`
+	Value    string `json:"value"`
+}
+
+// SnapshotSlot is a contlet of a piece. Class and Summary describe the contlet at
+// the time; restoring a piece restores its order, not the contlets' content,
+// which have their own history.
+type SnapshotSlot struct {
+	ContletID int    `json:"contlet_id"`
+	SortOrder int    `json:"sort_order"`
+	Class     string `json:"class"`
+	Summary   string `json:"summary"`
+}
+
+// SnapshotLine is one labelled value of a snapshot as shown on the history pages.
+type SnapshotLine struct {
+	Field string
+	Value string
+}
+
+// FieldChange is one line of a diff between two revisions.
+type FieldChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+// unrestorableColumns are the columns a restore leaves alone: the key, the
+// creation time, the publication status, which has its own workflow, and the
+// schedule, which must not bring back times that have already fired.
+var unrestorableColumns = map[string]bool{
+	"id": true, "created_at": true, "status": true,
+	"publish_at": true, "unpublish_at": true, "scheduled_by": true, "schedule_error": true,
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// hasRevisions reports whether objects of an entity class are revisioned.
+func hasRevisions(class string) bool {
+	return class == "content_piece" || entityKind(class) == "contlet"
+}
+
+// takeSnapshot reads the current state of an object through q, which may be the
+// transaction of an uncommitted change.
+func takeSnapshot(q queryer, entityID int, class string) (Snapshot, error) {
+	if !validIdentifier(class) {
+		return Snapshot{}, fmt.Errorf("invalid entity class %q", class)
+	}
+	snap := Snapshot{Class: class, Fields: map[string]*string{}, Tags: []SnapshotTag{}}
+
+	rows, err := q.Query("SELECT * FROM `"+class+"` WHERE id = ?", entityID)
+	if err != nil {
+		return snap, fmt.Errorf("failed to read %s %d: %w", class, entityID, err)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return snap, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return snap, err
+	}
+	found := false
+	for rows.Next() {
+		found = true
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return snap, err
+		}
+		for i, col := range columns {
+			if col != "id" {
+				snap.Fields[col] = columnText(values[i], types[i].DatabaseTypeName())
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return snap, err
+	}
+	if !found {
+		return snap, sql.ErrNoRows
+	}
+
+	rows, err = q.Query(`
+		SELECT t.id, tx.name, t.value
+		FROM entity_tags et
+		JOIN tag t ON t.id = et.tag_id
+		JOIN taxonomy tx ON tx.id = t.taxonomy_id
+		WHERE et.entity_id = ?
+		ORDER BY tx.name, t.value`, entityID)
+	if err != nil {
+		return snap, fmt.Errorf("failed to read tags of %d: %w", entityID, err)
+	}
+	for rows.Next() {
+		var t SnapshotTag
+		if err := rows.Scan(&t.ID, &t.Taxonomy, &t.Value); err != nil {
+			rows.Close()
+			return snap, err
+		}
+		snap.Tags = append(snap.Tags, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return snap, err
+	}
+
+	if class == "content_piece" {
+		if snap.Contlets, err = snapshotSlots(q, entityID); err != nil {
+			return snap, err
+		}
+	}
+	return snap, nil
+}
+
+// columnText turns a scanned column value into its text form as MariaDB reads
+// it back, or nil for NULL. DATE, DATETIME and TIMESTAMP columns arrive as
+// time.Time, which would otherwise become RFC 3339 text that strict mode refuses
+// to store.
+func columnText(v interface{}, databaseType string) *string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		s = string(v)
+	case time.Time:
+		if databaseType == "DATE" {
+			s = v.Format("2006-01-02")
+		} else {
+			s = v.Format("2006-01-02 15:04:05.999999")
+		}
+	default:
+		s = fmt.Sprint(v)
+	}
+	return &s
+}
+
+// snapshotSlots reads the ordered contlets of a piece with the class and summary of each.
+func snapshotSlots(q queryer, pieceID int) ([]SnapshotSlot, error) {
+	rows, err := q.Query(`
+		SELECT pc.contlet_id, pc.sort_order, COALESCE(e.class, '')
+		FROM content_piece_contlets pc
+		JOIN entity e ON e.id = pc.contlet_id
+		WHERE pc.content_piece_id = ?
+		ORDER BY pc.sort_order`, pieceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contlets of piece %d: %w", pieceID, err)
+	}
+	var slots []SnapshotSlot
+	for rows.Next() {
+		var s SnapshotSlot
+		if err := rows.Scan(&s.ContletID, &s.SortOrder, &s.Class); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.Class = strings.TrimPrefix(s.Class, "contlet_")
+		slots = append(slots, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Summaries come from the label column of each class, one query per class.
+	for _, c := range getContletClasses() {
+		if c.LabelColumn == "" {
+			continue
+		}
+		for i := range slots {
+			if slots[i].Class != c.Name {
+				continue
+			}
+			var summary sql.NullString
+			err := q.QueryRow("SELECT `"+c.LabelColumn+"` FROM `"+c.Table()+"` WHERE id = ?", slots[i].ContletID).Scan(&summary)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("failed to read contlet %d: %w", slots[i].ContletID, err)
+			}
+			slots[i].Summary = summary.String
+		}
+	}
+	return slots, nil
+}
+
+// recordRevision snapshots an object inside the transaction of a change to it and
+// stores the snapshot as its next revision. Objects that are not revisioned, and
+// changes that leave the snapshot as it was, are not recorded.
+func recordRevision(tx *sql.Tx, entityID int, author, summary string) error {
+	var class sql.NullString
+	if err := tx.QueryRow("SELECT class FROM entity WHERE id = ?", entityID).Scan(&class); err != nil {
+		return fmt.Errorf("failed to read class of entity %d: %w", entityID, err)
+	}
+	if !hasRevisions(class.String) {
+		return nil
+	}
+	snap, err := takeSnapshot(tx, entityID, class.String)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	// Lock the latest revision so that concurrent changes are numbered in order.
+	var number int
+	var latest sql.NullString
+	err = tx.QueryRow(`
+		SELECT revision_number, snapshot FROM revision
+		WHERE entity_id = ? ORDER BY revision_number DESC LIMIT 1 FOR UPDATE`, entityID).Scan(&number, &latest)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read latest revision of %d: %w", entityID, err)
+	}
+	if latest.Valid && bytes.Equal([]byte(latest.String), encoded) {
+		return nil
+	}
+
+	if author == "" {
+		author = "anonymous"
+	}
+	if r := []rune(summary); len(r) > 255 {
+		summary = string(r[:252]) + "..." // summaries may quote a comment
+	}
+	_, err = tx.Exec("INSERT INTO revision (entity_id, revision_number, author, summary, snapshot) VALUES (?, ?, ?, ?, ?)",
+		entityID, number+1, author, summary, string(encoded))
+	if err != nil {
+		return fmt.Errorf("failed to record revision of %d: %w", entityID, err)
+	}
+	return nil
+}
+
+// inTransactionWithRevision runs fn in a transaction and records a revision of
+// entityID before committing.
+func inTransactionWithRevision(entityID int, author, summary string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := recordRevision(tx, entityID, author, summary); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillRevisions records a first revision of the pieces and contlets that were
+// created before revisions existed, so that their first change can be diffed and undone.
+func backfillRevisions() error {
+	rows, err := db.Query(`
+		SELECT e.id FROM entity e
+		WHERE (e.class = 'content_piece' OR (e.class LIKE 'contlet\_%' AND e.class <> 'contlet_class'))
+		AND NOT EXISTS (SELECT 1 FROM revision r WHERE r.entity_id = e.id)`)
+	if err != nil {
+		return fmt.Errorf("failed to find objects without revisions: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := inTransactionWithRevision(id, "system", "State before revisions were recorded", func(*sql.Tx) error { return nil })
+		if err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Recorded initial revisions of %d objects.", len(ids))
+	}
+	return nil
+}
+
+// scanRevision scans a revision row selected by revisionColumns.
+func scanRevision(row interface{ Scan(...interface{}) error }) (Revision, error) {
+	var rev Revision
+	var snapshot string
+	if err := row.Scan(&rev.EntityID, &rev.Number, &rev.Author, &rev.CreatedAt, &rev.Summary, &snapshot); err != nil {
+		return rev, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &rev.Snapshot); err != nil {
+		return rev, fmt.Errorf("failed to decode revision %d of %d: %w", rev.Number, rev.EntityID, err)
+	}
+	return rev, nil
+}
+
+const revisionColumns = "entity_id, revision_number, author, created_at, summary, snapshot"
+
+// getRevisions returns the revisions of an object, newest first.
+func getRevisions(entityID int) ([]Revision, error) {
+	rows, err := db.Query("SELECT "+revisionColumns+" FROM revision WHERE entity_id = ? ORDER BY revision_number DESC", entityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// getRevision returns one revision of an object, or sql.ErrNoRows.
+func getRevision(entityID, number int) (Revision, error) {
+	return scanRevision(db.QueryRow("SELECT "+revisionColumns+" FROM revision WHERE entity_id = ? AND revision_number = ?", entityID, number))
+}
+
+// Lines flattens a snapshot into labelled values, in a stable order, for display and diffs.
+func (s Snapshot) Lines() []SnapshotLine {
+	var names []string
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []SnapshotLine{{Field: "class", Value: s.Class}}
+	for _, name := range names {
+		v := "(empty)"
+		if p := s.Fields[name]; p != nil {
+			v = *p
+		}
+		lines = append(lines, SnapshotLine{Field: "field " + name, Value: v})
+	}
+	tags := make([]string, len(s.Tags))
+	for i, t := range s.Tags {
+		tags[i] = t.Taxonomy + ": " + t.Value
+	}
+	lines = append(lines, SnapshotLine{Field: "tags", Value: strings.Join(tags, "\n")})
+	if s.Class == "content_piece" {
+		slots := make([]string, len(s.Contlets))
+		for i, c := range s.Contlets {
+			slots[i] = fmt.Sprintf("#%d (%s) %s", c.ContletID, c.Class, c.Summary)
+		}
+		lines = append(lines, SnapshotLine{Field: "contlets", Value: strings.Join(slots, "\n")})
+	}
+	return lines
+}
+
+// diffSnapshots returns the lines that differ between two snapshots, including
+// fields that only exist in one of them.
+func diffSnapshots(from, to Snapshot) []FieldChange {
+	before := map[string]string{}
+	var order []string
+	for _, l := range from.Lines() {
+		before[l.Field] = l.Value
+		order = append(order, l.Field)
+	}
+	after := map[string]string{}
+	for _, l := range to.Lines() {
+		after[l.Field] = l.Value
+		if _, ok := before[l.Field]; !ok {
+			order = append(order, l.Field)
+		}
+	}
+
+	var changes []FieldChange
+	for _, field := range order {
+		a, inFrom := before[field]
+		b, inTo := after[field]
+		switch {
+		case !inFrom:
+			a = "(no such field)"
+		case !inTo:
+			b = "(no such field)"
+		}
+		if a != b {
+			changes = append(changes, FieldChange{Field: field, From: a, To: b})
+		}
+	}
+	return changes
+}
+
+// restoreRevision brings an object back to the state of one of its revisions and
+// records the result as a new revision. Tags and contlets that have been deleted
+// since are left out; fields that have been removed from the class are skipped.
+func restoreRevision(entityID, number int, author string) error {
+	rev, err := getRevision(entityID, number)
+	if err != nil {
+		return err
+	}
+	snap := rev.Snapshot
+	current, err := getEntityClass(entityID)
+	if err != nil {
+		return err
+	}
+	if current != snap.Class {
+		return &ConflictError{fmt.Sprintf("the object is now of class %s, not %s", current, snap.Class)}
+	}
+	columns, err := describeTable(snap.Class)
+	if err != nil {
+		return fmt.Errorf("failed to describe %s: %w", snap.Class, err)
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, col := range columns {
+		v, ok := snap.Fields[col.Field]
+		if !ok || unrestorableColumns[col.Field] {
+			continue
+		}
+		sets = append(sets, "`"+col.Field+"` = ?")
+		switch t := strings.ToLower(col.Type); {
+		case v == nil:
+			args = append(args, nil)
+		case t == "date":
+			// Revisions taken before columnText stored times as RFC 3339.
+			args = append(args, reformatTime("2006-01-02")(*v))
+		case strings.HasPrefix(t, "datetime"), strings.HasPrefix(t, "timestamp"):
+			args = append(args, reformatTime("2006-01-02 15:04:05.999999")(*v))
+		default:
+			args = append(args, *v)
+		}
+	}
+
+	return inTransactionWithRevision(entityID, author, "Restored revision "+strconv.Itoa(number), func(tx *sql.Tx) error {
+		if snap.Class == "content_piece" {
+			if _, err := lockPieceSlots(tx, entityID); err != nil {
+				return err
+			}
+		}
+		if len(sets) > 0 {
+			_, err := tx.Exec("UPDATE `"+snap.Class+"` SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, entityID)...)
+			if err != nil {
+				return fmt.Errorf("failed to restore %s %d: %w", snap.Class, entityID, err)
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM entity_tags WHERE entity_id = ?", entityID); err != nil {
+			return fmt.Errorf("failed to restore tags: %w", err)
+		}
+		for _, t := range snap.Tags {
+			_, err := tx.Exec("INSERT INTO entity_tags (entity_id, tag_id) SELECT ?, id FROM tag WHERE id = ?", entityID, t.ID)
+			if err != nil {
+				return fmt.Errorf("failed to restore tag %d: %w", t.ID, err)
+			}
+		}
+
+		if snap.Class != "content_piece" {
+			return nil
+		}
+		if _, err := tx.Exec("DELETE FROM content_piece_contlets WHERE content_piece_id = ?", entityID); err != nil {
+			return fmt.Errorf("failed to restore contlets: %w", err)
+		}
+		for _, s := range snap.Contlets {
+			_, err := tx.Exec(`
+				INSERT INTO content_piece_contlets (content_piece_id, contlet_id, sort_order)
+				SELECT ?, id, ? FROM entity WHERE id = ?`, entityID, s.SortOrder, s.ContletID)
+			if err != nil {
+				return fmt.Errorf("failed to restore contlet %d: %w", s.ContletID, err)
+			}
+		}
+		return nil
+	})
+}
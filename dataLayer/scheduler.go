@@ -0,0 +1,421 @@
+// In file: scheduler.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A content piece can be scheduled to be published at publish_at and taken down
+// at unpublish_at. The scheduler, a goroutine of the server, makes the workflow
+// transition of every due time in its own transaction, as the user who set the
+// schedule, and clears the time in that same transaction. A time therefore fires
+// exactly once, even across restarts and with several servers sharing a database.
+// Times are stored and shown in UTC.
+
+// PieceSchedule is when a piece is to be published and taken down.
+type PieceSchedule struct {
+	PublishAt   *time.Time `json:"publish_at"`
+	UnpublishAt *time.Time `json:"unpublish_at"`
+	ScheduledBy string     `json:"scheduled_by,omitempty"`
+	Error       string     `json:"error,omitempty"` // why a due transition failed; the schedule is held
+}
+
+// ScheduledPiece is a piece with a pending schedule, as listed on the schedule page.
+type ScheduledPiece struct {
+	PieceID int    `json:"piece_id"`
+	Title   string `json:"title"`
+	Status  string `json:"status"`
+	PieceSchedule
+}
+
+// NextAt returns the earlier of the scheduled times.
+func (p ScheduledPiece) NextAt() time.Time {
+	if p.PublishAt != nil && (p.UnpublishAt == nil || p.PublishAt.Before(*p.UnpublishAt)) {
+		return *p.PublishAt
+	}
+	if p.UnpublishAt != nil {
+		return *p.UnpublishAt
+	}
+	return time.Time{}
+}
+
+// Clock tells the time and waits. The scheduler reads the time only through its
+// Clock, so that it can be driven by a fake one.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Scheduler fires scheduled publish and unpublish times when they are due.
+type Scheduler struct {
+	clock    Clock
+	interval time.Duration // the longest wait between runs, to see schedules set by other servers
+	wake     chan struct{}
+}
+
+// scheduler is the scheduler of this server, or nil if it has not been started.
+var scheduler *Scheduler
+
+// newScheduler creates a scheduler that reads the time from clock.
+func newScheduler(clock Clock, interval time.Duration) *Scheduler {
+	return &Scheduler{clock: clock, interval: interval, wake: make(chan struct{}, 1)}
+}
+
+// Wake makes the scheduler look at the schedule again, e.g. because it has been
+// changed. It never blocks, and does nothing on a nil scheduler.
+func (s *Scheduler) Wake() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fires due times until stop is closed. Between runs it sleeps until the
+// next scheduled time, at most for the interval, or until it is woken.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	for {
+		if _, err := s.RunDue(); err != nil {
+			log.Printf("Scheduler: %v", err)
+		}
+
+		wait := s.interval
+		next, err := nextScheduledTime(s.clock.Now())
+		if err != nil {
+			log.Printf("Scheduler: %v", err)
+		} else if !next.IsZero() {
+			if d := next.Sub(s.clock.Now()); d < wait {
+				wait = d
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// RunDue fires every time that is due by the clock and returns how many pieces changed.
+func (s *Scheduler) RunDue() (int, error) {
+	return runScheduledTransitions(s.clock.Now())
+}
+
+// getSchedule returns the pieces with a scheduled time, the next one first.
+func getSchedule() ([]ScheduledPiece, error) {
+	rows, err := db.Query(`
+		SELECT id, title, status, publish_at, unpublish_at, COALESCE(scheduled_by, ''), COALESCE(schedule_error, '')
+		FROM content_piece
+		WHERE publish_at IS NOT NULL OR unpublish_at IS NOT NULL
+		ORDER BY LEAST(COALESCE(publish_at, unpublish_at), COALESCE(unpublish_at, publish_at)), id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pieces []ScheduledPiece
+	for rows.Next() {
+		var p ScheduledPiece
+		var publishAt, unpublishAt sql.NullTime
+		if err := rows.Scan(&p.PieceID, &p.Title, &p.Status, &publishAt, &unpublishAt, &p.ScheduledBy, &p.Error); err != nil {
+			return nil, err
+		}
+		p.PublishAt, p.UnpublishAt = timeOrNil(publishAt), timeOrNil(unpublishAt)
+		pieces = append(pieces, p)
+	}
+	return pieces, rows.Err()
+}
+
+// getPieceSchedule returns the schedule of a piece, or sql.ErrNoRows.
+func getPieceSchedule(pieceID int) (PieceSchedule, error) {
+	var s PieceSchedule
+	var publishAt, unpublishAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT publish_at, unpublish_at, COALESCE(scheduled_by, ''), COALESCE(schedule_error, '')
+		FROM content_piece WHERE id = ?`, pieceID).Scan(&publishAt, &unpublishAt, &s.ScheduledBy, &s.Error)
+	s.PublishAt, s.UnpublishAt = timeOrNil(publishAt), timeOrNil(unpublishAt)
+	return s, err
+}
+
+// setPieceSchedule replaces the schedule of a piece; nil times are not scheduled.
+// The scheduled transitions will be made as author. Setting a schedule clears
+// the error that held the previous one. A time in the past is due at once.
+func setPieceSchedule(pieceID int, publishAt, unpublishAt *time.Time, author string) error {
+	publishAt, unpublishAt = scheduleTime(publishAt), scheduleTime(unpublishAt)
+	if publishAt != nil && unpublishAt != nil && !unpublishAt.After(*publishAt) {
+		return &ValidationError{"the unpublish time must be after the publish time"}
+	}
+
+	var scheduledBy interface{}
+	if publishAt != nil || unpublishAt != nil {
+		scheduledBy = author
+	}
+	summary := describeSchedule(publishAt, unpublishAt)
+	err := inTransactionWithRevision(pieceID, author, summary, func(tx *sql.Tx) error {
+		var id int
+		if err := tx.QueryRow("SELECT id FROM content_piece WHERE id = ? FOR UPDATE", pieceID).Scan(&id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE content_piece SET publish_at = ?, unpublish_at = ?, scheduled_by = ?, schedule_error = NULL
+			WHERE id = ?`, nullTime(publishAt), nullTime(unpublishAt), scheduledBy, pieceID)
+		if err != nil {
+			return fmt.Errorf("failed to schedule piece %d: %w", pieceID, err)
+		}
+		return nil
+	})
+	if err == nil {
+		scheduler.Wake()
+	}
+	return err
+}
+
+// scheduleTime converts a time to what a DATETIME column keeps: UTC, whole seconds.
+func scheduleTime(t *time.Time) *time.Time {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	u := t.UTC().Truncate(time.Second)
+	return &u
+}
+
+// describeSchedule summarizes a new schedule for the revision history.
+func describeSchedule(publishAt, unpublishAt *time.Time) string {
+	var parts []string
+	if publishAt != nil {
+		parts = append(parts, "publishing for "+publishAt.Format("2006-01-02 15:04:05")+" UTC")
+	}
+	if unpublishAt != nil {
+		parts = append(parts, "unpublishing for "+unpublishAt.Format("2006-01-02 15:04:05")+" UTC")
+	}
+	if len(parts) == 0 {
+		return "Cleared the schedule"
+	}
+	return "Scheduled " + strings.Join(parts, " and ")
+}
+
+// nextScheduledTime returns the earliest scheduled time after now, or the zero
+// time if there is none.
+func nextScheduledTime(now time.Time) (time.Time, error) {
+	var next sql.NullTime
+	err := db.QueryRow(`
+		SELECT MIN(t) FROM (
+			SELECT publish_at AS t FROM content_piece WHERE publish_at > ? AND schedule_error IS NULL
+			UNION ALL
+			SELECT unpublish_at FROM content_piece WHERE unpublish_at > ? AND schedule_error IS NULL
+		) upcoming`, now.UTC(), now.UTC()).Scan(&next)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the next scheduled time: %w", err)
+	}
+	return next.Time, nil
+}
+
+// runScheduledTransitions fires every time due at now and returns how many pieces changed.
+func runScheduledTransitions(now time.Time) (int, error) {
+	rows, err := db.Query(`
+		SELECT id FROM content_piece
+		WHERE schedule_error IS NULL AND (publish_at <= ? OR unpublish_at <= ?)
+		ORDER BY LEAST(COALESCE(publish_at, unpublish_at), COALESCE(unpublish_at, publish_at)), id`, now.UTC(), now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find due schedules: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	fired := 0
+	var errs []error
+	for _, id := range ids {
+		changed, err := fireSchedule(id, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("piece %d: %w", id, err))
+		}
+		if changed {
+			fired++
+		}
+	}
+	return fired, errors.Join(errs...)
+}
+
+// fireSchedule makes the due scheduled transitions of one piece and reports
+// whether the piece changed.
+func fireSchedule(pieceID int, now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	summary, author, err := fireScheduleTx(tx, pieceID, now)
+	if err == nil && summary != "" {
+		err = recordRevision(tx, pieceID, author, summary)
+	}
+	if err != nil || summary == "" {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// fireScheduleTx makes the due scheduled transitions of a piece in tx. The piece
+// is locked and its schedule read again, so that a time another server has just
+// fired is not fired twice. A publish time waits while the workflow has no
+// transition from the current status into a published one, e.g. until the piece
+// is approved, and an unpublish time waits for a pending publish time. A
+// transition the workflow refuses holds the schedule with an error. It returns
+// the summary of the changes, empty if nothing changed, and who made them.
+func fireScheduleTx(tx *sql.Tx, pieceID int, now time.Time) (summary, author string, err error) {
+	if _, err := lockPieceSlots(tx, pieceID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", nil // deleted meanwhile
+		}
+		return "", "", err
+	}
+	var status string
+	var publishAt, unpublishAt sql.NullTime
+	var scheduledBy, scheduleError sql.NullString
+	err = tx.QueryRow(`
+		SELECT status, publish_at, unpublish_at, scheduled_by, schedule_error
+		FROM content_piece WHERE id = ?`, pieceID).Scan(&status, &publishAt, &unpublishAt, &scheduledBy, &scheduleError)
+	if err != nil || scheduleError.Valid {
+		return "", "", err
+	}
+	author = scheduledBy.String
+	if author == "" {
+		author = "scheduler"
+	}
+
+	var summaries []string
+	// fire makes the transition for one due time and clears the time. done is
+	// false if the time waits or has been held.
+	fire := func(column string, at time.Time, publish bool) (done bool, err error) {
+		published, err := isPublishedStatus(tx, status)
+		if err != nil {
+			return false, err
+		}
+		if published != publish {
+			t, ok, err := scheduledTransition(tx, status, publish)
+			if err != nil {
+				return false, err
+			}
+			var refusal error
+			if !ok && publish {
+				return false, nil
+			} else if !ok {
+				refusal = &ConflictError{fmt.Sprintf("the workflow has no transition out of the published status %s", status)}
+			} else {
+				if _, err := tx.Exec("SAVEPOINT scheduled_transition"); err != nil {
+					return false, err
+				}
+				comment := "Scheduled for " + at.Format("2006-01-02 15:04:05") + " UTC"
+				change, err := changeStatusTx(tx, pieceID, StatusRequest{To: t.To, Comment: comment}, author)
+				if err == nil {
+					status = t.To
+					summaries = append(summaries, change)
+				} else if isScheduleRefusal(err) {
+					refusal = err
+					if _, err := tx.Exec("ROLLBACK TO SAVEPOINT scheduled_transition"); err != nil {
+						return false, err
+					}
+				} else {
+					return false, err
+				}
+			}
+			if refusal != nil {
+				summaries = append(summaries, "Held the schedule: "+refusal.Error())
+				_, err := tx.Exec("UPDATE content_piece SET schedule_error = ? WHERE id = ?", refusal.Error(), pieceID)
+				return false, err
+			}
+		}
+		if _, err := tx.Exec("UPDATE content_piece SET "+column+" = NULL WHERE id = ?", pieceID); err != nil {
+			return false, fmt.Errorf("failed to clear %s of piece %d: %w", column, pieceID, err)
+		}
+		if len(summaries) == 0 {
+			summaries = append(summaries, "Cleared the due "+column+" time, as the piece already was in the scheduled state")
+		}
+		return true, nil
+	}
+
+	pending := publishAt.Valid
+	if publishAt.Valid && !publishAt.Time.After(now) {
+		done, err := fire("publish_at", publishAt.Time, true)
+		if err != nil {
+			return "", "", err
+		}
+		pending = !done
+	}
+	if unpublishAt.Valid && !unpublishAt.Time.After(now) && !pending {
+		if _, err := fire("unpublish_at", unpublishAt.Time, false); err != nil {
+			return "", "", err
+		}
+	}
+	return strings.Join(summaries, "; "), author, nil
+}
+
+// scheduledTransition picks the transition a schedule makes from a status: the
+// first one in workflow order into a published status, or out of the published
+// statuses. ok is false if the workflow has none.
+func scheduledTransition(q queryer, from string, publish bool) (t WorkflowTransition, ok bool, err error) {
+	transitions, err := queryTransitions(q, "WHERE t.from_status = ? AND s.published = ? AND t.to_status <> t.from_status", from, publish)
+	if err != nil || len(transitions) == 0 {
+		return t, false, err
+	}
+	return transitions[0], true, nil
+}
+
+// isPublishedStatus reports whether pieces in status are delivered to readers.
+func isPublishedStatus(q queryer, status string) (bool, error) {
+	s, err := getWorkflowStatus(q, status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return s.Published, err
+}
+
+// isScheduleRefusal reports whether err is the workflow refusing a scheduled
+// transition, as opposed to a failure to make it.
+func isScheduleRefusal(err error) bool {
+	var conflict *ConflictError
+	var forbidden *ForbiddenError
+	var invalid *ValidationError
+	return errors.As(err, &conflict) || errors.As(err, &forbidden) || errors.As(err, &invalid)
+}
+
+// timeOrNil returns a pointer to a valid time, or nil.
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// nullTime returns a time as a query argument, NULL for nil.
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
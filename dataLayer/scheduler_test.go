@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// These tests run against a scratch MariaDB database named by DATALAYER_TEST_DSN,
+// e.g. "user:pass@tcp(localhost:3306)/datalayer_test". It is migrated to the
+// current schema; the rows a test creates are deleted when it ends.
+
+// fakeClock is a Clock whose time only moves when the test says so.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After never fires; the tests drive the scheduler through RunDue.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// openTestDB connects db to the test database, or skips the test without one.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("DATALAYER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DATALAYER_TEST_DSN is not set")
+	}
+	mc, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("invalid DATALAYER_TEST_DSN: %v", err)
+	}
+	mc.ParseTime = true
+	mc.MultiStatements = true
+	if db, err = sql.Open("mysql", mc.FormatDSN()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadContletClasses(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestUser creates an account holding roles, deleted again when the test ends.
+func newTestUser(t *testing.T, name string, roles ...string) {
+	t.Helper()
+	if _, err := createUser(name, "scheduler-test-password", roles); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM role_member WHERE user_name = ?", name)
+		db.Exec("DELETE FROM app_user WHERE user_name = ?", name)
+	})
+}
+
+// newScheduledPiece creates an approved piece with a schedule set by author.
+func newScheduledPiece(t *testing.T, author string, publishAt, unpublishAt *time.Time) int {
+	t.Helper()
+	id64, err := createContentPiece("Scheduler test", "blog_post", nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := int(id64)
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM revision WHERE entity_id = ?", id)
+		db.Exec("DELETE FROM entity WHERE id = ?", id)
+	})
+	if _, err := db.Exec("UPDATE content_piece SET status = 'approved' WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPieceSchedule(id, publishAt, unpublishAt, author); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// runDue runs the due schedules and checks how many pieces changed.
+func runDue(t *testing.T, s *Scheduler, want int) {
+	t.Helper()
+	fired, err := s.RunDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fired != want {
+		t.Fatalf("RunDue at %s fired %d piece(s), want %d", s.clock.Now().Format(time.RFC3339), fired, want)
+	}
+}
+
+func pieceStatus(t *testing.T, id int) string {
+	t.Helper()
+	var status string
+	if err := db.QueryRow("SELECT status FROM content_piece WHERE id = ?", id).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestSchedulerFiresDueTimesOnce(t *testing.T) {
+	openTestDB(t)
+	const author = "scheduler-test-publisher"
+	newTestUser(t, author, rolePublisher)
+
+	// Far enough in the future that the real time can never make these times due.
+	start := time.Date(2099, 1, 1, 12, 0, 0, 0, time.UTC)
+	publishAt, unpublishAt := start.Add(time.Hour), start.Add(2*time.Hour)
+	clock := &fakeClock{now: start}
+	s := newScheduler(clock, time.Minute)
+	id := newScheduledPiece(t, author, &publishAt, &unpublishAt)
+
+	runDue(t, s, 0)
+	if got := pieceStatus(t, id); got != "approved" {
+		t.Fatalf("status before publish_at = %q, want approved", got)
+	}
+
+	clock.Set(publishAt)
+	runDue(t, s, 1)
+	if published, err := isPublishedStatus(db, pieceStatus(t, id)); err != nil || !published {
+		t.Fatalf("status after publish_at = %q, want a published one (err %v)", pieceStatus(t, id), err)
+	}
+	if _, err := getPublishedPiece(id); err != nil {
+		t.Fatalf("no published snapshot after publish_at: %v", err)
+	}
+	sched, err := getPieceSchedule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sched.PublishAt != nil || sched.UnpublishAt == nil {
+		t.Fatalf("schedule after publishing = %+v, want only unpublish_at left", sched)
+	}
+
+	// Running again, or from a new scheduler as after a restart, fires nothing.
+	runDue(t, s, 0)
+	runDue(t, newScheduler(clock, time.Minute), 0)
+
+	clock.Set(unpublishAt.Add(time.Second))
+	runDue(t, s, 1)
+	if published, err := isPublishedStatus(db, pieceStatus(t, id)); err != nil || published {
+		t.Fatalf("status after unpublish_at = %q, want an unpublished one (err %v)", pieceStatus(t, id), err)
+	}
+	if _, err := getPublishedPiece(id); err != sql.ErrNoRows {
+		t.Fatalf("published snapshot after unpublish_at: err = %v, want sql.ErrNoRows", err)
+	}
+	runDue(t, newScheduler(clock, time.Minute), 0)
+}
+
+func TestSchedulerHoldsRefusedTransition(t *testing.T) {
+	openTestDB(t)
+	// This user holds no role, so the workflow refuses the publishing transition.
+	const author = "scheduler-test-nobody"
+	newTestUser(t, author)
+	start := time.Date(2099, 1, 1, 12, 0, 0, 0, time.UTC)
+	publishAt := start.Add(time.Hour)
+	clock := &fakeClock{now: start}
+	s := newScheduler(clock, time.Minute)
+	id := newScheduledPiece(t, author, &publishAt, nil)
+
+	clock.Set(publishAt)
+	runDue(t, s, 1)
+	if got := pieceStatus(t, id); got != "approved" {
+		t.Fatalf("status after a refused publish = %q, want approved", got)
+	}
+	sched, err := getPieceSchedule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sched.Error == "" || sched.PublishAt == nil {
+		t.Fatalf("schedule after a refused publish = %+v, want it held with an error", sched)
+	}
+
+	// A held schedule is not retried until it is changed.
+	clock.Set(publishAt.Add(time.Hour))
+	runDue(t, s, 0)
+}
@@ -0,0 +1,320 @@
+// In file: schemaplan.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaRisk is one way a schema change can affect the rows already stored.
+type SchemaRisk struct {
+	Description string `json:"description"`
+	Rows        int64  `json:"rows"`
+}
+
+// SchemaChange is a single column change of a SchemaPlan.
+type SchemaChange struct {
+	Action string       `json:"action"` // "add", "modify" or "drop"
+	Column string       `json:"column"`
+	From   string       `json:"from"`   // the current column definition; empty for "add"
+	To     string       `json:"to"`     // the new column definition; empty for "drop"
+	Clause string       `json:"clause"` // the ALTER TABLE clause that performs the change
+	Risks  []SchemaRisk `json:"risks"`
+}
+
+// AffectedRows is the number of rows counted by the risks of the change. A row
+// may be counted more than once if several risks apply to it.
+func (c SchemaChange) AffectedRows() int64 {
+	var n int64
+	for _, r := range c.Risks {
+		n += r.Rows
+	}
+	return n
+}
+
+// SchemaPlan is the precise set of changes needed to bring a class table to the
+// submitted field definitions. It is shown to the administrator as a preview and
+// only executed after explicit confirmation.
+type SchemaPlan struct {
+	Table   string         `json:"table"`
+	Changes []SchemaChange `json:"changes"`
+}
+
+// DDL returns the single ALTER TABLE statement that applies the plan, or "" if there is nothing to do.
+func (p SchemaPlan) DDL() string {
+	if len(p.Changes) == 0 {
+		return ""
+	}
+	clauses := make([]string, len(p.Changes))
+	for i, c := range p.Changes {
+		clauses[i] = c.Clause
+	}
+	return fmt.Sprintf("ALTER TABLE `%s` %s", p.Table, strings.Join(clauses, ", "))
+}
+
+// AffectedRows is the total number of rows counted by the risks of all changes.
+func (p SchemaPlan) AffectedRows() int64 {
+	var n int64
+	for _, c := range p.Changes {
+		n += c.AffectedRows()
+	}
+	return n
+}
+
+// applySchemaPlan executes the plan's DDL.
+func applySchemaPlan(p SchemaPlan) error {
+	query := p.DDL()
+	if query == "" {
+		return nil // No changes to make
+	}
+	if _, err := db.Exec(query); err != nil {
+		if isDuplicateColumn(err) {
+			return &ConflictError{fmt.Sprintf("%s already has a field with that name", p.Table)}
+		}
+		return fmt.Errorf("failed to alter table %s: %w. Query: %s", p.Table, err, query)
+	}
+	if strings.HasPrefix(p.Table, "contlet_") {
+		return loadContletClasses() // the registry holds the columns of contlet tables
+	}
+	invalidateOpenAPI()
+	invalidateGraphQLSchema()
+	return nil
+}
+
+// columnDefinition renders the type, nullability and default of a field as used in DDL.
+func columnDefinition(ft FieldType, required bool, def string) (string, error) {
+	defClause, err := defaultClause(ft, def)
+	if err != nil {
+		return "", err
+	}
+	null := " NULL"
+	if required {
+		null = " NOT NULL"
+	}
+	return ft.SQLType + null + defClause, nil
+}
+
+// describeColumn renders a column as reported by DESCRIBE in the same form as columnDefinition.
+func describeColumn(col ColumnDetail) string {
+	def := strings.ToUpper(col.Type)
+	if col.Null == "NO" {
+		def += " NOT NULL"
+	} else {
+		def += " NULL"
+	}
+	if col.Default.Valid {
+		def += " DEFAULT " + sqlQuoteString(col.Default.String)
+	}
+	return def
+}
+
+// sameDefault reports whether two default values are equal once parsed as ft,
+// so that e.g. "5" and "5.00" for a decimal field do not count as a change.
+func sameDefault(ft FieldType, current ColumnDetail, def string) bool {
+	if !current.Default.Valid || def == "" {
+		return !current.Default.Valid && def == ""
+	}
+	a, errA := ft.Parse(current.Default.String)
+	b, errB := ft.Parse(def)
+	if errA != nil || errB != nil {
+		return current.Default.String == def
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// conversionCondition returns an SQL condition matching the stored values of column
+// that do not fit ft, and a description of what happens to them.
+func conversionCondition(column string, ft FieldType) (string, string) {
+	c := "`" + column + "`"
+	switch ft.Name {
+	case "single_line_text":
+		return "CHAR_LENGTH(" + c + ") > 255", "values longer than 255 characters would be truncated or rejected"
+	case "url":
+		return "CHAR_LENGTH(" + c + ") > 2048", "values longer than 2048 characters would be truncated or rejected"
+	case "number":
+		return c + " NOT REGEXP '^-?[0-9]+$'", "values that are not whole numbers would be rounded, zeroed or rejected"
+	case "decimal":
+		return c + " NOT REGEXP '^-?[0-9]{1,10}(\\\\.[0-9]{1,2})?$'",
+			"values that are not numbers with at most two decimals would be rounded, zeroed or rejected"
+	case "date":
+		return c + " NOT REGEXP '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'", "values that are not plain dates would lose their time or be rejected"
+	case "datetime":
+		return c + " NOT REGEXP '^[0-9]{4}-[0-9]{2}-[0-9]{2}( [0-9]{2}:[0-9]{2}:[0-9]{2})?$'",
+			"values that are not dates would be rejected"
+	case "boolean":
+		return c + " NOT IN ('0', '1')", "values other than 0 and 1 would be changed or rejected"
+	}
+	return "", "" // paragraph: every other registry type fits in TEXT
+}
+
+// countRows counts the rows of table matching an SQL condition built by this file.
+func countRows(table, condition string) (int64, error) {
+	var n int64
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE %s", table, condition)).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate affected rows of %s: %w", table, err)
+	}
+	return n, nil
+}
+
+// currentClassColumn finds a column of a class table in DESCRIBE output and
+// rejects columns that the Class Management UI may not touch.
+func currentClassColumn(table string, columns []ColumnDetail, name string) (ColumnDetail, FieldType, error) {
+	if !validIdentifier(name) {
+		return ColumnDetail{}, FieldType{}, &ValidationError{fmt.Sprintf("invalid column name: %s", name)}
+	}
+	if isSystemColumn(table, name) {
+		return ColumnDetail{}, FieldType{}, &ValidationError{fmt.Sprintf("%s.%s is a system field and cannot be modified", table, name)}
+	}
+	for _, col := range columns {
+		if col.Field == name {
+			ft, ok := fieldTypeForColumn(col.Type)
+			if !ok {
+				return ColumnDetail{}, FieldType{}, &ValidationError{fmt.Sprintf("%s.%s has type %s, which the schema editor does not manage", table, name, col.Type)}
+			}
+			return col, ft, nil
+		}
+	}
+	return ColumnDetail{}, FieldType{}, &ValidationError{fmt.Sprintf("%s has no field named %s", table, name)}
+}
+
+// describeClassTable returns the current columns of a class table.
+func describeClassTable(table string) ([]ColumnDetail, error) {
+	if !isClassTable(table) {
+		return nil, &ValidationError{fmt.Sprintf("%s is not a class table and cannot be edited", table)}
+	}
+	return describeTable(table)
+}
+
+// planFieldUpdates compares the submitted definitions of existing fields with the
+// current schema and plans a MODIFY COLUMN only for the fields that changed.
+// Each column's Type must be the SQL type of a semantic field type from the registry.
+func planFieldUpdates(table string, columns []ColumnDetail) (SchemaPlan, error) {
+	current, err := describeClassTable(table)
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+
+	plan := SchemaPlan{Table: table}
+	for _, col := range columns {
+		cur, curType, err := currentClassColumn(table, current, col.Field)
+		if err != nil {
+			return SchemaPlan{}, err
+		}
+		ft, ok := fieldTypeForColumn(col.Type)
+		if !ok {
+			return SchemaPlan{}, &ValidationError{fmt.Sprintf("unsupported column type for %s: %s", col.Field, col.Type)}
+		}
+		required := col.Null == "NO"
+		def := ""
+		if col.Default.Valid {
+			def = col.Default.String
+		}
+
+		typeChanged := ft.Name != curType.Name
+		requiredNow := required && cur.Null != "NO"
+		if !typeChanged && required == (cur.Null == "NO") && sameDefault(ft, cur, def) {
+			continue
+		}
+
+		definition, err := columnDefinition(ft, required, def)
+		if err != nil {
+			return SchemaPlan{}, &ValidationError{fmt.Sprintf("column %s: %s", col.Field, err)}
+		}
+		change := SchemaChange{
+			Action: "modify",
+			Column: col.Field,
+			From:   describeColumn(cur),
+			To:     definition,
+			Clause: fmt.Sprintf("MODIFY COLUMN `%s` %s", col.Field, definition),
+		}
+		if typeChanged {
+			if cond, desc := conversionCondition(col.Field, ft); cond != "" {
+				n, err := countRows(table, fmt.Sprintf("`%s` IS NOT NULL AND %s", col.Field, cond))
+				if err != nil {
+					return SchemaPlan{}, err
+				}
+				change.Risks = append(change.Risks, SchemaRisk{Description: desc, Rows: n})
+			}
+		}
+		if requiredNow {
+			n, err := countRows(table, fmt.Sprintf("`%s` IS NULL", col.Field))
+			if err != nil {
+				return SchemaPlan{}, err
+			}
+			change.Risks = append(change.Risks, SchemaRisk{
+				Description: "empty values would violate the new NOT NULL constraint and make the change fail",
+				Rows:        n,
+			})
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+	return plan, nil
+}
+
+// planAddField plans adding an administrator-defined field to a class table.
+func planAddField(table, name, typeName string, required bool, def string) (SchemaPlan, error) {
+	current, err := describeClassTable(table)
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+	if !validIdentifier(name) || len(name) > 64 {
+		return SchemaPlan{}, &ValidationError{fmt.Sprintf("invalid field name %q: use letters, digits and underscores", name)}
+	}
+	for _, col := range current {
+		if col.Field == name {
+			return SchemaPlan{}, &ConflictError{fmt.Sprintf("%s already has a field named %q", table, name)}
+		}
+	}
+	ft, ok := fieldTypeByName(typeName)
+	if !ok {
+		return SchemaPlan{}, &ValidationError{fmt.Sprintf("unknown field type %q", typeName)}
+	}
+	definition, err := columnDefinition(ft, required, def)
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+
+	change := SchemaChange{
+		Action: "add",
+		Column: name,
+		To:     definition,
+		Clause: fmt.Sprintf("ADD COLUMN `%s` %s", name, definition),
+	}
+	if required && def == "" {
+		n, err := countRows(table, "1 = 1")
+		if err != nil {
+			return SchemaPlan{}, err
+		}
+		change.Risks = append(change.Risks, SchemaRisk{
+			Description: "existing objects have no value for the new required field and would get the type's zero value",
+			Rows:        n,
+		})
+	}
+	return SchemaPlan{Table: table, Changes: []SchemaChange{change}}, nil
+}
+
+// planRemoveField plans dropping an administrator-defined field from a class table.
+func planRemoveField(table, name string) (SchemaPlan, error) {
+	current, err := describeClassTable(table)
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+	cur, _, err := currentClassColumn(table, current, name)
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+
+	n, err := countRows(table, fmt.Sprintf("`%s` IS NOT NULL", name))
+	if err != nil {
+		return SchemaPlan{}, err
+	}
+	change := SchemaChange{
+		Action: "drop",
+		Column: name,
+		From:   describeColumn(cur),
+		Clause: fmt.Sprintf("DROP COLUMN `%s`", name),
+		Risks:  []SchemaRisk{{Description: "stored values would be deleted permanently", Rows: n}},
+	}
+	return SchemaPlan{Table: table, Changes: []SchemaChange{change}}, nil
+}
@@ -0,0 +1,569 @@
+// In file: sitebuild.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The build-site command writes the published pieces as a static site: a page
+// per piece, paginated lists of all pieces and of the pieces with each tag, a
+// page per taxonomy, the static assets and a sitemap. Pages are rendered with
+// the templates in templates/site, the piece bodies with the html channel
+// renderer. Only published snapshots are used, so drafts never reach the site.
+//
+// A manifest in the output directory remembers what the last build wrote. A
+// piece page is only rendered again when its inputs changed; pages and files
+// that are no longer part of the site are removed.
+
+// siteManifestFile is the name of the manifest in the output directory.
+const siteManifestFile = ".build-manifest.json"
+
+// SiteOptions configures a site build.
+type SiteOptions struct {
+	OutDir   string
+	BaseURL  string // the address the site is served from, for the sitemap
+	PageSize int    // pieces per list page
+	Full     bool   // render every page, even those that did not change
+}
+
+// SiteBuildStats tells what a build did.
+type SiteBuildStats struct {
+	Written int // files that were new or changed
+	Skipped int // piece pages that were not rendered because nothing they show changed
+	Removed int // files of the previous build that are no longer part of the site
+}
+
+// siteManifest is what a build leaves for the next one.
+type siteManifest struct {
+	BuiltAt time.Time              `json:"built_at"`
+	Inputs  string                 `json:"inputs"` // hash of what every page depends on
+	Pieces  map[int]sitePageRecord `json:"pieces"`
+	Files   []string               `json:"files"` // every file written, relative to the output directory
+}
+
+// sitePageRecord records the page of one piece and a hash of what it was rendered from.
+type sitePageRecord struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// sitePiece is a piece as the site templates see it.
+type sitePiece struct {
+	ID          int
+	Title       string
+	URL         string
+	PublishedAt time.Time
+	Tags        []siteTag
+}
+
+// siteTag is a tag or taxonomy as the site templates see it.
+type siteTag struct {
+	Name  string
+	URL   string
+	Count int // published pieces with the tag
+}
+
+// sitePagination links the pages of a list.
+type sitePagination struct {
+	Page, Pages int
+	Prev, Next  string
+}
+
+// SitePage is the data of one page of the site.
+type SitePage struct {
+	Root       string // path of the site root, without a trailing slash
+	Title      string
+	Piece      sitePiece     // piece pages
+	Body       template.HTML // piece pages: the rendered piece
+	Pieces     []sitePiece   // list pages
+	Tags       []siteTag     // taxonomy pages: the tags; piece pages: the tags of the piece
+	Pagination sitePagination
+	Taxonomies []siteTag // for the navigation of every page
+}
+
+// siteBuild holds the state of one build.
+type siteBuild struct {
+	opts      SiteOptions
+	root      string
+	templates map[string]*template.Template
+	written   map[string]bool
+	stats     SiteBuildStats
+}
+
+// runBuildSiteCommand implements "build-site [-out dir] -base-url URL [-page-size n] [-full]".
+func runBuildSiteCommand(args []string) {
+	flags := flag.NewFlagSet("build-site", flag.ExitOnError)
+	opts := SiteOptions{}
+	flags.StringVar(&opts.OutDir, "out", "site", "Directory to write the site to.")
+	flags.StringVar(&opts.BaseURL, "base-url", "", "Address the site is served from, e.g. https://blog.example.com/ (required).")
+	flags.IntVar(&opts.PageSize, "page-size", 10, "Pieces per list page.")
+	flags.BoolVar(&opts.Full, "full", false, "Render every page, not only the changed ones.")
+	flags.Parse(args)
+	if err := cfg.ValidateDirs(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	start := time.Now()
+	stats, err := buildSite(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("✅ Built the site in %s in %s: %d file(s) written, %d unchanged piece page(s) skipped, %d file(s) removed.",
+		opts.OutDir, time.Since(start).Round(time.Millisecond), stats.Written, stats.Skipped, stats.Removed)
+}
+
+// buildSite writes the site described by opts.
+func buildSite(opts SiteOptions) (SiteBuildStats, error) {
+	base, err := url.Parse(opts.BaseURL)
+	if opts.BaseURL == "" || err != nil || base.Scheme == "" || base.Host == "" {
+		return SiteBuildStats{}, &ValidationError{"build-site needs an absolute -base-url, e.g. https://blog.example.com/"}
+	}
+	if opts.PageSize < 1 {
+		return SiteBuildStats{}, &ValidationError{"the page size must be at least 1"}
+	}
+	pieces, err := getPublishedPieces()
+	if err != nil {
+		return SiteBuildStats{}, fmt.Errorf("failed to read the published pieces: %w", err)
+	}
+	pieceTags, err := getPublishedPieceTags()
+	if err != nil {
+		return SiteBuildStats{}, fmt.Errorf("failed to read the tags of the published pieces: %w", err)
+	}
+
+	b := &siteBuild{opts: opts, root: strings.TrimSuffix(base.Path, "/"), templates: map[string]*template.Template{}, written: map[string]bool{}}
+	for _, name := range []string{"piece.html", "list.html", "taxonomy.html"} {
+		t, err := template.ParseFiles(filepath.Join(cfg.TemplateDir, "site", "layout.html"), filepath.Join(cfg.TemplateDir, "site", name))
+		if err != nil {
+			return SiteBuildStats{}, fmt.Errorf("failed to parse the site templates: %w", err)
+		}
+		b.templates[name] = t
+	}
+	err = b.build(base, pieces, pieceTags)
+	return b.stats, err
+}
+
+// build writes the site of the given pieces, most recently published first,
+// and their tags.
+func (b *siteBuild) build(base *url.URL, pieces []PublishedPiece, pieceTags map[int][]Tag) error {
+	opts := b.opts
+	previous := readSiteManifest(opts.OutDir)
+	manifest := siteManifest{BuiltAt: time.Now().UTC(), Pieces: map[int]sitePageRecord{}}
+
+	// Slugs are given out in ID order, so the oldest piece keeps the plain one.
+	byID := slices.Clone(pieces)
+	sort.Slice(byID, func(i, j int) bool { return byID[i].ID < byID[j].ID })
+	pieceSlugs := newSlugger("page", "tags", "static", "sitemap.xml")
+	slugOf := map[int]string{}
+	for _, p := range byID {
+		slugOf[p.ID] = pieceSlugs.slug(p.Title, "piece", p.ID)
+	}
+
+	// Tags are grouped by taxonomy: /tags/{taxonomy}/ and /tags/{taxonomy}/{tag}/.
+	type tagPages struct {
+		tag    siteTag
+		pieces []sitePiece
+	}
+	taxonomySlugs := newSlugger()
+	taxonomyURL := map[int]string{}
+	taxonomyName := map[int]string{}
+	tagSlugs := map[int]*slugger{}
+	tags := map[int]*tagPages{}
+	tagURL := func(t Tag) string {
+		if tags[t.ID] != nil {
+			return tags[t.ID].tag.URL
+		}
+		if _, ok := taxonomyURL[t.TaxonomyID]; !ok {
+			taxonomyURL[t.TaxonomyID] = b.root + "/tags/" + taxonomySlugs.slug(t.TaxonomyName, "taxonomy", t.TaxonomyID) + "/"
+			taxonomyName[t.TaxonomyID] = t.TaxonomyName
+			tagSlugs[t.TaxonomyID] = newSlugger("page")
+		}
+		u := taxonomyURL[t.TaxonomyID] + tagSlugs[t.TaxonomyID].slug(t.Value, "tag", t.ID) + "/"
+		tags[t.ID] = &tagPages{tag: siteTag{Name: t.Value, URL: u}}
+		return u
+	}
+	// Tags get their URLs in ID order too, for the same reason.
+	var allTags []Tag
+	for _, p := range byID {
+		allTags = append(allTags, pieceTags[p.ID]...)
+	}
+	sort.Slice(allTags, func(i, j int) bool { return allTags[i].ID < allTags[j].ID })
+	allTags = slices.CompactFunc(allTags, func(a, b Tag) bool { return a.ID == b.ID })
+	for _, t := range allTags {
+		tagURL(t)
+	}
+
+	var listed []sitePiece
+	for _, p := range pieces {
+		sp := sitePiece{ID: p.ID, Title: p.Title, URL: b.root + "/" + slugOf[p.ID] + "/", PublishedAt: p.PublishedAt}
+		for _, t := range pieceTags[p.ID] {
+			sp.Tags = append(sp.Tags, siteTag{Name: t.TaxonomyName + ": " + t.Value, URL: tagURL(t)})
+		}
+		for _, t := range pieceTags[p.ID] {
+			tags[t.ID].pieces = append(tags[t.ID].pieces, sp)
+		}
+		listed = append(listed, sp)
+	}
+
+	var navigation []siteTag
+	for id, u := range taxonomyURL {
+		navigation = append(navigation, siteTag{Name: taxonomyName[id], URL: u})
+	}
+	sort.Slice(navigation, func(i, j int) bool { return navigation[i].Name < navigation[j].Name })
+
+	// Everything that goes into every page decides whether a previous build can
+	// be kept at all.
+	inputs, err := b.inputsHash(navigation)
+	if err != nil {
+		return err
+	}
+	manifest.Inputs = inputs
+	full := opts.Full || previous.Inputs != inputs
+
+	for i, p := range pieces {
+		sp := listed[i]
+		page := path.Join(slugOf[p.ID], "index.html")
+		hash, err := hashJSON(struct {
+			Piece PublishedPiece
+			Site  sitePiece
+		}{p, sp})
+		if err != nil {
+			return err
+		}
+		manifest.Pieces[p.ID] = sitePageRecord{Path: page, Hash: hash}
+		if old, ok := previous.Pieces[p.ID]; !full && ok && old == manifest.Pieces[p.ID] && fileExists(filepath.Join(opts.OutDir, page)) {
+			b.written[page] = true
+			b.stats.Skipped++
+			continue
+		}
+		rendering, err := renderPiece(p.PieceDetail, "html")
+		if err != nil {
+			return err
+		}
+		data := SitePage{Title: p.Title, Piece: sp, Body: template.HTML(rendering.Body()), Tags: sp.Tags}
+		if err := b.writePage(page, "piece.html", data, navigation); err != nil {
+			return err
+		}
+	}
+
+	// The lists are cheap to render; they are written when they differ.
+	if err := b.writeList("", "All pieces", listed, navigation); err != nil {
+		return err
+	}
+	taxonomyTags := map[string][]siteTag{}
+	for _, t := range allTags {
+		tp := tags[t.ID]
+		tp.tag.Count = len(tp.pieces)
+		taxonomyTags[taxonomyURL[t.TaxonomyID]] = append(taxonomyTags[taxonomyURL[t.TaxonomyID]], tp.tag)
+		dir := strings.TrimPrefix(tp.tag.URL, b.root+"/")
+		if err := b.writeList(dir, t.TaxonomyName+": "+t.Value, tp.pieces, navigation); err != nil {
+			return err
+		}
+	}
+	for _, tax := range navigation {
+		list := taxonomyTags[tax.URL]
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		dir := strings.TrimPrefix(tax.URL, b.root+"/")
+		if err := b.writePage(path.Join(dir, "index.html"), "taxonomy.html", SitePage{Title: tax.Name, Tags: list}, navigation); err != nil {
+			return err
+		}
+	}
+
+	if err := b.copyStatic(); err != nil {
+		return err
+	}
+	if err := b.writeSitemap(base, pieces, listed, taxonomyTags, navigation); err != nil {
+		return err
+	}
+
+	// Remove what the previous build wrote and this one did not.
+	for _, f := range previous.Files {
+		if b.written[f] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(opts.OutDir, filepath.FromSlash(f))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", f, err)
+		}
+		removeEmptyDirs(opts.OutDir, path.Dir(f))
+		b.stats.Removed++
+	}
+
+	for f := range b.written {
+		manifest.Files = append(manifest.Files, f)
+	}
+	sort.Strings(manifest.Files)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(opts.OutDir, siteManifestFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write the build manifest: %w", err)
+	}
+	return nil
+}
+
+// inputsHash hashes what every page depends on: the site templates, the base
+// address and the navigation.
+func (b *siteBuild) inputsHash(navigation []siteTag) (string, error) {
+	h := sha256.New()
+	files, err := filepath.Glob(filepath.Join(cfg.TemplateDir, "site", "*.html"))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", f, err)
+		}
+		fmt.Fprintf(h, "%s %d\n", filepath.Base(f), len(data))
+		h.Write(data)
+	}
+	nav, err := json.Marshal(navigation)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "%s\n%s\n", b.opts.BaseURL, nav)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeList writes the paginated list of pieces under dir: page 1 at
+// dir/index.html, the others at dir/page/{n}/index.html.
+func (b *siteBuild) writeList(dir, title string, pieces []sitePiece, navigation []siteTag) error {
+	pages := max((len(pieces)+b.opts.PageSize-1)/b.opts.PageSize, 1)
+	pageURL := func(n int) string {
+		u := b.root + "/" + dir
+		if n > 1 {
+			u += fmt.Sprintf("page/%d/", n)
+		}
+		return u
+	}
+	for n := 1; n <= pages; n++ {
+		data := SitePage{Title: title, Pieces: pieces[(n-1)*b.opts.PageSize : min(n*b.opts.PageSize, len(pieces))],
+			Pagination: sitePagination{Page: n, Pages: pages}}
+		if n > 1 {
+			data.Pagination.Prev = pageURL(n - 1)
+		}
+		if n < pages {
+			data.Pagination.Next = pageURL(n + 1)
+		}
+		file := path.Join(strings.TrimPrefix(pageURL(n), b.root+"/"), "index.html")
+		if err := b.writePage(file, "list.html", data, navigation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePage renders a page of the site to file, relative to the output directory.
+func (b *siteBuild) writePage(file, tmpl string, data SitePage, navigation []siteTag) error {
+	data.Root, data.Taxonomies = b.root, navigation
+	var buf bytes.Buffer
+	if err := b.templates[tmpl].Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render %s: %w", file, err)
+	}
+	return b.writeFile(file, buf.Bytes())
+}
+
+// writeFile writes data to file, relative to the output directory, unless the
+// file already holds it, so that unchanged files keep their modification time.
+func (b *siteBuild) writeFile(file string, data []byte) error {
+	b.written[file] = true
+	target := filepath.Join(b.opts.OutDir, filepath.FromSlash(file))
+	if old, err := os.ReadFile(target); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create the directory of %s: %w", file, err)
+	}
+	if err := os.WriteFile(target, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", file, err)
+	}
+	b.stats.Written++
+	return nil
+}
+
+// copyStatic copies the static directory to static/ in the site.
+func (b *siteBuild) copyStatic() error {
+	return filepath.WalkDir(cfg.StaticDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.StaticDir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		return b.writeFile(path.Join("static", filepath.ToSlash(rel)), data)
+	})
+}
+
+// writeSitemap writes sitemap.xml with the first page of every list and every piece.
+func (b *siteBuild) writeSitemap(base *url.URL, pieces []PublishedPiece, listed []sitePiece, taxonomyTags map[string][]siteTag, navigation []siteTag) error {
+	origin := base.Scheme + "://" + base.Host
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+	entry := func(u string, lastmod time.Time) {
+		buf.WriteString("  <url><loc>")
+		xml.EscapeText(&buf, []byte(origin+u))
+		buf.WriteString("</loc>")
+		if !lastmod.IsZero() {
+			buf.WriteString("<lastmod>" + lastmod.UTC().Format(time.RFC3339) + "</lastmod>")
+		}
+		buf.WriteString("</url>\n")
+	}
+	var newest time.Time
+	if len(pieces) > 0 {
+		newest = pieces[0].PublishedAt
+	}
+	entry(b.root+"/", newest)
+	for _, p := range listed {
+		entry(p.URL, p.PublishedAt)
+	}
+	for _, tax := range navigation {
+		entry(tax.URL, time.Time{})
+		for _, t := range taxonomyTags[tax.URL] {
+			entry(t.URL, time.Time{})
+		}
+	}
+	buf.WriteString("</urlset>\n")
+	return b.writeFile("sitemap.xml", buf.Bytes())
+}
+
+// getPublishedPieceTags returns the current tags of every published piece, by piece ID.
+func getPublishedPieceTags() (map[int][]Tag, error) {
+	rows, err := db.Query(`
+	SELECT et.entity_id, t.id, t.value, tx.id, tx.name
+	FROM entity_tags et
+	JOIN published_piece pp ON pp.piece_id = et.entity_id
+	JOIN tag t ON t.id = et.tag_id
+	JOIN taxonomy tx ON t.taxonomy_id = tx.id
+	ORDER BY tx.name, t.value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := map[int][]Tag{}
+	for rows.Next() {
+		var pieceID int
+		var t Tag
+		if err := rows.Scan(&pieceID, &t.ID, &t.Value, &t.TaxonomyID, &t.TaxonomyName); err != nil {
+			return nil, err
+		}
+		tags[pieceID] = append(tags[pieceID], t)
+	}
+	return tags, rows.Err()
+}
+
+// readSiteManifest reads the manifest of the last build in dir. Without one,
+// every page is new.
+func readSiteManifest(dir string) siteManifest {
+	var m siteManifest
+	data, err := os.ReadFile(filepath.Join(dir, siteManifestFile))
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Ignoring the build manifest in %s: %v", dir, err)
+		return siteManifest{}
+	}
+	return m
+}
+
+// hashJSON returns the SHA-256 of the JSON encoding of v.
+func hashJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fileExists reports whether name is an existing file.
+func fileExists(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+// removeEmptyDirs removes dir, relative to root, and its parents while they are empty.
+func removeEmptyDirs(root, dir string) {
+	for dir != "." && dir != "/" && dir != "" {
+		if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// slugger hands out slugs that are unique among those it has given out.
+type slugger struct {
+	taken map[string]bool
+}
+
+// newSlugger returns a slugger that never gives out the reserved names.
+func newSlugger(reserved ...string) *slugger {
+	s := &slugger{taken: map[string]bool{}}
+	for _, r := range reserved {
+		s.taken[r] = true
+	}
+	return s
+}
+
+// slug returns the slug of text, or kind-id if the text has no usable
+// characters; a slug that is taken gets -id appended.
+func (s *slugger) slug(text, kind string, id int) string {
+	slug := slugify(text)
+	if slug == "" {
+		slug = fmt.Sprintf("%s-%d", kind, id)
+	}
+	if s.taken[slug] {
+		slug = fmt.Sprintf("%s-%d", slug, id)
+	}
+	s.taken[slug] = true
+	return slug
+}
+
+// slugify lowercases text and joins its runs of ASCII letters and digits with
+// hyphens: "Hello, World!" becomes "hello-world".
+func slugify(text string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(text) {
+		if r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	slug := b.String()
+	if len(slug) > 80 {
+		slug = strings.TrimRight(slug[:80], "-")
+	}
+	return slug
+}
@@ -0,0 +1,272 @@
+// In file: tokens.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Machine clients call the JSON API with "Authorization: Bearer <token>". A token
+// acts as the account it belongs to, so the roles of that account still apply,
+// and is further limited to its scopes. Tokens are only accepted under /api/;
+// the HTML pages, including the token admin page, need a login session.
+
+// The scopes a token can carry.
+const (
+	scopePiecesRead  = "pieces:read"  // GET requests and GraphQL queries
+	scopePiecesWrite = "pieces:write" // every other change to content; includes pieces:read
+	scopeSchemaAdmin = "schema:admin" // reading and changing the schema
+)
+
+// apiScopes lists the scopes in the order they are offered.
+var apiScopes = []string{scopePiecesRead, scopePiecesWrite, scopeSchemaAdmin}
+
+// tokenPrefix starts every token, so that leaked tokens are easy to recognize.
+const tokenPrefix = "dlt_"
+
+// maxTokenDays is the longest a token may be valid.
+const maxTokenDays = 730
+
+// APIToken describes a token; the token itself is only shown when it is created.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	UserID     int        `json:"user_id"`
+	UserName   string     `json:"user_name"`
+	Kind       string     `json:"kind"` // "personal" or "service"
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Allows reports whether the token carries scope; pieces:write includes pieces:read.
+func (t *APIToken) Allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope) ||
+		(scope == scopePiecesRead && slices.Contains(t.Scopes, scopePiecesWrite))
+}
+
+// State is "revoked", "expired" or "active".
+func (t APIToken) State() string {
+	switch {
+	case t.RevokedAt != nil:
+		return "revoked"
+	case !t.ExpiresAt.After(time.Now()):
+		return "expired"
+	}
+	return "active"
+}
+
+// APITokenInput asks for a new token.
+type APITokenInput struct {
+	Name   string
+	UserID int
+	Kind   string
+	Scopes []string
+	Days   int // how long the token is valid
+}
+
+// apiTokenColumns selects what scanAPITokens expects from api_token t and app_user u.
+const apiTokenColumns = `t.id, t.name, t.token_prefix, t.user_id, u.user_name, t.kind, t.scopes,
+	t.created_by, t.created_at, t.expires_at, t.last_used_at, t.revoked_at`
+
+// scanAPITokens collects the tokens selected by apiTokenColumns.
+func scanAPITokens(rows *sql.Rows) ([]APIToken, error) {
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		var lastUsed, revoked sql.NullTime
+		err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &t.UserID, &t.UserName, &t.Kind, &scopes,
+			&t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &lastUsed, &revoked)
+		if err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		t.LastUsedAt, t.RevokedAt = timeOrNil(lastUsed), timeOrNil(revoked)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// getAPITokens returns the tokens of one account, or of every account for
+// userID 0, newest first.
+func getAPITokens(userID int) ([]APIToken, error) {
+	query := "SELECT " + apiTokenColumns + " FROM api_token t JOIN app_user u ON u.id = t.user_id"
+	var args []interface{}
+	if userID != 0 {
+		query += " WHERE t.user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := db.Query(query+" ORDER BY t.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAPITokens(rows)
+}
+
+// getAPIToken returns one token, or sql.ErrNoRows.
+func getAPIToken(id int) (APIToken, error) {
+	rows, err := db.Query("SELECT "+apiTokenColumns+" FROM api_token t JOIN app_user u ON u.id = t.user_id WHERE t.id = ?", id)
+	if err != nil {
+		return APIToken{}, err
+	}
+	tokens, err := scanAPITokens(rows)
+	if err != nil {
+		return APIToken{}, err
+	}
+	if len(tokens) == 0 {
+		return APIToken{}, sql.ErrNoRows
+	}
+	return tokens[0], nil
+}
+
+// createAPIToken creates a token and returns it. This is the only time the token
+// is available; only its hash is kept.
+func createAPIToken(in APITokenInput, createdBy string) (string, error) {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || len(in.Name) > 255 {
+		return "", &ValidationError{"a token needs a name of at most 255 characters"}
+	}
+	if in.Kind != "personal" && in.Kind != "service" {
+		return "", &ValidationError{fmt.Sprintf("invalid token kind %q: use personal or service", in.Kind)}
+	}
+	if len(in.Scopes) == 0 {
+		return "", &ValidationError{"a token needs at least one scope"}
+	}
+	for _, s := range in.Scopes {
+		if !slices.Contains(apiScopes, s) {
+			return "", &ValidationError{fmt.Sprintf("unknown scope %q; the scopes are %s", s, strings.Join(apiScopes, ", "))}
+		}
+	}
+	if in.Days < 1 || in.Days > maxTokenDays {
+		return "", &ValidationError{fmt.Sprintf("a token must be valid for 1 to %d days", maxTokenDays)}
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + secret
+	_, err = db.Exec(`
+		INSERT INTO api_token (name, token_hash, token_prefix, user_id, kind, scopes, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP() + INTERVAL ? DAY)`,
+		in.Name, hashToken(token), token[:len(tokenPrefix)+6], in.UserID, in.Kind,
+		strings.Join(in.Scopes, ","), createdBy, in.Days)
+	if isMissingReference(err) {
+		return "", &ValidationError{fmt.Sprintf("user %d does not exist", in.UserID)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+	return token, nil
+}
+
+// revokeAPIToken stops a token from working. Revoked tokens stay listed.
+func revokeAPIToken(id int) error {
+	res, err := db.Exec("UPDATE api_token SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := getAPIToken(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenUser returns the account a valid token acts as, with the token attached,
+// or nil if the token is unknown, expired or revoked. It records the use.
+func tokenUser(token string) (*User, error) {
+	var id, userID int
+	var scopes string
+	err := db.QueryRow(`
+		SELECT id, user_id, scopes FROM api_token
+		WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > UTC_TIMESTAMP()`, hashToken(token)).
+		Scan(&id, &userID, &scopes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the API token: %w", err)
+	}
+
+	_, err = db.Exec(`
+		UPDATE api_token SET last_used_at = UTC_TIMESTAMP()
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < UTC_TIMESTAMP() - INTERVAL 1 MINUTE)`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the use of token %d: %w", id, err)
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	user.Token = &APIToken{ID: id, UserID: userID, Scopes: strings.Split(scopes, ",")}
+	return &user, nil
+}
+
+// authorizeToken is authorize for a request that carries a bearer token: the
+// account of the token must hold the role and the token one of the scopes the
+// request needs.
+func authorizeToken(w http.ResponseWriter, r *http.Request, token, readRole, writeRole string, h http.HandlerFunc) {
+	user, err := tokenUser(token)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to check the API token: "+err.Error())
+		return
+	}
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "Unknown, expired or revoked API token")
+		return
+	}
+
+	role := writeRole
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		role = readRole
+	}
+	if !user.Has(role) {
+		forbidRole(w, r, role)
+		return
+	}
+	if scopes := acceptedScopes(r); !slices.ContainsFunc(scopes, user.Token.Allows) {
+		writeAPIError(w, http.StatusForbidden, "Forbidden: this token needs the "+strings.Join(scopes, " or ")+" scope")
+		return
+	}
+	h(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// acceptedScopes returns the scopes of which a token needs one for an API request.
+func acceptedScopes(r *http.Request) []string {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(apiPrefix, "/"))
+	switch {
+	case path == "/schema" || strings.HasPrefix(path, "/schema/"):
+		if read {
+			return []string{scopePiecesRead, scopeSchemaAdmin}
+		}
+		return []string{scopeSchemaAdmin}
+	case read || strings.HasPrefix(r.URL.Path, graphQLPath): // GraphQL only answers queries
+		return []string{scopePiecesRead}
+	}
+	return []string{scopePiecesWrite}
+}
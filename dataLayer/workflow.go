@@ -0,0 +1,404 @@
+// In file: workflow.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The editorial workflow gives content_piece.status its meaning. The statuses and
+// the transitions between them are configured in workflow_status and
+// workflow_transition; a transition may be limited to the members of an approver
+// role and may require a comment, as rejections do. Every status change is checked
+// against the workflow, whether it comes from the piece page, the piece form or
+// the JSON API, and is logged in status_change.
+
+// WorkflowStatus is a status a content piece can be in.
+type WorkflowStatus struct {
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	SortOrder int    `json:"sort_order"`
+	Published bool   `json:"published"` // pieces in this status are delivered to readers
+	Count     int    `json:"piece_count"`
+}
+
+// WorkflowTransition is an allowed change from one status to another.
+type WorkflowTransition struct {
+	ID              int    `json:"id"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Label           string `json:"label"`
+	ApproverRole    string `json:"approver_role,omitempty"` // empty: anyone may make the transition
+	RequiresComment bool   `json:"requires_comment"`
+}
+
+// RoleMember grants a role to a user.
+type RoleMember struct {
+	Role     string `json:"role"`
+	UserName string `json:"user_name"`
+}
+
+// StatusChange is one logged status change of a piece.
+type StatusChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Author    string    `json:"author"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StatusRequest asks for the status of a piece to change. A zero StatusRequest
+// leaves the status as it is.
+type StatusRequest struct {
+	To      string `json:"to"`
+	Comment string `json:"comment"`
+}
+
+// ForbiddenError is returned for a change the requesting user may not make.
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+// getWorkflowStatuses returns the statuses in workflow order with the number of
+// pieces in each.
+func getWorkflowStatuses() ([]WorkflowStatus, error) {
+	rows, err := db.Query(`
+		SELECT ws.name, ws.label, ws.sort_order, ws.published, COUNT(p.id)
+		FROM workflow_status ws
+		LEFT JOIN content_piece p ON p.status = ws.name
+		GROUP BY ws.name, ws.label, ws.sort_order, ws.published
+		ORDER BY ws.sort_order, ws.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []WorkflowStatus
+	for rows.Next() {
+		var s WorkflowStatus
+		if err := rows.Scan(&s.Name, &s.Label, &s.SortOrder, &s.Published, &s.Count); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// getWorkflowStatus returns one status through q, or sql.ErrNoRows.
+func getWorkflowStatus(q queryer, name string) (WorkflowStatus, error) {
+	var s WorkflowStatus
+	err := q.QueryRow("SELECT name, label, sort_order, published FROM workflow_status WHERE name = ?", name).
+		Scan(&s.Name, &s.Label, &s.SortOrder, &s.Published)
+	return s, err
+}
+
+// initialStatus returns the status new pieces start in: the first one in workflow order.
+func initialStatus(q queryer) (string, error) {
+	var name string
+	err := q.QueryRow("SELECT name FROM workflow_status ORDER BY sort_order, name LIMIT 1").Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", &ConflictError{"the workflow has no statuses"}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the initial status: %w", err)
+	}
+	return name, nil
+}
+
+// queryTransitions runs a query selecting transition columns and collects the transitions.
+func queryTransitions(q queryer, where string, args ...interface{}) ([]WorkflowTransition, error) {
+	rows, err := q.Query(`
+		SELECT t.id, t.from_status, t.to_status, t.label, COALESCE(t.approver_role, ''), t.requires_comment
+		FROM workflow_transition t
+		JOIN workflow_status f ON f.name = t.from_status
+		JOIN workflow_status s ON s.name = t.to_status
+		`+where+`
+		ORDER BY f.sort_order, s.sort_order, t.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transitions []WorkflowTransition
+	for rows.Next() {
+		var t WorkflowTransition
+		if err := rows.Scan(&t.ID, &t.From, &t.To, &t.Label, &t.ApproverRole, &t.RequiresComment); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// getWorkflowTransitions returns every transition of the workflow.
+func getWorkflowTransitions() ([]WorkflowTransition, error) {
+	return queryTransitions(db, "")
+}
+
+// getTransitionsFrom returns the transitions out of a status.
+func getTransitionsFrom(status string) ([]WorkflowTransition, error) {
+	return queryTransitions(db, "WHERE t.from_status = ?", status)
+}
+
+// hasRole reports whether a user holds a role, directly or through a higher access role.
+func hasRole(q queryer, user, role string) (bool, error) {
+	rows, err := q.Query("SELECT role FROM role_member WHERE user_name = ?", user)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the roles of %s: %w", user, err)
+	}
+	defer rows.Close()
+
+	var held []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return false, err
+		}
+		held = append(held, r)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return rolesGrant(held, role), nil
+}
+
+// getRoleMembers returns every role membership, by role and user name.
+func getRoleMembers() ([]RoleMember, error) {
+	rows, err := db.Query("SELECT role, user_name FROM role_member ORDER BY role, user_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []RoleMember
+	for rows.Next() {
+		var m RoleMember
+		if err := rows.Scan(&m.Role, &m.UserName); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// getStatusChanges returns the status changes of a piece, newest first.
+func getStatusChanges(pieceID int) ([]StatusChange, error) {
+	rows, err := db.Query(`
+		SELECT from_status, to_status, author, comment, created_at
+		FROM status_change WHERE piece_id = ? ORDER BY id DESC`, pieceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []StatusChange
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.From, &c.To, &c.Author, &c.Comment, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// changeStatusTx moves a piece, locked by tx, to the requested status if the
+// workflow allows it and author may make the transition. Entering a published
+// status publishes the draft as seen by tx; leaving the published statuses
+// withdraws the published version. It returns the summary of the change.
+func changeStatusTx(tx *sql.Tx, pieceID int, req StatusRequest, author string) (string, error) {
+	var from string
+	if err := tx.QueryRow("SELECT status FROM content_piece WHERE id = ?", pieceID).Scan(&from); err != nil {
+		return "", err
+	}
+
+	transitions, err := queryTransitions(tx, "WHERE t.from_status = ? AND t.to_status = ?", from, req.To)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the workflow: %w", err)
+	}
+	if len(transitions) == 0 {
+		return "", &ConflictError{fmt.Sprintf("the workflow does not allow a piece to go from %s to %s", from, req.To)}
+	}
+	t := transitions[0]
+
+	if t.ApproverRole != "" {
+		ok, err := hasRole(tx, author, t.ApproverRole)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", &ForbiddenError{fmt.Sprintf("%q (%s to %s) can only be done by the %s role, which %s does not have", t.Label, from, req.To, t.ApproverRole, author)}
+		}
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if t.RequiresComment && comment == "" {
+		return "", &ValidationError{fmt.Sprintf("%q requires a comment", t.Label)}
+	}
+
+	to, err := getWorkflowStatus(tx, req.To)
+	if err != nil {
+		return "", fmt.Errorf("failed to read status %s: %w", req.To, err)
+	}
+	if _, err := tx.Exec("UPDATE content_piece SET status = ? WHERE id = ?", to.Name, pieceID); err != nil {
+		return "", fmt.Errorf("failed to update status of piece %d: %w", pieceID, err)
+	}
+	if to.Published {
+		err = publishSnapshot(tx, pieceID, author)
+	} else {
+		err = withdrawSnapshot(tx, pieceID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO status_change (piece_id, from_status, to_status, author, comment) VALUES (?, ?, ?, ?, ?)",
+		pieceID, from, to.Name, author, comment)
+	if err != nil {
+		return "", fmt.Errorf("failed to log status change of piece %d: %w", pieceID, err)
+	}
+
+	summary := t.Label
+	if comment != "" {
+		summary += ": " + comment
+	}
+	return summary, nil
+}
+
+// changePieceStatus makes a workflow transition of a piece and records it as a revision.
+func changePieceStatus(pieceID int, req StatusRequest, author string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = lockPieceSlots(tx, pieceID)
+	var summary string
+	if err == nil {
+		summary, err = changeStatusTx(tx, pieceID, req, author)
+	}
+	if err == nil {
+		err = recordRevision(tx, pieceID, author, summary)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// createWorkflowStatus adds a status to the workflow.
+func createWorkflowStatus(s WorkflowStatus) error {
+	if !validIdentifier(s.Name) || len(s.Name) > 50 {
+		return &ValidationError{fmt.Sprintf("invalid status name %q: use letters, digits and underscores", s.Name)}
+	}
+	if s.Label == "" {
+		s.Label = s.Name
+	}
+	_, err := db.Exec("INSERT INTO workflow_status (name, label, sort_order, published) VALUES (?, ?, ?, ?)",
+		s.Name, s.Label, s.SortOrder, s.Published)
+	if isDuplicateEntry(err) {
+		return &ConflictError{fmt.Sprintf("a status named %q already exists", s.Name)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create status %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// deleteWorkflowStatus removes a status and its transitions. A status that pieces
+// are in cannot be removed.
+func deleteWorkflowStatus(name string) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM content_piece WHERE status = ?", name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return &ConflictError{fmt.Sprintf("%d piece(s) are in status %s; move them to another status first", n, name)}
+	}
+	res, err := db.Exec("DELETE FROM workflow_status WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete status %s: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// createWorkflowTransition allows a new transition between two existing statuses.
+func createWorkflowTransition(t WorkflowTransition) error {
+	if t.Label == "" {
+		return &ValidationError{"a transition needs a label"}
+	}
+	if t.ApproverRole != "" && (!validIdentifier(t.ApproverRole) || len(t.ApproverRole) > 50) {
+		return &ValidationError{fmt.Sprintf("invalid role name %q: use letters, digits and underscores", t.ApproverRole)}
+	}
+	_, err := db.Exec(`
+		INSERT INTO workflow_transition (from_status, to_status, label, approver_role, requires_comment)
+		VALUES (?, ?, ?, ?, ?)`, t.From, t.To, t.Label, nullIfEmpty(t.ApproverRole), t.RequiresComment)
+	switch {
+	case isDuplicateEntry(err):
+		return &ConflictError{fmt.Sprintf("there already is a transition from %s to %s", t.From, t.To)}
+	case isMissingReference(err):
+		return &ValidationError{fmt.Sprintf("%s and %s must both be statuses of the workflow", t.From, t.To)}
+	case err != nil:
+		return fmt.Errorf("failed to create transition: %w", err)
+	}
+	return nil
+}
+
+// deleteWorkflowTransition removes a transition.
+func deleteWorkflowTransition(id int) error {
+	if _, err := db.Exec("DELETE FROM workflow_transition WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete transition %d: %w", id, err)
+	}
+	return nil
+}
+
+// addRoleMember grants a role to a user name.
+func addRoleMember(m RoleMember) error {
+	if !validIdentifier(m.Role) || len(m.Role) > 50 {
+		return &ValidationError{fmt.Sprintf("invalid role name %q: use letters, digits and underscores", m.Role)}
+	}
+	if m.UserName == "" {
+		return &ValidationError{"a user name is required"}
+	}
+	_, err := db.Exec("INSERT INTO role_member (role, user_name) VALUES (?, ?)", m.Role, m.UserName)
+	if isDuplicateEntry(err) {
+		return &ConflictError{fmt.Sprintf("%s already has the %s role", m.UserName, m.Role)}
+	}
+	if isMissingReference(err) {
+		return &ValidationError{fmt.Sprintf("there is no user named %q", m.UserName)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add %s to role %s: %w", m.UserName, m.Role, err)
+	}
+	return nil
+}
+
+// removeRoleMember withdraws a role from a user. The last schema admin keeps the role.
+func removeRoleMember(m RoleMember) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if m.Role == roleSchemaAdmin {
+		err = checkOtherSchemaAdmin(tx, m.UserName)
+	}
+	if err == nil {
+		if _, err = tx.Exec("DELETE FROM role_member WHERE role = ? AND user_name = ?", m.Role, m.UserName); err != nil {
+			err = fmt.Errorf("failed to remove %s from role %s: %w", m.UserName, m.Role, err)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}